@@ -4,6 +4,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -13,13 +14,16 @@ import (
 	"time"
 
 	"bunghole/internal/audio"
+	"bunghole/internal/clipboard"
 	"bunghole/internal/types"
+	"bunghole/internal/vsockmux"
 )
 
 var (
-	flagTransport       = flag.String("transport", "auto", "Transport: auto, vsock, or udp")
+	flagTransport       = flag.String("transport", "auto", "Transport: auto, vsock, udp, or mux (audio and clipboard over one vsock connection)")
 	flagUDP             = flag.String("udp", "", "host:port to send raw Opus packet datagrams (UDP mode)")
-	flagVsockPort       = flag.Uint("vsock-port", 5000, "Vsock port to connect to (vsock mode)")
+	flagVsockPort       = flag.Uint("vsock-port", audio.DefaultVsockPort, "Vsock port to connect to (vsock mode; must match the host's --vsock-audio-port)")
+	flagMuxPort         = flag.Uint("mux-port", vsockmux.DefaultPort, "Vsock port to connect to (mux mode; must match the host's --vsock-mux-port)")
 	flagStats           = flag.Bool("stats", true, "Log packet stats")
 	flagStatsInterval   = flag.Duration("stats-interval", 5*time.Second, "Stats logging interval")
 	flagProbePermission = flag.Bool("probe-permission", false, "Initialize ScreenCaptureKit audio once, then exit (used by installer)")
@@ -44,8 +48,8 @@ func main() {
 	}
 
 	transport := *flagTransport
-	if transport != "auto" && transport != "vsock" && transport != "udp" {
-		log.Fatalf("--transport must be auto, vsock, or udp, got %q", transport)
+	if transport != "auto" && transport != "vsock" && transport != "udp" && transport != "mux" {
+		log.Fatalf("--transport must be auto, vsock, udp, or mux, got %q", transport)
 	}
 
 	var sender packetSender
@@ -54,6 +58,8 @@ func main() {
 		sender = connectVsock(uint32(*flagVsockPort))
 	case "udp":
 		sender = connectUDP()
+	case "mux":
+		sender = connectMux(uint32(*flagMuxPort))
 	case "auto":
 		sender = connectAuto(uint32(*flagVsockPort))
 	}
@@ -75,6 +81,7 @@ func main() {
 	}
 
 	var (
+		sendFailures    int64
 		intervalPackets int64
 		intervalBytes   int64
 		totalPackets    int64
@@ -93,7 +100,10 @@ func main() {
 			}
 
 			if err := sender.send(pkt.Data); err != nil {
-				log.Printf("send failed: %v", err)
+				// Log the first failure and then every 100th, not every one.
+				if sendFailures++; sendFailures%100 == 1 {
+					log.Printf("send failed: %v (%d failures)", err, sendFailures)
+				}
 				continue
 			}
 
@@ -126,16 +136,72 @@ type packetSender interface {
 	name() string
 }
 
+// udpRedialAfter is how many sends in a row may fail before udpSender
+// drops its socket and resolves and dials --udp again, e.g. because the
+// host restarted (a connected UDP socket keeps failing with "connection
+// refused" once the host's port was closed) or came back on a new address.
+// udpRedialInterval spaces the attempts, as the clipboard agent does.
+const (
+	udpRedialAfter    = 5
+	udpRedialInterval = time.Second
+)
+
 type udpSender struct {
-	conn *net.UDPConn
+	dest     string
+	conn     *net.UDPConn // nil until (re)dialed
+	failures int          // sends failed in a row
+	nextDial time.Time
 }
 
 func (s *udpSender) send(data []byte) error {
-	_, err := s.conn.Write(data)
+	if s.conn == nil {
+		if err := s.dial(); err != nil {
+			return err
+		}
+	}
+	n, err := s.conn.Write(data)
+	if err == nil && n < len(data) {
+		err = fmt.Errorf("short write: %d of %d bytes", n, len(data))
+	}
+	if err == nil {
+		s.failures = 0
+		return nil
+	}
+	s.failures++
+	if s.failures >= udpRedialAfter {
+		log.Printf("udp: %d sends failed in a row (%v), reconnecting to %s", s.failures, err, s.dest)
+		s.conn.Close()
+		s.conn = nil
+		s.failures = 0
+	}
 	return err
 }
 
-func (s *udpSender) close() { s.conn.Close() }
+// dial resolves the destination and connects to it, at most once per
+// udpRedialInterval.
+func (s *udpSender) dial() error {
+	if time.Now().Before(s.nextDial) {
+		return fmt.Errorf("not connected to %s", s.dest)
+	}
+	s.nextDial = time.Now().Add(udpRedialInterval)
+	addr, err := net.ResolveUDPAddr("udp", s.dest)
+	if err != nil {
+		return fmt.Errorf("resolve %s: %w", s.dest, err)
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", s.dest, err)
+	}
+	s.conn = conn
+	log.Printf("sending Opus datagrams to %s", addr.String())
+	return nil
+}
+
+func (s *udpSender) close() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
 
 func (s *udpSender) name() string { return "udp" }
 
@@ -151,6 +217,24 @@ func (s *vsockSender) close() { s.conn.Close() }
 
 func (s *vsockSender) name() string { return "vsock" }
 
+// muxSender sends audio on one stream of a multiplexed vsock connection
+// while clipboard sync runs on another.
+type muxSender struct {
+	audio    net.Conn
+	clipStop chan struct{}
+}
+
+func (s *muxSender) send(data []byte) error {
+	return audio.WriteFrame(s.audio, data)
+}
+
+func (s *muxSender) close() {
+	close(s.clipStop)
+	s.audio.Close()
+}
+
+func (s *muxSender) name() string { return "mux" }
+
 type nullSender struct{}
 
 func (s *nullSender) send(data []byte) error { return nil }
@@ -161,6 +245,11 @@ func (s *nullSender) name() string { return "none" }
 
 func connectVsock(port uint32) packetSender {
 	conn, err := audio.DialVsock(port, 5*time.Second)
+	if err == nil {
+		if err = audio.WriteHello(conn); err != nil {
+			conn.Close()
+		}
+	}
 	if err != nil {
 		log.Fatalf("vsock connect failed: %v", err)
 	}
@@ -168,26 +257,50 @@ func connectVsock(port uint32) packetSender {
 	return &vsockSender{conn: conn}
 }
 
+func connectMux(port uint32) packetSender {
+	conn, err := audio.DialVsock(port, 5*time.Second)
+	if err == nil {
+		if err = vsockmux.WriteHello(conn); err != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		log.Fatalf("vsock mux connect failed: %v", err)
+	}
+	streams := vsockmux.Split(conn, vsockmux.StreamAudio, vsockmux.StreamClipboard)
+	if err := audio.WriteHello(streams[0]); err != nil {
+		log.Fatalf("vsock mux connect failed: %v", err)
+	}
+	s := &muxSender{audio: streams[0], clipStop: make(chan struct{})}
+	go clipboard.RunGuestSession(streams[1], s.clipStop)
+	log.Printf("connected via vsock mux (port %d), carrying audio and clipboard", port)
+	return s
+}
+
 func connectUDP() packetSender {
 	if *flagUDP == "" {
 		log.Printf("no --udp destination set; capturing only")
 		return &nullSender{}
 	}
-	addr, err := net.ResolveUDPAddr("udp", *flagUDP)
-	if err != nil {
-		log.Fatalf("resolve --udp %q: %v", *flagUDP, err)
+	if _, _, err := net.SplitHostPort(*flagUDP); err != nil {
+		log.Fatalf("--udp %q: %v", *flagUDP, err)
 	}
-	conn, err := net.DialUDP("udp", nil, addr)
-	if err != nil {
-		log.Fatalf("dial --udp %q: %v", *flagUDP, err)
+	// A host that can't be resolved yet is retried as packets are sent.
+	s := &udpSender{dest: *flagUDP}
+	if err := s.dial(); err != nil {
+		log.Printf("udp: %v; retrying", err)
 	}
-	log.Printf("sending Opus datagrams to %s", addr.String())
-	return &udpSender{conn: conn}
+	return s
 }
 
 func connectAuto(vsockPort uint32) packetSender {
 	// Try vsock first
 	conn, err := audio.DialVsock(vsockPort, 2*time.Second)
+	if err == nil {
+		if err = audio.WriteHello(conn); err != nil {
+			conn.Close()
+		}
+	}
 	if err == nil {
 		log.Printf("auto: connected via vsock (port %d)", vsockPort)
 		return &vsockSender{conn: conn}
@@ -13,10 +13,12 @@ import (
 	"time"
 
 	"golang.org/x/sys/unix"
+
+	"bunghole/internal/clipboard"
 )
 
 var (
-	flagVsockPort = flag.Uint("vsock-port", 5002, "Vsock port to connect to")
+	flagVsockPort = flag.Uint("vsock-port", clipboard.DefaultVsockPort, "Vsock port to connect to (must match the host's --vsock-clipboard-port)")
 )
 
 func main() {
@@ -56,7 +58,7 @@ func main() {
 		}
 		log.Printf("connected to host vsock port %d", port)
 
-		runSession(conn, stop)
+		clipboard.RunGuestSession(conn, stop)
 		log.Printf("disconnected, reconnecting...")
 	}
 }
@@ -5,8 +5,13 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
 	"unsafe"
 
+	"bunghole/internal/audio"
 	"bunghole/internal/capture"
 	"bunghole/internal/clipboard"
 	"bunghole/internal/encode"
@@ -14,25 +19,72 @@ import (
 	"bunghole/internal/platform"
 	"bunghole/internal/types"
 	"bunghole/internal/vm"
+	"bunghole/internal/vsockmux"
 )
 
 var (
 	flagVM              = flag.Bool("vm", false, "Run macOS VM and stream its display")
-	flagVMShare         = flag.String("vm-share", "", "Directory to share with VM via VirtioFS")
 	flagVMAudioPassthru = flag.Bool("vm-audio-passthru", false, "Pass VM guest audio through to host speakers")
+	flagVMName          = flag.String("vm-name", "", "Named VM to run or set up, kept in its own bundle; empty = the default VM")
+	flagVMNetwork       = flag.String("vm-network", "nat", "VM guest networking: nat, bridged, or bridged:IFACE to bridge a host interface such as en0")
 	flagDisk            = flag.Int("disk", 64, "VM disk size in GB (used with setup)")
+	flagVsockAudioPort  = flag.Uint("vsock-audio-port", audio.DefaultVsockPort, "Vsock port the VM guest sends audio to (match the guest agent's --vsock-port)")
+	flagVsockClipPort   = flag.Uint("vsock-clipboard-port", clipboard.DefaultVsockPort, "Vsock port for VM clipboard sync (match bunghole-vm-clipboard's --vsock-port)")
+	flagVsockMuxPort    = flag.Uint("vsock-mux-port", vsockmux.DefaultPort, "Vsock port for guests sending audio and clipboard over one connection (bunghole-vm-audio --transport=mux); 0 = off")
+	flagDoubleClick     = flag.Duration("double-click-interval", 500*time.Millisecond, "Longest gap between presses of a mouse button that make a double-click")
+	flagProbePermission = flag.Bool("probe-permission", false, "Check the Screen Recording permission by capturing the main display once, explain how to grant it if missing, then exit")
 )
 
+// flagVMShares collects the repeatable --vm-share flag.
+var flagVMShares []string
+
 func registerPlatformFlags() {
-	// flags are registered above via flag.Bool/flag.String
+	flag.Func("vm-share", "Directory to share with VM via VirtioFS, as DIR or TAG=DIR; repeat for several (default $HOME)", func(v string) error {
+		flagVMShares = append(flagVMShares, v)
+		return nil
+	})
 }
 
 func fillPlatformConfig(cfg *platform.Config) {
+	if *flagProbePermission {
+		probeScreenRecording()
+	}
+
 	cfg.VM = *flagVM
-	cfg.VMShare = *flagVMShare
+	cfg.VMShare = flagVMShares
+	if err := vm.ValidateName(*flagVMName); err != nil {
+		log.Fatalf("--vm-name: %v", err)
+	}
+	cfg.VMName = *flagVMName
+	if _, err := vm.ParseNetwork(*flagVMNetwork); err != nil {
+		log.Fatalf("--vm-network: %v", err)
+	}
+	cfg.VMNetwork = *flagVMNetwork
 	cfg.VMAudioPassthru = *flagVMAudioPassthru
 	cfg.DiskGB = *flagDisk
 
+	if *flagVsockAudioPort == 0 || *flagVsockAudioPort > math.MaxUint32 ||
+		*flagVsockClipPort == 0 || *flagVsockClipPort > math.MaxUint32 {
+		log.Fatalf("--vsock-audio-port and --vsock-clipboard-port must be 1 to %d", uint32(math.MaxUint32))
+	}
+	if *flagVsockAudioPort == *flagVsockClipPort {
+		log.Fatalf("--vsock-audio-port and --vsock-clipboard-port must differ, both are %d", *flagVsockAudioPort)
+	}
+	if *flagVsockMuxPort > math.MaxUint32 {
+		log.Fatalf("--vsock-mux-port must be 0 to %d", uint32(math.MaxUint32))
+	}
+	if *flagVsockMuxPort != 0 && (*flagVsockMuxPort == *flagVsockAudioPort || *flagVsockMuxPort == *flagVsockClipPort) {
+		log.Fatalf("--vsock-mux-port must differ from the audio and clipboard ports, got %d", *flagVsockMuxPort)
+	}
+	cfg.VsockAudioPort = uint32(*flagVsockAudioPort)
+	cfg.VsockClipboardPort = uint32(*flagVsockClipPort)
+	cfg.VsockMuxPort = uint32(*flagVsockMuxPort)
+
+	if *flagDoubleClick < 0 {
+		log.Fatal("--double-click-interval must be >= 0")
+	}
+	input.SetDoubleClickInterval(*flagDoubleClick)
+
 	if cfg.VM {
 		var w, h int
 		if _, err := fmt.Sscanf(cfg.Resolution, "%dx%d", &w, &h); err != nil || w <= 0 || h <= 0 {
@@ -43,6 +95,30 @@ func fillPlatformConfig(cfg *platform.Config) {
 	}
 }
 
+// probeScreenRecording exits 0 if the main display can be captured and 1
+// otherwise, explaining how to grant the Screen Recording permission.
+func probeScreenRecording() {
+	err := capture.ProbeScreenRecording()
+	if err == nil {
+		fmt.Println("screen recording permission ok")
+		os.Exit(0)
+	}
+	if !capture.IsScreenRecordingError(err) {
+		fmt.Fprintf(os.Stderr, "screen capture failed: %v\n", err)
+		os.Exit(1)
+	}
+	exe, _ := os.Executable()
+	fmt.Fprintf(os.Stderr, `Screen Recording permission is not granted.
+
+1. Open System Settings > Privacy & Security > Screen & System Audio Recording
+2. Switch on the app running bunghole: your terminal (Terminal, iTerm, ...)
+   or, if launched directly, %s
+   (use + to add it if it isn't listed)
+3. Quit and reopen that app, then run this probe again
+`, exe)
+	os.Exit(1)
+}
+
 func newCapturer(display string, fps, gpu int) (types.MediaCapturer, error) {
 	if display == "vm" {
 		if g := vm.GetGlobal(); g != nil {
@@ -52,14 +128,19 @@ func newCapturer(display string, fps, gpu int) (types.MediaCapturer, error) {
 	return capture.NewCapturer(display, fps, gpu)
 }
 
-func newEncoder(width, height, fps, bitrateKbps, gpu int, codec string, gop int, cudaCtx, cuMemcpy2D unsafe.Pointer) (types.VideoEncoder, error) {
-	return encode.NewEncoder(width, height, fps, bitrateKbps, gpu, codec, gop, cudaCtx, cuMemcpy2D)
+// platformEncoderOptions sets the encoder options only this platform has
+// flags for.
+func platformEncoderOptions(opts *types.EncoderOptions) {
+}
+
+func newEncoder(width, height, fps, bitrateKbps, gpu int, codec string, gop int, opts types.EncoderOptions, cudaCtx, cuMemcpy2D unsafe.Pointer) (types.VideoEncoder, error) {
+	return encode.NewEncoder(width, height, fps, bitrateKbps, gpu, codec, gop, opts, cudaCtx, cuMemcpy2D)
 }
 
 func newInputHandler(displayName string) (types.EventInjector, error) {
 	if displayName == "vm" {
 		if g := vm.GetGlobal(); g != nil {
-			return vm.NewVMInputHandler(g.View()), nil
+			return vm.NewVMInputHandler(g.View(), g.Width, g.Height), nil
 		}
 	}
 	return input.NewInputHandler(displayName)
@@ -4,38 +4,136 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"image"
+	"log"
 	"unsafe"
 
+	"bunghole/internal/audio"
 	"bunghole/internal/capture"
 	"bunghole/internal/clipboard"
 	"bunghole/internal/encode"
 	"bunghole/internal/input"
 	"bunghole/internal/platform"
 	"bunghole/internal/types"
+	"bunghole/internal/xserver"
 )
 
 var (
 	flagStartX            = flag.Bool("start-x", false, "Start a new Xorg server with nvidia driver")
+	flagStartXvfb         = flag.Bool("start-xvfb", false, "Start an Xvfb server instead of Xorg: no GPU needed, captured with XShm and encoded in software (for development and CI)")
 	flagUser              = flag.String("user", "", "Run desktop session as this user (with --start-x)")
+	flagAttachExisting    = flag.Bool("attach-existing", false, "With --start-x, capture the --display (or $DISPLAY) X server if it is already running instead of starting a new one")
+	flagXorgVerbose       = flag.Int("xorg-verbose", 3, "Xorg -verbose level, 0-7 (with --start-x)")
+	flagXorgLogDir        = flag.String("xorg-log-dir", "", "Keep the Xorg and desktop session logs in this directory instead of the temp dir removed on exit (with --start-x)")
 	flagExperimentalNvFBC = flag.Bool("experimental-nvfbc", false, "Enable experimental NvFBC capture path (Linux/NVIDIA only)")
+	flagNvFBCPush         = flag.Bool("nvfbc-push", false, "Use NvFBC's push model: wait for rendered frames instead of polling (with --experimental-nvfbc)")
+	flagNvFBCForceRefresh = flag.Bool("nvfbc-force-refresh", false, "Capture a full NvFBC frame on every poll even if nothing changed (with --experimental-nvfbc)")
+	flagNvFBCSampleRate   = flag.Int("nvfbc-sample-rate", 0, "Times a second NvFBC samples the screen, up to 1000; above --fps, each grab gets a fresher frame (with --experimental-nvfbc; 0 = --fps)")
+	flagVirtual           = flag.String("virtual", "", "Framebuffer size for --start-x (WxH), may exceed --resolution; default = --resolution")
+	flagCaptureRegion     = flag.String("capture-region", "", "Capture only this region of the screen (WxH+X+Y), e.g. 1920x1080+0+0; default = whole screen")
+	flagFollowCursor      = flag.String("follow-cursor", "", "Capture a WxH window centered on the pointer that pans as it moves, e.g. 1280x720 (XShm capture only)")
+	flagNvencRGB          = flag.Bool("nvenc-rgb", false, "Feed XShm's BGRA frames to NVENC as RGB and let it convert to YUV on the GPU, skipping the CPU color conversion")
+	flagDebugOverlay      = flag.Bool("debug-overlay", false, "Burn a frame counter and timestamp into the top-left of each frame (XShm capture only), for latency measurement")
+	flagCompositeCursor   = flag.Bool("composite-cursor", true, "Draw the pointer into captured frames; false leaves it out (XShm tracks it separately for clients that draw it locally)")
+	flagWatermark         = flag.String("watermark", "", "PNG image to blend into a corner of the stream (XShm capture only)")
+	flagWatermarkPos      = flag.String("watermark-pos", "bottom-right", "Watermark corner: top-left, top-right, bottom-left or bottom-right")
+	flagMixSource         = flag.String("mix-source", "", "PulseAudio source to mix into the desktop audio, e.g. a microphone (\"default\" = default source)")
+	flagKeyboardLayout    = flag.String("keyboard-layout", "", "XKB layout to apply to the display at session start via setxkbmap (e.g. us); empty = leave as is")
 )
 
+// flagMasks collects the repeatable --mask flag.
+var flagMasks []image.Rectangle
+
 func registerPlatformFlags() {
-	// flags are registered above via flag.Bool/flag.String
+	flag.StringVar(flagUser, "desktop-user", "", "Alias for --user")
+	flag.Func("mask", "Black out this region of the captured frame (x,y,w,h); repeat for several regions (XShm capture only)", func(v string) error {
+		var x, y, w, h int
+		if _, err := fmt.Sscanf(v, "%d,%d,%d,%d", &x, &y, &w, &h); err != nil || w <= 0 || h <= 0 || x < 0 || y < 0 {
+			return fmt.Errorf("want x,y,w,h")
+		}
+		flagMasks = append(flagMasks, image.Rect(x, y, x+w, y+h))
+		return nil
+	})
 }
 
 func fillPlatformConfig(cfg *platform.Config) {
 	cfg.StartX = *flagStartX
+	cfg.StartXvfb = *flagStartXvfb
+	if *flagStartXvfb {
+		if *flagStartX {
+			log.Fatal("--start-x and --start-xvfb are mutually exclusive")
+		}
+		if *flagExperimentalNvFBC {
+			log.Fatal("--experimental-nvfbc needs an NVIDIA X server, not Xvfb")
+		}
+		// Xvfb has no GPU behind it; keep the whole pipeline in software.
+		if *flagEncoder == "auto" {
+			*flagEncoder = "software"
+		}
+	}
 	cfg.User = *flagUser
+	cfg.AttachExisting = *flagAttachExisting
+	cfg.Virtual = *flagVirtual
+	if *flagXorgVerbose < 0 || *flagXorgVerbose > 7 {
+		log.Fatalf("--xorg-verbose must be 0 to 7, got %d", *flagXorgVerbose)
+	}
+	xserver.SetXorgVerbose(*flagXorgVerbose)
+	xserver.SetLogDir(*flagXorgLogDir)
+	if *flagExperimentalNvFBC && *flagEncoder == "software" {
+		log.Fatal("--experimental-nvfbc needs a hardware encoder; drop it or --encoder software")
+	}
 	capture.SetExperimentalNvFBC(*flagExperimentalNvFBC)
+	capture.SetNvFBCPushModel(*flagNvFBCPush)
+	capture.SetNvFBCForceRefresh(*flagNvFBCForceRefresh)
+	if *flagNvFBCSampleRate < 0 || *flagNvFBCSampleRate > 1000 {
+		log.Fatalf("--nvfbc-sample-rate must be 0 to 1000, got %d", *flagNvFBCSampleRate)
+	}
+	capture.SetNvFBCSampleRate(*flagNvFBCSampleRate)
+	capture.SetDebugOverlay(*flagDebugOverlay)
+	capture.SetCompositeCursor(*flagCompositeCursor)
+	capture.SetMasks(flagMasks)
+	if *flagWatermark != "" {
+		if err := capture.SetWatermark(*flagWatermark, *flagWatermarkPos); err != nil {
+			log.Fatalf("--watermark: %v", err)
+		}
+	}
+	if *flagCaptureRegion != "" {
+		var w, h, x, y int
+		if _, err := fmt.Sscanf(*flagCaptureRegion, "%dx%d+%d+%d", &w, &h, &x, &y); err != nil || w <= 0 || h <= 0 || x < 0 || y < 0 {
+			log.Fatalf("invalid --capture-region %q: want WxH+X+Y", *flagCaptureRegion)
+		}
+		capture.SetCaptureRegion(x, y, w, h)
+		input.SetCaptureRegion(x, y, w, h)
+	}
+	if *flagFollowCursor != "" {
+		var w, h int
+		if _, err := fmt.Sscanf(*flagFollowCursor, "%dx%d", &w, &h); err != nil || w <= 0 || h <= 0 {
+			log.Fatalf("invalid --follow-cursor %q: want WxH", *flagFollowCursor)
+		}
+		if *flagCaptureRegion != "" {
+			log.Fatal("--follow-cursor and --capture-region are mutually exclusive")
+		}
+		capture.SetFollowCursor(w, h)
+		input.SetCaptureRegion(0, 0, w, h)
+		input.SetCaptureRegionOrigin(capture.FollowOrigin)
+	}
+	input.SetKeyboardLayout(*flagKeyboardLayout)
+	audio.SetMixSource(*flagMixSource)
 }
 
 func newCapturer(display string, fps, gpu int) (types.MediaCapturer, error) {
 	return capture.NewCapturer(display, fps, gpu)
 }
 
-func newEncoder(width, height, fps, bitrateKbps, gpu int, codec string, gop int, cudaCtx, cuMemcpy2D unsafe.Pointer) (types.VideoEncoder, error) {
-	return encode.NewEncoder(width, height, fps, bitrateKbps, gpu, codec, gop, cudaCtx, cuMemcpy2D)
+// platformEncoderOptions sets the encoder options only this platform has
+// flags for.
+func platformEncoderOptions(opts *types.EncoderOptions) {
+	opts.RGBInput = *flagNvencRGB
+}
+
+func newEncoder(width, height, fps, bitrateKbps, gpu int, codec string, gop int, opts types.EncoderOptions, cudaCtx, cuMemcpy2D unsafe.Pointer) (types.VideoEncoder, error) {
+	return encode.NewEncoder(width, height, fps, bitrateKbps, gpu, codec, gop, opts, cudaCtx, cuMemcpy2D)
 }
 
 func newInputHandler(displayName string) (types.EventInjector, error) {
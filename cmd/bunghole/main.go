@@ -1,46 +1,111 @@
 package main
 
 import (
+	"cmp"
 	crypto_tls "crypto/tls"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"bunghole/internal/audio"
+	"bunghole/internal/encode"
+	"bunghole/internal/logfile"
 	"bunghole/internal/platform"
 	"bunghole/internal/server"
+	"bunghole/internal/session"
 	tlsutil "bunghole/internal/tls"
+	"bunghole/internal/token"
+	"bunghole/internal/types"
 )
 
 var (
-	flagDisplay        = flag.String("display", "", "X11 display to capture (auto-detected or started if empty)")
+	flagDisplay        = flag.String("display", "", "Display to capture: X11 display (auto-detected or started if empty), or on macOS main or a display ID from bunghole list")
 	flagAddr           = flag.String("addr", "127.0.0.1:8080", "HTTP listen address")
-	flagToken          = flag.String("token", "", "Bearer token for authentication (required)")
+	flagToken          = flag.String("token", "", "Bearer token for authentication (required unless --client-ca is set)")
 	flagFPS            = flag.Int("fps", 30, "Capture frame rate")
 	flagBitrate        = flag.Int("bitrate", 4000, "Video bitrate in kbps")
+	flagMaxFPS         = flag.Int("max-fps", 0, "Highest frame rate --fps or a runtime change may set (0 = the hard limit of 240)")
+	flagMaxBitrate     = flag.Int("max-bitrate", 0, "Highest bitrate in kbps --bitrate or a runtime change may set (0 = the hard limit of 500000)")
 	flagGPU            = flag.Int("gpu", 0, "GPU index for Xorg (0=first, 1=second)")
+	flagStreamID       = flag.String("stream-id", "bunghole", "WebRTC stream ID of the video/audio tracks; set distinct IDs to embed several servers in one page")
+	flagRTSPAddr       = flag.String("rtsp-addr", "", "Also serve video+audio over RTSP on this address (e.g. :8554); requires --token")
+	flagEncodeGPU      = flag.Int("encode-gpu", -1, "GPU index for NVENC encoding (Linux); -1 = same as --gpu")
 	flagCodec          = flag.String("codec", "h264", "Video codec (h264 or h265)")
-	flagGOP            = flag.Int("gop", 0, "Keyframe interval in frames (0 = 2x FPS)")
+	flagEncoder        = flag.String("encoder", "auto", "Video encoder: auto (hardware, falling back to software) or software (libx264/libx265 only, for machines without a GPU such as CI)")
+	flagCodecFallback  = flag.String("codec-fallback", "", "With --codec h265 and no hardware HEVC encoder: h264 = fall back to hardware H.264 instead of libx265")
+	flagH264Profile    = flag.String("h264-profile", "baseline", "H.264 profile: baseline, main or high (encoder and SDP)")
+	flagH264Level      = flag.String("h264-level", "", "H.264 level, 3.1 to 6.2 (encoder and SDP); default = lowest that fits resolution, FPS and bitrate")
+	flagGOP            = flag.Int("gop", 0, "Keyframe interval in frames (0 = from --profile)")
+	flagProfile        = flag.String("profile", "low-latency", "Encoder profile: low-latency, balanced or quality (explicit encoder flags override)")
+	flagEncPreset      = flag.String("encoder-preset", "", "NVENC preset p1 (fastest) to p7 (best quality); default from --profile")
+	flagEncTune        = flag.String("encoder-tune", "", "NVENC tune: ull, ll or hq; default from --profile")
+	flagRateControl    = flag.String("rate-control", "", "NVENC rate control: cbr or vbr; default from --profile")
+	flagLibavLogLevel  = flag.String("libav-log-level", "info", "Least severe FFmpeg (libav) message to log: quiet, panic, fatal, error, warning, info, verbose, debug or trace")
+	flagKeyframeMin    = flag.Duration("keyframe-min-interval", 500*time.Millisecond, "Minimum gap between keyframes forced by client picture-loss requests (PLI/FIR); 0 = no throttling")
 	flagStats          = flag.Bool("stats", false, "Log pipeline stats every 5 seconds")
+	flagLogFile        = flag.String("log-file", "", "Write logs (and stdout/stderr of the capture/encode libraries) to this file instead of stderr")
+	flagLogMaxSize     = flag.Int("log-max-size", 100, "Rotate --log-file when it exceeds this size in MB (0 = never)")
+	flagLogKeep        = flag.Int("log-keep", 5, "Number of rotated log files to keep")
+	flagAudioGain      = flag.Float64("audio-gain", 1.0, "Multiplier applied to captured audio before encoding (e.g. 2.0 = +6 dB)")
+	flagAudioLimit     = flag.Bool("audio-limit", false, "Soft-limit captured audio peaks instead of hard clipping (useful with --audio-gain > 1)")
+	flagOpusFEC        = flag.Bool("opus-fec", false, "Enable Opus in-band FEC: each packet carries a copy of the previous frame so single lost packets can be recovered (for lossy links such as WiFi)")
+	flagOpusLoss       = flag.Int("opus-loss", 10, "Packet loss in percent that --opus-fec plans for, 1-100; more adds more redundancy at the cost of quality")
+	flagOpusDTX        = flag.Bool("opus-dtx", false, "Enable Opus DTX: skip sending audio during silence (some decoders handle the gaps poorly)")
 	flagAudioUDPListen = flag.String("audio-udp-listen", "", "Listen address for external Opus packets (e.g. guest agent), example :18080")
+	flagNoUI           = flag.Bool("no-ui", false, "Don't serve the web UI (GET / returns 404), for API-only use or a custom front-end")
+	flagUIDir          = flag.String("ui-dir", "", "Serve the web UI from this directory (index.html and its assets) instead of the built-in one")
 	flagOfferTimeout   = flag.Duration("offer-timeout", 10*time.Second, "Timeout for WHEP offer processing and ICE gathering")
 	flagAllowOrigins   = flag.String("allow-origins", "", "Comma-separated CORS allowlist (in addition to same-origin). Empty = same-origin only")
 	flagResolution     = flag.String("resolution", "1920x1080", "Display resolution (WxH)")
 	flagAuthFailLimit  = flag.Int("auth-fail-limit", 10, "Max failed auth attempts per client IP per window")
 	flagAuthFailWindow = flag.Duration("auth-fail-window", time.Minute, "Window for auth failure rate limiting")
+	flagMaxSession     = flag.Duration("max-session-duration", 0, "Disconnect controller and viewer sessions after this long (0 = no limit)")
+	flagDCMaxBuffered  = flag.Uint64("dc-max-buffered", 1<<20, "Bytes a client's data channel may have queued before server messages on it (clipboard, chat, pings) are dropped (0 = queue everything)")
+	flagKeepalive      = flag.Duration("keepalive-timeout", 30*time.Second, "Disconnect a controller whose client stops answering pings on its input channel for this long (0 = no pings)")
+	flagClipInterval   = flag.Duration("clipboard-min-interval", 500*time.Millisecond, "Shortest gap between clipboard syncs in each direction; faster changes are coalesced (0 = no limit)")
+	flagInputQueue     = flag.Int("input-queue", 1024, "Input events that may wait for injection before further ones are dropped")
+	flagInputMaxAge    = flag.Duration("input-max-age", 0, "Drop absolute mousemoves that reach injection this long after the client sent them (0 = never; needs client timestamps)")
+	flagPipelineLinger = flag.Duration("pipeline-linger", 0, "Keep the capture/encode pipeline alive this long after the last session disconnects (0 = stop immediately)")
+	flagPinCPUs        = flag.String("pin-cpus", "", "Comma-separated CPU cores to pin the capture/encode thread to (Linux), e.g. 2,3")
+	flagRealtime       = flag.Bool("realtime", false, "Run the capture/encode thread with SCHED_FIFO priority, falling back to a nice boost (Linux; needs CAP_SYS_NICE)")
+	flagEvenPacing     = flag.Bool("even-pacing", false, "Pace frames to absolute deadlines, compensating for overruns, instead of a ticker; smoother motion under load")
 	flagTLS            = flag.Bool("tls", false, "Enable TLS with auto-generated self-signed certificate")
 	flagTLSCert        = flag.String("tls-cert", "", "Path to TLS certificate file (PEM)")
 	flagTLSKey         = flag.String("tls-key", "", "Path to TLS private key file (PEM)")
+	flagTLSSAN         = flag.String("tls-san", "", "Comma-separated extra DNS names/IPs for the self-signed certificate")
+	flagTLSCertDays    = flag.Int("tls-cert-days", 365, "Validity period of the self-signed certificate in days")
+	flagClientCA       = flag.String("client-ca", "", "PEM CA bundle for client certificate auth (mTLS); with --token, both are required")
 )
 
 func main() {
 	registerPlatformFlags()
 	flag.Parse()
 
+	if *flagLogFile != "" {
+		setupLogFile()
+	}
+
+	// Subcommand: bunghole --token SECRET token [--ttl 10m] [--once]
+	if flag.NArg() > 0 && flag.Arg(0) == "token" {
+		runTokenCommand(flag.Args()[1:])
+		return
+	}
+
+	// Subcommand: bunghole list
+	if flag.NArg() > 0 && flag.Arg(0) == "list" {
+		runListCommand()
+		return
+	}
+
 	cfg := &platform.Config{
 		Display:    *flagDisplay,
 		GPU:        *flagGPU,
@@ -71,13 +136,187 @@ func main() {
 	}
 }
 
-func runServer(cfg *platform.Config) {
+// runTokenCommand prints a signed access token that the server (running
+// with the same --token) accepts until it expires.
+func runTokenCommand(args []string) {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	ttl := fs.Duration("ttl", time.Hour, "How long the token is valid")
+	once := fs.Bool("once", false, "The token creates a single session, and then only works for that session")
+	fs.Parse(args)
+
 	if *flagToken == "" {
-		log.Fatal("--token is required")
+		log.Fatal("token: --token is required (signed tokens are derived from it)")
+	}
+	if *ttl <= 0 {
+		log.Fatal("token: --ttl must be > 0")
+	}
+	tok, err := token.Mint(*flagToken, *ttl, *once)
+	if err != nil {
+		log.Fatalf("token: %v", err)
+	}
+	fmt.Println(tok)
+}
+
+// runListCommand prints the displays, outputs and GPUs (windows on macOS)
+// that bunghole can capture from, as JSON.
+func runListCommand() {
+	out, err := json.MarshalIndent(platform.List(), "", "  ")
+	if err != nil {
+		log.Fatalf("list: %v", err)
+	}
+	fmt.Println(string(out))
+}
+
+// setupLogFile sends the log, and everything written to stdout/stderr
+// (including fprintf from nvfbc/ffmpeg cgo code), to --log-file.
+func setupLogFile() {
+	w, err := logfile.Open(*flagLogFile, int64(*flagLogMaxSize)<<20, *flagLogKeep)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, fd := range []int{1, 2} {
+		if err := w.RedirectFD(fd); err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.SetOutput(w)
+}
+
+// encoderProfile is a named combination of encoder settings.
+type encoderProfile struct {
+	tuning     types.EncoderOptions // preset, tune and rate control
+	gopSeconds int                  // keyframe interval
+}
+
+var encoderProfiles = map[string]encoderProfile{
+	// What bunghole has always done: fastest preset, no lookahead.
+	"low-latency": {types.EncoderOptions{Preset: "p1", Tune: "ull", RC: "cbr"}, 2},
+	// A slower preset for noticeably better text/detail at a few ms more.
+	"balanced": {types.EncoderOptions{Preset: "p4", Tune: "ll", RC: "cbr"}, 2},
+	// For watching rather than interacting: VBR and fewer keyframes.
+	"quality": {types.EncoderOptions{Preset: "p6", Tune: "hq", RC: "vbr"}, 4},
+}
+
+// parseH264Level validates --h264-level and returns the level to pin the
+// encoder to, "" for none.
+func parseH264Level(v string) string {
+	if v == "" {
+		return ""
+	}
+	major, minor, _ := strings.Cut(v, ".")
+	if minor == "" {
+		minor = "0"
+	}
+	maj, err1 := strconv.Atoi(major)
+	sub, err2 := strconv.Atoi(minor)
+	idc := maj*10 + sub
+	switch {
+	case err1 != nil || err2 != nil || len(minor) != 1:
+	case idc == 31 || idc == 32 || (maj >= 4 && maj <= 6 && sub <= 2):
+		return fmt.Sprintf("%d.%d", maj, sub)
+	}
+	log.Fatalf("--h264-level must be 3.1, 3.2 or 4 to 6.2, got %q", v)
+	return ""
+}
+
+// applyEncoderProfile expands --profile into encoder settings, lets the
+// individual encoder flags override it, and returns the settings and the
+// GOP to use, for server.Config.
+func applyEncoderProfile() (types.EncoderOptions, int) {
+	p, ok := encoderProfiles[*flagProfile]
+	if !ok {
+		log.Fatalf("--profile must be low-latency, balanced or quality, got %q", *flagProfile)
+	}
+
+	t := p.tuning
+	if *flagEncPreset != "" {
+		if len(*flagEncPreset) != 2 || (*flagEncPreset)[0] != 'p' || (*flagEncPreset)[1] < '1' || (*flagEncPreset)[1] > '7' {
+			log.Fatalf("--encoder-preset must be p1 to p7, got %q", *flagEncPreset)
+		}
+		t.Preset = *flagEncPreset
+	}
+	switch *flagEncTune {
+	case "":
+	case "ull", "ll", "hq":
+		t.Tune = *flagEncTune
+	default:
+		log.Fatalf("--encoder-tune must be ull, ll or hq, got %q", *flagEncTune)
+	}
+	switch *flagRateControl {
+	case "":
+	case "cbr", "vbr":
+		t.RC = *flagRateControl
+	default:
+		log.Fatalf("--rate-control must be cbr or vbr, got %q", *flagRateControl)
+	}
+	if err := encode.SetLibavLogLevel(*flagLibavLogLevel); err != nil {
+		log.Fatalf("--libav-log-level: %v", err)
+	}
+
+	gop := *flagGOP
+	if gop <= 0 {
+		gop = p.gopSeconds * *flagFPS
+	}
+	log.Printf("encoder profile %s: preset=%s tune=%s rc=%s gop=%d", *flagProfile, t.Preset, t.Tune, t.RC, gop)
+	return t, gop
+}
+
+// audioCapturerFactory picks where the pipeline's audio comes from: Opus
+// packets from a guest over UDP or vsock if either is set up, otherwise
+// the host's own audio.
+func audioCapturerFactory(udpListen string, vsockCh <-chan net.Conn) server.AudioCapturerFactory {
+	return func() (types.AudioCapturer, error) {
+		switch {
+		case udpListen != "":
+			ac, err := audio.NewUDPAudioCapture(udpListen)
+			if err == nil {
+				log.Printf("audio: source=guest-udp listen=%s", udpListen)
+			}
+			return ac, err
+		case vsockCh != nil:
+			// VM mode: the guest HAL driver sends Opus directly over
+			// vsock, no host-side SCK needed.
+			log.Printf("audio: source=guest-vsock")
+			return audio.NewVsockAudioCapture(vsockCh), nil
+		default:
+			// Host desktop: PulseAudio on Linux, ScreenCaptureKit on macOS.
+			return audio.NewAudioCapture()
+		}
+	}
+}
+
+func runServer(cfg *platform.Config) {
+	if *flagToken == "" && *flagClientCA == "" {
+		log.Fatal("--token is required (or --client-ca for certificate auth)")
+	}
+	if *flagRTSPAddr != "" && *flagToken == "" {
+		log.Fatal("--rtsp-addr requires --token (RTSP readers authenticate with it as the password)")
+	}
+	if *flagRTSPAddr != "" && *flagCodecFallback != "" {
+		log.Fatal("--rtsp-addr can't be combined with --codec-fallback (RTSP announces --codec at startup, before the encoder has fallen back)")
 	}
 	if *flagFPS <= 0 {
 		log.Fatal("--fps must be > 0")
 	}
+	if *flagBitrate <= 0 {
+		log.Fatal("--bitrate must be > 0")
+	}
+	if *flagMaxFPS < 0 || *flagMaxFPS > server.HardMaxFPS {
+		log.Fatalf("--max-fps must be 0 to %d", server.HardMaxFPS)
+	}
+	if *flagMaxBitrate < 0 || *flagMaxBitrate > server.HardMaxBitrate {
+		log.Fatalf("--max-bitrate must be 0 to %d", server.HardMaxBitrate)
+	}
+	// Clamp here rather than leave it to the server so the GOP derived
+	// from --fps below matches what the encoder gets.
+	if maxFPS := cmp.Or(*flagMaxFPS, server.HardMaxFPS); *flagFPS > maxFPS {
+		log.Printf("warning: --fps %d is over the %d fps cap, using %d", *flagFPS, maxFPS, maxFPS)
+		*flagFPS = maxFPS
+	}
+	if maxBitrate := cmp.Or(*flagMaxBitrate, server.HardMaxBitrate); *flagBitrate > maxBitrate {
+		log.Printf("warning: --bitrate %d is over the %d kbps cap, using %d", *flagBitrate, maxBitrate, maxBitrate)
+		*flagBitrate = maxBitrate
+	}
 
 	platform.SaveTermState()
 
@@ -98,24 +337,133 @@ func runServer(cfg *platform.Config) {
 	if codec != "h264" && codec != "h265" {
 		log.Fatalf("--codec must be h264 or h265, got %q", codec)
 	}
+	encOpts, gop := applyEncoderProfile()
+	switch *flagEncoder {
+	case "auto", "software":
+		encOpts.SoftwareOnly = *flagEncoder == "software"
+	default:
+		log.Fatalf("--encoder must be auto or software, got %q", *flagEncoder)
+	}
+	switch *flagCodecFallback {
+	case "", "h264":
+		encOpts.CodecFallback = *flagCodecFallback
+	default:
+		log.Fatalf("--codec-fallback must be h264, got %q", *flagCodecFallback)
+	}
+	switch *flagH264Profile {
+	case "baseline", "main", "high":
+		encOpts.H264Profile = *flagH264Profile
+	default:
+		log.Fatalf("--h264-profile must be baseline, main or high, got %q", *flagH264Profile)
+	}
+	encOpts.H264Level = parseH264Level(*flagH264Level)
+	platformEncoderOptions(&encOpts)
+
+	if *flagAudioGain <= 0 {
+		log.Fatal("--audio-gain must be > 0")
+	}
+	audio.SetGain(*flagAudioGain, *flagAudioLimit)
+	audio.SetDTX(*flagOpusDTX)
+	if *flagOpusLoss < 1 || *flagOpusLoss > 100 {
+		log.Fatalf("--opus-loss must be 1 to 100, got %d", *flagOpusLoss)
+	}
+	audio.SetFEC(*flagOpusFEC, *flagOpusLoss)
+	if *flagOpusFEC && *flagOpusDTX {
+		log.Printf("warning: --opus-fec and --opus-dtx combine poorly: the last frame before each silence is left unprotected, and lost comfort-noise updates can't be recovered")
+	}
+
+	if *flagKeepalive < 0 {
+		log.Fatal("--keepalive-timeout must be >= 0")
+	}
+	session.SetKeepaliveTimeout(*flagKeepalive)
+	session.SetMaxBuffered(*flagDCMaxBuffered)
+	if *flagInputMaxAge < 0 {
+		log.Fatal("--input-max-age must be >= 0")
+	}
+	session.SetMaxInputAge(*flagInputMaxAge)
+	if *flagInputQueue < 1 {
+		log.Fatal("--input-queue must be >= 1")
+	}
+	session.SetInputQueueSize(*flagInputQueue)
+	if *flagClipInterval < 0 {
+		log.Fatal("--clipboard-min-interval must be >= 0")
+	}
+	session.SetClipboardMinInterval(*flagClipInterval)
 
 	// TLS validation
 	if (*flagTLSCert != "") != (*flagTLSKey != "") {
 		log.Fatal("--tls-cert and --tls-key must both be set")
 	}
 
-	var serverTLSCert, serverTLSKey string
+	var serverTLSCert, serverTLSKey, serverTLSFingerprint string
 	var serverTLSConfig *crypto_tls.Config
 
 	if *flagTLSCert != "" {
 		serverTLSCert = *flagTLSCert
 		serverTLSKey = *flagTLSKey
 	} else if *flagTLS {
-		tc, err := tlsutil.SelfSigned()
+		if *flagTLSCertDays <= 0 {
+			log.Fatal("--tls-cert-days must be > 0")
+		}
+		opts := tlsutil.Options{
+			Validity: time.Duration(*flagTLSCertDays) * 24 * time.Hour,
+		}
+		for _, san := range strings.Split(*flagTLSSAN, ",") {
+			san = strings.TrimSpace(san)
+			if san == "" {
+				continue
+			}
+			if ip := net.ParseIP(san); ip != nil {
+				opts.IPs = append(opts.IPs, ip)
+			} else {
+				opts.DNSNames = append(opts.DNSNames, san)
+			}
+		}
+		tc, fp, err := tlsutil.SelfSigned(opts)
 		if err != nil {
 			log.Fatalf("self-signed cert: %v", err)
 		}
 		serverTLSConfig = tc
+		serverTLSFingerprint = fp
+	}
+
+	if *flagClientCA != "" {
+		if serverTLSCert == "" && serverTLSConfig == nil {
+			log.Fatal("--client-ca requires --tls or --tls-cert/--tls-key")
+		}
+		pool, err := tlsutil.LoadClientCAs(*flagClientCA)
+		if err != nil {
+			log.Fatalf("client CA: %v", err)
+		}
+		if serverTLSConfig == nil {
+			serverTLSConfig = &crypto_tls.Config{}
+		}
+		serverTLSConfig.ClientAuth = crypto_tls.RequireAndVerifyClientCert
+		serverTLSConfig.ClientCAs = pool
+	}
+
+	var pinCPUs []int
+	for _, c := range strings.Split(*flagPinCPUs, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		n, err := strconv.Atoi(c)
+		if err != nil || n < 0 {
+			log.Fatalf("--pin-cpus: invalid CPU %q", c)
+		}
+		pinCPUs = append(pinCPUs, n)
+	}
+
+	if *flagNoUI && *flagUIDir != "" {
+		log.Fatal("--no-ui and --ui-dir are mutually exclusive")
+	}
+	if *flagUIDir != "" {
+		if fi, err := os.Stat(*flagUIDir); err != nil {
+			log.Fatalf("--ui-dir: %v", err)
+		} else if !fi.IsDir() {
+			log.Fatalf("--ui-dir: %s is not a directory", *flagUIDir)
+		}
 	}
 
 	var allowedOrigins []string
@@ -127,31 +475,48 @@ func runServer(cfg *platform.Config) {
 	}
 
 	srv := server.New(server.Config{
-		Display:        cfg.Display,
-		Token:          *flagToken,
-		FPS:            *flagFPS,
-		Bitrate:        *flagBitrate,
-		GPU:            *flagGPU,
-		Codec:          codec,
-		GOP:            *flagGOP,
-		Addr:           *flagAddr,
-		Stats:          *flagStats,
-		AudioUDPListen: *flagAudioUDPListen,
-		VsockAudioCh:   cfg.VsockAudioCh,
+		Display:    cfg.Display,
+		Token:      *flagToken,
+		FPS:        *flagFPS,
+		Bitrate:    *flagBitrate,
+		MaxFPS:     *flagMaxFPS,
+		MaxBitrate: *flagMaxBitrate,
+		GPU:        *flagGPU,
+		EncodeGPU:  *flagEncodeGPU,
+		RTSPAddr:   *flagRTSPAddr,
+		StreamID:   *flagStreamID,
+		Codec:      codec,
+		GOP:        gop,
+		Encoder:    encOpts,
+		Addr:       *flagAddr,
+		Stats:      *flagStats,
 
 		OfferTimeout:   *flagOfferTimeout,
 		AllowedOrigins: allowedOrigins,
 		AuthFailLimit:  *flagAuthFailLimit,
 		AuthFailWindow: *flagAuthFailWindow,
+		PipelineLinger: *flagPipelineLinger,
+		PinCPUs:        pinCPUs,
+		Realtime:       *flagRealtime,
+		EvenPacing:     *flagEvenPacing,
+
+		KeyframeInterval:   *flagKeyframeMin,
+		MaxSessionDuration: *flagMaxSession,
+
+		NoUI:  *flagNoUI,
+		UIDir: *flagUIDir,
 
-		TLSCert: serverTLSCert,
-		TLSKey:  serverTLSKey,
-		TLS:     serverTLSConfig,
+		TLSCert:        serverTLSCert,
+		TLSKey:         serverTLSKey,
+		TLS:            serverTLSConfig,
+		TLSFingerprint: serverTLSFingerprint,
+		ClientCertAuth: *flagClientCA != "",
 
-		NewCapturer:  newCapturer,
-		NewEncoder:   newEncoder,
-		InputFactory: newInputHandler,
-		ClipFactory:  newClipboardHandler,
+		NewCapturer:      newCapturer,
+		NewEncoder:       newEncoder,
+		NewAudioCapturer: audioCapturerFactory(*flagAudioUDPListen, cfg.VsockAudioCh),
+		InputFactory:     newInputHandler,
+		ClipFactory:      newClipboardHandler,
 	})
 
 	// Handle graceful shutdown
@@ -0,0 +1,26 @@
+/*
+ * X display connections that survive the X server going away.
+ *
+ * By default Xlib exits the process on a fatal I/O error (e.g. the server
+ * restarted). xconn_open installs a per-display exit handler that only
+ * raises *dead instead, so the owner can close the display and open a new
+ * one. Requires libX11 >= 1.7 for XSetIOErrorExitHandler.
+ */
+#ifndef XCONN_H
+#define XCONN_H
+
+#include <X11/Xlib.h>
+
+static void xconn_io_exit(Display *dpy, void *user_data) {
+	(void)dpy;
+	*(volatile int *)user_data = 1;
+}
+
+static Display* xconn_open(const char *name, int *dead) {
+	*dead = 0;
+	Display *d = XOpenDisplay(name);
+	if (d) XSetIOErrorExitHandler(d, xconn_io_exit, dead);
+	return d;
+}
+
+#endif
@@ -40,8 +40,14 @@ struct sockaddr_vm {
 
 /* CID 2 = host in Apple's Virtualization.framework */
 #define VSOCK_HOST_CID  2
+/* Must match the host's --vsock-audio-port; set with
+ * cmake -DBUNGHOLE_VSOCK_AUDIO_PORT=... */
+#ifndef VSOCK_PORT_OUT
 #define VSOCK_PORT_OUT  5000
+#endif
+#ifndef VSOCK_PORT_IN
 #define VSOCK_PORT_IN   5001
+#endif
 
 /* Opus encoder/decoder — linked at build time.
  * Include path comes from pkg-config which points into the opus/ subdir. */
@@ -60,7 +66,7 @@ struct sockaddr_vm {
 
 /* Opus: 20ms frames = 960 samples at 48kHz */
 #define OPUS_FRAME_SIZE     960
-#define OPUS_MAX_PACKET     1500
+#define OPUS_MAX_PACKET     4000    /* maxFrameSize in internal/audio/vsock_frame.go */
 #define OPUS_BITRATE        128000
 
 /* IO nominal buffer = 512 frames */
@@ -240,6 +246,21 @@ static int framed_write(int fd, const unsigned char *data, uint16_t len) {
     return 0;
 }
 
+/* Hello sent before the first frame: magic "BHA" + protocol version.
+ * Keep in sync with FrameVersion in internal/audio/vsock_frame.go. */
+#define FRAME_VERSION 2
+
+static int write_hello(int fd) {
+    const unsigned char hello[4] = { 'B', 'H', 'A', FRAME_VERSION };
+    ssize_t n = 0;
+    while (n < 4) {
+        ssize_t w = write(fd, hello + n, 4 - n);
+        if (w <= 0) return -1;
+        n += w;
+    }
+    return 0;
+}
+
 static int framed_read(int fd, unsigned char *buf, int bufsize, uint16_t *out_len) {
     unsigned char hdr[2];
     ssize_t n = 0;
@@ -296,6 +317,11 @@ static void *output_transport_thread(void *arg) {
             sleep(1);
             continue;
         }
+        if (write_hello(fd) < 0) {
+            close(fd);
+            sleep(1);
+            continue;
+        }
         os_log(drv->logger, "output vsock connected to host port %d", VSOCK_PORT_OUT);
 
         while (atomic_load(&drv->running)) {
@@ -68,6 +68,12 @@ CLIP_AGENT_DIR="$REAL_HOME/Library/LaunchAgents"
 CLIP_PLIST="$CLIP_AGENT_DIR/$CLIP_LABEL.plist"
 CLIP_LOG_OUT="$REAL_HOME/Library/Logs/bunghole-vm-clipboard.log"
 CLIP_LOG_ERR="$REAL_HOME/Library/Logs/bunghole-vm-clipboard.err.log"
+CLIP_VSOCK_PORT="${BUNGHOLE_VM_CLIPBOARD_VSOCK_PORT:-}"
+CLIP_ARGS=""
+if [[ -n "$CLIP_VSOCK_PORT" ]]; then
+    CLIP_ARGS="
+        <string>--vsock-port=$CLIP_VSOCK_PORT</string>"
+fi
 
 echo
 echo "Installing clipboard agent for user $REAL_USER ..."
@@ -86,7 +92,7 @@ cat > "$CLIP_PLIST" <<PLIST
 
     <key>ProgramArguments</key>
     <array>
-        <string>$CLIP_BIN_DST</string>
+        <string>$CLIP_BIN_DST</string>$CLIP_ARGS
     </array>
 
     <key>RunAtLoad</key>
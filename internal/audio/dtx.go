@@ -0,0 +1,27 @@
+package audio
+
+import "github.com/hraban/opus"
+
+var opusDTX bool
+
+// SetDTX enables Opus discontinuous transmission for locally encoded
+// audio: during silence the encoder only emits a comfort-noise update
+// every 400ms and the frames in between are not sent.
+func SetDTX(enabled bool) {
+	opusDTX = enabled
+}
+
+// configureDTX applies the DTX setting to a newly created encoder.
+func configureDTX(enc *opus.Encoder) error {
+	if !opusDTX {
+		return nil
+	}
+	return enc.SetDTX(true)
+}
+
+// isDTXFrame reports whether an encoded packet of n bytes is a DTX
+// placeholder. libopus marks these by returning 2 bytes or less; they
+// carry nothing the decoder needs and are not transmitted.
+func isDTXFrame(n int) bool {
+	return opusDTX && n <= 2
+}
@@ -0,0 +1,30 @@
+package audio
+
+import "github.com/hraban/opus"
+
+var (
+	opusFEC      bool
+	opusLossPerc = 10
+)
+
+// SetFEC enables Opus in-band forward error correction for locally
+// encoded audio: each packet also carries a low-bitrate copy of the
+// previous frame, so the decoder can conceal a single lost packet. lossPerc
+// is the packet loss (1-100%) the encoder plans for; libopus only adds the
+// redundancy when it's above zero, and more loss buys more of it at the
+// expense of the primary encoding.
+func SetFEC(enabled bool, lossPerc int) {
+	opusFEC = enabled
+	opusLossPerc = lossPerc
+}
+
+// configureFEC applies the FEC setting to a newly created encoder.
+func configureFEC(enc *opus.Encoder) error {
+	if !opusFEC {
+		return nil
+	}
+	if err := enc.SetInBandFEC(true); err != nil {
+		return err
+	}
+	return enc.SetPacketLossPerc(opusLossPerc)
+}
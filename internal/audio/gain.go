@@ -0,0 +1,52 @@
+package audio
+
+import "math"
+
+// limiterKnee is the level (fraction of full scale) above which the soft
+// limiter starts compressing.
+const limiterKnee = 0.8
+
+var (
+	gain      = 1.0
+	softLimit bool
+)
+
+// SetGain sets the multiplier applied to captured PCM before Opus
+// encoding. With limit set, peaks above limiterKnee are compressed
+// smoothly toward full scale instead of being hard-clipped.
+func SetGain(g float64, limit bool) {
+	gain = g
+	softLimit = limit
+}
+
+// applyGain scales pcm in place by the configured gain, clamping to the
+// int16 range so overflow never wraps around.
+func applyGain(pcm []int16) {
+	if gain == 1 && !softLimit {
+		return
+	}
+	for i, s := range pcm {
+		v := float64(s) * gain / 32768
+		if softLimit {
+			v = limit(v)
+		}
+		v *= 32768
+		if v > 32767 {
+			v = 32767
+		} else if v < -32768 {
+			v = -32768
+		}
+		pcm[i] = int16(v)
+	}
+}
+
+// limit maps v (full scale = 1) through a tanh curve above limiterKnee, so
+// any input level stays below full scale.
+func limit(v float64) float64 {
+	a := math.Abs(v)
+	if a <= limiterKnee {
+		return v
+	}
+	a = limiterKnee + (1-limiterKnee)*math.Tanh((a-limiterKnee)/(1-limiterKnee))
+	return math.Copysign(a, v)
+}
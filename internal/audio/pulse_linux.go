@@ -23,10 +23,21 @@ const (
 	frameSize     = sampleRate * frameDuration / 1000 // 960 samples per channel
 )
 
+// mixSource names a PulseAudio source (e.g. a microphone) mixed into the
+// desktop audio; empty = desktop audio only.
+var mixSource string
+
+// SetMixSource sets a second PulseAudio source to mix with the default
+// sink monitor. "default" selects the default source.
+func SetMixSource(name string) {
+	mixSource = name
+}
+
 type AudioCapture struct {
-	client  *pulse.Client
-	stream  *pulse.RecordStream
-	encoder *opus.Encoder
+	client    *pulse.Client
+	stream    *pulse.RecordStream
+	mixStream *pulse.RecordStream
+	encoder   *opus.Encoder
 }
 
 // pcmCollector implements pulse.Writer — receives raw PCM from PulseAudio
@@ -67,6 +78,23 @@ func (p *pcmCollector) drain(count int) []int16 {
 	return out
 }
 
+// mixPCM adds src into dst sample by sample, clamping to the int16 range
+// so loud passages clip instead of wrapping around.
+func mixPCM(dst, src []int16) {
+	for i := range dst {
+		if i >= len(src) {
+			return
+		}
+		v := int32(dst[i]) + int32(src[i])
+		if v > 32767 {
+			v = 32767
+		} else if v < -32768 {
+			v = -32768
+		}
+		dst[i] = int16(v)
+	}
+}
+
 func NewAudioCapture() (types.AudioCapturer, error) {
 	client, err := pulse.NewClient(
 		pulse.ClientApplicationName("bunghole"),
@@ -80,6 +108,14 @@ func NewAudioCapture() (types.AudioCapturer, error) {
 		client.Close()
 		return nil, fmt.Errorf("opus encoder: %w", err)
 	}
+	if err := configureDTX(enc); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("opus DTX: %w", err)
+	}
+	if err := configureFEC(enc); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("opus FEC: %w", err)
+	}
 
 	ac := &AudioCapture{
 		client:  client,
@@ -115,8 +151,17 @@ func (ac *AudioCapture) Run(packets chan<- *types.OpusPacket, stop <-chan struct
 	ac.stream = stream
 	stream.Start()
 
+	var mixCollector *pcmCollector
+	if mixSource != "" {
+		mixCollector, err = ac.startMix()
+		if err != nil {
+			log.Printf("audio: mix source %q unavailable (continuing with desktop audio only): %v", mixSource, err)
+		}
+	}
+
 	opusBuf := make([]byte, 4000)
 	samplesPerFrame := frameSize * channels // 960 * 2 = 1920 int16 samples per 20ms stereo frame
+	skipped := 0                            // DTX frames since the last packet sent
 
 	ticker := time.NewTicker(time.Duration(frameDuration) * time.Millisecond)
 	defer ticker.Stop()
@@ -127,9 +172,19 @@ func (ac *AudioCapture) Run(packets chan<- *types.OpusPacket, stop <-chan struct
 			return
 		case <-ticker.C:
 			pcm := collector.drain(samplesPerFrame)
+			if mixCollector != nil {
+				// The two streams are clocked independently; a frame
+				// missing from either side is sent without it.
+				if mix := mixCollector.drain(samplesPerFrame); pcm == nil {
+					pcm = mix
+				} else if mix != nil {
+					mixPCM(pcm, mix)
+				}
+			}
 			if pcm == nil {
 				continue
 			}
+			applyGain(pcm)
 
 			encoded, err := ac.encoder.Encode(pcm, opusBuf)
 			if err != nil {
@@ -137,11 +192,18 @@ func (ac *AudioCapture) Run(packets chan<- *types.OpusPacket, stop <-chan struct
 				continue
 			}
 
+			if isDTXFrame(encoded) {
+				skipped++
+				continue
+			}
+
 			pkt := &types.OpusPacket{
 				Data:     make([]byte, encoded),
 				Duration: time.Duration(frameDuration) * time.Millisecond,
+				Skipped:  skipped,
 			}
 			copy(pkt.Data, opusBuf[:encoded])
+			skipped = 0
 
 			select {
 			case packets <- pkt:
@@ -151,9 +213,44 @@ func (ac *AudioCapture) Run(packets chan<- *types.OpusPacket, stop <-chan struct
 	}
 }
 
+// startMix opens a record stream on mixSource.
+func (ac *AudioCapture) startMix() (*pcmCollector, error) {
+	var src *pulse.Source
+	var err error
+	if mixSource == "default" {
+		src, err = ac.client.DefaultSource()
+	} else {
+		src, err = ac.client.SourceByID(mixSource)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	collector := &pcmCollector{
+		format: proto.FormatInt16LE,
+	}
+	stream, err := ac.client.NewRecord(
+		collector,
+		pulse.RecordSource(src),
+		pulse.RecordStereo,
+		pulse.RecordSampleRate(sampleRate),
+		pulse.RecordBufferFragmentSize(uint32(frameSize*channels*2)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create record stream: %w", err)
+	}
+	ac.mixStream = stream
+	stream.Start()
+	log.Printf("audio: mixing source %s", src.ID())
+	return collector, nil
+}
+
 func (ac *AudioCapture) Close() {
 	if ac.stream != nil {
 		ac.stream.Stop()
 	}
+	if ac.mixStream != nil {
+		ac.mixStream.Stop()
+	}
 	ac.client.Close()
 }
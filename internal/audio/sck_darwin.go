@@ -52,6 +52,12 @@ func NewAudioCapture() (types.AudioCapturer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("opus encoder: %w", err)
 	}
+	if err := configureDTX(enc); err != nil {
+		return nil, fmt.Errorf("opus DTX: %w", err)
+	}
+	if err := configureFEC(enc); err != nil {
+		return nil, fmt.Errorf("opus FEC: %w", err)
+	}
 
 	ac := &AudioCapture{encoder: enc}
 	var vmErr error
@@ -87,6 +93,7 @@ func (ac *AudioCapture) Run(packets chan<- *types.OpusPacket, stop <-chan struct
 	silentFrames := 0
 	seenFrame := false
 	seenAudible := false
+	skipped := 0 // DTX frames since the last packet sent
 
 	fallbackToDisplay := func(reason string) {
 		log.Printf("audio: %s; falling back to display audio", reason)
@@ -154,17 +161,25 @@ func (ac *AudioCapture) Run(packets chan<- *types.OpusPacket, stop <-chan struct
 				continue
 			}
 
+			applyGain(pcmBuf)
 			encoded, err := ac.encoder.Encode(pcmBuf, opusBuf)
 			if err != nil {
 				log.Printf("opus encode: %v", err)
 				continue
 			}
 
+			if isDTXFrame(encoded) {
+				skipped++
+				continue
+			}
+
 			pkt := &types.OpusPacket{
 				Data:     make([]byte, encoded),
 				Duration: time.Duration(frameDuration) * time.Millisecond,
+				Skipped:  skipped,
 			}
 			copy(pkt.Data, opusBuf[:encoded])
+			skipped = 0
 
 			select {
 			case packets <- pkt:
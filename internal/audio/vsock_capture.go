@@ -3,6 +3,7 @@
 package audio
 
 import (
+	"bufio"
 	"log"
 	"net"
 	"time"
@@ -39,6 +40,26 @@ func (ac *VsockAudioCapture) Run(packets chan<- *types.OpusPacket, stop <-chan s
 func (ac *VsockAudioCapture) readLoop(conn net.Conn, packets chan<- *types.OpusPacket, stop <-chan struct{}) {
 	defer conn.Close()
 
+	// ReadFrame blocks until the guest sends; unblock it on stop so the
+	// pipeline isn't held up by a quiet guest.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	br := bufio.NewReader(conn)
+	version, err := ReadHello(br)
+	if err != nil {
+		log.Printf("audio: vsock guest rejected: %v", err)
+		return
+	}
+	log.Printf("audio: vsock guest speaks frame protocol v%d", version)
+
 	seenFirst := false
 	for {
 		select {
@@ -47,7 +68,7 @@ func (ac *VsockAudioCapture) readLoop(conn net.Conn, packets chan<- *types.OpusP
 		default:
 		}
 
-		data, err := ReadFrame(conn)
+		data, err := ReadFrame(br)
 		if err != nil {
 			return
 		}
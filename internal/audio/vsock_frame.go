@@ -1,12 +1,67 @@
 package audio
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
 	"io"
 )
 
-const maxFrameSize = 1500
+// maxFrameSize is the largest frame payload: one Opus packet, sized like
+// the capture encoders' output buffers. Packets can exceed an Ethernet MTU
+// at high bitrates or with in-band FEC, so this is not 1500 bytes (the
+// limit up to protocol v1).
+const maxFrameSize = 4000
+
+// DefaultVsockPort is the vsock port the guest sends audio to by default.
+// The host (--vsock-audio-port), bunghole-vm-audio (--vsock-port) and the
+// BungholeAudio driver (VSOCK_PORT_OUT) must agree on it.
+const DefaultVsockPort = 5000
+
+// FrameVersion is the audio frame protocol version this build speaks.
+//
+// A guest starts each connection with a hello: the magic "BHA" and its
+// version byte. Guests from before the hello (version 0) start straight
+// with a frame, whose first byte is the high byte of a length of at most
+// maxFrameSize and so never 'B'. Hosts from before the hello read the magic
+// as an oversized length and drop the connection instead of misreading it.
+//
+// Version 2 raised maxFrameSize from 1500 to 4000 bytes. A v1 host would
+// drop the connection on the first larger frame, so it refuses v2 guests
+// up front instead.
+const FrameVersion = 2
+
+var helloMagic = [3]byte{'B', 'H', 'A'}
+
+// WriteHello sends the guest's hello; call it once, before any frame.
+func WriteHello(w io.Writer) error {
+	_, err := w.Write([]byte{helloMagic[0], helloMagic[1], helloMagic[2], FrameVersion})
+	return err
+}
+
+// ReadHello reads the guest's hello and returns its protocol version, or 0
+// for a guest that sends none. Read frames from br afterwards: for a
+// version-0 guest it holds the start of the first frame.
+func ReadHello(br *bufio.Reader) (int, error) {
+	b, err := br.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	if b[0] != helloMagic[0] {
+		return 0, nil
+	}
+	var hello [4]byte
+	if _, err := io.ReadFull(br, hello[:]); err != nil {
+		return 0, err
+	}
+	if [3]byte(hello[:3]) != helloMagic {
+		return 0, fmt.Errorf("not an audio stream (hello %q); check the vsock ports", hello[:3])
+	}
+	if v := int(hello[3]); v > FrameVersion {
+		return 0, fmt.Errorf("guest speaks audio frame protocol v%d, this host only up to v%d; update bunghole on the host", v, FrameVersion)
+	}
+	return int(hello[3]), nil
+}
 
 // WriteFrame writes a length-prefixed frame: [2-byte big-endian length][payload].
 func WriteFrame(w io.Writer, data []byte) error {
@@ -0,0 +1,28 @@
+package capture
+
+import (
+	"image"
+	"unsafe"
+)
+
+// masks are frame regions blacked out before encoding.
+var masks []image.Rectangle
+
+// SetMasks blacks out the given rectangles (in captured-frame coordinates)
+// in every frame, so that part of the screen is never streamed. Only CPU
+// (BGRA) capture paths support it.
+func SetMasks(rects []image.Rectangle) {
+	masks = rects
+}
+
+// drawMasks fills the masked regions of a BGRA buffer with black, clipped
+// to the frame.
+func drawMasks(buf unsafe.Pointer, width, height, stride int) {
+	pix := unsafe.Slice((*byte)(buf), stride*height)
+	for _, r := range masks {
+		r = r.Intersect(image.Rect(0, 0, width, height))
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			clear(pix[y*stride+r.Min.X*4 : y*stride+r.Max.X*4])
+		}
+	}
+}
@@ -40,6 +40,9 @@ typedef struct {
 	int width;
 	int height;
 	int stride;
+	int push;                          // push model: grabs block for a new frame
+	int force_refresh;                 // poll model: capture even if nothing changed
+	uint32_t timeout_ms;               // push model: longest a grab waits
 } NvFBCCapturer;
 
 // Load CUDA driver API dynamically
@@ -116,9 +119,19 @@ static void nvfbc_cleanup(NvFBCCapturer *c, int has_session, int has_handle) {
 	free(c);
 }
 
-static NvFBCCapturer* nvfbc_init(const char *display_name, int fps, const char *pci_bus_id) {
+// nvfbc_init captures the given box of the X screen, or the whole screen
+// if box->w or box->h is 0. With push set, NvFBC delivers frames as they
+// are rendered and each grab waits up to one frame interval for one.
+// Otherwise grabs poll; force_refresh makes each poll capture the screen
+// even when NvFBC saw no change. with_cursor draws the pointer into frames.
+// NvFBC samples the screen sample_fps times a second, which may be faster
+// than the fps frames are grabbed at.
+static NvFBCCapturer* nvfbc_init(const char *display_name, int fps, int sample_fps, const char *pci_bus_id, const NVFBC_BOX *box, int push, int force_refresh, int with_cursor) {
 	NvFBCCapturer *c = (NvFBCCapturer*)calloc(1, sizeof(NvFBCCapturer));
 	if (!c) return NULL;
+	c->push = push;
+	c->force_refresh = force_refresh;
+	c->timeout_ms = fps > 0 ? 1000 / fps : 33;
 
 	// Step 1: Load CUDA
 	if (load_cuda(c) != 0) {
@@ -232,6 +245,16 @@ static NvFBCCapturer* nvfbc_init(const char *display_name, int fps, const char *
 
 	c->width = statusParams.screenSize.w;
 	c->height = statusParams.screenSize.h;
+	if (box->w > 0 && box->h > 0) {
+		if (box->x + box->w > (uint32_t)c->width || box->y + box->h > (uint32_t)c->height) {
+			fprintf(stderr, "nvfbc: capture region %ux%u+%u+%u exceeds screen %dx%d\n",
+				box->w, box->h, box->x, box->y, c->width, c->height);
+			nvfbc_cleanup(c, 0, 1);
+			return NULL;
+		}
+		c->width = box->w;
+		c->height = box->h;
+	}
 
 	// Step 6: Create capture session
 	NVFBC_CREATE_CAPTURE_SESSION_PARAMS captureParams;
@@ -239,9 +262,12 @@ static NvFBCCapturer* nvfbc_init(const char *display_name, int fps, const char *
 	captureParams.dwVersion = NVFBC_CREATE_CAPTURE_SESSION_PARAMS_VER;
 	captureParams.eCaptureType = NVFBC_CAPTURE_SHARED_CUDA;
 	captureParams.eTrackingType = NVFBC_TRACKING_DEFAULT;
-	captureParams.bWithCursor = NVFBC_TRUE;
-	captureParams.dwSamplingRateMs = fps > 0 ? 1000 / fps : 33;
-	captureParams.bPushModel = NVFBC_FALSE;
+	captureParams.bWithCursor = with_cursor ? NVFBC_TRUE : NVFBC_FALSE;
+	if (box->w > 0 && box->h > 0) {
+		captureParams.captureBox = *box;
+	}
+	captureParams.dwSamplingRateMs = sample_fps > 0 ? 1000 / sample_fps : 33;
+	captureParams.bPushModel = push ? NVFBC_TRUE : NVFBC_FALSE;
 
 	status = c->fn.nvFBCCreateCaptureSession(c->session, &captureParams);
 	if (status != NVFBC_SUCCESS) {
@@ -268,12 +294,14 @@ static NvFBCCapturer* nvfbc_init(const char *display_name, int fps, const char *
 	// NV12 stride is typically width aligned to 256 bytes for NVENC
 	c->stride = (c->width + 255) & ~255;
 
-	fprintf(stderr, "nvfbc: initialized %dx%d capture (TOCUDA, poll+force_refresh)\n",
-		c->width, c->height);
+	fprintf(stderr, "nvfbc: initialized %dx%d capture (TOCUDA, %s)\n",
+		c->width, c->height, push ? "push" : force_refresh ? "poll+force_refresh" : "poll");
 	return c;
 }
 
-// Returns: 0=success (new frame), 1=reused last frame, -1=error
+// Returns: 0=success (new frame), 1=reused last frame, -1=error.
+// In push mode a grab that times out returns the last frame again with
+// bIsNewFrame unset, which is reported as 1.
 static int nvfbc_grab(NvFBCCapturer *c) {
 	struct timespec t0, t1;
 	clock_gettime(CLOCK_MONOTONIC, &t0);
@@ -285,11 +313,20 @@ static int nvfbc_grab(NvFBCCapturer *c) {
 	NVFBC_TOCUDA_GRAB_FRAME_PARAMS grabParams;
 	memset(&grabParams, 0, sizeof(grabParams));
 	grabParams.dwVersion = NVFBC_TOCUDA_GRAB_FRAME_PARAMS_VER;
-	grabParams.dwFlags = NVFBC_TOCUDA_GRAB_FLAGS_FORCE_REFRESH
-	                   | NVFBC_TOCUDA_GRAB_FLAGS_NOWAIT;
+	if (c->push) {
+		grabParams.dwFlags = NVFBC_TOCUDA_GRAB_FLAGS_NOFLAGS;
+		grabParams.dwTimeoutMs = c->timeout_ms;
+	} else {
+		// Without FORCE_REFRESH an unchanged screen returns the last
+		// frame with bIsNewFrame unset, which the pipeline skips.
+		grabParams.dwFlags = NVFBC_TOCUDA_GRAB_FLAGS_NOWAIT;
+		if (c->force_refresh) {
+			grabParams.dwFlags |= NVFBC_TOCUDA_GRAB_FLAGS_FORCE_REFRESH;
+		}
+		grabParams.dwTimeoutMs = 0;
+	}
 	grabParams.pCUDADeviceBuffer = (void*)&c->grab_ptr;
 	grabParams.pFrameGrabInfo = &c->grab_info;
-	grabParams.dwTimeoutMs = 0;
 
 	NVFBCSTATUS status = c->fn.nvFBCToCudaGrabFrame(c->session, &grabParams);
 
@@ -337,7 +374,12 @@ static int nvfbc_grab(NvFBCCapturer *c) {
 
 	// Success — update frame_ptr from grab target
 	c->frame_ptr = c->grab_ptr;
-	new_count++;
+	int fresh = c->grab_info.bIsNewFrame;
+	if (fresh) {
+		new_count++;
+	} else {
+		reuse_count++;
+	}
 
 	// Update dimensions from grab info (may differ on resolution change)
 	c->width = c->grab_info.dwWidth;
@@ -370,7 +412,7 @@ static int nvfbc_grab(NvFBCCapturer *c) {
 		last_report = t1;
 	}
 
-	return 0;
+	return fresh ? 0 : 1;
 }
 
 // Return the last captured frame's CUDA device pointer as a void* for Go.
@@ -378,6 +420,19 @@ static void* nvfbc_frame_ptr(NvFBCCapturer *c) {
 	return (void*)(uintptr_t)c->frame_ptr;
 }
 
+// Copy the NV12 CUDA frame into dst, which must hold stride*height*3/2 bytes.
+// Returns 0 on success.
+static int nvfbc_copy_to_host(NvFBCCapturer *c, void *dst, int size) {
+	if (!fn_cuMemcpyDtoH || !c->frame_ptr) return -1;
+	if (size < c->stride * c->height * 3 / 2) return -1;
+	CUresult r = fn_cuMemcpyDtoH(dst, c->frame_ptr, c->stride * c->height * 3 / 2);
+	if (r != CUDA_SUCCESS) {
+		fprintf(stderr, "nvfbc: cuMemcpyDtoH failed: %d\n", r);
+		return -1;
+	}
+	return 0;
+}
+
 // Download the NV12 CUDA frame to CPU memory. Caller must free the returned buffer.
 // Returns NULL on failure. *out_size receives the total byte size.
 static uint8_t* nvfbc_download_frame(NvFBCCapturer *c, int *out_size) {
@@ -438,10 +493,45 @@ import (
 	"bunghole/internal/types"
 )
 
+// NvFBC grab tuning (see SetNvFBCPushModel and SetNvFBCForceRefresh).
+var nvfbcPushModel, nvfbcForceRefresh bool
+
+// nvfbcSampleRate is how many times a second NvFBC samples the screen;
+// 0 = the capture frame rate.
+var nvfbcSampleRate int
+
+// SetNvFBCSampleRate sets how many times a second NvFBC samples the screen,
+// independently of the rate frames are grabbed and encoded at. Sampling
+// faster than that means each grab gets a fresher frame, cutting motion
+// latency by up to a frame interval, for some extra GPU work. 0 samples
+// at the capture frame rate.
+func SetNvFBCSampleRate(hz int) {
+	nvfbcSampleRate = hz
+}
+
+// SetNvFBCPushModel makes NvFBC deliver frames as they are rendered, with
+// each grab blocking up to one frame interval for a new one, instead of
+// polling with a forced refresh every tick.
+func SetNvFBCPushModel(enabled bool) {
+	nvfbcPushModel = enabled
+}
+
+// SetNvFBCForceRefresh makes every poll capture the screen even when NvFBC
+// saw no change. It is off by default so unchanged frames come back stale
+// and aren't encoded; turn it on if a driver misses updates. Ignored with
+// the push model.
+func SetNvFBCForceRefresh(enabled bool) {
+	nvfbcForceRefresh = enabled
+}
+
 // NvfbcCapturer captures frames via NvFBC TOCUDA (zero-copy GPU capture).
 type NvfbcCapturer struct {
 	c   *C.NvFBCCapturer
 	fps int
+
+	hostFrames bool         // copy each frame to host memory instead of handing out the CUDA pointer
+	host       []byte       // reused NV12 host buffer when hostFrames is set
+	hostLast   *types.Frame // last host frame, returned again for stale grabs
 }
 
 // NewNvFBCCapturer creates an NvFBC TOCUDA capturer for the given PCI bus ID.
@@ -451,11 +541,30 @@ func NewNvFBCCapturer(displayName string, fps int, pciBusID string) (types.Media
 	cBusID := C.CString(pciBusID)
 	defer C.free(unsafe.Pointer(cBusID))
 
-	c := C.nvfbc_init(cDisplay, C.int(fps), cBusID)
+	r := captureRegion
+	box := C.NVFBC_BOX{x: C.uint32_t(r.X), y: C.uint32_t(r.Y), w: C.uint32_t(r.W), h: C.uint32_t(r.H)}
+	push, forceRefresh := C.int(0), C.int(0)
+	if nvfbcPushModel {
+		push = 1
+	}
+	if nvfbcForceRefresh {
+		forceRefresh = 1
+	}
+	withCursor := C.int(0)
+	if compositeCursor {
+		withCursor = 1
+	}
+	sampleRate := nvfbcSampleRate
+	if sampleRate == 0 {
+		sampleRate = fps
+	} else if sampleRate < fps {
+		log.Printf("warning: NvFBC sample rate %d Hz is below the %d fps capture rate; some grabs will repeat frames", sampleRate, fps)
+	}
+	c := C.nvfbc_init(cDisplay, C.int(fps), C.int(sampleRate), cBusID, &box, push, forceRefresh, withCursor)
 	if c == nil {
 		return nil, fmt.Errorf("failed to initialize NvFBC capture")
 	}
-	log.Printf("capture: NvFBC (%dx%d)", int(c.width), int(c.height))
+	log.Printf("capture: NvFBC (%dx%d, sampling at %d Hz)", int(c.width), int(c.height), sampleRate)
 	return &NvfbcCapturer{c: c, fps: fps}, nil
 }
 
@@ -468,6 +577,17 @@ func (c *NvfbcCapturer) Grab() (*types.Frame, error) {
 		return nil, fmt.Errorf("NvFBC grab failed")
 	}
 
+	// ret == 1: NvFBC had nothing new and we're handing back the last frame.
+	stale := ret == 1
+
+	if c.hostFrames {
+		if stale && c.hostLast != nil {
+			c.hostLast.Stale = true
+			return c.hostLast, nil
+		}
+		return c.hostFrame()
+	}
+
 	return &types.Frame{
 		Ptr:    unsafe.Pointer(C.nvfbc_frame_ptr(c.c)),
 		Width:  int(c.c.width),
@@ -475,9 +595,35 @@ func (c *NvfbcCapturer) Grab() (*types.Frame, error) {
 		Stride: int(c.c.stride),
 		IsCUDA: true,
 		PixFmt: types.PixFmtNV12,
+		Stale:  stale,
 	}, nil
 }
 
+// SetHostFrames makes Grab return NV12 frames in host memory, for an
+// encoder that cannot share this capturer's CUDA context (another GPU).
+func (c *NvfbcCapturer) SetHostFrames(enabled bool) {
+	c.hostFrames = enabled
+}
+
+func (c *NvfbcCapturer) hostFrame() (*types.Frame, error) {
+	// The stride can change between grabs (see nvfbc_grab), so size per frame.
+	size := int(c.c.stride) * int(c.c.height) * 3 / 2
+	if len(c.host) < size {
+		c.host = make([]byte, size)
+	}
+	if C.nvfbc_copy_to_host(c.c, unsafe.Pointer(&c.host[0]), C.int(len(c.host))) != 0 {
+		return nil, fmt.Errorf("NvFBC host copy failed")
+	}
+	c.hostLast = &types.Frame{
+		Data:   c.host[:size],
+		Width:  int(c.c.width),
+		Height: int(c.c.height),
+		Stride: int(c.c.stride),
+		PixFmt: types.PixFmtNV12,
+	}
+	return c.hostLast, nil
+}
+
 // CUDAContext returns the CUDA context for the encoder to share.
 func (c *NvfbcCapturer) CUDAContext() unsafe.Pointer {
 	return unsafe.Pointer(c.c.cuda_ctx)
@@ -490,7 +636,7 @@ func (c *NvfbcCapturer) CuMemcpy2D() unsafe.Pointer {
 
 // GrabImage grabs a frame and returns it as a Go image (for debug endpoint).
 func (c *NvfbcCapturer) GrabImage() (image.Image, error) {
-	if C.nvfbc_grab(c.c) != 0 {
+	if C.nvfbc_grab(c.c) < 0 {
 		return nil, fmt.Errorf("NvFBC grab failed")
 	}
 	w := int(c.c.width)
@@ -0,0 +1,64 @@
+package capture
+
+import (
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+// overlayScale is the size in pixels of one glyph dot.
+const overlayScale = 4
+
+var debugOverlay bool
+
+// SetDebugOverlay burns a frame counter and wall-clock time into the
+// top-left corner of each captured frame, for measuring glass-to-glass
+// latency by photographing the source and client screens together.
+// Only CPU (BGRA) capture paths support it.
+func SetDebugOverlay(enabled bool) {
+	debugOverlay = enabled
+}
+
+// overlayFont is a 3x5 bitmap font; each row's low 3 bits are the dots,
+// most significant bit leftmost.
+var overlayFont = map[byte][5]byte{
+	'0': {7, 5, 5, 5, 7},
+	'1': {2, 6, 2, 2, 7},
+	'2': {7, 1, 7, 4, 7},
+	'3': {7, 1, 7, 1, 7},
+	'4': {5, 5, 7, 1, 1},
+	'5': {7, 4, 7, 1, 7},
+	'6': {7, 4, 7, 5, 7},
+	'7': {7, 1, 1, 1, 1},
+	'8': {7, 5, 7, 5, 7},
+	'9': {7, 5, 7, 1, 7},
+	':': {0, 2, 0, 2, 0},
+	'.': {0, 0, 0, 0, 2},
+	' ': {0, 0, 0, 0, 0},
+}
+
+// drawOverlay writes "<frame> <hh:mm:ss.mmm>" in white on black into a
+// BGRA buffer, clipped to the frame.
+func drawOverlay(buf unsafe.Pointer, width, height, stride int, frame uint64, now time.Time) {
+	text := fmt.Sprintf("%06d %s", frame%1000000, now.Format("15:04:05.000"))
+	pix := unsafe.Slice((*byte)(buf), stride*height)
+
+	// One dot of padding around the text, glyphs 3 dots wide plus 1 gap.
+	boxW := (len(text)*4 + 1) * overlayScale
+	boxH := 7 * overlayScale
+	for y := 0; y < boxH && y < height; y++ {
+		for x := 0; x < boxW && x < width; x++ {
+			off := y*stride + x*4
+			on := false
+			gy, gx := y/overlayScale-1, x/overlayScale-1
+			if gy >= 0 && gy < 5 && gx >= 0 && gx%4 < 3 && gx/4 < len(text) {
+				on = overlayFont[text[gx/4]][gy]&(4>>(gx%4)) != 0
+			}
+			var v byte
+			if on {
+				v = 255
+			}
+			pix[off], pix[off+1], pix[off+2], pix[off+3] = v, v, v, 255
+		}
+	}
+}
@@ -8,6 +8,9 @@ package capture
 
 #include <stdint.h>
 
+#define SCK_ERR_PERMISSION -2
+#define SCK_ERR_NOT_FOUND  -3
+
 typedef struct {
 	void *stream;
 	void *delegate;
@@ -16,29 +19,112 @@ typedef struct {
 	int height;
 } SCKCaptureHandle;
 
-int  sck_capture_start_display(int fps, SCKCaptureHandle *out);
+int  sck_capture_start_display(uint32_t display_id, int fps, SCKCaptureHandle *out);
 int  sck_capture_start_window(uint32_t window_id, int fps, int w, int h, SCKCaptureHandle *out);
 int  sck_capture_grab(SCKCaptureHandle *h, uint8_t **buf, int *stride, int *w, int *h_out);
 void sck_capture_stop(SCKCaptureHandle *h);
+int  sck_has_screen_access(void);
+void sck_request_screen_access(void);
+
+typedef struct {
+	uint32_t display_id;
+	int width;
+	int height;
+} SCKDisplayInfo;
+
+typedef struct {
+	uint32_t window_id;
+	char app[128];
+	char title[256];
+	int width;
+	int height;
+	int on_screen;
+} SCKWindowInfo;
+
+int sck_list(SCKDisplayInfo *displays, int max_displays, int *n_displays,
+             SCKWindowInfo *windows, int max_windows, int *n_windows);
 */
 import "C"
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"unsafe"
 
 	"bunghole/internal/types"
 )
 
+// errScreenRecording is returned when macOS hasn't granted the Screen
+// Recording permission, the usual reason capture fails on a new install.
+var errScreenRecording = errors.New("screen recording permission not granted: " +
+	"allow the app running bunghole (e.g. Terminal, or bunghole itself) in System Settings > " +
+	"Privacy & Security > Screen & System Audio Recording, then restart it")
+
+// captureError explains a failed ScreenCaptureKit start, singling out the
+// missing permission.
+func captureError(ret C.int, what string) error {
+	if ret == C.SCK_ERR_PERMISSION || C.sck_has_screen_access() == 0 {
+		return errScreenRecording
+	}
+	return fmt.Errorf("ScreenCaptureKit %s capture failed", what)
+}
+
+// ProbeScreenRecording starts and stops a capture of the main display to
+// check for the Screen Recording permission. If it is missing, macOS is
+// asked to prompt for it, which also adds the app to the list in System
+// Settings so it only needs to be switched on.
+func ProbeScreenRecording() error {
+	var handle C.SCKCaptureHandle
+	ret := C.sck_capture_start_display(0, 1, &handle)
+	if ret == 0 {
+		C.sck_capture_stop(&handle)
+		return nil
+	}
+	err := captureError(ret, "display")
+	if errors.Is(err, errScreenRecording) {
+		C.sck_request_screen_access()
+	}
+	return err
+}
+
+// IsScreenRecordingError reports whether err is the missing Screen
+// Recording permission.
+func IsScreenRecordingError(err error) bool {
+	return errors.Is(err, errScreenRecording)
+}
+
 // DisplayCapturer wraps ScreenCaptureKit display capture.
 type DisplayCapturer struct {
 	handle C.SCKCaptureHandle
 }
 
-// NewCapturer creates a ScreenCaptureKit display capturer.
+// ParseDisplay returns the CGDirectDisplayID a --display value names: 0
+// for "main" (the largest display), else a display ID as listed by
+// `bunghole list`.
+func ParseDisplay(name string) (uint32, error) {
+	if name == "main" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(name, 10, 32)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("display %q: want main or a display ID from `bunghole list`", name)
+	}
+	return uint32(id), nil
+}
+
+// NewCapturer creates a ScreenCaptureKit display capturer for the display
+// ParseDisplay names.
 func NewCapturer(displayName string, fps, gpu int) (types.MediaCapturer, error) {
+	id, err := ParseDisplay(displayName)
+	if err != nil {
+		return nil, err
+	}
 	var handle C.SCKCaptureHandle
-	if ret := C.sck_capture_start_display(C.int(fps), &handle); ret != 0 {
-		return nil, fmt.Errorf("ScreenCaptureKit display capture failed")
+	if ret := C.sck_capture_start_display(C.uint32_t(id), C.int(fps), &handle); ret != 0 {
+		if ret == C.SCK_ERR_NOT_FOUND {
+			return nil, fmt.Errorf("display %d not found; see `bunghole list`", id)
+		}
+		return nil, captureError(ret, "display")
 	}
 	return &DisplayCapturer{handle: handle}, nil
 }
@@ -79,7 +165,7 @@ func NewWindowCapturer(windowID uint32, fps, w, h int) (types.MediaCapturer, err
 	}
 	var handle C.SCKCaptureHandle
 	if ret := C.sck_capture_start_window(C.uint32_t(windowID), C.int(fps), C.int(w), C.int(h), &handle); ret != 0 {
-		return nil, fmt.Errorf("ScreenCaptureKit window capture failed")
+		return nil, captureError(ret, "window")
 	}
 	return &WindowCapturer{
 		handle: handle,
@@ -110,3 +196,52 @@ func (c *WindowCapturer) Grab() (*types.Frame, error) {
 func (c *WindowCapturer) Close() {
 	C.sck_capture_stop(&c.handle)
 }
+
+// DisplayInfo is a display ScreenCaptureKit can capture.
+type DisplayInfo struct {
+	ID     uint32 `json:"id"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// WindowInfo is a window ScreenCaptureKit can capture.
+type WindowInfo struct {
+	ID       uint32 `json:"id"`
+	App      string `json:"app,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	OnScreen bool   `json:"on_screen"`
+}
+
+// ListShareable returns the displays and windows ScreenCaptureKit offers
+// for capture (at most 16 displays and 1024 windows).
+func ListShareable() ([]DisplayInfo, []WindowInfo, error) {
+	var cDisplays [16]C.SCKDisplayInfo
+	cWindows := make([]C.SCKWindowInfo, 1024)
+	var nd, nw C.int
+	if ret := C.sck_list(&cDisplays[0], C.int(len(cDisplays)), &nd, &cWindows[0], C.int(len(cWindows)), &nw); ret != 0 {
+		if ret == C.SCK_ERR_PERMISSION || C.sck_has_screen_access() == 0 {
+			return nil, nil, errScreenRecording
+		}
+		return nil, nil, fmt.Errorf("ScreenCaptureKit shareable content unavailable")
+	}
+
+	displays := make([]DisplayInfo, 0, int(nd))
+	for _, d := range cDisplays[:nd] {
+		displays = append(displays, DisplayInfo{ID: uint32(d.display_id), Width: int(d.width), Height: int(d.height)})
+	}
+	windows := make([]WindowInfo, 0, int(nw))
+	for i := range cWindows[:nw] {
+		w := &cWindows[i]
+		windows = append(windows, WindowInfo{
+			ID:       uint32(w.window_id),
+			App:      C.GoString(&w.app[0]),
+			Title:    C.GoString(&w.title[0]),
+			Width:    int(w.width),
+			Height:   int(w.height),
+			OnScreen: w.on_screen != 0,
+		})
+	}
+	return displays, windows, nil
+}
@@ -82,6 +82,29 @@ typedef struct {
 
 // ---- Shared helpers ----
 
+// Returned instead of -1 when capture failed because the user hasn't
+// granted Screen Recording permission.
+#define SCK_ERR_PERMISSION -2
+#define SCK_ERR_NOT_FOUND  -3
+
+static int sck_error_result(NSError *error) {
+    if ([error.domain isEqualToString:SCStreamErrorDomain] &&
+        error.code == SCStreamErrorUserDeclined) {
+        return SCK_ERR_PERMISSION;
+    }
+    return -1;
+}
+
+int sck_has_screen_access(void) {
+    return CGPreflightScreenCaptureAccess() ? 1 : 0;
+}
+
+// Shows the system prompt (once per app) and adds the app to the Screen
+// Recording list in System Settings.
+void sck_request_screen_access(void) {
+    CGRequestScreenCaptureAccess();
+}
+
 static int sck_start_stream(SCContentFilter *filter, int fps, int w, int h,
                             SCKCaptureHandle *out) {
     SCStreamConfiguration *config = [[SCStreamConfiguration alloc] init];
@@ -116,7 +139,7 @@ static int sck_start_stream(SCContentFilter *filter, int fps, int w, int h,
     [stream startCaptureWithCompletionHandler:^(NSError *error) {
         if (error) {
             NSLog(@"sck_start_stream: startCapture error: %@", error);
-            startResult = -1;
+            startResult = sck_error_result(error);
         }
         dispatch_semaphore_signal(sem);
     }];
@@ -125,7 +148,7 @@ static int sck_start_stream(SCContentFilter *filter, int fps, int w, int h,
     if (startResult != 0) {
         pthread_mutex_destroy(&frame->lock);
         free(frame);
-        return -1;
+        return startResult;
     }
 
     out->stream = (void *)CFBridgingRetain(stream);
@@ -138,34 +161,48 @@ static int sck_start_stream(SCContentFilter *filter, int fps, int w, int h,
 
 // ---- Host display capture ----
 
-int sck_capture_start_display(int fps, SCKCaptureHandle *out) {
+// sck_capture_start_display captures the display with the given
+// CGDirectDisplayID, or the main (largest) display if display_id is 0.
+int sck_capture_start_display(uint32_t display_id, int fps, SCKCaptureHandle *out) {
     @autoreleasepool {
         memset(out, 0, sizeof(SCKCaptureHandle));
 
         __block SCDisplay *mainDisplay = nil;
+        __block int lookupResult = -1;
         dispatch_semaphore_t sem = dispatch_semaphore_create(0);
 
         [SCShareableContent getShareableContentWithCompletionHandler:
             ^(SCShareableContent *content, NSError *error) {
                 if (error) {
                     NSLog(@"sck_capture_start_display: error: %@", error);
+                    lookupResult = sck_error_result(error);
                     dispatch_semaphore_signal(sem);
                     return;
                 }
-                // Find main display (largest or first)
                 for (SCDisplay *d in content.displays) {
+                    if (display_id != 0) {
+                        if (d.displayID == display_id) {
+                            mainDisplay = d;
+                            break;
+                        }
+                        continue;
+                    }
+                    // Find main display (largest or first)
                     if (!mainDisplay || (d.width * d.height > mainDisplay.width * mainDisplay.height)) {
                         mainDisplay = d;
                     }
                 }
+                if (!mainDisplay && display_id != 0) {
+                    lookupResult = SCK_ERR_NOT_FOUND;
+                }
                 dispatch_semaphore_signal(sem);
             }];
 
         dispatch_semaphore_wait(sem, DISPATCH_TIME_FOREVER);
 
         if (!mainDisplay) {
-            NSLog(@"sck_capture_start_display: no display found");
-            return -1;
+            NSLog(@"sck_capture_start_display: display %u not found", display_id);
+            return lookupResult;
         }
 
         int w = (int)mainDisplay.width;
@@ -309,3 +346,71 @@ void sck_capture_stop(SCKCaptureHandle *h) {
         }
     }
 }
+
+// ---- Enumeration (bunghole list) ----
+
+typedef struct {
+    uint32_t display_id;
+    int width;
+    int height;
+} SCKDisplayInfo;
+
+typedef struct {
+    uint32_t window_id;
+    char app[128];
+    char title[256];
+    int width;
+    int height;
+    int on_screen;
+} SCKWindowInfo;
+
+// sck_list fills up to max_* shareable displays and windows and sets the
+// counts. Returns SCK_ERR_PERMISSION without screen recording permission,
+// -1 on other errors or a timeout.
+int sck_list(SCKDisplayInfo *displays, int max_displays, int *n_displays,
+             SCKWindowInfo *windows, int max_windows, int *n_windows) {
+    @autoreleasepool {
+        *n_displays = 0;
+        *n_windows = 0;
+
+        __block int ret = -1;
+        dispatch_semaphore_t sem = dispatch_semaphore_create(0);
+
+        [SCShareableContent getShareableContentWithCompletionHandler:
+            ^(SCShareableContent *content, NSError *error) {
+                if (error) {
+                    NSLog(@"sck_list: error: %@", error);
+                    ret = sck_error_result(error);
+                    dispatch_semaphore_signal(sem);
+                    return;
+                }
+                for (SCDisplay *d in content.displays) {
+                    if (*n_displays >= max_displays) break;
+                    SCKDisplayInfo *di = &displays[(*n_displays)++];
+                    di->display_id = d.displayID;
+                    di->width = (int)d.width;
+                    di->height = (int)d.height;
+                }
+                for (SCWindow *win in content.windows) {
+                    if (*n_windows >= max_windows) break;
+                    SCKWindowInfo *wi = &windows[(*n_windows)++];
+                    memset(wi, 0, sizeof(*wi));
+                    wi->window_id = win.windowID;
+                    NSString *app = win.owningApplication.applicationName;
+                    if (app) strlcpy(wi->app, app.UTF8String, sizeof(wi->app));
+                    if (win.title) strlcpy(wi->title, win.title.UTF8String, sizeof(wi->title));
+                    wi->width = (int)win.frame.size.width;
+                    wi->height = (int)win.frame.size.height;
+                    wi->on_screen = win.onScreen ? 1 : 0;
+                }
+                ret = 0;
+                dispatch_semaphore_signal(sem);
+            }];
+
+        if (dispatch_semaphore_wait(sem, dispatch_time(DISPATCH_TIME_NOW, 10 * NSEC_PER_SEC)) != 0) {
+            NSLog(@"sck_list: timed out waiting for shareable content");
+            return -1;
+        }
+        return ret;
+    }
+}
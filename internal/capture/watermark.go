@@ -0,0 +1,105 @@
+package capture
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"os"
+	"unsafe"
+)
+
+// watermarkMargin is the gap in pixels between the watermark and the
+// frame edges.
+const watermarkMargin = 16
+
+type watermarkImage struct {
+	img    *image.NRGBA
+	right  bool // anchored to the right edge, else the left
+	bottom bool // anchored to the bottom edge, else the top
+}
+
+// watermark is the image blended into every frame, or nil for none.
+var watermark *watermarkImage
+
+// SetWatermark loads a PNG to blend into a corner of each captured frame:
+// top-left, top-right, bottom-left or bottom-right. Only CPU (BGRA)
+// capture paths support it.
+func SetWatermark(path, pos string) error {
+	var right, bottom bool
+	switch pos {
+	case "top-left":
+	case "top-right":
+		right = true
+	case "bottom-left":
+		bottom = true
+	case "bottom-right":
+		right, bottom = true, true
+	default:
+		return fmt.Errorf("watermark position must be top-left, top-right, bottom-left or bottom-right, got %q", pos)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open watermark: %w", err)
+	}
+	defer f.Close()
+	src, err := png.Decode(f)
+	if err != nil {
+		return fmt.Errorf("decode watermark %s: %w", path, err)
+	}
+
+	// Normalize to non-premultiplied RGBA so blending doesn't care what
+	// kind of PNG it was.
+	img := image.NewNRGBA(src.Bounds().Sub(src.Bounds().Min))
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+
+	watermark = &watermarkImage{img: img, right: right, bottom: bottom}
+	return nil
+}
+
+// drawWatermark alpha-blends the watermark into a BGRA buffer (RGBA with
+// rgb), the same way xshm_composite_cursor blends the cursor, clipped to
+// the frame.
+func drawWatermark(buf unsafe.Pointer, width, height, stride int, rgb bool) {
+	wm := watermark.img
+	ww, wh := wm.Rect.Dx(), wm.Rect.Dy()
+	x0, y0 := watermarkMargin, watermarkMargin
+	if watermark.right {
+		x0 = width - ww - watermarkMargin
+	}
+	if watermark.bottom {
+		y0 = height - wh - watermarkMargin
+	}
+
+	r, b := 2, 0
+	if rgb {
+		r, b = 0, 2
+	}
+	pix := unsafe.Slice((*byte)(buf), stride*height)
+	for y := 0; y < wh; y++ {
+		dy := y0 + y
+		if dy < 0 || dy >= height {
+			continue
+		}
+		for x := 0; x < ww; x++ {
+			dx := x0 + x
+			if dx < 0 || dx >= width {
+				continue
+			}
+			s := wm.Pix[y*wm.Stride+x*4:]
+			a := int(s[3])
+			if a == 0 {
+				continue
+			}
+			d := pix[dy*stride+dx*4:]
+			if a == 255 {
+				d[r], d[1], d[b] = s[0], s[1], s[2]
+			} else {
+				d[r] = byte((int(s[0])*a + int(d[r])*(255-a)) / 255)
+				d[1] = byte((int(s[1])*a + int(d[1])*(255-a)) / 255)
+				d[b] = byte((int(s[2])*a + int(d[b])*(255-a)) / 255)
+			}
+		}
+	}
+}
@@ -4,6 +4,7 @@ package capture
 
 /*
 #cgo pkg-config: x11 xext xfixes
+#cgo CFLAGS: -I${SRCDIR}/../../cvendor
 #include <X11/Xlib.h>
 #include <X11/Xutil.h>
 #include <X11/extensions/XShm.h>
@@ -12,6 +13,7 @@ package capture
 #include <sys/shm.h>
 #include <stdlib.h>
 #include <string.h>
+#include "xconn.h"
 
 // ---------------------------------------------------------------------------
 // XShm capturer (fallback when NvFBC is unavailable)
@@ -22,21 +24,61 @@ typedef struct {
 	Window root;
 	XShmSegmentInfo shminfo;
 	XImage *image;
+	int x, y;     // origin of the captured region on the root window
 	int width;
 	int height;
+	int screen_width, screen_height;
+	int rgb;      // 1 = pixels are RGBX, 0 = BGRX, -1 = neither (unsupported visual)
+	int dead;     // set by Xlib when the connection to the server is lost
 } XShmCapturer;
 
-static XShmCapturer* xshm_init(const char *display_name) {
+// xshm_byte_of returns which byte of a pixel in img holds the 8-bit
+// channel with the given mask, or -1 if it isn't a whole byte.
+static int xshm_byte_of(XImage *img, unsigned long mask) {
+	if (mask == 0) return -1;
+	int shift = 0;
+	while (!(mask & 1)) { mask >>= 1; shift++; }
+	if (mask != 0xFF || shift % 8) return -1;
+	return img->byte_order == LSBFirst ? shift / 8 : 3 - shift / 8;
+}
+
+// xshm_pixel_order tells BGRX, by far the most common layout, from RGBX.
+// The 4th byte is padding either way; X leaves it undefined.
+static int xshm_pixel_order(XImage *img) {
+	if (img->bits_per_pixel != 32) return -1;
+	int r = xshm_byte_of(img, img->red_mask);
+	int b = xshm_byte_of(img, img->blue_mask);
+	if (r == 2 && b == 0) return 0;
+	if (r == 0 && b == 2) return 1;
+	return -1;
+}
+
+// xshm_init captures the w x h region at (x, y), or the whole screen if
+// w or h is 0. Returns NULL if the region does not fit on the screen.
+static XShmCapturer* xshm_init(const char *display_name, int x, int y, int w, int h) {
 	XShmCapturer *c = (XShmCapturer*)calloc(1, sizeof(XShmCapturer));
 	if (!c) return NULL;
 
-	c->display = XOpenDisplay(display_name);
+	c->display = xconn_open(display_name, &c->dead);
 	if (!c->display) { free(c); return NULL; }
 
 	int screen = DefaultScreen(c->display);
 	c->root = RootWindow(c->display, screen);
 	c->width = DisplayWidth(c->display, screen);
 	c->height = DisplayHeight(c->display, screen);
+	c->screen_width = c->width;
+	c->screen_height = c->height;
+	if (w > 0 && h > 0) {
+		if (x < 0 || y < 0 || x + w > c->width || y + h > c->height) {
+			XCloseDisplay(c->display);
+			free(c);
+			return NULL;
+		}
+		c->x = x;
+		c->y = y;
+		c->width = w;
+		c->height = h;
+	}
 
 	c->image = XShmCreateImage(c->display,
 		DefaultVisual(c->display, screen),
@@ -48,6 +90,7 @@ static XShmCapturer* xshm_init(const char *display_name) {
 		free(c);
 		return NULL;
 	}
+	c->rgb = xshm_pixel_order(c->image);
 
 	c->shminfo.shmid = shmget(IPC_PRIVATE,
 		c->image->bytes_per_line * c->image->height,
@@ -77,20 +120,36 @@ static XShmCapturer* xshm_init(const char *display_name) {
 	return c;
 }
 
+// xshm_follow moves the captured region so it is centered on the pointer,
+// clamped to the screen.
+static void xshm_follow(XShmCapturer *c) {
+	Window root, child;
+	int px, py, wx, wy;
+	unsigned int mask;
+	if (!XQueryPointer(c->display, c->root, &root, &child, &px, &py, &wx, &wy, &mask)) return;
+	int x = px - c->width / 2;
+	int y = py - c->height / 2;
+	if (x > c->screen_width - c->width) x = c->screen_width - c->width;
+	if (y > c->screen_height - c->height) y = c->screen_height - c->height;
+	c->x = x < 0 ? 0 : x;
+	c->y = y < 0 ? 0 : y;
+}
+
 static int xshm_grab(XShmCapturer *c) {
-	if (!XShmGetImage(c->display, c->root, c->image, 0, 0, AllPlanes)) {
+	if (!XShmGetImage(c->display, c->root, c->image, c->x, c->y, AllPlanes)) {
 		return -1;
 	}
 	XSync(c->display, False);
 	return 0;
 }
 
+// xshm_composite_cursor blends the pointer into the captured image.
 static void xshm_composite_cursor(XShmCapturer *c) {
 	XFixesCursorImage *cursor = XFixesGetCursorImage(c->display);
 	if (!cursor) return;
 
-	int cx = cursor->x - cursor->xhot;
-	int cy = cursor->y - cursor->yhot;
+	int cx = cursor->x - cursor->xhot - c->x;
+	int cy = cursor->y - cursor->yhot - c->y;
 
 	for (int y = 0; y < (int)cursor->height; y++) {
 		int dy = cy + y;
@@ -107,6 +166,8 @@ static void xshm_composite_cursor(XShmCapturer *c) {
 			unsigned char cg = (pixel >> 8) & 0xFF;
 			unsigned char cb = (pixel >> 16) & 0xFF;
 
+			if (c->rgb) { unsigned char t = cr; cr = cb; cb = t; }
+
 			int offset = dy * c->image->bytes_per_line + dx * 4;
 			unsigned char *dst = (unsigned char*)c->image->data + offset;
 
@@ -124,9 +185,15 @@ static void xshm_composite_cursor(XShmCapturer *c) {
 	XFree(cursor);
 }
 
+// xshm_cursor_image returns the current pointer, to be freed with XFree,
+// or NULL. pixels holds width*height ARGB values, one per unsigned long.
+static XFixesCursorImage* xshm_cursor_image(XShmCapturer *c) {
+	return XFixesGetCursorImage(c->display);
+}
+
 static void xshm_destroy(XShmCapturer *c) {
 	if (!c) return;
-	XShmDetach(c->display, &c->shminfo);
+	if (!c->dead) XShmDetach(c->display, &c->shminfo);
 	shmdt(c->shminfo.shmaddr);
 	XDestroyImage(c->image);
 	XCloseDisplay(c->display);
@@ -141,6 +208,9 @@ import (
 	"log"
 	"os/exec"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"bunghole/internal/types"
@@ -148,12 +218,32 @@ import (
 
 // XshmCapturer captures frames via X11 shared memory (CPU fallback).
 type XshmCapturer struct {
-	c   *C.XShmCapturer
-	fps int
+	c       *C.XShmCapturer
+	display string
+	fps     int
+	frames  uint64    // frames grabbed, for the debug overlay
+	retryAt time.Time // next reconnect attempt after the X server went away
+
+	// The pointer as of the last Grab, when it isn't composited; read by
+	// CursorInfo from other goroutines.
+	cursorMu sync.Mutex
+	cursor   types.Cursor
+	hasCur   bool
 }
 
 var experimentalNvFBC bool
 
+// captureRegion restricts capture to part of the screen; zero W/H means
+// the whole screen.
+var captureRegion struct{ X, Y, W, H int }
+
+// followSize, when set, makes XShm capture a window of this size that
+// follows the pointer; see SetFollowCursor.
+var followSize struct{ W, H int }
+
+// followOrigin is the followed window's current origin, x<<32 | y.
+var followOrigin atomic.Uint64
+
 // SetExperimentalNvFBC toggles the Linux NvFBC capture probe.
 //
 // NvFBC is currently experimental and disabled by default.
@@ -161,14 +251,59 @@ func SetExperimentalNvFBC(enabled bool) {
 	experimentalNvFBC = enabled
 }
 
+// compositeCursor draws the pointer into captured frames.
+var compositeCursor = true
+
+// SetCompositeCursor sets whether the pointer is drawn into captured
+// frames. Without it, XShm capture reports the pointer through
+// CursorInfo instead, for clients that draw it themselves.
+func SetCompositeCursor(enabled bool) {
+	compositeCursor = enabled
+}
+
+// SetCaptureRegion restricts capture to the w x h region at (x, y) of the
+// X screen, e.g. part of a virtual desktop larger than the output mode.
+// A zero size captures the whole screen.
+func SetCaptureRegion(x, y, w, h int) {
+	captureRegion.X, captureRegion.Y = x, y
+	captureRegion.W, captureRegion.H = w, h
+}
+
+// SetFollowCursor makes capture a w x h window centered on the pointer
+// that pans as the pointer moves, clamped to the screen: a magnifier for
+// screencasts of a large desktop. The encoded size stays w x h; only the
+// source offset moves. XShm only, and exclusive with SetCaptureRegion.
+func SetFollowCursor(w, h int) {
+	followSize.W, followSize.H = w, h
+}
+
+// FollowOrigin returns where on the screen the window followed with
+// SetFollowCursor is, as of the last Grab.
+func FollowOrigin() (x, y int) {
+	o := followOrigin.Load()
+	return int(o >> 32), int(uint32(o))
+}
+
 // NewCapturer creates a screen capturer.
 //
 // Linux defaults to XShm. NvFBC can be enabled with --experimental-nvfbc.
 func NewCapturer(displayName string, fps, gpu int) (types.MediaCapturer, error) {
-	if experimentalNvFBC {
+	if experimentalNvFBC && len(masks) > 0 {
+		// NvFBC frames never pass through host memory, so masks can't be
+		// applied; never stream a region the user asked to hide.
+		log.Printf("capture: --mask is not supported with NvFBC, using XShm")
+	} else if experimentalNvFBC && followSize.W > 0 {
+		log.Printf("capture: --follow-cursor is not supported with NvFBC, using XShm")
+	} else if experimentalNvFBC {
 		if busID, err := rawPCIBusIDForGPU(gpu); err == nil {
 			cap, err := NewNvFBCCapturer(displayName, fps, busID)
 			if err == nil {
+				if debugOverlay {
+					log.Printf("capture: --debug-overlay is not supported with NvFBC, ignoring")
+				}
+				if watermark != nil {
+					log.Printf("capture: --watermark is not supported with NvFBC, ignoring")
+				}
 				return cap, nil
 			}
 			log.Printf("capture: experimental NvFBC unavailable on GPU %d (%s): %v; falling back to XShm", gpu, busID, err)
@@ -180,12 +315,56 @@ func NewCapturer(displayName string, fps, gpu int) (types.MediaCapturer, error)
 	cDisplay := C.CString(displayName)
 	defer C.free(unsafe.Pointer(cDisplay))
 
-	xshm := C.xshm_init(cDisplay)
+	r := xshmRegion()
+	xshm := C.xshm_init(cDisplay, C.int(r.X), C.int(r.Y), C.int(r.W), C.int(r.H))
 	if xshm == nil {
+		if followSize.W > 0 {
+			return nil, fmt.Errorf("failed to initialize XShm capture on %s (--follow-cursor %dx%d larger than the screen?)",
+				displayName, followSize.W, followSize.H)
+		}
+		if r.W > 0 {
+			return nil, fmt.Errorf("failed to initialize XShm capture of %dx%d+%d+%d on %s (region off screen?)",
+				r.W, r.H, r.X, r.Y, displayName)
+		}
 		return nil, fmt.Errorf("failed to initialize XShm capture on %s", displayName)
 	}
-	log.Printf("capture: XShm (%dx%d)", int(xshm.width), int(xshm.height))
-	return &XshmCapturer{c: xshm, fps: fps}, nil
+	if err := checkPixelOrder(xshm, displayName); err != nil {
+		C.xshm_destroy(xshm)
+		return nil, err
+	}
+	order := "BGRX"
+	if xshm.rgb == 1 {
+		order = "RGBX"
+	}
+	log.Printf("capture: XShm (%dx%d, %s)", int(xshm.width), int(xshm.height), order)
+	return &XshmCapturer{c: xshm, display: displayName, fps: fps}, nil
+}
+
+// checkPixelOrder rejects a screen whose pixels aren't 32-bit BGRX or
+// RGBX, the only layouts the encoder and the drawing on frames handle.
+func checkPixelOrder(xshm *C.XShmCapturer, displayName string) error {
+	if xshm.rgb >= 0 {
+		return nil
+	}
+	img := xshm.image
+	if img.depth == 30 {
+		// X2R10G10B10: each channel spans byte boundaries, so the frame
+		// would be encoded as noise.
+		return fmt.Errorf("XShm capture on %s: the screen is 10-bit (depth 30), which capture doesn't support; run X at depth 24 (DefaultDepth 24 in the xorg.conf Screen section, as --start-x writes)",
+			displayName)
+	}
+	return fmt.Errorf("XShm capture on %s: unsupported pixel format (depth %d, %d bits per pixel, red mask %#x, blue mask %#x); need 32-bit BGRX or RGBX",
+		displayName, int(img.depth), int(img.bits_per_pixel), uint64(img.red_mask), uint64(img.blue_mask))
+}
+
+// xshmRegion is the region XShm capture is opened with: the capture
+// region, or the followed window at the top left until the first grab
+// moves it.
+func xshmRegion() struct{ X, Y, W, H int } {
+	if followSize.W > 0 {
+		return struct{ X, Y, W, H int }{0, 0, followSize.W, followSize.H}
+	}
+	return captureRegion
 }
 
 func rawPCIBusIDForGPU(gpu int) (string, error) {
@@ -209,45 +388,178 @@ func rawPCIBusIDForGPU(gpu int) (string, error) {
 func (c *XshmCapturer) Width() int  { return int(c.c.width) }
 func (c *XshmCapturer) Height() int { return int(c.c.height) }
 
-func (c *XshmCapturer) Grab() (*types.Frame, error) {
+// reconnect reopens the display after the X server went away (e.g. it
+// was restarted), at most once a second. The pipeline's buffers are sized
+// for the old screen, so a server that comes back at a different size is
+// an error rather than a silent resize.
+func (c *XshmCapturer) reconnect() error {
+	now := time.Now()
+	if now.Before(c.retryAt) {
+		return fmt.Errorf("X display %s lost", c.display)
+	}
+	if c.retryAt.IsZero() {
+		log.Printf("capture: X display %s lost, reconnecting", c.display)
+	}
+	c.retryAt = now.Add(time.Second)
+
+	cDisplay := C.CString(c.display)
+	defer C.free(unsafe.Pointer(cDisplay))
+	r := xshmRegion()
+	xshm := C.xshm_init(cDisplay, C.int(r.X), C.int(r.Y), C.int(r.W), C.int(r.H))
+	if xshm == nil {
+		return fmt.Errorf("X display %s lost, reconnect failed", c.display)
+	}
+	if xshm.width != c.c.width || xshm.height != c.c.height {
+		w, h := int(xshm.width), int(xshm.height)
+		C.xshm_destroy(xshm)
+		return fmt.Errorf("X display %s came back at %dx%d, capture is %dx%d",
+			c.display, w, h, int(c.c.width), int(c.c.height))
+	}
+	if xshm.rgb != c.c.rgb {
+		err := checkPixelOrder(xshm, c.display)
+		if err == nil {
+			err = fmt.Errorf("X display %s came back with another pixel order", c.display)
+		}
+		C.xshm_destroy(xshm)
+		return err
+	}
+	C.xshm_destroy(c.c)
+	c.c = xshm
+	c.retryAt = time.Time{}
+	log.Printf("capture: reconnected to X display %s", c.display)
+	return nil
+}
+
+// grab refreshes the shared image, reconnecting first if the X server
+// went away. With SetFollowCursor the region is first moved to the pointer.
+func (c *XshmCapturer) grab() error {
+	if c.c.dead != 0 {
+		if err := c.reconnect(); err != nil {
+			return err
+		}
+	}
+	if followSize.W > 0 {
+		C.xshm_follow(c.c)
+		followOrigin.Store(uint64(c.c.x)<<32 | uint64(uint32(c.c.y)))
+	}
 	if C.xshm_grab(c.c) != 0 {
-		return nil, fmt.Errorf("XShmGetImage failed")
+		return fmt.Errorf("XShmGetImage failed")
 	}
-	C.xshm_composite_cursor(c.c)
+	return nil
+}
 
+func (c *XshmCapturer) Grab() (*types.Frame, error) {
+	if err := c.grab(); err != nil {
+		return nil, err
+	}
+	if compositeCursor {
+		C.xshm_composite_cursor(c.c)
+	} else {
+		c.updateCursor()
+	}
+	if len(masks) > 0 {
+		drawMasks(unsafe.Pointer(c.c.image.data), int(c.c.width), int(c.c.height),
+			int(c.c.image.bytes_per_line))
+	}
+	if watermark != nil {
+		drawWatermark(unsafe.Pointer(c.c.image.data), int(c.c.width), int(c.c.height),
+			int(c.c.image.bytes_per_line), c.c.rgb == 1)
+	}
+
+	c.frames++
+	if debugOverlay {
+		drawOverlay(unsafe.Pointer(c.c.image.data), int(c.c.width), int(c.c.height),
+			int(c.c.image.bytes_per_line), c.frames, time.Now())
+	}
+
+	pixFmt := types.PixFmtBGRA
+	if c.c.rgb == 1 {
+		pixFmt = types.PixFmtRGBA
+	}
 	return &types.Frame{
 		Ptr:    unsafe.Pointer(c.c.image.data),
 		Width:  int(c.c.width),
 		Height: int(c.c.height),
 		Stride: int(c.c.image.bytes_per_line),
+		PixFmt: pixFmt,
 	}, nil
 }
 
 // GrabImage grabs a frame and returns it as a Go image (for debug endpoint).
 func (c *XshmCapturer) GrabImage() (image.Image, error) {
-	if C.xshm_grab(c.c) != 0 {
-		return nil, fmt.Errorf("XShmGetImage failed")
+	if err := c.grab(); err != nil {
+		return nil, err
+	}
+	if compositeCursor {
+		C.xshm_composite_cursor(c.c)
 	}
-	C.xshm_composite_cursor(c.c)
 	w := int(c.c.width)
 	h := int(c.c.height)
 	stride := int(c.c.image.bytes_per_line)
+	if len(masks) > 0 {
+		drawMasks(unsafe.Pointer(c.c.image.data), w, h, stride)
+	}
 	size := stride * h
-	bgra := C.GoBytes(unsafe.Pointer(c.c.image.data), C.int(size))
-	return bgraToImage(bgra, w, h, stride), nil
+	pix := C.GoBytes(unsafe.Pointer(c.c.image.data), C.int(size))
+	return xPixelsToImage(pix, w, h, stride, c.c.rgb == 1), nil
 }
 
 func (c *XshmCapturer) Close() {
 	C.xshm_destroy(c.c)
 }
 
-// bgraToImage converts BGRA pixel data to an RGBA image.
-func bgraToImage(bgra []byte, w, h, stride int) image.Image {
+// updateCursor records the pointer for CursorInfo. The image is only
+// converted when X reports a new one; moves just update the position.
+func (c *XshmCapturer) updateCursor() {
+	ci := C.xshm_cursor_image(c.c)
+	if ci == nil {
+		return
+	}
+	defer C.XFree(unsafe.Pointer(ci))
+
+	c.cursorMu.Lock()
+	defer c.cursorMu.Unlock()
+	cur := &c.cursor
+	if !c.hasCur || uint64(ci.cursor_serial) != cur.Serial {
+		w, h := int(ci.width), int(ci.height)
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		pixels := unsafe.Slice((*C.ulong)(unsafe.Pointer(ci.pixels)), w*h)
+		for i, p := range pixels {
+			img.Pix[i*4+0] = byte(p >> 16) // R
+			img.Pix[i*4+1] = byte(p >> 8)  // G
+			img.Pix[i*4+2] = byte(p)       // B
+			img.Pix[i*4+3] = byte(p >> 24) // A
+		}
+		cur.Image = img
+		cur.HotX, cur.HotY = int(ci.xhot), int(ci.yhot)
+		cur.Serial = uint64(ci.cursor_serial)
+	}
+	cur.X = int(ci.x) - int(ci.xhot) - int(c.c.x)
+	cur.Y = int(ci.y) - int(ci.yhot) - int(c.c.y)
+	c.hasCur = true
+}
+
+// CursorInfo returns the pointer as of the last Grab. It is only tracked
+// with SetCompositeCursor(false); otherwise it is in the frames.
+func (c *XshmCapturer) CursorInfo() (types.Cursor, bool) {
+	c.cursorMu.Lock()
+	defer c.cursorMu.Unlock()
+	return c.cursor, c.hasCur
+}
+
+// xPixelsToImage converts BGRX (or, with rgb, RGBX) pixel data to an
+// opaque RGBA image. The 4th byte is padding X leaves undefined, not
+// alpha, so it is ignored.
+func xPixelsToImage(pix []byte, w, h, stride int, rgb bool) image.Image {
+	r, b := 2, 0
+	if rgb {
+		r, b = 0, 2
+	}
 	img := image.NewRGBA(image.Rect(0, 0, w, h))
 	for y := 0; y < h; y++ {
 		for x := 0; x < w; x++ {
 			off := y*stride + x*4
-			img.SetRGBA(x, y, color.RGBA{bgra[off+2], bgra[off+1], bgra[off], 255})
+			img.SetRGBA(x, y, color.RGBA{pix[off+r], pix[off+1], pix[off+b], 255})
 		}
 	}
 	return img
@@ -1,29 +1,35 @@
 //go:build darwin
 
-package main
+package clipboard
 
 import (
 	"io"
 	"log"
 	"sync"
-
-	"bunghole/internal/clipboard"
 )
 
-func runSession(conn io.ReadWriteCloser, stop <-chan struct{}) {
+// RunGuestSession syncs the guest pasteboard with the host over conn until
+// it fails or stop is closed, then closes conn. It runs inside the guest,
+// in bunghole-vm-clipboard or a multiplexing bunghole-vm-audio.
+func RunGuestSession(conn io.ReadWriteCloser, stop <-chan struct{}) {
 	defer conn.Close()
 
+	if err := WriteClipHello(conn); err != nil {
+		log.Printf("clipboard: hello to host failed: %v", err)
+		return
+	}
+
 	// Guest pasteboard handler — sendFn writes frames to host over vsock
 	var writeMu sync.Mutex
 	sendFn := func(text string) {
 		writeMu.Lock()
 		defer writeMu.Unlock()
-		if err := clipboard.WriteClipFrame(conn, text); err != nil {
+		if err := WriteClipFrame(conn, text); err != nil {
 			log.Printf("clipboard: write to host failed: %v", err)
 		}
 	}
 
-	handler, err := clipboard.NewClipboardHandler("main", sendFn)
+	handler, err := NewClipboardHandler("main", sendFn)
 	if err != nil {
 		log.Printf("clipboard handler init failed: %v", err)
 		return
@@ -49,7 +55,7 @@ func runSession(conn io.ReadWriteCloser, stop <-chan struct{}) {
 		default:
 		}
 
-		text, err := clipboard.ReadClipFrame(conn)
+		text, err := ReadClipFrame(conn)
 		if err != nil {
 			close(pollStop)
 			wg.Wait()
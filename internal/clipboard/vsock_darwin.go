@@ -3,6 +3,7 @@
 package clipboard
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -15,6 +16,53 @@ import (
 
 const maxClipFrameSize = 1 << 20 // 1 MB
 
+// DefaultVsockPort is the vsock port clipboard sync uses by default. The
+// host (--vsock-clipboard-port) and bunghole-vm-clipboard (--vsock-port)
+// must agree on it.
+const DefaultVsockPort = 5002
+
+// ClipFrameVersion is the clipboard frame protocol version this build
+// speaks.
+//
+// The guest agent starts each connection with a hello: the magic "BHC" and
+// its version byte. Agents from before the hello (version 0) start straight
+// with a frame, whose 4-byte length is at most maxClipFrameSize and so
+// begins with a zero byte. Hosts from before the hello read the magic as an
+// oversized length and drop the connection instead of misreading it.
+const ClipFrameVersion = 1
+
+var clipHelloMagic = [3]byte{'B', 'H', 'C'}
+
+// WriteClipHello sends the guest's hello; call it once, before any frame.
+func WriteClipHello(w io.Writer) error {
+	_, err := w.Write([]byte{clipHelloMagic[0], clipHelloMagic[1], clipHelloMagic[2], ClipFrameVersion})
+	return err
+}
+
+// ReadClipHello reads the guest's hello and returns its protocol version,
+// or 0 for a guest that sends none. Read frames from br afterwards: for a
+// version-0 guest it holds the start of the first frame.
+func ReadClipHello(br *bufio.Reader) (int, error) {
+	b, err := br.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	if b[0] != clipHelloMagic[0] {
+		return 0, nil
+	}
+	var hello [4]byte
+	if _, err := io.ReadFull(br, hello[:]); err != nil {
+		return 0, err
+	}
+	if [3]byte(hello[:3]) != clipHelloMagic {
+		return 0, fmt.Errorf("not a clipboard stream (hello %q); check the vsock ports", hello[:3])
+	}
+	if v := int(hello[3]); v > ClipFrameVersion {
+		return 0, fmt.Errorf("guest agent speaks clipboard frame protocol v%d, this host only up to v%d; update bunghole on the host", v, ClipFrameVersion)
+	}
+	return int(hello[3]), nil
+}
+
 // WriteClipFrame writes a clipboard frame: [4-byte BE length][UTF-8 payload].
 func WriteClipFrame(w io.Writer, text string) error {
 	if len(text) > maxClipFrameSize {
@@ -114,6 +162,14 @@ func (v *VsockClipboardSync) Run(stop <-chan struct{}) {
 func (v *VsockClipboardSync) readLoop(conn net.Conn, stop <-chan struct{}) {
 	defer conn.Close()
 
+	br := bufio.NewReader(conn)
+	version, err := ReadClipHello(br)
+	if err != nil {
+		log.Printf("clipboard: vsock guest rejected: %v", err)
+		return
+	}
+	log.Printf("clipboard: vsock guest speaks frame protocol v%d", version)
+
 	for {
 		select {
 		case <-stop:
@@ -121,7 +177,7 @@ func (v *VsockClipboardSync) readLoop(conn net.Conn, stop <-chan struct{}) {
 		default:
 		}
 
-		text, err := ReadClipFrame(conn)
+		text, err := ReadClipFrame(br)
 		if err != nil {
 			return
 		}
@@ -4,13 +4,16 @@ package clipboard
 
 /*
 #cgo pkg-config: x11
+#cgo CFLAGS: -I${SRCDIR}/../../cvendor
 #include <X11/Xlib.h>
 #include <X11/Xatom.h>
 #include <stdlib.h>
 #include <string.h>
 #include <time.h>
+#include "xconn.h"
 
 static Display *clip_display = NULL;
+static int clip_dead = 0; // set by Xlib when the connection to the server is lost
 static Window clip_window;
 static Atom CLIPBOARD;
 static Atom UTF8_STRING;
@@ -20,7 +23,7 @@ static char *owned_text = NULL;
 static int own_len = 0;
 
 static int clip_init(const char *display_name) {
-	clip_display = XOpenDisplay(display_name);
+	clip_display = xconn_open(display_name, &clip_dead);
 	if (!clip_display) return -1;
 
 	CLIPBOARD = XInternAtom(clip_display, "CLIPBOARD", False);
@@ -145,10 +148,16 @@ static int clip_we_own() {
 	return XGetSelectionOwner(clip_display, CLIPBOARD) == clip_window ? 1 : 0;
 }
 
+static int clip_is_dead() {
+	return clip_display && clip_dead;
+}
+
 static void clip_destroy() {
 	if (!clip_display) return;
 	if (owned_text) free(owned_text);
-	XDestroyWindow(clip_display, clip_window);
+	owned_text = NULL;
+	own_len = 0;
+	if (!clip_dead) XDestroyWindow(clip_display, clip_window);
 	XCloseDisplay(clip_display);
 	clip_display = NULL;
 }
@@ -157,6 +166,7 @@ import "C"
 import (
 	"fmt"
 	"log"
+	"sync"
 	"time"
 	"unsafe"
 
@@ -164,8 +174,12 @@ import (
 )
 
 type ClipboardHandler struct {
+	display     string
 	lastContent string
 	sendFn      func(string) // callback to send clipboard to client
+	retryAt     time.Time    // next reconnect attempt after the X server went away
+
+	mu sync.Mutex // keeps SetFromClient off the display while it is reopened
 }
 
 func NewClipboardHandler(displayName string, sendFn func(string)) (types.ClipboardSync, error) {
@@ -176,11 +190,38 @@ func NewClipboardHandler(displayName string, sendFn func(string)) (types.Clipboa
 		return nil, fmt.Errorf("failed to open display for clipboard: %s", displayName)
 	}
 
-	return &ClipboardHandler{sendFn: sendFn}, nil
+	return &ClipboardHandler{display: displayName, sendFn: sendFn}, nil
+}
+
+// reconnect reopens the display after the X server went away (e.g. it
+// was restarted), at most once a second. Whatever we owned on the old
+// server is gone with it.
+func (ch *ClipboardHandler) reconnect() {
+	now := time.Now()
+	if now.Before(ch.retryAt) {
+		return
+	}
+	if ch.retryAt.IsZero() {
+		log.Printf("clipboard: X display %s lost, reconnecting", ch.display)
+	}
+	ch.retryAt = now.Add(time.Second)
+
+	cDisplay := C.CString(ch.display)
+	defer C.free(unsafe.Pointer(cDisplay))
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	C.clip_destroy()
+	if C.clip_init(cDisplay) != 0 {
+		return
+	}
+	ch.retryAt = time.Time{}
+	log.Printf("clipboard: reconnected to X display %s", ch.display)
 }
 
 // SetFromClient sets the X11 clipboard with content received from the browser
 func (ch *ClipboardHandler) SetFromClient(text string) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
 	ch.lastContent = text
 	cText := C.CString(text)
 	defer C.free(unsafe.Pointer(cText))
@@ -197,6 +238,13 @@ func (ch *ClipboardHandler) Run(stop <-chan struct{}) {
 		case <-stop:
 			return
 		case <-ticker.C:
+			if C.clip_is_dead() != 0 || !ch.retryAt.IsZero() {
+				ch.reconnect()
+				if !ch.retryAt.IsZero() {
+					continue
+				}
+			}
+
 			// Process any pending X events
 			for {
 				var outText *C.char
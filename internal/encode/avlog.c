@@ -0,0 +1,28 @@
+//go:build linux || darwin
+
+#include <libavutil/log.h>
+#include <pthread.h>
+#include <stdarg.h>
+
+// Go callback declared in avlog.go
+extern void encode_go_av_log(int level, char *line);
+
+static pthread_mutex_t av_log_mu = PTHREAD_MUTEX_INITIALIZER;
+static int av_log_prefix = 1;
+
+// av_log_to_go formats a libav message the way the default callback would
+// and hands it to Go. Encoders log from their own threads, so the line
+// state is shared under a lock, as in av_log_default_callback.
+static void av_log_to_go(void *avcl, int level, const char *fmt, va_list vl) {
+	if (level > av_log_get_level()) return;
+
+	char line[1024];
+	pthread_mutex_lock(&av_log_mu);
+	av_log_format_line(avcl, level, fmt, vl, line, sizeof(line), &av_log_prefix);
+	pthread_mutex_unlock(&av_log_mu);
+	encode_go_av_log(level, line);
+}
+
+void av_log_install(void) {
+	av_log_set_callback(av_log_to_go);
+}
@@ -0,0 +1,72 @@
+//go:build linux || darwin
+
+package encode
+
+/*
+#cgo pkg-config: libavutil
+#include <libavutil/log.h>
+
+void av_log_install(void);
+*/
+import "C"
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// libavLevels are the --libav-log-level names, most to least severe.
+var libavLevels = []struct {
+	name  string
+	level C.int
+}{
+	{"quiet", C.AV_LOG_QUIET},
+	{"panic", C.AV_LOG_PANIC},
+	{"fatal", C.AV_LOG_FATAL},
+	{"error", C.AV_LOG_ERROR},
+	{"warning", C.AV_LOG_WARNING},
+	{"info", C.AV_LOG_INFO},
+	{"verbose", C.AV_LOG_VERBOSE},
+	{"debug", C.AV_LOG_DEBUG},
+	{"trace", C.AV_LOG_TRACE},
+}
+
+// libav's messages go through the log package rather than straight to
+// stderr, so they carry timestamps, land in --log-file in order with ours
+// and can be matched to the encoder failure they explain.
+func init() {
+	C.av_log_install()
+}
+
+// SetLibavLogLevel sets the least severe libav (FFmpeg) message that is
+// logged, by name: quiet, panic, fatal, error, warning, info (libav's
+// default), verbose, debug or trace.
+func SetLibavLogLevel(name string) error {
+	for _, l := range libavLevels {
+		if l.name == name {
+			C.av_log_set_level(l.level)
+			return nil
+		}
+	}
+	names := make([]string, len(libavLevels))
+	for i, l := range libavLevels {
+		names[i] = l.name
+	}
+	return fmt.Errorf("unknown level %q, want one of %s", name, strings.Join(names, ", "))
+}
+
+//export encode_go_av_log
+func encode_go_av_log(level C.int, line *C.char) {
+	msg := strings.TrimRight(C.GoString(line), "\n")
+	if strings.TrimSpace(msg) == "" {
+		return
+	}
+	switch {
+	case level <= C.AV_LOG_ERROR:
+		log.Printf("libav error: %s", msg)
+	case level <= C.AV_LOG_WARNING:
+		log.Printf("libav warning: %s", msg)
+	default:
+		log.Printf("libav: %s", msg)
+	}
+}
@@ -15,9 +15,63 @@ package encode
 #include <string.h>
 #include "cuda_defs.h"
 
+// Encoder tuning from Go (see Tuning). sw_* are the libx264/libx265
+// equivalents; an empty sw_tune means no tune. h264_profile and
+// h264_level (empty = encoder's choice) apply to both H.264 encoders.
+// rgb_input makes the CPU encoder hand BGRA frames to NVENC unconverted.
+typedef struct {
+	const char *preset;
+	const char *tune;
+	const char *rc;
+	const char *sw_preset;
+	const char *sw_tune;
+	const char *h264_profile;
+	const char *h264_level;
+	int rgb_input;
+} EncoderTuning;
+
+// set_av_error writes "what: <FFmpeg error text>" to err for the Go side.
+static void set_av_error(char *err, int err_len, const char *what, int averr) {
+	char msg[AV_ERROR_MAX_STRING_SIZE];
+	av_make_error_string(msg, sizeof(msg), averr);
+	snprintf(err, err_len, "%s: %s", what, msg);
+}
+
+// set_h264_options applies the H.264 profile and level. The server
+// advertises the stream as what was asked for, so an encoder that rejects
+// either must not be used: it would silently encode its default instead.
+static int set_h264_options(AVCodecContext *ctx, const EncoderTuning *t, char *err, int err_len) {
+	if (av_opt_set(ctx->priv_data, "profile", t->h264_profile, 0) < 0) {
+		snprintf(err, err_len, "H.264 profile %s not supported", t->h264_profile);
+		return -1;
+	}
+	if (t->h264_level[0] && av_opt_set(ctx->priv_data, "level", t->h264_level, 0) < 0) {
+		snprintf(err, err_len, "H.264 level %s not supported", t->h264_level);
+		return -1;
+	}
+	return 0;
+}
+
+// set_open_error reports avcodec_open2 failing with averr. FFmpeg maps
+// NV_ENC_ERR_OUT_OF_MEMORY from opening an NVENC session to ENOMEM, and
+// that is what consumer GPUs return once their limit on concurrent
+// sessions is reached, so for NVENC it sets *session_limit as well.
+static void set_open_error(char *err, int err_len, const AVCodec *codec, int averr,
+                           int *session_limit) {
+	if (averr == AVERROR(ENOMEM) && strstr(codec->name, "_nvenc")) {
+		*session_limit = 1;
+		snprintf(err, err_len, "avcodec_open2: NVENC session limit reached (or GPU out of memory)");
+		return;
+	}
+	set_av_error(err, err_len, "avcodec_open2", averr);
+}
+
 // ---------------------------------------------------------------------------
-// CPU encoder — sws_scale BGRA→NV12/YUV420P, then avcodec_send_frame.
-// Used when XShm fallback is active (no CUDA context).
+// CPU encoder — sws_scale BGRA/NV12→NV12/YUV420P, then avcodec_send_frame.
+// Used when XShm fallback is active (no CUDA context), or for NV12 host
+// frames when NvFBC captures on a different GPU than the encoder. With
+// rgb_input, NVENC takes BGRA frames as BGR0 and converts them on the GPU,
+// so sws_scale is skipped (RGBX frames are still swizzled by sws_scale).
 // ---------------------------------------------------------------------------
 
 typedef struct {
@@ -25,35 +79,42 @@ typedef struct {
 	AVFrame *frame;
 	AVPacket *pkt;
 	struct SwsContext *sws;
+	enum AVPixelFormat src_fmt; // input format sws is set up for
 	int width;
 	int height;
 	int64_t pts;
 } CPUEncoder;
 
+// encoder_name is the FFmpeg encoder to use (h264_nvenc, libx264, ...).
+// On failure the reason is written to err, and *session_limit is set if
+// NVENC refused the session (see set_open_error).
 static CPUEncoder* cpu_encoder_init(int width, int height, int fps,
                                      int bitrate_kbps, int keyint,
-                                     int gpu_index, const char *codec_name) {
+                                     int gpu_index, const char *encoder_name,
+                                     const EncoderTuning *t, char *err, int err_len,
+                                     int *session_limit) {
+	const AVCodec *codec = avcodec_find_encoder_by_name(encoder_name);
+	if (!codec) {
+		snprintf(err, err_len, "not available in this FFmpeg build");
+		return NULL;
+	}
+
 	CPUEncoder *e = (CPUEncoder*)calloc(1, sizeof(CPUEncoder));
-	if (!e) return NULL;
+	if (!e) {
+		snprintf(err, err_len, "out of memory");
+		return NULL;
+	}
 
 	e->width = width;
 	e->height = height;
 	e->pts = 0;
 
-	const AVCodec *codec = NULL;
-	int is_hevc = (strcmp(codec_name, "h265") == 0);
-
-	if (is_hevc) {
-		codec = avcodec_find_encoder_by_name("hevc_nvenc");
-		if (!codec) codec = avcodec_find_encoder_by_name("libx265");
-	} else {
-		codec = avcodec_find_encoder_by_name("h264_nvenc");
-		if (!codec) codec = avcodec_find_encoder_by_name("libx264");
-	}
-	if (!codec) return NULL;
-
 	e->ctx = avcodec_alloc_context3(codec);
-	if (!e->ctx) { free(e); return NULL; }
+	if (!e->ctx) {
+		snprintf(err, err_len, "out of memory");
+		free(e);
+		return NULL;
+	}
 
 	e->ctx->width = width;
 	e->ctx->height = height;
@@ -64,35 +125,42 @@ static CPUEncoder* cpu_encoder_init(int width, int height, int fps,
 	e->ctx->gop_size = keyint;
 	e->ctx->max_b_frames = 0;
 
+	int opts = 0; // < 0: an option was rejected and err is set
 	if (strcmp(codec->name, "h264_nvenc") == 0) {
-		av_opt_set(e->ctx->priv_data, "preset", "p1", 0);
-		av_opt_set(e->ctx->priv_data, "tune", "ull", 0);
-		av_opt_set(e->ctx->priv_data, "profile", "baseline", 0);
-		av_opt_set(e->ctx->priv_data, "rc", "cbr", 0);
+		av_opt_set(e->ctx->priv_data, "preset", t->preset, 0);
+		av_opt_set(e->ctx->priv_data, "tune", t->tune, 0);
+		opts = set_h264_options(e->ctx, t, err, err_len);
+		av_opt_set(e->ctx->priv_data, "rc", t->rc, 0);
 		av_opt_set(e->ctx->priv_data, "zerolatency", "1", 0);
+		av_opt_set(e->ctx->priv_data, "forced-idr", "1", 0);
 		av_opt_set_int(e->ctx->priv_data, "gpu", gpu_index, 0);
+		if (t->rgb_input) e->ctx->pix_fmt = AV_PIX_FMT_BGR0;
 	} else if (strcmp(codec->name, "hevc_nvenc") == 0) {
-		av_opt_set(e->ctx->priv_data, "preset", "p1", 0);
-		av_opt_set(e->ctx->priv_data, "tune", "ull", 0);
+		av_opt_set(e->ctx->priv_data, "preset", t->preset, 0);
+		av_opt_set(e->ctx->priv_data, "tune", t->tune, 0);
 		av_opt_set(e->ctx->priv_data, "profile", "main", 0);
-		av_opt_set(e->ctx->priv_data, "rc", "cbr", 0);
+		av_opt_set(e->ctx->priv_data, "rc", t->rc, 0);
 		av_opt_set(e->ctx->priv_data, "zerolatency", "1", 0);
+		av_opt_set(e->ctx->priv_data, "forced-idr", "1", 0);
 		av_opt_set_int(e->ctx->priv_data, "gpu", gpu_index, 0);
+		if (t->rgb_input) e->ctx->pix_fmt = AV_PIX_FMT_BGR0;
 	} else if (strcmp(codec->name, "libx265") == 0) {
-		av_opt_set(e->ctx->priv_data, "preset", "ultrafast", 0);
-		av_opt_set(e->ctx->priv_data, "tune", "zerolatency", 0);
+		av_opt_set(e->ctx->priv_data, "preset", t->sw_preset, 0);
+		if (t->sw_tune[0]) av_opt_set(e->ctx->priv_data, "tune", t->sw_tune, 0);
 		e->ctx->pix_fmt = AV_PIX_FMT_YUV420P;
 	} else {
 		// libx264 fallback
-		av_opt_set(e->ctx->priv_data, "preset", "ultrafast", 0);
-		av_opt_set(e->ctx->priv_data, "tune", "zerolatency", 0);
-		av_opt_set(e->ctx->priv_data, "profile", "baseline", 0);
+		av_opt_set(e->ctx->priv_data, "preset", t->sw_preset, 0);
+		if (t->sw_tune[0]) av_opt_set(e->ctx->priv_data, "tune", t->sw_tune, 0);
+		opts = set_h264_options(e->ctx, t, err, err_len);
 		e->ctx->pix_fmt = AV_PIX_FMT_YUV420P;
 	}
 
 	e->ctx->flags |= AV_CODEC_FLAG_LOW_DELAY;
 
-	if (avcodec_open2(e->ctx, codec, NULL) < 0) {
+	int ret = opts < 0 ? opts : avcodec_open2(e->ctx, codec, NULL);
+	if (ret < 0) {
+		if (opts == 0) set_open_error(err, err_len, codec, ret, session_limit);
 		avcodec_free_context(&e->ctx);
 		free(e);
 		return NULL;
@@ -106,12 +174,14 @@ static CPUEncoder* cpu_encoder_init(int width, int height, int fps,
 
 	e->pkt = av_packet_alloc();
 
+	e->src_fmt = AV_PIX_FMT_BGR0;
 	e->sws = sws_getContext(
-		width, height, AV_PIX_FMT_BGRA,
+		width, height, e->src_fmt,
 		width, height, e->ctx->pix_fmt,
 		SWS_FAST_BILINEAR, NULL, NULL, NULL);
 
 	if (!e->sws) {
+		snprintf(err, err_len, "sws_getContext failed");
 		av_packet_free(&e->pkt);
 		av_frame_free(&e->frame);
 		avcodec_free_context(&e->ctx);
@@ -122,18 +192,44 @@ static CPUEncoder* cpu_encoder_init(int width, int height, int fps,
 	return e;
 }
 
-static int cpu_encoder_encode(CPUEncoder *e, const uint8_t *bgra, int stride,
+// src is packed BGRX, RGBX, or NV12 (Y plane of height rows followed by
+// interleaved UV, both with the given stride), as src_fmt says. height is
+// the frame's own, which may be a row more than the encoder's even height.
+// force_key requests an IDR.
+static int cpu_encoder_encode(CPUEncoder *e, const uint8_t *src, int stride,
+                               int height, enum AVPixelFormat src_fmt, int force_key,
                                uint8_t **out_buf, int *out_size, int *is_key) {
 	*out_size = 0;
 
-	const uint8_t *src_data[1] = { bgra };
-	int src_linesize[1] = { stride };
+	int nv12 = src_fmt == AV_PIX_FMT_NV12;
+	if (src_fmt != e->src_fmt) {
+		struct SwsContext *sws = sws_getCachedContext(e->sws,
+			e->width, e->height, src_fmt,
+			e->width, e->height, e->ctx->pix_fmt,
+			SWS_FAST_BILINEAR, NULL, NULL, NULL);
+		if (!sws) return -1;
+		e->sws = sws;
+		e->src_fmt = src_fmt;
+	}
 
 	av_frame_make_writable(e->frame);
-	sws_scale(e->sws, src_data, src_linesize, 0, e->height,
-	          e->frame->data, e->frame->linesize);
+	if (src_fmt == AV_PIX_FMT_BGR0 && e->ctx->pix_fmt == AV_PIX_FMT_BGR0) {
+		// Same layout (alpha ignored); NVENC does the color conversion.
+		av_image_copy_plane(e->frame->data[0], e->frame->linesize[0],
+		                    src, stride, e->width * 4, e->height);
+	} else {
+		const uint8_t *src_data[2] = { src, NULL };
+		int src_linesize[2] = { stride, 0 };
+		if (nv12) {
+			src_data[1] = src + (size_t)stride * height;
+			src_linesize[1] = stride;
+		}
+		sws_scale(e->sws, src_data, src_linesize, 0, e->height,
+		          e->frame->data, e->frame->linesize);
+	}
 
 	e->frame->pts = e->pts++;
+	e->frame->pict_type = force_key ? AV_PICTURE_TYPE_I : AV_PICTURE_TYPE_NONE;
 
 	int ret = avcodec_send_frame(e->ctx, e->frame);
 	if (ret < 0) return -1;
@@ -179,13 +275,20 @@ typedef struct {
 	void *cuMemcpy2D_fn; // cuMemcpy2D function pointer (passed from capturer via Go)
 } CUDAEncoder;
 
+// encoder_name is h264_nvenc or hevc_nvenc. On failure the reason is
+// written to err, as for cpu_encoder_init.
 static CUDAEncoder* cuda_encoder_init(int width, int height, int fps,
                                        int bitrate_kbps, int keyint,
-                                       int gpu_index, const char *codec_name,
-                                       void *cuda_ctx_ptr, void *cuMemcpy2D_fn) {
+                                       int gpu_index, const char *encoder_name,
+                                       void *cuda_ctx_ptr, void *cuMemcpy2D_fn,
+                                       const EncoderTuning *t, char *err, int err_len,
+                                       int *session_limit) {
 	CUcontext cuda_ctx = (CUcontext)cuda_ctx_ptr;
 	CUDAEncoder *e = (CUDAEncoder*)calloc(1, sizeof(CUDAEncoder));
-	if (!e) return NULL;
+	if (!e) {
+		snprintf(err, err_len, "out of memory");
+		return NULL;
+	}
 
 	e->width = width;
 	e->height = height;
@@ -194,7 +297,11 @@ static CUDAEncoder* cuda_encoder_init(int width, int height, int fps,
 
 	// Create hw device context from existing CUDA context
 	e->hw_device_ctx = av_hwdevice_ctx_alloc(AV_HWDEVICE_TYPE_CUDA);
-	if (!e->hw_device_ctx) { free(e); return NULL; }
+	if (!e->hw_device_ctx) {
+		snprintf(err, err_len, "FFmpeg built without CUDA support");
+		free(e);
+		return NULL;
+	}
 
 	AVHWDeviceContext *device_ctx = (AVHWDeviceContext*)e->hw_device_ctx->data;
 	AVCUDADeviceContext *cuda_device_ctx = (AVCUDADeviceContext*)device_ctx->hwctx;
@@ -204,6 +311,7 @@ static CUDAEncoder* cuda_encoder_init(int width, int height, int fps,
 
 	int ret = av_hwdevice_ctx_init(e->hw_device_ctx);
 	if (ret < 0) {
+		set_av_error(err, err_len, "CUDA device init", ret);
 		av_buffer_unref(&e->hw_device_ctx);
 		free(e);
 		return NULL;
@@ -212,6 +320,7 @@ static CUDAEncoder* cuda_encoder_init(int width, int height, int fps,
 	// Create hw frames context
 	e->hw_frames_ctx = av_hwframe_ctx_alloc(e->hw_device_ctx);
 	if (!e->hw_frames_ctx) {
+		snprintf(err, err_len, "out of memory");
 		av_buffer_unref(&e->hw_device_ctx);
 		free(e);
 		return NULL;
@@ -226,22 +335,16 @@ static CUDAEncoder* cuda_encoder_init(int width, int height, int fps,
 
 	ret = av_hwframe_ctx_init(e->hw_frames_ctx);
 	if (ret < 0) {
+		set_av_error(err, err_len, "CUDA frame pool init", ret);
 		av_buffer_unref(&e->hw_frames_ctx);
 		av_buffer_unref(&e->hw_device_ctx);
 		free(e);
 		return NULL;
 	}
 
-	// Find NVENC codec
-	const AVCodec *codec = NULL;
-	int is_hevc = (strcmp(codec_name, "h265") == 0);
-
-	if (is_hevc) {
-		codec = avcodec_find_encoder_by_name("hevc_nvenc");
-	} else {
-		codec = avcodec_find_encoder_by_name("h264_nvenc");
-	}
+	const AVCodec *codec = avcodec_find_encoder_by_name(encoder_name);
 	if (!codec) {
+		snprintf(err, err_len, "not available in this FFmpeg build");
 		av_buffer_unref(&e->hw_frames_ctx);
 		av_buffer_unref(&e->hw_device_ctx);
 		free(e);
@@ -250,6 +353,7 @@ static CUDAEncoder* cuda_encoder_init(int width, int height, int fps,
 
 	e->ctx = avcodec_alloc_context3(codec);
 	if (!e->ctx) {
+		snprintf(err, err_len, "out of memory");
 		av_buffer_unref(&e->hw_frames_ctx);
 		av_buffer_unref(&e->hw_device_ctx);
 		free(e);
@@ -267,26 +371,30 @@ static CUDAEncoder* cuda_encoder_init(int width, int height, int fps,
 	e->ctx->max_b_frames = 0;
 	e->ctx->hw_frames_ctx = av_buffer_ref(e->hw_frames_ctx);
 
+	int opts = 0; // < 0: an option was rejected and err is set
 	if (strcmp(codec->name, "h264_nvenc") == 0) {
-		av_opt_set(e->ctx->priv_data, "preset", "p1", 0);
-		av_opt_set(e->ctx->priv_data, "tune", "ull", 0);
-		av_opt_set(e->ctx->priv_data, "profile", "baseline", 0);
-		av_opt_set(e->ctx->priv_data, "rc", "cbr", 0);
+		av_opt_set(e->ctx->priv_data, "preset", t->preset, 0);
+		av_opt_set(e->ctx->priv_data, "tune", t->tune, 0);
+		opts = set_h264_options(e->ctx, t, err, err_len);
+		av_opt_set(e->ctx->priv_data, "rc", t->rc, 0);
 		av_opt_set(e->ctx->priv_data, "zerolatency", "1", 0);
+		av_opt_set(e->ctx->priv_data, "forced-idr", "1", 0);
 		av_opt_set_int(e->ctx->priv_data, "gpu", gpu_index, 0);
 	} else {
-		av_opt_set(e->ctx->priv_data, "preset", "p1", 0);
-		av_opt_set(e->ctx->priv_data, "tune", "ull", 0);
+		av_opt_set(e->ctx->priv_data, "preset", t->preset, 0);
+		av_opt_set(e->ctx->priv_data, "tune", t->tune, 0);
 		av_opt_set(e->ctx->priv_data, "profile", "main", 0);
-		av_opt_set(e->ctx->priv_data, "rc", "cbr", 0);
+		av_opt_set(e->ctx->priv_data, "rc", t->rc, 0);
 		av_opt_set(e->ctx->priv_data, "zerolatency", "1", 0);
+		av_opt_set(e->ctx->priv_data, "forced-idr", "1", 0);
 		av_opt_set_int(e->ctx->priv_data, "gpu", gpu_index, 0);
 	}
 
 	e->ctx->flags |= AV_CODEC_FLAG_LOW_DELAY;
 
-	ret = avcodec_open2(e->ctx, codec, NULL);
+	ret = opts < 0 ? opts : avcodec_open2(e->ctx, codec, NULL);
 	if (ret < 0) {
+		if (opts == 0) set_open_error(err, err_len, codec, ret, session_limit);
 		avcodec_free_context(&e->ctx);
 		av_buffer_unref(&e->hw_frames_ctx);
 		av_buffer_unref(&e->hw_device_ctx);
@@ -297,6 +405,7 @@ static CUDAEncoder* cuda_encoder_init(int width, int height, int fps,
 	// Allocate a CUDA AVFrame from the hw_frames_ctx
 	e->frame = av_frame_alloc();
 	if (!e->frame) {
+		snprintf(err, err_len, "out of memory");
 		avcodec_free_context(&e->ctx);
 		av_buffer_unref(&e->hw_frames_ctx);
 		av_buffer_unref(&e->hw_device_ctx);
@@ -310,9 +419,11 @@ static CUDAEncoder* cuda_encoder_init(int width, int height, int fps,
 }
 
 // Encode an NV12 frame from a CUDA device pointer.
-// cuda_ptr is the device pointer to the NV12 frame, stride is the row pitch.
+// cuda_ptr is the device pointer to the NV12 frame, stride is the row pitch
+// and height the frame's rows, which may be one more than the encoder's.
+// force_key requests an IDR.
 static int cuda_encoder_encode(CUDAEncoder *e, unsigned long long cuda_ptr,
-                                int stride,
+                                int stride, int height, int force_key,
                                 uint8_t **out_buf, int *out_size, int *is_key) {
 	*out_size = 0;
 
@@ -325,7 +436,7 @@ static int cuda_encoder_encode(CUDAEncoder *e, unsigned long long cuda_ptr,
 	// Both are on the same GPU so this is a fast device-to-device copy.
 	// NV12 layout: Y plane = stride * height, UV plane = stride * height/2
 
-	size_t y_size = (size_t)stride * e->height;
+	size_t y_size = (size_t)stride * height;
 
 	CUdeviceptr src_y = (CUdeviceptr)cuda_ptr;
 	CUdeviceptr src_uv = src_y + y_size;
@@ -392,6 +503,7 @@ static int cuda_encoder_encode(CUDAEncoder *e, unsigned long long cuda_ptr,
 	}
 
 	e->frame->pts = e->pts++;
+	e->frame->pict_type = force_key ? AV_PICTURE_TYPE_I : AV_PICTURE_TYPE_NONE;
 
 	ret = avcodec_send_frame(e->ctx, e->frame);
 	if (ret < 0) {
@@ -429,6 +541,8 @@ static void cuda_encoder_destroy(CUDAEncoder *e) {
 import "C"
 import (
 	"fmt"
+	"strings"
+	"sync/atomic"
 	"unsafe"
 
 	"bunghole/internal/types"
@@ -436,53 +550,152 @@ import (
 
 // cpuEncoder wraps the CPU-based encoder (sws_scale BGRA→NV12 + NVENC/libx264).
 type cpuEncoder struct {
-	e *C.CPUEncoder
+	e        *C.CPUEncoder
+	format   types.VideoFormat
+	forceKey atomic.Bool
 }
 
 // cudaEncoder wraps the CUDA-based encoder (NV12 CUDA ptr → NVENC).
 type cudaEncoder struct {
-	e *C.CUDAEncoder
+	e             *C.CUDAEncoder
+	width, height int
+	format        types.VideoFormat
+	forceKey      atomic.Bool
 }
 
-func NewEncoder(width, height, fps, bitrateKbps, gpu int, codec string, gop int, cudaCtx, cuMemcpy2D unsafe.Pointer) (types.VideoEncoder, error) {
+// nvencSessionLimitHint explains an NVENC session refused for lack of
+// sessions. Consumer GeForce drivers allow only a few concurrent NVENC
+// sessions across all processes.
+const nvencSessionLimitHint = "NVENC session limit reached; close other encoders (nvidia-smi lists processes using the GPU) or apply the nvidia-patch that lifts the limit"
+
+func NewEncoder(width, height, fps, bitrateKbps, gpu int, codec string, gop int, opts types.EncoderOptions, cudaCtx, cuMemcpy2D unsafe.Pointer) (types.VideoEncoder, error) {
 	keyint := gop
 	if keyint <= 0 {
 		keyint = fps * 2
 	}
+	opts = withDefaults(opts)
+
+	// Hardware encoders are tried before software, each through CUDA
+	// first when frames are on the GPU. With --codec-fallback h264, H.265
+	// falls back to h264_nvenc rather than libx265, which can't keep up
+	// in real time.
+	hw, sw := []encoderChoice{{"h264_nvenc", "h264"}}, encoderChoice{"libx264", "h264"}
+	if codec == "h265" {
+		hw, sw = []encoderChoice{{"hevc_nvenc", "h265"}}, encoderChoice{"libx265", "h265"}
+		if opts.CodecFallback == "h264" && !opts.SoftwareOnly {
+			hw = append(hw, encoderChoice{"h264_nvenc", "h264"})
+			sw = encoderChoice{"libx264", "h264"}
+		}
+	}
+	if opts.SoftwareOnly {
+		hw = nil // --encoder software
+	}
+
+	t, freeTuning := cTuning(opts)
+	defer freeTuning()
 
-	cCodec := C.CString(codec)
-	defer C.free(unsafe.Pointer(cCodec))
+	// Each failed attempt's reason is kept, so the final error says whether
+	// a codec is missing from FFmpeg, NVENC refused the session (busy or
+	// unsupported GPU), or the resolution was rejected.
+	var failures []string
+	var errBuf [256]C.char
+	var sessionLimit C.int
 
-	if cudaCtx != nil {
-		// CUDA path: zero-copy from NvFBC CUDA buffer to NVENC
+	// CUDA path: zero-copy from NvFBC CUDA buffer to NVENC
+	tryCUDA := func(c encoderChoice) types.VideoEncoder {
+		cName := C.CString(c.name)
 		e := C.cuda_encoder_init(
 			C.int(width), C.int(height), C.int(fps),
 			C.int(bitrateKbps), C.int(keyint), C.int(gpu),
-			cCodec, cudaCtx, cuMemcpy2D)
+			cName, cudaCtx, cuMemcpy2D, &t, &errBuf[0], C.int(len(errBuf)), &sessionLimit)
+		C.free(unsafe.Pointer(cName))
 		if e != nil {
+			c.warnFallback(codec, opts.CodecFallback)
 			name := C.GoString(C.cuda_encoder_name(e))
 			fmt.Printf("video encoder: %s CUDA (%dx%d @ %d kbps)\n", name, width, height, bitrateKbps)
-			return &cudaEncoder{e: e}, nil
+			return &cudaEncoder{e: e, width: width, height: height, format: videoFormat(c.codec, int(e.ctx.profile), int(e.ctx.level), opts)}
 		}
-		fmt.Println("CUDA encoder init failed, falling back to CPU encoder")
+		failures = append(failures, fmt.Sprintf("%s (CUDA): %s", c.name, C.GoString(&errBuf[0])))
+		fmt.Printf("CUDA encoder init failed (%s), falling back to CPU encoder\n", C.GoString(&errBuf[0]))
+		return nil
+	}
+
+	// CPU path: encoder fed from host memory
+	tryCPU := func(c encoderChoice) types.VideoEncoder {
+		cName := C.CString(c.name)
+		e := C.cpu_encoder_init(
+			C.int(width), C.int(height), C.int(fps),
+			C.int(bitrateKbps), C.int(keyint), C.int(gpu),
+			cName, &t, &errBuf[0], C.int(len(errBuf)), &sessionLimit)
+		C.free(unsafe.Pointer(cName))
+		if e != nil {
+			if sessionLimit != 0 && c == sw {
+				fmt.Printf("warning: %s\n", nvencSessionLimitHint)
+			}
+			c.warnFallback(codec, opts.CodecFallback)
+			fmt.Printf("video encoder: %s (%dx%d @ %d kbps)\n", C.GoString(C.cpu_encoder_name(e)), width, height, bitrateKbps)
+			return &cpuEncoder{e: e, format: videoFormat(c.codec, int(e.ctx.profile), int(e.ctx.level), opts)}
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s", c.name, C.GoString(&errBuf[0])))
+		return nil
+	}
+
+	for _, c := range hw {
+		if cudaCtx != nil {
+			if enc := tryCUDA(c); enc != nil {
+				return enc, nil
+			}
+		}
+		if enc := tryCPU(c); enc != nil {
+			return enc, nil
+		}
+	}
+	if enc := tryCPU(sw); enc != nil {
+		return enc, nil
+	}
+	if sessionLimit != 0 {
+		failures = append(failures, nvencSessionLimitHint)
 	}
+	return nil, fmt.Errorf("failed to initialize video encoder at %dx%d: %s",
+		width, height, strings.Join(failures, "; "))
+}
 
-	// CPU fallback path
-	e := C.cpu_encoder_init(
-		C.int(width), C.int(height), C.int(fps),
-		C.int(bitrateKbps), C.int(keyint), C.int(gpu), cCodec)
-	if e == nil {
-		if codec == "h265" {
-			return nil, fmt.Errorf("failed to initialize video encoder (tried hardware h265 then libx265)")
+// cTuning converts encoder options for C. The strings are freed by the
+// returned function. With RGBInput, NVENC takes XShm's BGRA frames
+// directly and converts them to YUV on the GPU, instead of each frame
+// being converted with sws_scale on the CPU first; the frame is still
+// uploaded from host memory. It has no effect on the NvFBC CUDA path
+// (already NV12) or the software encoders.
+func cTuning(opts types.EncoderOptions) (C.EncoderTuning, func()) {
+	strs := []*C.char{
+		C.CString(opts.Preset),
+		C.CString(opts.Tune),
+		C.CString(opts.RC),
+		C.CString(softwarePreset(opts.Preset)),
+		C.CString(softwareTune(opts.Tune)),
+		C.CString(opts.H264Profile),
+		C.CString(opts.H264Level),
+	}
+	t := C.EncoderTuning{
+		preset:       strs[0],
+		tune:         strs[1],
+		rc:           strs[2],
+		sw_preset:    strs[3],
+		sw_tune:      strs[4],
+		h264_profile: strs[5],
+		h264_level:   strs[6],
+	}
+	if opts.RGBInput {
+		t.rgb_input = 1
+	}
+	return t, func() {
+		for _, s := range strs {
+			C.free(unsafe.Pointer(s))
 		}
-		return nil, fmt.Errorf("failed to initialize video encoder (tried hardware h264 then libx264)")
 	}
-	name := C.GoString(C.cpu_encoder_name(e))
-	fmt.Printf("video encoder: %s (%dx%d @ %d kbps)\n", name, width, height, bitrateKbps)
-	return &cpuEncoder{e: e}, nil
 }
 
-// cpuEncoder — BGRA CPU buffer path
+// cpuEncoder — BGRA (or NV12) CPU buffer path
 
 func (enc *cpuEncoder) Encode(frame *types.Frame) (*types.EncodedFrame, error) {
 	var outBuf *C.uint8_t
@@ -496,8 +709,22 @@ func (enc *cpuEncoder) Encode(frame *types.Frame) (*types.EncodedFrame, error) {
 		srcPtr = unsafe.Pointer(&frame.Data[0])
 	}
 
+	// X's 4th byte is padding, not alpha, hence BGR0/RGB0.
+	var srcFmt C.enum_AVPixelFormat = C.AV_PIX_FMT_BGR0
+	switch frame.PixFmt {
+	case types.PixFmtNV12:
+		srcFmt = C.AV_PIX_FMT_NV12
+	case types.PixFmtRGBA:
+		srcFmt = C.AV_PIX_FMT_RGB0
+	}
+
+	var forceKey C.int
+	if enc.forceKey.Swap(false) {
+		forceKey = 1
+	}
+
 	ret := C.cpu_encoder_encode(enc.e,
-		(*C.uint8_t)(srcPtr), C.int(frame.Stride),
+		(*C.uint8_t)(srcPtr), C.int(frame.Stride), C.int(frame.Height), srcFmt, forceKey,
 		&outBuf, &outSize, &isKey)
 
 	if ret != 0 {
@@ -516,6 +743,16 @@ func (enc *cpuEncoder) Encode(frame *types.Frame) (*types.EncodedFrame, error) {
 	}, nil
 }
 
+// ForceKeyframe makes the next encoded frame an IDR.
+func (enc *cpuEncoder) ForceKeyframe() {
+	enc.forceKey.Store(true)
+}
+
+// Format returns what the encoder produces.
+func (enc *cpuEncoder) Format() types.VideoFormat {
+	return enc.format
+}
+
 func (enc *cpuEncoder) Close() {
 	C.cpu_encoder_destroy(enc.e)
 }
@@ -526,6 +763,14 @@ func (enc *cudaEncoder) Encode(frame *types.Frame) (*types.EncodedFrame, error)
 	if !frame.IsCUDA {
 		return nil, fmt.Errorf("CUDA encoder received non-CUDA frame")
 	}
+	// The device copy takes the encoder's width x height from the frame
+	// and finds its UV plane below the frame's rows, so a frame of any
+	// other size (NvFBC after a resolution change) would be copied with
+	// its planes misplaced. Odd sizes are encoded one row/column short.
+	if frame.Width&^1 != enc.width || frame.Height&^1 != enc.height || frame.Stride < frame.Width {
+		return nil, fmt.Errorf("%w: frame is %dx%d (stride %d), encoder is %dx%d",
+			types.ErrFrameSize, frame.Width, frame.Height, frame.Stride, enc.width, enc.height)
+	}
 
 	var outBuf *C.uint8_t
 	var outSize C.int
@@ -534,7 +779,12 @@ func (enc *cudaEncoder) Encode(frame *types.Frame) (*types.EncodedFrame, error)
 	// frame.Ptr is a CUdeviceptr (uint64) stored as unsafe.Pointer
 	cudaPtr := C.ulonglong(uintptr(frame.Ptr))
 
-	ret := C.cuda_encoder_encode(enc.e, cudaPtr, C.int(frame.Stride),
+	var forceKey C.int
+	if enc.forceKey.Swap(false) {
+		forceKey = 1
+	}
+
+	ret := C.cuda_encoder_encode(enc.e, cudaPtr, C.int(frame.Stride), C.int(frame.Height), forceKey,
 		&outBuf, &outSize, &isKey)
 
 	if ret != 0 {
@@ -553,6 +803,16 @@ func (enc *cudaEncoder) Encode(frame *types.Frame) (*types.EncodedFrame, error)
 	}, nil
 }
 
+// ForceKeyframe makes the next encoded frame an IDR.
+func (enc *cudaEncoder) ForceKeyframe() {
+	enc.forceKey.Store(true)
+}
+
+// Format returns what the encoder produces.
+func (enc *cudaEncoder) Format() types.VideoFormat {
+	return enc.format
+}
+
 func (enc *cudaEncoder) Close() {
 	C.cuda_encoder_destroy(enc.e)
 }
@@ -0,0 +1,55 @@
+package encode
+
+import (
+	"strconv"
+	"strings"
+
+	"bunghole/internal/types"
+)
+
+// libavcodec's H.264 profile values (AV_PROFILE_H264_*). Constrained
+// baseline is baseline with a flag bit set.
+const (
+	avProfileH264Baseline    = 66
+	avProfileH264Main        = 77
+	avProfileH264High        = 100
+	avProfileH264Constrained = 1 << 9
+)
+
+// videoFormat describes what an opened encoder of codec produces, from the
+// profile and level libavcodec reports after avcodec_open2 (negative =
+// not reported). Encoders that don't report them were opened with the
+// configured profile and level, which they must have accepted (see
+// set_h264_options).
+func videoFormat(codec string, profile, level int, opts types.EncoderOptions) types.VideoFormat {
+	f := types.VideoFormat{Codec: codec}
+	if codec != "h264" {
+		return f
+	}
+	switch profile &^ avProfileH264Constrained {
+	case avProfileH264Baseline:
+		f.Profile = "baseline"
+	case avProfileH264Main:
+		f.Profile = "main"
+	case avProfileH264High:
+		f.Profile = "high"
+	default:
+		f.Profile = opts.H264Profile
+	}
+	f.Level = level
+	if f.Level <= 0 {
+		f.Level = levelIDC(opts.H264Level)
+	}
+	return f
+}
+
+// levelIDC converts a level such as "5.1" to its level_idc, 51; 0 for "".
+func levelIDC(level string) int {
+	major, minor, _ := strings.Cut(level, ".")
+	maj, err := strconv.Atoi(major)
+	if err != nil {
+		return 0
+	}
+	sub, _ := strconv.Atoi(minor)
+	return maj*10 + sub
+}
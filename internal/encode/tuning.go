@@ -0,0 +1,71 @@
+package encode
+
+import (
+	"fmt"
+	"strings"
+
+	"bunghole/internal/types"
+)
+
+// withDefaults fills in the options left empty. The NVENC preset and
+// tune are mapped to the nearest equivalents for libx264/libx265 and
+// VideoToolbox (see softwarePreset and softwareTune).
+func withDefaults(o types.EncoderOptions) types.EncoderOptions {
+	if o.Preset == "" {
+		o.Preset = "p1"
+	}
+	if o.Tune == "" {
+		o.Tune = "ull"
+	}
+	if o.RC == "" {
+		o.RC = "cbr"
+	}
+	if o.H264Profile == "" {
+		o.H264Profile = "baseline"
+	}
+	return o
+}
+
+// encoderChoice is an FFmpeg encoder NewEncoder tries and the codec it
+// produces.
+type encoderChoice struct {
+	name  string
+	codec string
+}
+
+// warnFallback says when the chosen encoder doesn't produce the codec
+// that was asked for.
+func (c encoderChoice) warnFallback(requested, fallback string) {
+	if c.codec != requested {
+		fmt.Printf("warning: no hardware %s encoder; encoding %s with %s (--codec-fallback %s)\n",
+			strings.ToUpper(requested), strings.ToUpper(c.codec), c.name, fallback)
+	}
+}
+
+// softwarePreset maps an NVENC preset to the closest x264/x265 preset.
+func softwarePreset(preset string) string {
+	switch preset {
+	case "p2":
+		return "superfast"
+	case "p3":
+		return "veryfast"
+	case "p4":
+		return "faster"
+	case "p5":
+		return "fast"
+	case "p6":
+		return "medium"
+	case "p7":
+		return "slow"
+	default:
+		return "ultrafast"
+	}
+}
+
+// softwareTune maps an NVENC tune to an x264/x265 tune ("" = none).
+func softwareTune(tune string) string {
+	if tune == "hq" {
+		return ""
+	}
+	return "zerolatency"
+}
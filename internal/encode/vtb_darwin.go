@@ -11,6 +11,18 @@ package encode
 #include <stdlib.h>
 #include <string.h>
 
+// Encoder tuning from Go (see Tuning). realtime selects VideoToolbox's
+// real-time mode; sw_* are the libx264/libx265 equivalents (empty sw_tune
+// means no tune). h264_profile and h264_level (empty = encoder's choice)
+// apply to both H.264 encoders.
+typedef struct {
+	int realtime;
+	const char *sw_preset;
+	const char *sw_tune;
+	const char *h264_profile;
+	const char *h264_level;
+} EncoderTuning;
+
 typedef struct {
 	AVCodecContext *ctx;
 	AVFrame *frame;
@@ -21,28 +33,53 @@ typedef struct {
 	int64_t pts;
 } VTBEncoder;
 
-static VTBEncoder* vtb_encoder_init(int width, int height, int fps, int bitrate_kbps, int keyint, int gpu_index, const char *codec_name) {
+// set_av_error writes "what: <FFmpeg error text>" to err for the Go side.
+static void set_av_error(char *err, int err_len, const char *what, int averr) {
+	char msg[AV_ERROR_MAX_STRING_SIZE];
+	av_make_error_string(msg, sizeof(msg), averr);
+	snprintf(err, err_len, "%s: %s", what, msg);
+}
+
+// set_h264_options applies the H.264 profile and level. The server
+// advertises the stream as what was asked for, so an encoder that rejects
+// either must not be used: it would silently encode its default instead.
+static int set_h264_options(AVCodecContext *ctx, const EncoderTuning *t, char *err, int err_len) {
+	if (av_opt_set(ctx->priv_data, "profile", t->h264_profile, 0) < 0) {
+		snprintf(err, err_len, "H.264 profile %s not supported", t->h264_profile);
+		return -1;
+	}
+	if (t->h264_level[0] && av_opt_set(ctx->priv_data, "level", t->h264_level, 0) < 0) {
+		snprintf(err, err_len, "H.264 level %s not supported", t->h264_level);
+		return -1;
+	}
+	return 0;
+}
+
+// encoder_name is the FFmpeg encoder to use (h264_videotoolbox, libx264,
+// ...). On failure the reason is written to err.
+static VTBEncoder* vtb_encoder_init(int width, int height, int fps, int bitrate_kbps, int keyint, int gpu_index, const char *encoder_name, const EncoderTuning *t, char *err, int err_len) {
+	const AVCodec *codec = avcodec_find_encoder_by_name(encoder_name);
+	if (!codec) {
+		snprintf(err, err_len, "not available in this FFmpeg build");
+		return NULL;
+	}
+
 	VTBEncoder *e = (VTBEncoder*)calloc(1, sizeof(VTBEncoder));
-	if (!e) return NULL;
+	if (!e) {
+		snprintf(err, err_len, "out of memory");
+		return NULL;
+	}
 
 	e->width = width;
 	e->height = height;
 	e->pts = 0;
 
-	const AVCodec *codec = NULL;
-	int is_hevc = (strcmp(codec_name, "h265") == 0);
-
-	if (is_hevc) {
-		codec = avcodec_find_encoder_by_name("hevc_videotoolbox");
-		if (!codec) codec = avcodec_find_encoder_by_name("libx265");
-	} else {
-		codec = avcodec_find_encoder_by_name("h264_videotoolbox");
-		if (!codec) codec = avcodec_find_encoder_by_name("libx264");
-	}
-	if (!codec) return NULL;
-
 	e->ctx = avcodec_alloc_context3(codec);
-	if (!e->ctx) { free(e); return NULL; }
+	if (!e->ctx) {
+		snprintf(err, err_len, "out of memory");
+		free(e);
+		return NULL;
+	}
 
 	e->ctx->width = width;
 	e->ctx->height = height;
@@ -53,31 +90,34 @@ static VTBEncoder* vtb_encoder_init(int width, int height, int fps, int bitrate_
 	e->ctx->gop_size = keyint;
 	e->ctx->max_b_frames = 0;
 
+	int opts = 0; // < 0: an option was rejected and err is set
 	if (strcmp(codec->name, "h264_videotoolbox") == 0) {
-		av_opt_set(e->ctx->priv_data, "realtime", "1", 0);
+		av_opt_set_int(e->ctx->priv_data, "realtime", t->realtime, 0);
 		av_opt_set(e->ctx->priv_data, "allow_sw", "1", 0);
-		av_opt_set(e->ctx->priv_data, "profile", "baseline", 0);
+		opts = set_h264_options(e->ctx, t, err, err_len);
 		e->ctx->pix_fmt = AV_PIX_FMT_NV12;
 	} else if (strcmp(codec->name, "hevc_videotoolbox") == 0) {
-		av_opt_set(e->ctx->priv_data, "realtime", "1", 0);
+		av_opt_set_int(e->ctx->priv_data, "realtime", t->realtime, 0);
 		av_opt_set(e->ctx->priv_data, "allow_sw", "1", 0);
 		av_opt_set(e->ctx->priv_data, "profile", "main", 0);
 		e->ctx->pix_fmt = AV_PIX_FMT_NV12;
 	} else if (strcmp(codec->name, "libx265") == 0) {
-		av_opt_set(e->ctx->priv_data, "preset", "ultrafast", 0);
-		av_opt_set(e->ctx->priv_data, "tune", "zerolatency", 0);
+		av_opt_set(e->ctx->priv_data, "preset", t->sw_preset, 0);
+		if (t->sw_tune[0]) av_opt_set(e->ctx->priv_data, "tune", t->sw_tune, 0);
 		e->ctx->pix_fmt = AV_PIX_FMT_YUV420P;
 	} else {
 		// libx264 fallback
-		av_opt_set(e->ctx->priv_data, "preset", "ultrafast", 0);
-		av_opt_set(e->ctx->priv_data, "tune", "zerolatency", 0);
-		av_opt_set(e->ctx->priv_data, "profile", "baseline", 0);
+		av_opt_set(e->ctx->priv_data, "preset", t->sw_preset, 0);
+		if (t->sw_tune[0]) av_opt_set(e->ctx->priv_data, "tune", t->sw_tune, 0);
+		opts = set_h264_options(e->ctx, t, err, err_len);
 		e->ctx->pix_fmt = AV_PIX_FMT_YUV420P;
 	}
 
 	e->ctx->flags |= AV_CODEC_FLAG_LOW_DELAY;
 
-	if (avcodec_open2(e->ctx, codec, NULL) < 0) {
+	int ret = opts < 0 ? opts : avcodec_open2(e->ctx, codec, NULL);
+	if (ret < 0) {
+		if (opts == 0) set_av_error(err, err_len, "avcodec_open2", ret);
 		avcodec_free_context(&e->ctx);
 		free(e);
 		return NULL;
@@ -98,6 +138,7 @@ static VTBEncoder* vtb_encoder_init(int width, int height, int fps, int bitrate_
 		SWS_FAST_BILINEAR, NULL, NULL, NULL);
 
 	if (!e->sws) {
+		snprintf(err, err_len, "sws_getContext failed");
 		av_packet_free(&e->pkt);
 		av_frame_free(&e->frame);
 		avcodec_free_context(&e->ctx);
@@ -109,7 +150,8 @@ static VTBEncoder* vtb_encoder_init(int width, int height, int fps, int bitrate_
 }
 
 // Returns: 0 = success, -1 = error. out_size=0 means no output yet.
-static int vtb_encoder_encode(VTBEncoder *e, const uint8_t *bgra, int stride,
+// force_key requests an IDR.
+static int vtb_encoder_encode(VTBEncoder *e, const uint8_t *bgra, int stride, int force_key,
                           uint8_t **out_buf, int *out_size, int *is_key) {
 	*out_size = 0;
 
@@ -122,6 +164,7 @@ static int vtb_encoder_encode(VTBEncoder *e, const uint8_t *bgra, int stride,
 	          e->frame->data, e->frame->linesize);
 
 	e->frame->pts = e->pts++;
+	e->frame->pict_type = force_key ? AV_PICTURE_TYPE_I : AV_PICTURE_TYPE_NONE;
 
 	int ret = avcodec_send_frame(e->ctx, e->frame);
 	if (ret < 0) return -1;
@@ -158,32 +201,74 @@ static void vtb_encoder_destroy(VTBEncoder *e) {
 import "C"
 import (
 	"fmt"
+	"strings"
+	"sync/atomic"
 	"unsafe"
 
 	"bunghole/internal/types"
 )
 
 type vtbEncoder struct {
-	e *C.VTBEncoder
+	e        *C.VTBEncoder
+	format   types.VideoFormat
+	forceKey atomic.Bool
 }
 
-func NewEncoder(width, height, fps, bitrateKbps, gpu int, codec string, gop int, cudaCtx, cuMemcpy2D unsafe.Pointer) (types.VideoEncoder, error) {
+func NewEncoder(width, height, fps, bitrateKbps, gpu int, codec string, gop int, opts types.EncoderOptions, cudaCtx, cuMemcpy2D unsafe.Pointer) (types.VideoEncoder, error) {
 	keyint := gop
 	if keyint <= 0 {
 		keyint = fps * 2 // default: keyframe every 2 seconds
 	}
-	cCodec := C.CString(codec)
-	defer C.free(unsafe.Pointer(cCodec))
-	e := C.vtb_encoder_init(C.int(width), C.int(height), C.int(fps), C.int(bitrateKbps), C.int(keyint), C.int(gpu), cCodec)
-	if e == nil {
-		if codec == "h265" {
-			return nil, fmt.Errorf("failed to initialize video encoder (tried hardware h265 then libx265)")
+	opts = withDefaults(opts)
+	swPreset := C.CString(softwarePreset(opts.Preset))
+	defer C.free(unsafe.Pointer(swPreset))
+	swTune := C.CString(softwareTune(opts.Tune))
+	defer C.free(unsafe.Pointer(swTune))
+	profile := C.CString(opts.H264Profile)
+	defer C.free(unsafe.Pointer(profile))
+	level := C.CString(opts.H264Level)
+	defer C.free(unsafe.Pointer(level))
+	t := C.EncoderTuning{sw_preset: swPreset, sw_tune: swTune, h264_profile: profile, h264_level: level}
+	if opts.Tune != "hq" {
+		t.realtime = 1
+	}
+
+	// With --codec-fallback h264, H.265 falls back to hardware H.264
+	// rather than libx265.
+	choices := []encoderChoice{{"h264_videotoolbox", "h264"}, {"libx264", "h264"}}
+	if codec == "h265" {
+		choices = []encoderChoice{{"hevc_videotoolbox", "h265"}, {"libx265", "h265"}}
+		if opts.CodecFallback == "h264" && !opts.SoftwareOnly {
+			choices = []encoderChoice{{"hevc_videotoolbox", "h265"}, {"h264_videotoolbox", "h264"}, {"libx264", "h264"}}
+		}
+	}
+	if opts.SoftwareOnly {
+		choices = choices[len(choices)-1:] // --encoder software
+	}
+
+	// Keep each attempt's reason so the error says why encoding won't start.
+	var failures []string
+	var errBuf [256]C.char
+	var e *C.VTBEncoder
+	var chosen encoderChoice
+	for _, c := range choices {
+		cName := C.CString(c.name)
+		e = C.vtb_encoder_init(C.int(width), C.int(height), C.int(fps), C.int(bitrateKbps), C.int(keyint), C.int(gpu), cName, &t, &errBuf[0], C.int(len(errBuf)))
+		C.free(unsafe.Pointer(cName))
+		if e != nil {
+			chosen = c
+			break
 		}
-		return nil, fmt.Errorf("failed to initialize video encoder (tried hardware h264 then libx264)")
+		failures = append(failures, fmt.Sprintf("%s: %s", c.name, C.GoString(&errBuf[0])))
+	}
+	if e == nil {
+		return nil, fmt.Errorf("failed to initialize video encoder at %dx%d: %s",
+			width, height, strings.Join(failures, "; "))
 	}
+	chosen.warnFallback(codec, opts.CodecFallback)
 	name := C.GoString(C.vtb_encoder_name(e))
 	fmt.Printf("video encoder: %s (%dx%d @ %d kbps)\n", name, width, height, bitrateKbps)
-	return &vtbEncoder{e: e}, nil
+	return &vtbEncoder{e: e, format: videoFormat(chosen.codec, int(e.ctx.profile), int(e.ctx.level), opts)}, nil
 }
 
 func (enc *vtbEncoder) Encode(frame *types.Frame) (*types.EncodedFrame, error) {
@@ -199,9 +284,15 @@ func (enc *vtbEncoder) Encode(frame *types.Frame) (*types.EncodedFrame, error) {
 		srcPtr = unsafe.Pointer(&frame.Data[0])
 	}
 
+	var forceKey C.int
+	if enc.forceKey.Swap(false) {
+		forceKey = 1
+	}
+
 	ret := C.vtb_encoder_encode(enc.e,
 		(*C.uint8_t)(srcPtr),
 		C.int(frame.Stride),
+		forceKey,
 		&outBuf, &outSize, &isKey)
 
 	if ret != 0 {
@@ -220,6 +311,16 @@ func (enc *vtbEncoder) Encode(frame *types.Frame) (*types.EncodedFrame, error) {
 	}, nil
 }
 
+// ForceKeyframe makes the next encoded frame an IDR.
+func (enc *vtbEncoder) ForceKeyframe() {
+	enc.forceKey.Store(true)
+}
+
+// Format returns what the encoder produces.
+func (enc *vtbEncoder) Format() types.VideoFormat {
+	return enc.format
+}
+
 func (enc *vtbEncoder) Close() {
 	C.vtb_encoder_destroy(enc.e)
 }
@@ -0,0 +1,68 @@
+//go:build darwin
+
+package input
+
+import (
+	"math"
+	"time"
+
+	"bunghole/internal/types"
+)
+
+// doubleClickInterval is the longest gap between presses of the same
+// button that still counts as a multi-click. 500ms is the macOS default.
+var doubleClickInterval = 500 * time.Millisecond
+
+// SetDoubleClickInterval sets the longest gap between presses of a button
+// that make a double (or triple, ...) click.
+func SetDoubleClickInterval(d time.Duration) {
+	doubleClickInterval = d
+}
+
+// clickSlop is how far, in points, the pointer may move between presses
+// that still make a multi-click.
+const clickSlop = 4
+
+// clickEpoch is the base of the clock presses without a client timestamp
+// are timed by.
+var clickEpoch = time.Now()
+
+// ClickCounter gives each mouse press its click count. macOS doesn't work
+// out double-clicks from the timing of posted events; each event carries
+// its count, so without this every click arrives as a single click.
+// Exported for use by the VM input handler.
+type ClickCounter struct {
+	button int
+	count  int     // 0 = no press yet
+	at     float64 // ms, of the last press
+	x, y   float64
+}
+
+// Press returns the click count of a press of event.Button at x, y: one
+// more than the last press if it was the same button, recent and close
+// by, else 1. Presses are timed by the client's timestamps when they have
+// them, so network jitter doesn't split or merge clicks.
+func (c *ClickCounter) Press(event types.InputEvent, x, y float64) int {
+	at := event.TS
+	if at <= 0 {
+		at = float64(time.Since(clickEpoch)) / float64(time.Millisecond)
+	}
+	if c.count > 0 && event.Button == c.button &&
+		at-c.at <= float64(doubleClickInterval)/float64(time.Millisecond) &&
+		math.Abs(x-c.x) <= clickSlop && math.Abs(y-c.y) <= clickSlop {
+		c.count++
+	} else {
+		c.count = 1
+	}
+	c.button, c.at, c.x, c.y = event.Button, at, x, y
+	return c.count
+}
+
+// Release returns the click count of a release of event.Button: that of
+// the press it ends.
+func (c *ClickCounter) Release(event types.InputEvent) int {
+	if c.count > 0 && event.Button == c.button {
+		return c.count
+	}
+	return 1
+}
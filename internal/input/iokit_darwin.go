@@ -6,7 +6,7 @@ package input
 #cgo LDFLAGS: -framework CoreGraphics
 #include <CoreGraphics/CoreGraphics.h>
 
-static int _buttons_down = 0;  // bitmask of held buttons
+static int _buttons_down = 0;  // bitmask of held buttons (1=left, 2=other, 4=right)
 
 static void input_mouse_move_abs(int x, int y) {
 	CGEventType evtype;
@@ -22,6 +22,9 @@ static void input_mouse_move_abs(int x, int y) {
 	} else if (_buttons_down & 2) {
 		evtype = kCGEventOtherMouseDragged;
 		button = kCGMouseButtonCenter;
+	} else if (_buttons_down & (8 | 16)) {
+		evtype = kCGEventOtherMouseDragged;
+		button = (_buttons_down & 8) ? 3 : 4;
 	} else {
 		evtype = kCGEventMouseMoved;
 		button = kCGMouseButtonLeft;
@@ -40,7 +43,9 @@ static void input_mouse_move_rel(int dx, int dy) {
 	input_mouse_move_abs((int)(cur.x + dx), (int)(cur.y + dy));
 }
 
-static void input_mouse_button(int button, int press, int x, int y) {
+// clicks is the event's click count (2 for the second press of a
+// double-click), which macOS apps read instead of timing clicks themselves.
+static void input_mouse_button(int button, int press, int x, int y, int clicks) {
 	CGEventType evtype;
 	CGMouseButton cgbutton;
 	int mask;
@@ -53,6 +58,11 @@ static void input_mouse_button(int button, int press, int x, int y) {
 		cgbutton = kCGMouseButtonRight;
 		evtype = press ? kCGEventRightMouseDown : kCGEventRightMouseUp;
 		mask = 4;
+	} else if (button == 3 || button == 4) {
+		// Back/forward thumb buttons are "other" buttons 3 and 4
+		cgbutton = (CGMouseButton)button;
+		evtype = press ? kCGEventOtherMouseDown : kCGEventOtherMouseUp;
+		mask = button == 3 ? 8 : 16;
 	} else {
 		cgbutton = kCGMouseButtonCenter;
 		evtype = press ? kCGEventOtherMouseDown : kCGEventOtherMouseUp;
@@ -67,6 +77,7 @@ static void input_mouse_button(int button, int press, int x, int y) {
 
 	CGEventRef ev = CGEventCreateMouseEvent(NULL, evtype,
 		CGPointMake(x, y), cgbutton);
+	CGEventSetIntegerValueField(ev, kCGMouseEventClickState, clicks);
 	CGEventPost(kCGHIDEventTap, ev);
 	CFRelease(ev);
 }
@@ -79,23 +90,81 @@ static void input_mouse_scroll(int dx, int dy) {
 	CFRelease(ev);
 }
 
+// input_largest_display returns the largest active display, the one
+// capture picks for "main" (the first on a tie), or 0 if there is none.
+static uint32_t input_largest_display(void) {
+	CGDirectDisplayID ids[32];
+	uint32_t n = 0;
+	if (CGGetActiveDisplayList(32, ids, &n) != kCGErrorSuccess) {
+		return 0;
+	}
+	CGDirectDisplayID best = 0;
+	double bestArea = 0;
+	for (uint32_t i = 0; i < n; i++) {
+		CGRect b = CGDisplayBounds(ids[i]);
+		double area = b.size.width * b.size.height;
+		if (!best || area > bestArea) {
+			best = ids[i];
+			bestArea = area;
+		}
+	}
+	return best;
+}
+
+// input_display_bounds returns a display's origin and size in global
+// points, the space CGEvent locations are in.
+static void input_display_bounds(uint32_t id, int *x, int *y, int *w, int *h) {
+	CGRect bounds = CGDisplayBounds(id);
+	*x = (int)bounds.origin.x;
+	*y = (int)bounds.origin.y;
+	*w = (int)bounds.size.width;
+	*h = (int)bounds.size.height;
+}
+
 static void input_key(int keycode, int press) {
 	CGEventRef ev = CGEventCreateKeyboardEvent(NULL, (CGKeyCode)keycode, press);
 	CGEventPost(kCGHIDEventTap, ev);
 	CFRelease(ev);
 }
+
+// input_set_caps_lock turns Caps Lock on or off with a synthetic Caps Lock
+// press, unless the system's state already matches.
+static void input_set_caps_lock(int on) {
+	CGEventFlags flags = CGEventSourceFlagsState(kCGEventSourceStateHIDSystemState);
+	if (((flags & kCGEventFlagMaskAlphaShift) != 0) == (on != 0)) {
+		return;
+	}
+	input_key(0x39, 1); // kVK_CapsLock
+	input_key(0x39, 0);
+}
 */
 import "C"
 import (
+	"errors"
 	"log"
 
+	"bunghole/internal/capture"
 	"bunghole/internal/types"
 )
 
-type InputHandler struct{}
+type InputHandler struct {
+	display uint32 // CGDirectDisplayID input goes to
+	clicks  ClickCounter
+}
 
+// NewInputHandler injects input into the display capture.ParseDisplay
+// names, so pointer positions land on the display being streamed.
 func NewInputHandler(displayName string) (types.EventInjector, error) {
-	return &InputHandler{}, nil
+	id, err := capture.ParseDisplay(displayName)
+	if err != nil {
+		return nil, err
+	}
+	if id == 0 {
+		if id = uint32(C.input_largest_display()); id == 0 {
+			return nil, errors.New("input: no active display")
+		}
+	}
+	return &InputHandler{display: id}, nil
 }
 
 func (ih *InputHandler) Inject(event types.InputEvent) {
@@ -104,14 +173,26 @@ func (ih *InputHandler) Inject(event types.InputEvent) {
 		if event.Relative {
 			C.input_mouse_move_rel(C.int(event.DX), C.int(event.DY))
 		} else {
-			C.input_mouse_move_abs(C.int(event.X), C.int(event.Y))
+			x, y := ih.position(event)
+			C.input_mouse_move_abs(C.int(x), C.int(y))
 		}
 	case "mousedown":
-		C.input_mouse_button(C.int(event.Button), C.int(1), C.int(event.X), C.int(event.Y))
+		if event.Button > 4 {
+			return
+		}
+		x, y := ih.position(event)
+		clicks := ih.clicks.Press(event, x, y)
+		C.input_mouse_button(C.int(event.Button), C.int(1), C.int(x), C.int(y), C.int(clicks))
 	case "mouseup":
-		C.input_mouse_button(C.int(event.Button), C.int(0), C.int(event.X), C.int(event.Y))
+		if event.Button > 4 {
+			return
+		}
+		x, y := ih.position(event)
+		C.input_mouse_button(C.int(event.Button), C.int(0), C.int(x), C.int(y), C.int(ih.clicks.Release(event)))
 	case "wheel":
-		C.input_mouse_scroll(C.int(event.DX), C.int(event.DY))
+		_, _, w, h := ih.bounds()
+		dx, dy := event.WheelDelta(w, h)
+		C.input_mouse_scroll(C.int(dx), C.int(dy))
 	case "keydown":
 		if kc, ok := CodeMap[event.Code]; ok {
 			C.input_key(C.int(kc), C.int(1))
@@ -122,11 +203,38 @@ func (ih *InputHandler) Inject(event types.InputEvent) {
 		if kc, ok := CodeMap[event.Code]; ok {
 			C.input_key(C.int(kc), C.int(0))
 		}
+	case "setlock":
+		// Macs have no Num Lock.
+		C.input_set_caps_lock(cBool(event.CapsLock))
 	}
 }
 
 func (ih *InputHandler) Close() {}
 
+func cBool(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// bounds returns the display's origin and size in global points (the
+// CGEvent coordinate space). It is read per event so display
+// rearrangements and mode changes are picked up.
+func (ih *InputHandler) bounds() (x, y, w, h int) {
+	var cx, cy, cw, ch C.int
+	C.input_display_bounds(C.uint32_t(ih.display), &cx, &cy, &cw, &ch)
+	return int(cx), int(cy), int(cw), int(ch)
+}
+
+// position returns an event's absolute position in global points: its
+// position on the display, offset by the display's origin.
+func (ih *InputHandler) position(event types.InputEvent) (float64, float64) {
+	ox, oy, w, h := ih.bounds()
+	x, y := event.Position(w, h)
+	return float64(ox) + x, float64(oy) + y
+}
+
 // macOS virtual keycodes (from HIToolbox/Events.h)
 const (
 	kVK_ANSI_A              = 0x00
@@ -4,17 +4,20 @@ package input
 
 /*
 #cgo pkg-config: x11 xtst
+#cgo CFLAGS: -I${SRCDIR}/../../cvendor
 #include <X11/Xlib.h>
 #include <X11/keysym.h>
 #include <X11/extensions/XTest.h>
 #include <X11/XKBlib.h>
 #include <stdlib.h>
 #include <string.h>
+#include "xconn.h"
 
 static Display* input_display = NULL;
+static int input_dead = 0; // set by Xlib when the connection to the server is lost
 
 static int input_init(const char *display_name) {
-	input_display = XOpenDisplay(display_name);
+	input_display = xconn_open(display_name, &input_dead);
 	if (!input_display) return -1;
 	return 0;
 }
@@ -22,19 +25,23 @@ static int input_init(const char *display_name) {
 static void input_mouse_move_abs(int x, int y) {
 	if (!input_display) return;
 	XTestFakeMotionEvent(input_display, DefaultScreen(input_display), x, y, 0);
-	XFlush(input_display);
+}
+
+static void input_screen_size(int *w, int *h) {
+	if (!input_display) { *w = 0; *h = 0; return; }
+	int screen = DefaultScreen(input_display);
+	*w = DisplayWidth(input_display, screen);
+	*h = DisplayHeight(input_display, screen);
 }
 
 static void input_mouse_move_rel(int dx, int dy) {
 	if (!input_display) return;
 	XWarpPointer(input_display, None, None, 0, 0, 0, 0, dx, dy);
-	XFlush(input_display);
 }
 
 static void input_mouse_button(int button, int press) {
 	if (!input_display) return;
 	XTestFakeButtonEvent(input_display, button, press, 0);
-	XFlush(input_display);
 }
 
 // Accumulate sub-step scroll deltas
@@ -67,18 +74,140 @@ static void input_mouse_scroll(double dx, double dy) {
 		XTestFakeButtonEvent(input_display, 7, False, 0);
 		scroll_accum_x -= 40;
 	}
-	XFlush(input_display);
+}
+
+// Modifiers synthesized for a pressed keycode, released again with it.
+#define MOD_SHIFT  1
+#define MOD_LEVEL3 2
+static unsigned char added_mods[256];
+
+// Spare keycode (no keysyms in the current keymap) used to inject keysyms
+// the layout doesn't have, e.g. "€" on a US keymap.
+static KeyCode spare_keycode = 0;
+
+// Find the keycode and shift level (0-3, group 0) that produce keysym.
+// Returns 0 if the keysym isn't in the current keymap.
+static KeyCode input_lookup_keysym(KeySym keysym, int *level) {
+	int min_kc, max_kc;
+	XDisplayKeycodes(input_display, &min_kc, &max_kc);
+	for (int lvl = 0; lvl < 4; lvl++) {
+		for (int kc = min_kc; kc <= max_kc; kc++) {
+			if (XkbKeycodeToKeysym(input_display, kc, 0, lvl) == keysym) {
+				*level = lvl;
+				return (KeyCode)kc;
+			}
+		}
+	}
+	return 0;
+}
+
+// Bind keysym to a spare keycode at every level, so it is produced
+// regardless of which modifiers are held.
+static KeyCode input_bind_spare(KeySym keysym) {
+	if (!spare_keycode) {
+		int min_kc, max_kc;
+		XDisplayKeycodes(input_display, &min_kc, &max_kc);
+		for (int kc = max_kc; kc >= min_kc; kc--) {
+			if (XkbKeycodeToKeysym(input_display, kc, 0, 0) == NoSymbol) {
+				spare_keycode = (KeyCode)kc;
+				break;
+			}
+		}
+		if (!spare_keycode) return 0;
+	}
+	KeySym syms[4] = { keysym, keysym, keysym, keysym };
+	XChangeKeyboardMapping(input_display, spare_keycode, 4, syms, 1);
+	XSync(input_display, False);
+	return spare_keycode;
+}
+
+static void input_fake_keysym(KeySym keysym, int press) {
+	KeyCode kc = XKeysymToKeycode(input_display, keysym);
+	if (kc) XTestFakeKeyEvent(input_display, kc, press, 0);
 }
 
 static void input_key(unsigned int keysym, int press) {
 	if (!input_display) return;
-	KeyCode kc = XKeysymToKeycode(input_display, keysym);
-	if (kc == 0) return;
-	XTestFakeKeyEvent(input_display, kc, press, 0);
-	XFlush(input_display);
+
+	int level = 0;
+	KeyCode kc = input_lookup_keysym(keysym, &level);
+	if (kc == 0) {
+		if (!press) {
+			// Release whatever the spare keycode was bound to on press
+			if (spare_keycode) XTestFakeKeyEvent(input_display, spare_keycode, False, 0);
+			return;
+		}
+		kc = input_bind_spare(keysym);
+		if (kc == 0) return;
+		level = 0;
+	}
+
+	if (press) {
+		// Add Shift / Level3 when the keysym lives on a higher level and
+		// the modifier isn't already held (e.g. by a forwarded AltGr).
+		XkbStateRec state;
+		unsigned int mods = 0;
+		if (XkbGetState(input_display, XkbUseCoreKbd, &state) == Success) mods = state.mods;
+		unsigned int l3_mask = XkbKeysymToModifiers(input_display, XK_ISO_Level3_Shift);
+
+		unsigned char add = 0;
+		if ((level & 1) && !(mods & ShiftMask)) add |= MOD_SHIFT;
+		if ((level & 2) && !(l3_mask && (mods & l3_mask))) add |= MOD_LEVEL3;
+		added_mods[kc] = add;
+
+		if (add & MOD_SHIFT) input_fake_keysym(XK_Shift_L, True);
+		if (add & MOD_LEVEL3) input_fake_keysym(XK_ISO_Level3_Shift, True);
+		XTestFakeKeyEvent(input_display, kc, True, 0);
+	} else {
+		XTestFakeKeyEvent(input_display, kc, False, 0);
+		unsigned char add = added_mods[kc];
+		added_mods[kc] = 0;
+		if (add & MOD_LEVEL3) input_fake_keysym(XK_ISO_Level3_Shift, False);
+		if (add & MOD_SHIFT) input_fake_keysym(XK_Shift_L, False);
+	}
+}
+
+// Set Caps Lock / Num Lock to the requested state (1=on, 0=off).
+// Only modifiers whose current state differs are changed.
+static void input_set_locks(int caps, int num) {
+	if (!input_display) return;
+
+	XkbStateRec state;
+	if (XkbGetState(input_display, XkbUseCoreKbd, &state) != Success) return;
+
+	unsigned int num_mask = XkbKeysymToModifiers(input_display, XK_Num_Lock);
+	unsigned int affect = 0, values = 0;
+
+	if (((state.locked_mods & LockMask) != 0) != (caps != 0)) {
+		affect |= LockMask;
+		if (caps) values |= LockMask;
+	}
+	if (num_mask && ((state.locked_mods & num_mask) != 0) != (num != 0)) {
+		affect |= num_mask;
+		if (num) values |= num_mask;
+	}
+	if (!affect) return;
+
+	XkbLockModifiers(input_display, XkbUseCoreKbd, affect, values);
+}
+
+// The functions above only queue requests; input_flush sends them, so a
+// batch of events costs one write to the server.
+static void input_flush() {
+	if (input_display) XFlush(input_display);
+}
+
+static int input_is_dead() {
+	return input_display && input_dead;
 }
 
 static void input_destroy() {
+	if (input_display && !input_dead && spare_keycode) {
+		KeySym none = NoSymbol;
+		XChangeKeyboardMapping(input_display, spare_keycode, 1, &none, 1);
+	}
+	spare_keycode = 0;
+	memset(added_mods, 0, sizeof(added_mods));
 	if (input_display) {
 		XCloseDisplay(input_display);
 		input_display = NULL;
@@ -89,48 +218,174 @@ import "C"
 import (
 	"fmt"
 	"log"
+	"os/exec"
 	"strings"
+	"time"
+	"unicode/utf8"
 	"unsafe"
 
 	"bunghole/internal/types"
 )
 
-type InputHandler struct{}
+type InputHandler struct {
+	display string
+	level3  bool            // AltGr held on the client
+	down    map[string]uint // code -> keysym injected on keydown, reused for keyup
+	retryAt time.Time       // next reconnect attempt after the X server went away
+}
+
+var keyboardLayout string
+
+// captureRegion mirrors capture.SetCaptureRegion so pointer coordinates,
+// which are relative to the streamed video, land on the captured region.
+var captureRegion struct{ X, Y, W, H int }
+
+// SetCaptureRegion tells input injection that the stream shows only the
+// w x h region at (x, y) of the screen. A zero size means the whole screen.
+func SetCaptureRegion(x, y, w, h int) {
+	captureRegion.X, captureRegion.Y = x, y
+	captureRegion.W, captureRegion.H = w, h
+}
+
+// regionOrigin, if set, gives the capture region's current origin in
+// place of captureRegion.X/Y, for a region that moves.
+var regionOrigin func() (x, y int)
+
+// SetCaptureRegionOrigin makes pointer input follow a capture region that
+// moves (capture.SetFollowCursor): origin returns where the region is now.
+// Its size is still set with SetCaptureRegion.
+func SetCaptureRegionOrigin(origin func() (x, y int)) {
+	regionOrigin = origin
+}
+
+// SetKeyboardLayout sets an XKB layout (e.g. "us", "de") to apply to the
+// target display whenever an input handler is created, so keysym-based
+// injection behaves the same regardless of the host's configured layout.
+// Empty leaves the display's layout untouched.
+func SetKeyboardLayout(layout string) {
+	keyboardLayout = layout
+}
 
 func NewInputHandler(displayName string) (types.EventInjector, error) {
+	if keyboardLayout != "" {
+		applyKeyboardLayout(displayName, keyboardLayout)
+	}
+
 	cDisplay := C.CString(displayName)
 	defer C.free(unsafe.Pointer(cDisplay))
 
 	if C.input_init(cDisplay) != 0 {
 		return nil, fmt.Errorf("failed to open display for input: %s", displayName)
 	}
-	return &InputHandler{}, nil
+	return &InputHandler{display: displayName, down: make(map[string]uint)}, nil
+}
+
+// reconnect reopens the display after the X server went away (e.g. it
+// was restarted), at most once a second. Keys held on the old server are
+// forgotten, and the keyboard layout is applied again to the new one.
+func (ih *InputHandler) reconnect() {
+	now := time.Now()
+	if now.Before(ih.retryAt) {
+		return
+	}
+	if ih.retryAt.IsZero() {
+		log.Printf("input: X display %s lost, reconnecting", ih.display)
+	}
+	ih.retryAt = now.Add(time.Second)
+
+	cDisplay := C.CString(ih.display)
+	defer C.free(unsafe.Pointer(cDisplay))
+	C.input_destroy()
+	if C.input_init(cDisplay) != 0 {
+		return
+	}
+	if keyboardLayout != "" {
+		applyKeyboardLayout(ih.display, keyboardLayout)
+	}
+	ih.level3 = false
+	clear(ih.down)
+	ih.retryAt = time.Time{}
+	log.Printf("input: reconnected to X display %s", ih.display)
+}
+
+// applyKeyboardLayout runs setxkbmap against the display. Failure is
+// logged but not fatal: input still works with the existing layout.
+func applyKeyboardLayout(displayName, layout string) {
+	out, err := exec.Command("setxkbmap", "-display", displayName, layout).CombinedOutput()
+	if err != nil {
+		log.Printf("input: setxkbmap %s on %s failed: %v: %s", layout, displayName, err, strings.TrimSpace(string(out)))
+		return
+	}
+	log.Printf("input: keyboard layout set to %s on %s", layout, displayName)
 }
 
 func (ih *InputHandler) Inject(event types.InputEvent) {
+	ih.inject(event)
+	C.input_flush()
+}
+
+// InjectBatch injects events in order and flushes them to the X server
+// together.
+func (ih *InputHandler) InjectBatch(events []types.InputEvent) {
+	for _, event := range events {
+		ih.inject(event)
+	}
+	C.input_flush()
+}
+
+func (ih *InputHandler) inject(event types.InputEvent) {
+	if C.input_is_dead() != 0 || !ih.retryAt.IsZero() {
+		ih.reconnect()
+	}
 	switch event.Type {
 	case "mousemove":
 		if event.Relative {
 			C.input_mouse_move_rel(C.int(event.X), C.int(event.Y))
 		} else {
-			C.input_mouse_move_abs(C.int(event.X), C.int(event.Y))
+			x, y := event.Position(streamSize())
+			ox, oy := captureRegion.X, captureRegion.Y
+			if regionOrigin != nil {
+				ox, oy = regionOrigin()
+			}
+			C.input_mouse_move_abs(C.int(x)+C.int(ox), C.int(y)+C.int(oy))
 		}
 	case "mousedown":
-		C.input_mouse_button(C.int(jsButtonToX11(event.Button)), C.int(1))
+		if b := jsButtonToX11(event.Button); b != 0 {
+			C.input_mouse_button(C.int(b), C.int(1))
+		}
 	case "mouseup":
-		C.input_mouse_button(C.int(jsButtonToX11(event.Button)), C.int(0))
+		if b := jsButtonToX11(event.Button); b != 0 {
+			C.input_mouse_button(C.int(b), C.int(0))
+		}
 	case "wheel":
-		C.input_mouse_scroll(C.double(event.DX), C.double(event.DY))
+		dx, dy := event.WheelDelta(streamSize())
+		C.input_mouse_scroll(C.double(dx), C.double(dy))
 	case "keydown":
-		keysym := codeToKeysym(event.Code, event.Key)
+		keysym := codeToKeysym(event.Code, event.Key, ih.level3)
+		if keysym == XK_ISO_Level3_Shift {
+			ih.level3 = true
+		}
 		if keysym != 0 {
+			ih.down[event.Code] = keysym
 			C.input_key(C.uint(keysym), C.int(1))
 		}
 	case "keyup":
-		keysym := codeToKeysym(event.Code, event.Key)
+		// Release what was pressed: the key may report a different
+		// character on release (e.g. AltGr let go first).
+		keysym, ok := ih.down[event.Code]
+		if ok {
+			delete(ih.down, event.Code)
+		} else {
+			keysym = codeToKeysym(event.Code, event.Key, ih.level3)
+		}
+		if keysym == XK_ISO_Level3_Shift {
+			ih.level3 = false
+		}
 		if keysym != 0 {
 			C.input_key(C.uint(keysym), C.int(0))
 		}
+	case "setlock":
+		C.input_set_locks(cBool(event.CapsLock), cBool(event.NumLock))
 	}
 }
 
@@ -138,6 +393,33 @@ func (ih *InputHandler) Close() {
 	C.input_destroy()
 }
 
+func cBool(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// screenSize returns the size of the X screen input is injected into,
+// used to scale normalized coordinates.
+func screenSize() (int, int) {
+	var w, h C.int
+	C.input_screen_size(&w, &h)
+	return int(w), int(h)
+}
+
+// streamSize returns the size of the streamed area: the capture region if
+// one is set, otherwise the whole screen.
+func streamSize() (int, int) {
+	if captureRegion.W > 0 && captureRegion.H > 0 {
+		return captureRegion.W, captureRegion.H
+	}
+	return screenSize()
+}
+
+// jsButtonToX11 maps a MouseEvent.button value to an X11 button number.
+// X11 buttons 4-7 are scroll, so the thumb buttons land on 8/9.
+// Returns 0 for buttons with no mapping.
 func jsButtonToX11(button int) int {
 	switch button {
 	case 0:
@@ -146,12 +428,32 @@ func jsButtonToX11(button int) int {
 		return 2 // Middle
 	case 2:
 		return 3 // Right
+	case 3:
+		return 8 // Back
+	case 4:
+		return 9 // Forward
 	default:
-		return 1
+		log.Printf("input: unmapped mouse button %d", button)
+		return 0
 	}
 }
 
-func codeToKeysym(code, key string) uint {
+func codeToKeysym(code, key string, level3 bool) uint {
+	switch key {
+	case "AltGraph":
+		return XK_ISO_Level3_Shift
+	case "Dead":
+		// The composed character arrives with the next key event
+		return 0
+	}
+
+	// Characters typed with AltGr, or outside ASCII (AltGr/dead-key
+	// compositions), are injected by character so the server keymap
+	// picks the right keycode and level.
+	if r, ok := singleRune(key); ok && r >= 0x20 && (level3 || r > 0x7E) {
+		return runeToKeysym(r)
+	}
+
 	// First try the code-based mapping (physical key position)
 	if ks, ok := codeMap[code]; ok {
 		return ks
@@ -174,6 +476,27 @@ func codeToKeysym(code, key string) uint {
 	return 0
 }
 
+func singleRune(s string) (rune, bool) {
+	r, size := utf8.DecodeRuneInString(s)
+	if r == utf8.RuneError || size != len(s) {
+		return 0, false
+	}
+	return r, true
+}
+
+// runeToKeysym converts a Unicode character to an X11 keysym: Latin-1
+// maps directly, everything else uses the 0x01000000 Unicode range.
+func runeToKeysym(r rune) uint {
+	switch {
+	case r <= 0xFF:
+		return uint(r)
+	case r == 0x20AC:
+		return XK_EuroSign
+	default:
+		return 0x01000000 | uint(r)
+	}
+}
+
 // X11 keysym constants
 const (
 	XK_BackSpace   = 0xFF08
@@ -217,6 +540,9 @@ const (
 	XK_Pause       = 0xFF13
 	XK_Num_Lock    = 0xFF7F
 	XK_Menu        = 0xFF67
+
+	XK_ISO_Level3_Shift = 0xFE03
+	XK_EuroSign         = 0x20AC
 )
 
 var codeMap = map[string]uint{
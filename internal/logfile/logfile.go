@@ -0,0 +1,119 @@
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Writer is an io.Writer that appends to a file and rotates it when it
+// grows past a size limit: path is renamed to path.1, path.1 to path.2 and
+// so on, keeping at most Keep old files.
+type Writer struct {
+	path     string
+	maxBytes int64
+	keep     int
+
+	mu        sync.Mutex
+	f         *os.File
+	size      int64
+	redirects []int // fds re-pointed at the current file on every rotation
+}
+
+// Open opens (or creates) the log file at path. maxBytes <= 0 disables
+// rotation.
+func Open(path string, maxBytes int64, keep int) (*Writer, error) {
+	w := &Writer{path: path, maxBytes: maxBytes, keep: keep}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat log file: %w", err)
+	}
+	w.f = f
+	w.size = st.Size()
+	return nil
+}
+
+// RedirectFD points fd (e.g. 2 for stderr) at the log file, so output
+// written directly by C code ends up in the same place. The redirect
+// follows the file across rotations.
+func (w *Writer) RedirectFD(fd int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := unix.Dup2(int(w.f.Fd()), fd); err != nil {
+		return fmt.Errorf("redirect fd %d: %w", fd, err)
+	}
+	w.redirects = append(w.redirects, fd)
+	return nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.redirects) > 0 {
+		// Redirected fds write to the file behind our back.
+		if st, err := w.f.Stat(); err == nil {
+			w.size = st.Size()
+		}
+	}
+	if w.maxBytes > 0 && w.size+int64(len(p)) > w.maxBytes && w.size > 0 {
+		if err := w.rotateLocked(); err != nil {
+			// Keep logging to the old file rather than losing output.
+			fmt.Fprintf(w.f, "log rotation failed: %v\n", err)
+		}
+	}
+
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotateLocked shifts the old files up by one and starts a new file.
+// Must be called with w.mu held.
+func (w *Writer) rotateLocked() error {
+	if w.keep <= 0 {
+		os.Remove(w.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", w.path, w.keep))
+		for i := w.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			return err
+		}
+	}
+
+	old := w.f
+	if err := w.open(); err != nil {
+		return err
+	}
+	old.Close()
+
+	for _, fd := range w.redirects {
+		if err := unix.Dup2(int(w.f.Fd()), fd); err != nil {
+			return fmt.Errorf("redirect fd %d: %w", fd, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the current log file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
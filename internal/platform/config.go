@@ -4,17 +4,25 @@ import "net"
 
 // Config holds all platform-related configuration passed from CLI flags.
 type Config struct {
-	Display    string
-	GPU        int
-	StartX     bool   // Linux: start a headless Xorg server
-	Resolution string // Linux: screen resolution for headless X
-	User       string // Linux: run desktop session as this user (with --start-x)
-	VM              bool   // macOS: run a Virtualization.framework VM
-	VMShare         string // macOS: directory to share with VM via VirtioFS
-	VMWidth         int    // macOS: VM display width in pixels
-	VMHeight        int    // macOS: VM display height in pixels
-	VMAudioPassthru bool   // macOS: pass guest audio through to host speakers
-	DiskGB          int    // macOS: VM disk size in GB (used with setup)
+	Display            string
+	GPU                int
+	StartX             bool     // Linux: start a headless Xorg server
+	StartXvfb          bool     // Linux: start Xvfb instead of Xorg (no GPU needed)
+	Resolution         string   // Linux: screen resolution for headless X
+	Virtual            string   // Linux: framebuffer size for headless X (default: Resolution)
+	User               string   // Linux: run desktop session as this user (with --start-x)
+	AttachExisting     bool     // Linux: with StartX, capture Display if it is already running
+	VM                 bool     // macOS: run a Virtualization.framework VM
+	VMShare            []string // macOS: directories to share with VM via VirtioFS, each DIR or TAG=DIR
+	VMName             string   // macOS: named VM bundle to run or set up; empty = the default VM
+	VMNetwork          string   // macOS: guest networking, "nat", "bridged" or "bridged:IFACE"
+	VMWidth            int      // macOS: VM display width in pixels
+	VMHeight           int      // macOS: VM display height in pixels
+	VMAudioPassthru    bool     // macOS: pass guest audio through to host speakers
+	DiskGB             int      // macOS: VM disk size in GB (used with setup)
+	VsockAudioPort     uint32   // macOS VM: vsock port the guest sends audio to
+	VsockClipboardPort uint32   // macOS VM: vsock port for clipboard sync
+	VsockMuxPort       uint32   // macOS VM: vsock port for audio+clipboard on one connection, 0 = off
 
 	VsockAudioCh <-chan net.Conn // macOS VM: vsock audio connections from guest
 }
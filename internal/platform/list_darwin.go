@@ -0,0 +1,23 @@
+//go:build darwin
+
+package platform
+
+import "bunghole/internal/capture"
+
+// Inventory is what `bunghole list` reports: the displays and windows
+// ScreenCaptureKit can capture.
+type Inventory struct {
+	Displays []capture.DisplayInfo `json:"displays"`
+	Windows  []capture.WindowInfo  `json:"windows"`
+	Error    string                `json:"error,omitempty"` // e.g. screen recording permission denied
+}
+
+// List asks ScreenCaptureKit for the shareable displays and windows.
+func List() Inventory {
+	displays, windows, err := capture.ListShareable()
+	inv := Inventory{Displays: displays, Windows: windows}
+	if err != nil {
+		inv.Error = err.Error()
+	}
+	return inv
+}
@@ -0,0 +1,25 @@
+//go:build linux
+
+package platform
+
+import "bunghole/internal/xserver"
+
+// Inventory is what `bunghole list` reports: the values --display, --gpu
+// and --encode-gpu can take.
+type Inventory struct {
+	Displays []xserver.DisplayInfo `json:"displays"`
+	GPUs     []xserver.GPUInfo     `json:"gpus"`
+	GPUError string                `json:"gpu_error,omitempty"` // nvidia-smi missing or failed
+}
+
+// List detects the X displays and NVIDIA GPUs on this machine.
+func List() Inventory {
+	inv := Inventory{Displays: xserver.ListDisplays(), GPUs: []xserver.GPUInfo{}}
+	gpus, err := xserver.ListGPUs()
+	if err != nil {
+		inv.GPUError = err.Error()
+	} else {
+		inv.GPUs = gpus
+	}
+	return inv
+}
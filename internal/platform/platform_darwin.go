@@ -6,23 +6,35 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
+	"bunghole/internal/capture"
 	"bunghole/internal/vm"
+	"bunghole/internal/vsockmux"
 )
 
 func Init(cfg *Config) (func(), error) {
 	if cfg.VM {
-		path := vm.BundlePath()
+		path := vm.BundlePath(cfg.VMName)
 		if !vm.BundleExists(path) {
 			if err := vm.AutoProvision(path); err != nil {
 				return nil, fmt.Errorf("VM setup failed: %v", err)
 			}
 		}
-		sharedDir := cfg.VMShare
-		if sharedDir == "" {
-			sharedDir, _ = os.UserHomeDir()
+		specs := cfg.VMShare
+		if len(specs) == 0 {
+			home, _ := os.UserHomeDir()
+			specs = []string{home}
 		}
-		mgr, err := vm.NewVMManager(path, sharedDir, cfg.VMWidth, cfg.VMHeight, cfg.VMAudioPassthru)
+		shares, err := vm.ParseShares(specs)
+		if err != nil {
+			return nil, fmt.Errorf("--vm-share: %v", err)
+		}
+		network, err := vm.ParseNetwork(cfg.VMNetwork)
+		if err != nil {
+			return nil, fmt.Errorf("--vm-network: %v", err)
+		}
+		mgr, err := vm.NewVMManager(path, shares, cfg.VMWidth, cfg.VMHeight, cfg.VMAudioPassthru, network)
 		if err != nil {
 			return nil, fmt.Errorf("VM create failed: %v", err)
 		}
@@ -30,28 +42,50 @@ func Init(cfg *Config) (func(), error) {
 			return nil, fmt.Errorf("VM start failed: %v", err)
 		}
 		vm.SetGlobal(mgr)
+		if cfg.Display != "" && cfg.Display != "vm" {
+			log.Printf("warning: --display %s ignored, --vm streams the VM's display", cfg.Display)
+		}
 		cfg.Display = "vm"
 
-		connCh, err := vm.StartVsockListener(mgr.VMPtr(), 5000)
+		connCh, err := vm.StartVsockListener(mgr.VMPtr(), cfg.VsockAudioPort)
 		if err != nil {
 			log.Printf("vsock audio listener failed: %v", err)
 		} else {
 			cfg.VsockAudioCh = connCh
-			log.Printf("vsock audio listener started on port 5000")
+			log.Printf("vsock audio listener started on port %d", cfg.VsockAudioPort)
 		}
 
-		clipCh, err := vm.StartVsockListener(mgr.VMPtr(), 5002)
+		clipCh, err := vm.StartVsockListener(mgr.VMPtr(), cfg.VsockClipboardPort)
 		if err != nil {
 			log.Printf("vsock clipboard listener failed: %v", err)
 		} else {
 			mgr.SetVsockClipCh(clipCh)
-			log.Printf("vsock clipboard listener started on port 5002")
+			log.Printf("vsock clipboard listener started on port %d", cfg.VsockClipboardPort)
+		}
+
+		if cfg.VsockMuxPort != 0 {
+			routes := map[byte]uint32{
+				vsockmux.StreamAudio:     cfg.VsockAudioPort,
+				vsockmux.StreamClipboard: cfg.VsockClipboardPort,
+			}
+			if err := vm.StartVsockMux(mgr.VMPtr(), cfg.VsockMuxPort, routes); err != nil {
+				log.Printf("vsock mux listener failed: %v", err)
+			} else {
+				log.Printf("vsock mux listener started on port %d", cfg.VsockMuxPort)
+			}
 		}
 
-		log.Printf("VM running (bundle: %s, shared: %s)", path, sharedDir)
+		dirs := make([]string, len(shares))
+		for i, s := range shares {
+			dirs[i] = s.Dir
+		}
+		log.Printf("VM running (bundle: %s, shared: %s)", path, strings.Join(dirs, ", "))
 		return func() {
-			vm.StopVsockListener(mgr.VMPtr(), 5002)
-			vm.StopVsockListener(mgr.VMPtr(), 5000)
+			if cfg.VsockMuxPort != 0 {
+				vm.StopVsockListener(mgr.VMPtr(), cfg.VsockMuxPort)
+			}
+			vm.StopVsockListener(mgr.VMPtr(), cfg.VsockClipboardPort)
+			vm.StopVsockListener(mgr.VMPtr(), cfg.VsockAudioPort)
 			mgr.Stop()
 		}, nil
 	}
@@ -59,6 +93,9 @@ func Init(cfg *Config) (func(), error) {
 	if cfg.Display == "" {
 		cfg.Display = "main"
 	}
+	if _, err := capture.ParseDisplay(cfg.Display); err != nil {
+		return nil, fmt.Errorf("--display: %v", err)
+	}
 	return func() {}, nil
 }
 
@@ -72,5 +109,5 @@ func VMNSAppRun() { vm.NSAppRun() }
 func VMNSAppStop() { vm.NSAppStop() }
 
 func RunSetup(cfg *Config) {
-	vm.RunSetup(cfg.DiskGB)
+	vm.RunSetup(cfg.VMName, cfg.DiskGB)
 }
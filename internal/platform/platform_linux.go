@@ -12,33 +12,61 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// Init picks the X display to capture. In order of precedence:
+//
+//   - --start-x with --attach-existing: the --display (or $DISPLAY) X server
+//     if it answers, otherwise a new one as below
+//   - --start-x: a new Xorg and desktop session, ignoring --display
+//   - --start-xvfb: the same with Xvfb in place of Xorg
+//   - --display, or else $DISPLAY
+//   - neither set: a new Xorg and desktop session
 func Init(cfg *Config) (func(), error) {
-	if cfg.StartX || cfg.Display == "" {
-		if cfg.Display == "" {
-			cfg.Display = os.Getenv("DISPLAY")
+	startX := cfg.StartX || cfg.StartXvfb
+	if cfg.Display == "" {
+		cfg.Display = os.Getenv("DISPLAY")
+	}
+	if cfg.Display == "" {
+		startX = true
+	} else if startX && cfg.AttachExisting {
+		if xserver.Reachable(cfg.Display) {
+			log.Printf("attaching to running X server on %s instead of starting one", cfg.Display)
+			startX = false
+		} else {
+			log.Printf("no X server answering on %s, starting one", cfg.Display)
 		}
+	}
 
-		if cfg.Display == "" || cfg.StartX {
-			xs, err := xserver.StartXServer(cfg.Resolution, cfg.GPU)
-			if err != nil {
-				return nil, fmt.Errorf("failed to start X server: %v", err)
-			}
-			cfg.Display = xs.Display
-			os.Setenv("DISPLAY", cfg.Display)
-			os.Setenv("XAUTHORITY", xs.Xauthority)
-
-			if err := xs.StartDesktopSession(cfg.Resolution, cfg.User); err != nil {
-				log.Printf("warning: failed to start desktop session: %v", err)
-				log.Printf("X server is running on %s but no desktop — you may want to start one manually", cfg.Display)
+	if startX {
+		start := func() (*xserver.XServer, error) {
+			return xserver.StartXServer(cfg.Resolution, cfg.Virtual, cfg.GPU)
+		}
+		if cfg.StartXvfb {
+			start = func() (*xserver.XServer, error) {
+				return xserver.StartXvfb(cfg.Resolution, cfg.Virtual)
 			}
+		}
+		xs, err := start()
+		if err != nil {
+			return nil, fmt.Errorf("failed to start X server: %v", err)
+		}
+		cfg.Display = xs.Display
+		os.Setenv("DISPLAY", cfg.Display)
+		os.Setenv("XAUTHORITY", xs.Xauthority)
 
-			if xs.PulseServer != "" {
-				os.Setenv("PULSE_SERVER", xs.PulseServer)
-				log.Printf("audio: using %s", xs.PulseServer)
-			}
+		if err := xs.StartDesktopSession(cfg.Resolution, cfg.User); err != nil {
+			log.Printf("warning: failed to start desktop session: %v", err)
+			log.Printf("X server is running on %s but no desktop — you may want to start one manually", cfg.Display)
+		}
 
-			return func() { xs.Stop() }, nil
+		if xs.PulseServer != "" {
+			os.Setenv("PULSE_SERVER", xs.PulseServer)
+			log.Printf("audio: using %s", xs.PulseServer)
 		}
+
+		return func() { xs.Stop() }, nil
+	}
+	if cfg.User != "" {
+		log.Printf("warning: --user only applies to a desktop session started with --start-x; ignoring it for %s", cfg.Display)
 	}
 	return func() {}, nil
 }
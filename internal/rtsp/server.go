@@ -0,0 +1,345 @@
+// Package rtsp serves the pipeline's encoded video and Opus audio over
+// RTSP, so NVRs and standard players can consume bunghole like a camera.
+package rtsp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v5"
+	"github.com/bluenviron/gortsplib/v5/pkg/base"
+	"github.com/bluenviron/gortsplib/v5/pkg/description"
+	"github.com/bluenviron/gortsplib/v5/pkg/format"
+	"github.com/bluenviron/gortsplib/v5/pkg/format/rtpsimpleaudio"
+	"github.com/bluenviron/gortsplib/v5/pkg/liberrors"
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h265"
+	"github.com/pion/rtp"
+)
+
+// User is the RTSP username; the password is the server token.
+const User = "bunghole"
+
+// Config configures an RTSP server.
+type Config struct {
+	Addr  string // listen address, e.g. ":8554"
+	Codec string // "h264" or "h265", matching the video encoder
+	Token string // required password for readers
+
+	// OnPlay is called when a reader starts playing; returning an error
+	// rejects it, with 503 Service Unavailable unless it is a *PlayError.
+	// OnStop is called once for every successful OnPlay.
+	// Used to keep the capture/encode pipeline running while read.
+	OnPlay func() error
+	OnStop func()
+
+	// RequestKeyframe, if set, asks the encoder for a keyframe. It is
+	// called when a reader joins, which can't start decoding until one.
+	RequestKeyframe func()
+}
+
+// PlayError is returned by OnPlay to reject a reader with a particular
+// status.
+type PlayError struct {
+	Status     int // RTSP status code, e.g. 500
+	RetryAfter int // seconds, sent as Retry-After; 0 = none
+	Err        error
+}
+
+func (e *PlayError) Error() string { return e.Err.Error() }
+func (e *PlayError) Unwrap() error { return e.Err }
+
+type videoEncoder interface {
+	Encode(au [][]byte) ([]*rtp.Packet, error)
+}
+
+// Server is an RTSP server with a single stream at any path.
+type Server struct {
+	cfg Config
+
+	srv    *gortsplib.Server
+	stream *gortsplib.ServerStream
+	video  *description.Media
+	audio  *description.Media
+	start  time.Time
+
+	h264Fmt *format.H264
+	h265Fmt *format.H265
+
+	// Only touched by the pipeline (video) and audio goroutines respectively.
+	videoEnc videoEncoder
+	audioEnc *rtpsimpleaudio.Encoder
+
+	synced atomic.Bool // a keyframe has been written since the last Resync
+
+	mu      sync.Mutex
+	playing map[*gortsplib.ServerSession]struct{}
+	joining map[*gortsplib.ServerConn]struct{} // PLAY accepted, response not yet sent
+}
+
+// NewServer starts an RTSP server. Readers connect with
+// rtsp://bunghole:<token>@host<addr>/ (TCP interleaved transport).
+func NewServer(cfg Config) (*Server, error) {
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("rtsp requires a token")
+	}
+
+	s := &Server{
+		cfg:     cfg,
+		start:   time.Now(),
+		playing: make(map[*gortsplib.ServerSession]struct{}),
+		joining: make(map[*gortsplib.ServerConn]struct{}),
+	}
+
+	var videoFmt format.Format
+	if cfg.Codec == "h265" {
+		s.h265Fmt = &format.H265{PayloadTyp: 97}
+		enc, err := s.h265Fmt.CreateEncoder()
+		if err != nil {
+			return nil, fmt.Errorf("rtsp h265 encoder: %w", err)
+		}
+		s.videoEnc = enc
+		videoFmt = s.h265Fmt
+	} else {
+		s.h264Fmt = &format.H264{PayloadTyp: 96, PacketizationMode: 1}
+		enc, err := s.h264Fmt.CreateEncoder()
+		if err != nil {
+			return nil, fmt.Errorf("rtsp h264 encoder: %w", err)
+		}
+		s.videoEnc = enc
+		videoFmt = s.h264Fmt
+	}
+
+	opusFmt := &format.Opus{PayloadTyp: 111, ChannelCount: 2}
+	audioEnc, err := opusFmt.CreateEncoder()
+	if err != nil {
+		return nil, fmt.Errorf("rtsp opus encoder: %w", err)
+	}
+	s.audioEnc = audioEnc
+
+	s.video = &description.Media{Type: description.MediaTypeVideo, Formats: []format.Format{videoFmt}}
+	s.audio = &description.Media{Type: description.MediaTypeAudio, Formats: []format.Format{opusFmt}}
+
+	s.srv = &gortsplib.Server{
+		Handler:     s,
+		RTSPAddress: cfg.Addr,
+	}
+	if err := s.srv.Start(); err != nil {
+		return nil, fmt.Errorf("rtsp listen %s: %w", cfg.Addr, err)
+	}
+
+	s.stream = &gortsplib.ServerStream{
+		Server: s.srv,
+		Desc:   &description.Session{Medias: []*description.Media{s.video, s.audio}},
+	}
+	if err := s.stream.Initialize(); err != nil {
+		s.srv.Close()
+		return nil, fmt.Errorf("rtsp stream: %w", err)
+	}
+
+	log.Printf("rtsp: listening on %s (%s + opus)", cfg.Addr, cfg.Codec)
+	return s, nil
+}
+
+// Close stops the server and disconnects all readers.
+func (s *Server) Close() {
+	s.stream.Close()
+	s.srv.Close()
+}
+
+// Resync makes the next WriteVideo calls wait for a keyframe. Call it when
+// the pipeline (re)starts so readers never see a new encoder's P-frames
+// referencing the old one's pictures. It is also done whenever a reader
+// joins, as all readers share one stream.
+func (s *Server) Resync() {
+	s.synced.Store(false)
+}
+
+// WriteVideo sends one encoded Annex-B access unit to all readers.
+func (s *Server) WriteVideo(data []byte, isKey bool) {
+	if !s.synced.Load() {
+		if !isKey {
+			return
+		}
+		s.synced.Store(true)
+	}
+
+	var au h264.AnnexB
+	if err := au.Unmarshal(data); err != nil {
+		return
+	}
+	if isKey {
+		s.updateParams(au)
+	}
+
+	pkts, err := s.videoEnc.Encode(au)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	ts := s.timestamp(now, 90000)
+	for _, pkt := range pkts {
+		pkt.Timestamp = ts
+		s.stream.WritePacketRTPWithNTP(s.video, pkt, now)
+	}
+}
+
+// WriteAudio sends one Opus packet to all readers.
+func (s *Server) WriteAudio(data []byte) {
+	pkt, err := s.audioEnc.Encode(data)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	pkt.Timestamp = s.timestamp(now, 48000)
+	s.stream.WritePacketRTPWithNTP(s.audio, pkt, now)
+}
+
+// timestamp converts wall-clock time to an RTP timestamp. Both tracks
+// share the same origin, so players can sync them from RTCP reports.
+func (s *Server) timestamp(now time.Time, clockRate int64) uint32 {
+	return uint32(int64(now.Sub(s.start)) * clockRate / int64(time.Second))
+}
+
+// updateParams copies parameter sets from a keyframe into the SDP, so
+// readers that DESCRIBE later can configure their decoder up front.
+func (s *Server) updateParams(au [][]byte) {
+	if s.h264Fmt != nil {
+		sps, pps := s.h264Fmt.SafeParams()
+		for _, nalu := range au {
+			if len(nalu) == 0 {
+				continue
+			}
+			switch h264.NALUType(nalu[0] & 0x1f) {
+			case h264.NALUTypeSPS:
+				sps = nalu
+			case h264.NALUTypePPS:
+				pps = nalu
+			}
+		}
+		oldSPS, oldPPS := s.h264Fmt.SafeParams()
+		if !bytes.Equal(sps, oldSPS) || !bytes.Equal(pps, oldPPS) {
+			s.h264Fmt.SafeSetParams(sps, pps)
+		}
+		return
+	}
+
+	vps, sps, pps := s.h265Fmt.SafeParams()
+	oldVPS, oldSPS, oldPPS := vps, sps, pps
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch h265.NALUType((nalu[0] >> 1) & 0x3f) {
+		case h265.NALUType_VPS_NUT:
+			vps = nalu
+		case h265.NALUType_SPS_NUT:
+			sps = nalu
+		case h265.NALUType_PPS_NUT:
+			pps = nalu
+		}
+	}
+	if !bytes.Equal(vps, oldVPS) || !bytes.Equal(sps, oldSPS) || !bytes.Equal(pps, oldPPS) {
+		s.h265Fmt.SafeSetParams(vps, sps, pps)
+	}
+}
+
+func (s *Server) authorize(conn *gortsplib.ServerConn, req *base.Request) (*base.Response, error) {
+	if !conn.VerifyCredentials(req, User, s.cfg.Token) {
+		return &base.Response{StatusCode: base.StatusUnauthorized}, liberrors.ErrServerAuth{}
+	}
+	return nil, nil
+}
+
+// OnDescribe implements gortsplib.ServerHandlerOnDescribe.
+func (s *Server) OnDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	if resp, err := s.authorize(ctx.Conn, ctx.Request); err != nil {
+		return resp, nil, err
+	}
+	return &base.Response{StatusCode: base.StatusOK}, s.stream, nil
+}
+
+// OnSetup implements gortsplib.ServerHandlerOnSetup.
+func (s *Server) OnSetup(ctx *gortsplib.ServerHandlerOnSetupCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	if resp, err := s.authorize(ctx.Conn, ctx.Request); err != nil {
+		return resp, nil, err
+	}
+	return &base.Response{StatusCode: base.StatusOK}, s.stream, nil
+}
+
+// OnPlay implements gortsplib.ServerHandlerOnPlay.
+func (s *Server) OnPlay(ctx *gortsplib.ServerHandlerOnPlayCtx) (*base.Response, error) {
+	s.mu.Lock()
+	_, already := s.playing[ctx.Session]
+	s.mu.Unlock()
+
+	if !already && s.cfg.OnPlay != nil {
+		if err := s.cfg.OnPlay(); err != nil {
+			log.Printf("rtsp: reader %s rejected: %v", ctx.Conn.NetConn().RemoteAddr(), err)
+			return playErrorResponse(err), err
+		}
+	}
+
+	s.mu.Lock()
+	s.playing[ctx.Session] = struct{}{}
+	if !already {
+		s.joining[ctx.Conn] = struct{}{}
+	}
+	s.mu.Unlock()
+
+	log.Printf("rtsp: reader %s playing", ctx.Conn.NetConn().RemoteAddr())
+	return &base.Response{StatusCode: base.StatusOK}, nil
+}
+
+// playErrorResponse is the response rejecting a reader for an OnPlay error.
+func playErrorResponse(err error) *base.Response {
+	res := &base.Response{StatusCode: base.StatusServiceUnavailable}
+	var pe *PlayError
+	if errors.As(err, &pe) {
+		res.StatusCode = base.StatusCode(pe.Status)
+		if pe.RetryAfter > 0 {
+			res.Header = base.Header{"Retry-After": base.HeaderValue{strconv.Itoa(pe.RetryAfter)}}
+		}
+	}
+	return res
+}
+
+// OnResponse implements gortsplib.ServerHandlerOnResponse. A reader that
+// joins gets P-frames it can't decode until the next keyframe, which may
+// be a whole GOP away, so one is requested and video held back for
+// everyone until it arrives. That waits for the PLAY response, as only
+// then is the reader receiving: a keyframe sent before would be lost on it.
+func (s *Server) OnResponse(conn *gortsplib.ServerConn, res *base.Response) {
+	s.mu.Lock()
+	_, joined := s.joining[conn]
+	delete(s.joining, conn)
+	s.mu.Unlock()
+
+	if joined && res.StatusCode == base.StatusOK {
+		s.Resync()
+		if s.cfg.RequestKeyframe != nil {
+			s.cfg.RequestKeyframe()
+		}
+	}
+}
+
+// OnSessionClose implements gortsplib.ServerHandlerOnSessionClose.
+func (s *Server) OnSessionClose(ctx *gortsplib.ServerHandlerOnSessionCloseCtx) {
+	s.mu.Lock()
+	_, wasPlaying := s.playing[ctx.Session]
+	delete(s.playing, ctx.Session)
+	s.mu.Unlock()
+
+	if wasPlaying {
+		log.Printf("rtsp: reader stopped (%v)", ctx.Error)
+		if s.cfg.OnStop != nil {
+			s.cfg.OnStop()
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// webClient is a connected client like the web UI: receive-only video and
+// audio, and a signaling channel that answers the server's renegotiation
+// offers.
+type webClient struct {
+	pc       *webrtc.PeerConnection
+	signaled chan struct{}            // closed when the signaling channel opens
+	tracks   chan *webrtc.TrackRemote // remote tracks, as they arrive
+	offers   chan string              // renegotiation offers answered
+}
+
+// connectClient connects a webClient to a new session from handler.
+func connectClient(t *testing.T, handler http.HandlerFunc, path string) *webClient {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	c := &webClient{
+		pc:       pc,
+		signaled: make(chan struct{}),
+		tracks:   make(chan *webrtc.TrackRemote, 4),
+		offers:   make(chan string, 4),
+	}
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		c.tracks <- track
+	})
+
+	recvonly := webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err := pc.AddTransceiverFromKind(kind, recvonly); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sig, err := pc.CreateDataChannel("signaling", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig.OnOpen(func() { close(c.signaled) })
+	sig.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var m struct{ Type, SDP string }
+		if err := json.Unmarshal(msg.Data, &m); err != nil || m.Type != "offer" {
+			return
+		}
+		if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: m.SDP}); err != nil {
+			t.Errorf("renegotiation offer: %v", err)
+			return
+		}
+		answer, err := pc.CreateAnswer(nil)
+		if err != nil {
+			t.Errorf("renegotiation answer: %v", err)
+			return
+		}
+		gathered := webrtc.GatheringCompletePromise(pc)
+		if err := pc.SetLocalDescription(answer); err != nil {
+			t.Errorf("renegotiation answer: %v", err)
+			return
+		}
+		<-gathered
+		data, _ := json.Marshal(map[string]string{"type": "answer", "sdp": pc.LocalDescription().SDP})
+		sig.SendText(string(data))
+		c.offers <- m.SDP
+	})
+
+	o, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(o); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	id, w := offer(handler, path, pc.LocalDescription().SDP)
+	if id == "" {
+		t.Fatalf("offer: %d %s", w.Code, w.Body)
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: w.Body.String()}); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// wait returns the next value from ch, failing the test after a few
+// seconds.
+func wait[T any](t *testing.T, what string, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+		panic("unreachable")
+	}
+}
+
+// Audio that can't be captured when sessions connect is retried, and
+// sessions already connected get the track through renegotiation.
+func TestLateAudioRenegotiates(t *testing.T) {
+	dev := newFakeDevices()
+	dev.audioErrs = 1 << 30
+	s := newTestServer(t, dev, Config{AudioRetry: 10 * time.Millisecond})
+
+	ctrl := connectClient(t, s.handleWHEPOffer, "/whep")
+	viewer := connectClient(t, s.handleViewerOffer, "/whep/view")
+	for _, c := range []*webClient{ctrl, viewer} {
+		if kind := wait(t, "the video track", c.tracks).Kind(); kind != webrtc.RTPCodecTypeVideo {
+			t.Fatalf("first track is %s, want video", kind)
+		}
+		wait(t, "the signaling channel", c.signaled)
+	}
+
+	dev.mu.Lock()
+	dev.audioErrs = 0
+	dev.mu.Unlock()
+
+	for _, c := range []*webClient{ctrl, viewer} {
+		sdp := wait(t, "a renegotiation offer", c.offers)
+		if i := strings.Index(sdp, "m=audio"); i < 0 || !strings.Contains(sdp[i:], "a=sendonly") {
+			t.Errorf("renegotiation offer doesn't send audio:\n%s", sdp)
+		}
+		if kind := wait(t, "the audio track", c.tracks).Kind(); kind != webrtc.RTPCodecTypeAudio {
+			t.Errorf("renegotiated track is %s, want audio", kind)
+		}
+	}
+}
+
+// Frames skipped by Opus DTX leave a gap in RTP timestamps only: a gap in
+// sequence numbers would tell the receiver packets were lost.
+func TestAudioDTXKeepsSequenceNumbers(t *testing.T) {
+	dev := newFakeDevices()
+	dev.audioSkipped = 5
+	s := newTestServer(t, dev, Config{})
+
+	c := connectClient(t, s.handleViewerOffer, "/whep/view")
+	var audio *webrtc.TrackRemote
+	for audio == nil {
+		if track := wait(t, "the audio track", c.tracks); track.Kind() == webrtc.RTPCodecTypeAudio {
+			audio = track
+		}
+	}
+
+	var last *rtp.Packet
+	for i := 0; i < 5; i++ {
+		pkt, _, err := audio.ReadRTP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last != nil {
+			if d := pkt.SequenceNumber - last.SequenceNumber; d != 1 {
+				t.Errorf("sequence number went up by %d, want 1", d)
+			}
+			if d := pkt.Timestamp - last.Timestamp; d != 6*960 {
+				t.Errorf("timestamp went up by %d, want %d (a frame and 5 skipped)", d, 6*960)
+			}
+		}
+		last = pkt
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"bunghole/internal/token"
+)
+
+// A --once token creates one session, and then only works for that
+// session's own requests.
+func TestOnceTokenSingleSession(t *testing.T) {
+	dev := newFakeDevices()
+	s := newTestServer(t, dev, Config{})
+	tok, err := token.Mint(testToken, time.Minute, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sdp := clientOffer(t, true)
+
+	// Refused for anything but creating a session until it has.
+	r := httptest.NewRequest("GET", "/status", nil)
+	r.Header.Set("Authorization", "Bearer "+tok)
+	w := httptest.NewRecorder()
+	s.handleStatus(w, r)
+	if w.Code != 401 {
+		t.Errorf("GET /status with an unused single-use token: %d, want 401", w.Code)
+	}
+
+	// An offer that fails leaves it unused, so the client can retry.
+	dev.mu.Lock()
+	dev.capErr = errors.New("cannot open display")
+	dev.mu.Unlock()
+	if _, w := offerWith(tok, s.handleWHEPOffer, "/whep", sdp); w.Code != 503 {
+		t.Fatalf("offer with no display: %d, want 503", w.Code)
+	}
+	dev.mu.Lock()
+	dev.capErr = nil
+	dev.mu.Unlock()
+
+	id, w := offerWith(tok, s.handleWHEPOffer, "/whep", sdp)
+	if id == "" {
+		t.Fatalf("first offer: %d %s", w.Code, w.Body)
+	}
+	other, w := offer(s.handleViewerOffer, "/whep/view", sdp)
+	if other == "" {
+		t.Fatalf("offer with the static token: %d %s", w.Code, w.Body)
+	}
+
+	for _, tc := range []struct {
+		what string
+		code int
+		try  func() int
+	}{
+		{"second controller offer", 401, func() int { _, w := offerWith(tok, s.handleWHEPOffer, "/whep", sdp); return w.Code }},
+		{"viewer offer", 401, func() int { _, w := offerWith(tok, s.handleViewerOffer, "/whep/view", sdp); return w.Code }},
+		{"refresh of another session", 401, func() int {
+			return sessionRequest(tok, "POST", s.handleViewerRefresh, "/whep/view/", other)
+		}},
+		{"DELETE of another session", 401, func() int {
+			return sessionRequest(tok, "DELETE", s.handleViewerDelete, "/whep/view/", other)
+		}},
+		{"refresh of its session", 204, func() int {
+			return sessionRequest(tok, "POST", s.handleWHEPRefresh, "/whep/", id)
+		}},
+		{"DELETE of its session", 204, func() int {
+			return sessionRequest(tok, "DELETE", s.handleWHEPDelete, "/whep/", id)
+		}},
+		{"offer after its session ended", 401, func() int { _, w := offerWith(tok, s.handleWHEPOffer, "/whep", sdp); return w.Code }},
+	} {
+		if code := tc.try(); code != tc.code {
+			t.Errorf("%s with a used single-use token: %d, want %d", tc.what, code, tc.code)
+		}
+	}
+}
+
+func TestReusableSignedToken(t *testing.T) {
+	dev := newFakeDevices()
+	s := newTestServer(t, dev, Config{})
+	tok, err := token.Mint(testToken, time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sdp := clientOffer(t, true)
+	for i := 0; i < 2; i++ {
+		if id, w := offerWith(tok, s.handleViewerOffer, "/whep/view", sdp); id == "" {
+			t.Fatalf("offer %d: %d %s", i, w.Code, w.Body)
+		}
+	}
+}
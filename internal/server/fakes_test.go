@@ -0,0 +1,495 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"bunghole/internal/types"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// fakeDevices hands out fake capturers, encoders and audio sources to a
+// test server and records how the pipeline uses them: how many pipelines
+// are open at once, and anything used after it was closed.
+type fakeDevices struct {
+	width, height int
+
+	mu           sync.Mutex
+	open         int // capturers not yet closed
+	maxOpen      int
+	started      int // capturers opened in total
+	capErr       error
+	audioErrs    int  // audio opens that fail before one works
+	audioSkipped int  // frames each audio packet says DTX skipped before it
+	stale        bool // frames are marked stale, as from an idle desktop
+	lastCap      *fakeCapturer
+	misuse       []string
+	audioRuns    int
+	encoded      int
+	audioSent    int
+}
+
+func newFakeDevices() *fakeDevices {
+	return &fakeDevices{width: 64, height: 48}
+}
+
+func (d *fakeDevices) misused(format string, args ...any) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.misuse = append(d.misuse, fmt.Sprintf(format, args...))
+}
+
+// check fails the test if the pipeline misused a device or ever had more
+// than one open at a time.
+func (d *fakeDevices) check(t *testing.T) {
+	t.Helper()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, m := range d.misuse {
+		t.Error(m)
+	}
+	if d.maxOpen > 1 {
+		t.Errorf("%d pipelines were open at once, want at most 1", d.maxOpen)
+	}
+}
+
+// openPipelines returns how many capturers are open.
+func (d *fakeDevices) openPipelines() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.open
+}
+
+func (d *fakeDevices) newCapturer(display string, fps, gpu int) (types.MediaCapturer, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.capErr != nil {
+		return nil, d.capErr
+	}
+	d.open++
+	d.started++
+	if d.open > d.maxOpen {
+		d.maxOpen = d.open
+	}
+	d.lastCap = &fakeCapturer{dev: d, width: d.width, height: d.height}
+	return d.lastCap, nil
+}
+
+func (d *fakeDevices) newEncoder(width, height, fps, bitrateKbps, gpu int, codec string, gop int, opts types.EncoderOptions, cudaCtx, cuMemcpy2D unsafe.Pointer) (types.VideoEncoder, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	enc := &fakeEncoder{dev: d}
+	if d.lastCap != nil {
+		d.lastCap.enc = enc
+	}
+	return enc, nil
+}
+
+func (d *fakeDevices) newAudio() (types.AudioCapturer, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.audioErrs > 0 {
+		d.audioErrs--
+		return nil, errors.New("no audio server")
+	}
+	return &fakeAudio{dev: d}, nil
+}
+
+// fakeCapturer produces black BGRA frames.
+type fakeCapturer struct {
+	dev           *fakeDevices
+	width, height int
+
+	mu     sync.Mutex
+	closed bool
+	enc    *fakeEncoder // the encoder opened for this capture, if any
+}
+
+func (c *fakeCapturer) Width() int  { return c.width }
+func (c *fakeCapturer) Height() int { return c.height }
+
+func (c *fakeCapturer) Grab() (*types.Frame, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		c.dev.misused("Grab after capturer Close")
+		return nil, errors.New("closed")
+	}
+	c.dev.mu.Lock()
+	stale := c.dev.stale
+	c.dev.mu.Unlock()
+	return &types.Frame{
+		Data:   make([]byte, c.width*c.height*4),
+		Width:  c.width,
+		Height: c.height,
+		Stride: c.width * 4,
+		Stale:  stale,
+	}, nil
+}
+
+func (c *fakeCapturer) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		c.dev.misused("capturer closed twice")
+		return
+	}
+	c.closed = true
+	if c.enc != nil && !c.enc.isClosed() {
+		c.dev.misused("capturer closed before its encoder")
+	}
+	c.dev.mu.Lock()
+	c.dev.open--
+	c.dev.mu.Unlock()
+}
+
+// fakeEncoder turns each frame into a tiny H.264 slice: an IDR for the
+// first frame and after ForceKeyframe, a P-slice otherwise, as though the
+// GOP were endless.
+type fakeEncoder struct {
+	dev *fakeDevices
+
+	mu      sync.Mutex
+	closed  bool
+	started bool
+	force   bool
+}
+
+func (e *fakeEncoder) isClosed() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.closed
+}
+
+func (e *fakeEncoder) Encode(frame *types.Frame) (*types.EncodedFrame, error) {
+	e.mu.Lock()
+	closed := e.closed
+	key := !e.started || e.force
+	e.started, e.force = true, false
+	e.mu.Unlock()
+	if closed {
+		e.dev.misused("Encode after encoder Close")
+		return nil, errors.New("closed")
+	}
+	e.dev.mu.Lock()
+	e.dev.encoded++
+	e.dev.mu.Unlock()
+	if key {
+		return &types.EncodedFrame{Data: []byte{0x00, 0x00, 0x00, 0x01, 0x65, 0x88, 0x84, 0x00}, IsKey: true}, nil
+	}
+	return &types.EncodedFrame{Data: []byte{0x00, 0x00, 0x00, 0x01, 0x41, 0x9a, 0x02, 0x00}}, nil
+}
+
+func (e *fakeEncoder) Format() types.VideoFormat {
+	return types.VideoFormat{Codec: "h264", Profile: "baseline", Level: 31}
+}
+
+func (e *fakeEncoder) ForceKeyframe() {
+	// Take a moment, as a real encoder may, to widen the window for a
+	// Close to slip in.
+	time.Sleep(time.Millisecond)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		e.dev.misused("ForceKeyframe after encoder Close")
+		return
+	}
+	e.force = true
+}
+
+func (e *fakeEncoder) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		e.dev.misused("encoder closed twice")
+		return
+	}
+	e.closed = true
+}
+
+// fakeAudio sends a packet of Opus silence every 20ms.
+type fakeAudio struct {
+	dev *fakeDevices
+
+	mu      sync.Mutex
+	running bool
+	closed  bool
+}
+
+func (a *fakeAudio) Run(packets chan<- *types.OpusPacket, stop <-chan struct{}) {
+	a.dev.mu.Lock()
+	a.dev.audioRuns++
+	skipped := a.dev.audioSkipped
+	a.dev.mu.Unlock()
+	a.mu.Lock()
+	a.running = true
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		a.running = false
+		a.mu.Unlock()
+	}()
+
+	t := time.NewTicker(20 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		select {
+		case <-stop:
+			return
+		case packets <- &types.OpusPacket{Data: []byte{0xf8, 0xff, 0xfe}, Duration: 20 * time.Millisecond, Skipped: skipped}:
+			a.dev.mu.Lock()
+			a.dev.audioSent++
+			a.dev.mu.Unlock()
+		}
+	}
+}
+
+func (a *fakeAudio) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		a.dev.misused("audio capturer closed twice")
+	}
+	if a.running {
+		a.dev.misused("audio capturer closed while running")
+	}
+	a.closed = true
+}
+
+// sharedTrack is the server's video or audio track.
+type sharedTrack interface {
+	webrtc.TrackLocal
+	Codec() webrtc.RTPCodecCapability
+}
+
+// trackContext binds a shared track as a PeerConnection would, with a
+// writer that checks every packet is written while the pipeline that
+// owns the track is still up: the track not yet cleared from the server,
+// and the encoder feeding it not yet closed.
+type trackContext struct {
+	webrtc.TrackLocalContext // not called by TrackLocalStaticRTP.Bind
+
+	s     *Server
+	track sharedTrack
+	enc   *fakeEncoder
+	id    string
+}
+
+func (c *trackContext) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{{RTPCodecCapability: c.track.Codec(), PayloadType: 96}}
+}
+
+func (c *trackContext) SSRC() webrtc.SSRC                       { return 1 }
+func (c *trackContext) SSRCRetransmission() webrtc.SSRC         { return 0 }
+func (c *trackContext) SSRCForwardErrorCorrection() webrtc.SSRC { return 0 }
+func (c *trackContext) WriteStream() webrtc.TrackLocalWriter    { return c }
+func (c *trackContext) ID() string                              { return c.id }
+
+func (c *trackContext) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	c.check()
+	return len(payload), nil
+}
+
+func (c *trackContext) Write(b []byte) (int, error) {
+	c.check()
+	return len(b), nil
+}
+
+func (c *trackContext) check() {
+	// Writes hold the track's lock, and closing a session under s.mu
+	// unbinds it from the track, so waiting for s.mu here could deadlock.
+	// A write that finds s.mu taken skips that half of the check.
+	time.Sleep(100 * time.Microsecond) // as for ForceKeyframe
+	current := true
+	if c.s.mu.TryLock() {
+		current = c.s.videoTrack == c.track || c.s.audioTrack == c.track
+		c.s.mu.Unlock()
+	}
+	if !current {
+		c.enc.dev.misused("%s written after the pipeline cleared it", c.track.Kind())
+	}
+	if c.enc.isClosed() {
+		c.enc.dev.misused("%s written after encoder Close", c.track.Kind())
+	}
+}
+
+// bindTracks binds every pipeline's shared tracks to a trackContext as
+// soon as they appear, until stop is closed.
+func bindTracks(t *testing.T, s *Server, stop <-chan struct{}) {
+	bound := make(map[sharedTrack]bool)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Millisecond):
+		}
+		// Bound without s.mu; see trackContext.check.
+		s.mu.Lock()
+		video, audio := s.videoTrack, s.audioTrack
+		enc, _ := s.encoder.(*fakeEncoder)
+		s.mu.Unlock()
+		var tracks []sharedTrack
+		if video != nil {
+			tracks = append(tracks, video)
+		}
+		if audio != nil {
+			tracks = append(tracks, audio)
+		}
+		for _, track := range tracks {
+			if bound[track] {
+				continue
+			}
+			if _, err := track.Bind(&trackContext{s: s, track: track, enc: enc, id: track.ID()}); err != nil {
+				t.Errorf("bind %s track: %v", track.Kind(), err)
+			}
+			bound[track] = true
+		}
+	}
+}
+
+const testToken = "test-token"
+
+// newTestServer returns a server whose pipeline runs on dev.
+func newTestServer(t *testing.T, dev *fakeDevices, cfg Config) *Server {
+	t.Helper()
+	cfg.Token = testToken
+	if cfg.Codec == "" {
+		cfg.Codec = "h264"
+	}
+	cfg.EncodeGPU = -1
+	if cfg.FPS == 0 {
+		cfg.FPS = 60
+	}
+	cfg.NewCapturer = dev.newCapturer
+	cfg.NewEncoder = dev.newEncoder
+	cfg.NewAudioCapturer = dev.newAudio
+	s := New(cfg)
+	t.Cleanup(func() {
+		s.Teardown()
+		if n := dev.openPipelines(); n != 0 {
+			t.Errorf("%d pipelines still open after Teardown", n)
+		}
+		dev.check(t)
+	})
+	return s
+}
+
+// clientOffer returns a gathered SDP offer like the web UI's: receive-only
+// video and audio, and a data channel.
+func clientOffer(t *testing.T, audio bool) string {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	recvonly := webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, recvonly); err != nil {
+		t.Fatal(err)
+	}
+	if audio {
+		if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, recvonly); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := pc.CreateDataChannel("input", nil); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	return pc.LocalDescription().SDP
+}
+
+// offer posts an SDP offer to a handler and returns the new session's ID,
+// or "" with the response if it wasn't created.
+func offer(handler http.HandlerFunc, path, sdp string) (string, *httptest.ResponseRecorder) {
+	return offerWith(testToken, handler, path, sdp)
+}
+
+// offerWith is offer with a given bearer token.
+func offerWith(tok string, handler http.HandlerFunc, path, sdp string) (string, *httptest.ResponseRecorder) {
+	r := httptest.NewRequest("POST", path, strings.NewReader(sdp))
+	r.Header.Set("Authorization", "Bearer "+tok)
+	r.Header.Set("Content-Type", "application/sdp")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != 201 {
+		return "", w
+	}
+	loc := w.Header().Get("Location")
+	return loc[strings.LastIndex(loc, "/")+1:], w
+}
+
+// del sends a DELETE for a session to a handler and returns the status.
+func del(handler http.HandlerFunc, path, id string) int {
+	return sessionRequest(testToken, "DELETE", handler, path, id)
+}
+
+// sessionRequest sends a bodyless request about a session to a handler,
+// with a given bearer token, and returns the status.
+func sessionRequest(tok, method string, handler http.HandlerFunc, path, id string) int {
+	r := httptest.NewRequest(method, path+id, nil)
+	r.Header.Set("Authorization", "Bearer "+tok)
+	r.SetPathValue("id", id)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Code
+}
+
+// pipeline returns the pipeline's state and whether any shared track
+// exists. The audio track joins the video one once audio capture is up.
+func (s *Server) pipeline() (pipeState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pipeState, s.videoTrack != nil || s.audioTrack != nil
+}
+
+// waitStopped waits for the pipeline to have fully stopped.
+func waitStopped(t *testing.T, s *Server) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st, tracks := s.pipeline()
+		if st == pipeStopped && !tracks {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pipeline still in state %d after 5s", st)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitFor polls cond until it holds or a few seconds pass.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
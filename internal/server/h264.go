@@ -0,0 +1,57 @@
+package server
+
+import "fmt"
+
+// h264Levels lists the H.264 levels from 3.1 up (Table A-1): level_idc,
+// max macroblocks per second, max frame size in macroblocks and max
+// bitrate in kbps for baseline/main (high allows 1.25x). 3.1 is the
+// lowest we advertise, as bunghole always has.
+var h264Levels = []struct {
+	idc, mbps, fs, kbps int
+}{
+	{31, 108000, 3600, 14000},
+	{32, 216000, 5120, 20000},
+	{40, 245760, 8192, 20000},
+	{41, 245760, 8192, 50000},
+	{42, 522240, 8704, 50000},
+	{50, 589824, 22080, 135000},
+	{51, 983040, 36864, 240000},
+	{52, 2073600, 36864, 240000},
+	{60, 4177920, 139264, 240000},
+	{61, 8355840, 139264, 480000},
+	{62, 16711680, 139264, 800000},
+}
+
+// h264MinLevel returns the lowest level_idc whose limits cover the stream,
+// which is what the encoders choose when no level is set. Advertising less
+// than the stream needs (e.g. 3.1 at 4K60) makes strict decoders reject it.
+func h264MinLevel(width, height, fps, bitrateKbps int, profile string) int {
+	fs := ((width + 15) / 16) * ((height + 15) / 16)
+	mbps := fs * fps
+	for _, l := range h264Levels {
+		maxKbps := l.kbps
+		if profile == "high" {
+			maxKbps = maxKbps * 5 / 4
+		}
+		if fs <= l.fs && mbps <= l.mbps && bitrateKbps <= maxKbps {
+			return l.idc
+		}
+	}
+	return h264Levels[len(h264Levels)-1].idc
+}
+
+// h264ProfileLevelID returns the SDP profile-level-id for an H.264 profile
+// and level_idc. The profile must be the one the encoder reports
+// (VideoEncoder.Format), or browsers may refuse to decode the stream.
+func h264ProfileLevelID(profile string, level int) string {
+	var pc string
+	switch profile {
+	case "main":
+		pc = "4d00"
+	case "high":
+		pc = "6400"
+	default:
+		pc = "4200"
+	}
+	return fmt.Sprintf("%s%02x", pc, level)
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"time"
+
+	"bunghole/internal/types"
+)
+
+// requestKeyframe asks the encoder for an IDR on behalf of a client (RTCP
+// PLI/FIR). A request made while another is already pending is coalesced
+// into it.
+func (s *Server) requestKeyframe() {
+	select {
+	case s.keyReq <- struct{}{}:
+	default:
+		s.kfCoalesced.Add(1)
+	}
+}
+
+// runKeyframeBridge forwards keyframe requests to the encoder, forcing at
+// most one IDR per KeyframeInterval. Several viewers joining at once, or a
+// lossy link sending PLI after PLI, would otherwise trigger a burst of IDRs
+// and a bitrate spike for every client. Requests that arrive while waiting
+// out the interval are served by the same IDR.
+func (s *Server) runKeyframeBridge(kf types.KeyframeForcer, stop <-chan struct{}) {
+	var last time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.keyReq:
+		}
+
+		if wait := s.cfg.KeyframeInterval - time.Since(last); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-stop:
+				t.Stop()
+				return
+			case <-t.C:
+			}
+			select {
+			case <-s.keyReq:
+				s.kfCoalesced.Add(1)
+			default:
+			}
+		}
+
+		kf.ForceKeyframe()
+		s.kfPending.Store(true)
+		s.kfForced.Add(1)
+		last = time.Now()
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// The answer offers PLI and FIR on the video codec, without which clients
+// never ask for the keyframes the bridge forces.
+func TestAnswerOffersPictureLossFeedback(t *testing.T) {
+	dev := newFakeDevices()
+	s := newTestServer(t, dev, Config{})
+
+	id, w := offer(s.handleViewerOffer, "/whep/view", clientOffer(t, true))
+	if id == "" {
+		t.Fatalf("offer: %d %s", w.Code, w.Body)
+	}
+	answer := w.Body.String()
+	m := regexp.MustCompile(`a=rtpmap:(\d+) H264/90000`).FindStringSubmatch(answer)
+	if m == nil {
+		t.Fatalf("answer has no H.264:\n%s", answer)
+	}
+	for _, fb := range []string{"nack pli", "ccm fir"} {
+		if line := "a=rtcp-fb:" + m[1] + " " + fb; !strings.Contains(answer, line) {
+			t.Errorf("answer lacks %q:\n%s", line, answer)
+		}
+	}
+}
+
+// A PLI from a connected client forces a keyframe.
+func TestPictureLossForcesKeyframe(t *testing.T) {
+	dev := newFakeDevices()
+	s := newTestServer(t, dev, Config{})
+
+	c := connectClient(t, s.handleViewerOffer, "/whep/view")
+	var video *webrtc.TrackRemote
+	for video == nil {
+		if track := wait(t, "the video track", c.tracks); track.Kind() == webrtc.RTPCodecTypeVideo {
+			video = track
+		}
+	}
+	before := s.kfForced.Load()
+	if err := c.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(video.SSRC())}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a forced keyframe", func() bool { return s.kfForced.Load() > before })
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Most phone and tablet hardware decoders handle up to 1080p; beyond that
+// playback falls back to software decode and stutters.
+const mobileMaxWidth, mobileMaxHeight = 1920, 1080
+
+// isMobileUA reports whether a User-Agent looks like a phone or tablet
+// browser. iPadOS reports a desktop Safari UA and is not detected.
+func isMobileUA(ua string) bool {
+	return strings.Contains(ua, "Mobi") || strings.Contains(ua, "Android") ||
+		strings.Contains(ua, "iPhone") || strings.Contains(ua, "iPad")
+}
+
+// warnMobileLocked logs a warning when a mobile client joins a stream
+// larger than mobile decoders commonly support. The encoder is shared by
+// all sessions, so the stream can't be scaled down for one client; the
+// operator can lower --resolution instead.
+// Must be called with s.mu held and the pipeline running.
+func (s *Server) warnMobileLocked(r *http.Request) {
+	if s.capturer == nil || !isMobileUA(r.UserAgent()) {
+		return
+	}
+	w, h := s.capturer.Width(), s.capturer.Height()
+	if w*h <= mobileMaxWidth*mobileMaxHeight {
+		return
+	}
+	log.Printf("mobile client %s: stream is %dx%d, above the %dx%d most mobile hardware decoders handle; playback may stutter",
+		clientIP(r), w, h, mobileMaxWidth, mobileMaxHeight)
+}
@@ -0,0 +1,77 @@
+package server
+
+import "time"
+
+// framePacer wakes the capture loop once per frame interval.
+type framePacer interface {
+	// Wait blocks until the next frame is due, after the previous frame's
+	// work. It returns false if stop is closed first.
+	Wait(stop <-chan struct{}) bool
+	Stop()
+}
+
+// newFramePacer returns the pacer Config.EvenPacing asks for.
+func newFramePacer(even bool, interval time.Duration) framePacer {
+	if even {
+		return newDeadlinePacer(interval)
+	}
+	return tickerPacer{time.NewTicker(interval)}
+}
+
+// tickerPacer is a plain time.Ticker. Its ticks stay on the grid, but it
+// keeps one tick pending while grab+encode overruns an interval, so the
+// frame after a late one starts as soon as the late one is done: frames
+// come in an uneven pair, the second off the grid.
+type tickerPacer struct{ t *time.Ticker }
+
+func (p tickerPacer) Wait(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	case <-p.t.C:
+		return true
+	}
+}
+
+func (p tickerPacer) Stop() { p.t.Stop() }
+
+// deadlinePacer wakes at absolute deadlines start + n*interval, working
+// out the wait after each frame's work. A frame that runs late shortens
+// the wait for the next one, so frames stay on the grid; deadlines missed
+// entirely are skipped, so no frame starts off the grid right after a
+// late one.
+type deadlinePacer struct {
+	interval time.Duration
+	next     time.Time
+	timer    *time.Timer
+}
+
+func newDeadlinePacer(interval time.Duration) *deadlinePacer {
+	return &deadlinePacer{
+		interval: interval,
+		next:     time.Now(),
+		timer:    time.NewTimer(interval),
+	}
+}
+
+// advance moves to the next deadline not yet passed at now and returns
+// how long to wait for it.
+func (p *deadlinePacer) advance(now time.Time) time.Duration {
+	p.next = p.next.Add(p.interval)
+	if late := now.Sub(p.next); late > 0 {
+		p.next = p.next.Add((late/p.interval + 1) * p.interval)
+	}
+	return p.next.Sub(now)
+}
+
+func (p *deadlinePacer) Wait(stop <-chan struct{}) bool {
+	p.timer.Reset(p.advance(time.Now()))
+	select {
+	case <-stop:
+		return false
+	case <-p.timer.C:
+		return true
+	}
+}
+
+func (p *deadlinePacer) Stop() { p.timer.Stop() }
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// The deadline pacer's wait makes up for a late frame, and deadlines
+// missed entirely are skipped, keeping wake-ups on the grid.
+func TestDeadlinePacerStaysOnGrid(t *testing.T) {
+	const interval = 10 * time.Millisecond
+	start := time.Now()
+	p := &deadlinePacer{interval: interval, next: start}
+
+	for _, tc := range []struct {
+		now, want time.Duration // since start
+	}{
+		{2 * time.Millisecond, 8 * time.Millisecond},   // next deadline at 10ms
+		{14 * time.Millisecond, 6 * time.Millisecond},  // ran late: next at 20ms
+		{25 * time.Millisecond, 5 * time.Millisecond},  // overran 20ms: skip to 30ms
+		{30 * time.Millisecond, 10 * time.Millisecond}, // exactly on 30ms: next at 40ms
+	} {
+		if got := p.advance(start.Add(tc.now)); got != tc.want {
+			t.Errorf("at %v: wait %v, want %v", tc.now, got, tc.want)
+		}
+	}
+}
+
+// After a frame overruns its interval, the ticker wakes the loop at once
+// for an off-grid frame; the deadline pacer waits for the next deadline.
+func TestPacerAfterOverrun(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	for _, tc := range []struct {
+		even     bool
+		min, max time.Duration // wait after the late frame
+	}{
+		{false, 0, 15 * time.Millisecond},
+		{true, 15 * time.Millisecond, interval},
+	} {
+		p := newFramePacer(tc.even, interval)
+		if !p.Wait(nil) {
+			t.Fatal("Wait returned false")
+		}
+		time.Sleep(interval * 3 / 2) // overrun the next deadline by half an interval
+		done := time.Now()
+		p.Wait(nil)
+		if d := time.Since(done); d < tc.min || d > tc.max {
+			t.Errorf("even=%v: woke %v after the late frame, want %v to %v", tc.even, d, tc.min, tc.max)
+		}
+		p.Stop()
+	}
+}
@@ -0,0 +1,404 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bunghole/internal/rtsp"
+)
+
+func TestPipelineConnectDisconnectReconnect(t *testing.T) {
+	dev := newFakeDevices()
+	s := newTestServer(t, dev, Config{})
+
+	id, w := offer(s.handleWHEPOffer, "/whep", clientOffer(t, true))
+	if id == "" {
+		t.Fatalf("offer: %d %s", w.Code, w.Body)
+	}
+	if st, tracks := s.pipeline(); st != pipeRunning || !tracks {
+		t.Fatalf("after offer: state %d, tracks %v; want running with tracks", st, tracks)
+	}
+	waitFor(t, "frames to be encoded", func() bool {
+		dev.mu.Lock()
+		defer dev.mu.Unlock()
+		return dev.encoded > 0 && dev.audioSent > 0
+	})
+
+	if code := del(s.handleWHEPDelete, "/whep/", id); code != 204 {
+		t.Fatalf("DELETE: %d", code)
+	}
+	waitStopped(t, s)
+	if n := dev.openPipelines(); n != 0 {
+		t.Fatalf("%d pipelines open after the last session left", n)
+	}
+
+	id, w = offer(s.handleWHEPOffer, "/whep", clientOffer(t, true))
+	if id == "" {
+		t.Fatalf("reconnect: %d %s", w.Code, w.Body)
+	}
+	if st, tracks := s.pipeline(); st != pipeRunning || !tracks {
+		t.Fatalf("after reconnect: state %d, tracks %v; want running with tracks", st, tracks)
+	}
+	dev.mu.Lock()
+	started := dev.started
+	dev.mu.Unlock()
+	if started != 2 {
+		t.Errorf("%d pipelines started, want 2", started)
+	}
+}
+
+func TestPipelineControllerThenViewer(t *testing.T) {
+	dev := newFakeDevices()
+	s := newTestServer(t, dev, Config{})
+
+	ctrl, w := offer(s.handleWHEPOffer, "/whep", clientOffer(t, true))
+	if ctrl == "" {
+		t.Fatalf("controller offer: %d %s", w.Code, w.Body)
+	}
+	viewer, w := offer(s.handleViewerOffer, "/whep/view", clientOffer(t, false))
+	if viewer == "" {
+		t.Fatalf("viewer offer: %d %s", w.Code, w.Body)
+	}
+
+	// A new controller replaces the old one on the same pipeline.
+	ctrl2, w := offer(s.handleWHEPOffer, "/whep", clientOffer(t, true))
+	if ctrl2 == "" {
+		t.Fatalf("second controller offer: %d %s", w.Code, w.Body)
+	}
+	if code := del(s.handleWHEPDelete, "/whep/", ctrl); code != 204 {
+		t.Fatalf("DELETE of replaced controller: %d", code)
+	}
+	if code := del(s.handleWHEPDelete, "/whep/", ctrl2); code != 204 {
+		t.Fatalf("DELETE controller: %d", code)
+	}
+	if st, _ := s.pipeline(); st != pipeRunning {
+		t.Fatalf("pipeline state %d with a viewer left, want running", st)
+	}
+
+	if code := del(s.handleViewerDelete, "/whep/view/", viewer); code != 204 {
+		t.Fatalf("DELETE viewer: %d", code)
+	}
+	waitStopped(t, s)
+
+	dev.mu.Lock()
+	started := dev.started
+	dev.mu.Unlock()
+	if started != 1 {
+		t.Errorf("%d pipelines started, want 1", started)
+	}
+}
+
+func TestPipelineStopsWhenSessionCloses(t *testing.T) {
+	dev := newFakeDevices()
+	s := newTestServer(t, dev, Config{})
+
+	if id, w := offer(s.handleViewerOffer, "/whep/view", clientOffer(t, true)); id == "" {
+		t.Fatalf("offer: %d %s", w.Code, w.Body)
+	}
+	if id, w := offer(s.handleWHEPOffer, "/whep", clientOffer(t, true)); id == "" {
+		t.Fatalf("offer: %d %s", w.Code, w.Body)
+	}
+
+	// As when the client goes away without a DELETE: watchSession cleans
+	// up after each session.
+	s.mu.Lock()
+	sessions := s.sessionsLocked()
+	s.mu.Unlock()
+	for _, sess := range sessions {
+		sess.Close()
+	}
+	waitStopped(t, s)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctrl != nil || len(s.viewers) != 0 {
+		t.Errorf("sessions still registered after closing: ctrl %v, %d viewers", s.ctrl != nil, len(s.viewers))
+	}
+}
+
+func TestPipelineLinger(t *testing.T) {
+	dev := newFakeDevices()
+	s := newTestServer(t, dev, Config{PipelineLinger: 200 * time.Millisecond})
+
+	id, w := offer(s.handleWHEPOffer, "/whep", clientOffer(t, true))
+	if id == "" {
+		t.Fatalf("offer: %d %s", w.Code, w.Body)
+	}
+	del(s.handleWHEPDelete, "/whep/", id)
+	if st, tracks := s.pipeline(); st != pipeRunning || !tracks || !s.paused.Load() {
+		t.Fatalf("lingering: state %d, tracks %v, paused %v; want running, paused, with tracks", st, tracks, s.paused.Load())
+	}
+
+	// A reconnect while lingering reuses the pipeline.
+	id, w = offer(s.handleWHEPOffer, "/whep", clientOffer(t, true))
+	if id == "" {
+		t.Fatalf("reconnect: %d %s", w.Code, w.Body)
+	}
+	if s.paused.Load() {
+		t.Error("pipeline still paused after a reconnect")
+	}
+	del(s.handleWHEPDelete, "/whep/", id)
+	waitStopped(t, s)
+
+	dev.mu.Lock()
+	started := dev.started
+	dev.mu.Unlock()
+	if started != 1 {
+		t.Errorf("%d pipelines started, want 1", started)
+	}
+}
+
+func TestPipelineStartFailure(t *testing.T) {
+	dev := newFakeDevices()
+	dev.capErr = errors.New("cannot open display")
+	s := newTestServer(t, dev, Config{})
+
+	id, w := offer(s.handleWHEPOffer, "/whep", clientOffer(t, true))
+	if id != "" || w.Code != 503 || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("offer with no display: %d, Retry-After %q; want 503 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	if st, tracks := s.pipeline(); st != pipeStopped || tracks {
+		t.Fatalf("after failed start: state %d, tracks %v; want stopped without tracks", st, tracks)
+	}
+
+	dev.mu.Lock()
+	dev.capErr = nil
+	dev.mu.Unlock()
+	if id, w := offer(s.handleViewerOffer, "/whep/view", clientOffer(t, true)); id == "" {
+		t.Fatalf("offer once the display is up: %d %s", w.Code, w.Body)
+	}
+}
+
+// A capture H.265 could encode but H.264 can't is refused once the
+// encoder has fallen back to H.264, and the offer says what was encoded.
+func TestPipelineFallbackSizeLimit(t *testing.T) {
+	dev := newFakeDevices() // its encoder always produces H.264
+	s := newTestServer(t, dev, Config{Codec: "h265"})
+
+	id, w := offer(s.handleWHEPOffer, "/whep", clientOffer(t, true))
+	if id == "" {
+		t.Fatalf("offer: %d %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("X-Bunghole-Codec"); got != "h264" {
+		t.Errorf("X-Bunghole-Codec %q, want h264", got)
+	}
+	del(s.handleWHEPDelete, "/whep/", id)
+	waitStopped(t, s)
+
+	dev.mu.Lock()
+	dev.width = 5120
+	dev.mu.Unlock()
+	id, w = offer(s.handleWHEPOffer, "/whep", clientOffer(t, true))
+	if id != "" || w.Code != 500 || !strings.Contains(w.Body.String(), "h264") {
+		t.Fatalf("offer for a 5120-wide capture encoded as H.264: %d %s; want 500 naming h264", w.Code, w.Body)
+	}
+	if n := dev.openPipelines(); n != 0 {
+		t.Errorf("%d pipelines left open after the refused start", n)
+	}
+}
+
+// A client reconnecting right after leaving may find the old pipeline
+// still stopping; the new one must not open the capturer until the old
+// one has released it.
+func TestPipelineRestartWhileStopping(t *testing.T) {
+	dev := newFakeDevices()
+	s := newTestServer(t, dev, Config{})
+
+	sdp := clientOffer(t, true)
+	for i := 0; i < 10; i++ {
+		id, w := offer(s.handleWHEPOffer, "/whep", sdp)
+		if id == "" {
+			t.Fatalf("offer %d: %d %s", i, w.Code, w.Body)
+		}
+		del(s.handleWHEPDelete, "/whep/", id)
+	}
+	waitStopped(t, s)
+}
+
+func TestTeardown(t *testing.T) {
+	dev := newFakeDevices()
+	s := newTestServer(t, dev, Config{})
+
+	if id, w := offer(s.handleWHEPOffer, "/whep", clientOffer(t, true)); id == "" {
+		t.Fatalf("offer: %d %s", w.Code, w.Body)
+	}
+	if id, w := offer(s.handleViewerOffer, "/whep/view", clientOffer(t, false)); id == "" {
+		t.Fatalf("offer: %d %s", w.Code, w.Body)
+	}
+	s.mu.Lock()
+	sessions := s.sessionsLocked()
+	s.mu.Unlock()
+
+	s.Teardown()
+
+	if st, tracks := s.pipeline(); st != pipeStopped || tracks {
+		t.Errorf("after Teardown: state %d, tracks %v; want stopped without tracks", st, tracks)
+	}
+	if n := dev.openPipelines(); n != 0 {
+		t.Errorf("%d pipelines open after Teardown", n)
+	}
+	for _, sess := range sessions {
+		if !sess.IsClosed() {
+			t.Errorf("session %s still open after Teardown", sess.ID)
+		}
+	}
+}
+
+// Clients connecting and leaving as fast as they can, controllers and
+// viewers at once, some leaving by DELETE and some by closing: only one
+// pipeline may ever be open, no session may be built on a pipeline's
+// cleared tracks (newPeerConnection would panic on them), and once
+// everybody has left the pipeline stops.
+func TestPipelineRapidConnectDisconnect(t *testing.T) {
+	for _, linger := range []time.Duration{0, time.Millisecond} {
+		t.Run("linger="+linger.String(), func(t *testing.T) {
+			dev := newFakeDevices()
+			s := newTestServer(t, dev, Config{PipelineLinger: linger})
+
+			const clients, rounds = 4, 25
+			sdps := make([]string, clients)
+			for i := range sdps {
+				sdps[i] = clientOffer(t, i%3 != 0)
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, clients*rounds)
+			for i := 0; i < clients; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					handler, path := s.handleViewerOffer, "/whep/view"
+					deleter, delPath := s.handleViewerDelete, "/whep/view/"
+					if i%4 == 0 {
+						handler, path = s.handleWHEPOffer, "/whep"
+						deleter, delPath = s.handleWHEPDelete, "/whep/"
+					}
+					for r := 0; r < rounds; r++ {
+						// Spread out a little, so the pipeline also stops
+						// and restarts between clients.
+						time.Sleep(time.Duration(rand.IntN(5)) * time.Millisecond)
+						id, w := offer(handler, path, sdps[i])
+						if id == "" {
+							errs <- fmt.Errorf("client %d round %d: offer: %d %s", i, r, w.Code, w.Body)
+							continue
+						}
+						if r%2 == 0 {
+							if code := del(deleter, delPath, id); code != 204 {
+								errs <- fmt.Errorf("client %d round %d: DELETE: %d", i, r, code)
+							}
+							continue
+						}
+						// Leave without a DELETE, as a client that just goes away.
+						s.mu.Lock()
+						sess := s.viewers[id]
+						if s.ctrl != nil && s.ctrl.ID == id {
+							sess = s.ctrl
+						}
+						s.mu.Unlock()
+						if sess != nil {
+							sess.Close()
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+
+			waitStopped(t, s)
+			s.mu.Lock()
+			pending, ctrl, viewers := s.pendingOffers, s.ctrl, len(s.viewers)
+			s.mu.Unlock()
+			if pending != 0 || ctrl != nil || viewers != 0 {
+				t.Errorf("after everybody left: %d pending offers, controller %v, %d viewers", pending, ctrl != nil, viewers)
+			}
+			dev.mu.Lock()
+			started := dev.started
+			dev.mu.Unlock()
+			t.Logf("%d offers, %d pipelines started", clients*rounds, started)
+		})
+	}
+}
+
+// Nothing may be written to a shared track once the pipeline has cleared
+// it, and nothing may use the encoder once it is closed, however the
+// pipeline's stop lines up with frames, audio packets and keyframe
+// requests in flight.
+func TestPipelineNoUseAfterClose(t *testing.T) {
+	dev := newFakeDevices()
+	s := newTestServer(t, dev, Config{FPS: 240})
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		bindTracks(t, s, stop)
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.requestKeyframe()
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	sdp := clientOffer(t, true)
+	for i := 0; i < 30; i++ {
+		id, w := offer(s.handleWHEPOffer, "/whep", sdp)
+		if id == "" {
+			t.Fatalf("offer %d: %d %s", i, w.Code, w.Body)
+		}
+		time.Sleep(time.Duration(rand.IntN(40)) * time.Millisecond)
+		del(s.handleWHEPDelete, "/whep/", id)
+	}
+	waitStopped(t, s)
+	close(stop)
+	wg.Wait()
+
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if dev.encoded == 0 || dev.audioSent == 0 {
+		t.Errorf("%d frames encoded and %d audio packets sent; the test exercised nothing", dev.encoded, dev.audioSent)
+	}
+}
+
+func TestRTSPPlayStartError(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		dev                func(*fakeDevices)
+		status, retryAfter int
+	}{
+		{"no display", func(d *fakeDevices) { d.capErr = errors.New("cannot open display") }, 503, pipelineRetryAfter},
+		{"too large", func(d *fakeDevices) { d.width = 8192 }, 500, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dev := newFakeDevices()
+			tc.dev(dev)
+			s := newTestServer(t, dev, Config{})
+
+			var pe *rtsp.PlayError
+			if err := s.rtspPlay(); !errors.As(err, &pe) {
+				t.Fatalf("rtspPlay = %v, want a *rtsp.PlayError", err)
+			}
+			if pe.Status != tc.status || pe.RetryAfter != tc.retryAfter {
+				t.Errorf("rtspPlay rejects with %d, Retry-After %d; want %d, Retry-After %d", pe.Status, pe.RetryAfter, tc.status, tc.retryAfter)
+			}
+			if s.rtspReaders != 0 {
+				t.Errorf("%d RTSP readers counted after a failed play", s.rtspReaders)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+//go:build linux
+
+package server
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// realtimePriority is the SCHED_FIFO priority requested for the pipeline
+// thread: above normal threads, well below kernel and audio threads.
+const realtimePriority = 10
+
+// realtimeNice is the fallback nice value when SCHED_FIFO is not permitted.
+const realtimeNice = -10
+
+// pinPipelineThread locks the calling goroutine to its OS thread and
+// restricts that thread to the given CPUs. The thread is never unlocked,
+// so Go discards it when the pipeline goroutine exits instead of handing
+// the pinned thread to other goroutines.
+func pinPipelineThread(cpus []int) error {
+	runtime.LockOSThread()
+
+	var set unix.CPUSet
+	set.Zero()
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	// pid 0 = the calling thread
+	return unix.SchedSetaffinity(0, &set)
+}
+
+// raisePipelinePriority locks the calling goroutine to its OS thread and
+// switches that thread to SCHED_FIFO. Without CAP_SYS_NICE (or an
+// RLIMIT_RTPRIO allowance) it falls back to a negative nice value, and
+// returns an error only if neither is permitted. Like pinPipelineThread,
+// the thread stays locked so the priority dies with the pipeline goroutine.
+func raisePipelinePriority() (string, error) {
+	runtime.LockOSThread()
+
+	attr := &unix.SchedAttr{
+		Size:     unix.SizeofSchedAttr,
+		Policy:   unix.SCHED_FIFO,
+		Priority: realtimePriority,
+	}
+	rtErr := unix.SchedSetAttr(0, attr, 0)
+	if rtErr == nil {
+		return fmt.Sprintf("SCHED_FIFO priority %d", realtimePriority), nil
+	}
+
+	// PRIO_PROCESS with a thread ID applies to that thread only on Linux.
+	if err := unix.Setpriority(unix.PRIO_PROCESS, unix.Gettid(), realtimeNice); err != nil {
+		return "", fmt.Errorf("SCHED_FIFO: %v; nice %d: %v", rtErr, realtimeNice, err)
+	}
+	return fmt.Sprintf("nice %d (SCHED_FIFO not permitted: %v)", realtimeNice, rtErr), nil
+}
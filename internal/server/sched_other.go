@@ -0,0 +1,15 @@
+//go:build !linux
+
+package server
+
+import "fmt"
+
+// pinPipelineThread is only supported on Linux.
+func pinPipelineThread(cpus []int) error {
+	return fmt.Errorf("CPU pinning is not supported on this platform")
+}
+
+// raisePipelinePriority is only supported on Linux.
+func raisePipelinePriority() (string, error) {
+	return "", fmt.Errorf("real-time scheduling is not supported on this platform")
+}
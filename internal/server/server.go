@@ -1,27 +1,42 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"image/png"
 	"io"
+	"io/fs"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
-	"bunghole/internal/audio"
+	"bunghole/internal/rtsp"
 	"bunghole/internal/session"
+	"bunghole/internal/token"
 	"bunghole/internal/types"
 	"bunghole/web"
 
 	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v4"
 	"github.com/pion/webrtc/v4/pkg/media"
 )
@@ -29,61 +44,129 @@ import (
 // CapturerFactory creates a screen capturer for the given display.
 type CapturerFactory func(display string, fps, gpu int) (types.MediaCapturer, error)
 
+// AudioCapturerFactory opens the audio source for a pipeline.
+type AudioCapturerFactory func() (types.AudioCapturer, error)
+
 // EncoderFactory creates a video encoder.
-type EncoderFactory func(width, height, fps, bitrateKbps, gpu int, codec string, gop int, cudaCtx, cuMemcpy2D unsafe.Pointer) (types.VideoEncoder, error)
+type EncoderFactory func(width, height, fps, bitrateKbps, gpu int, codec string, gop int, opts types.EncoderOptions, cudaCtx, cuMemcpy2D unsafe.Pointer) (types.VideoEncoder, error)
+
+// Hard limits on the frame rate and bitrate (kbps), whatever MaxFPS and
+// MaxBitrate say. Encoders handed more fail in unhelpful ways, if at all.
+const (
+	HardMaxFPS     = 240
+	HardMaxBitrate = 500000
+)
 
 // Config holds all server configuration.
 type Config struct {
-	Display        string
-	Token          string
-	FPS            int
-	Bitrate        int
-	GPU            int
-	Codec          string
-	GOP            int
-	Addr           string
-	Stats          bool
-	AudioUDPListen string
-	VsockAudioCh   <-chan net.Conn // macOS VM: vsock audio connections from guest
+	Display    string
+	Token      string
+	FPS        int
+	Bitrate    int
+	MaxFPS     int // cap on FPS and on any rate changed at runtime; 0 = HardMaxFPS
+	MaxBitrate int // same for Bitrate, in kbps; 0 = HardMaxBitrate
+	GPU        int
+	EncodeGPU  int    // GPU index for the encoder; -1 = same as GPU
+	RTSPAddr   string // serve video+audio over RTSP on this address (requires Token)
+	StreamID   string // WebRTC stream (msid) ID of the shared tracks; default "bunghole"
+	Codec      string
+	GOP        int
+	Encoder    types.EncoderOptions // tuning, H.264 profile and level, fallback
+	Addr       string
+	Stats      bool
 
 	OfferTimeout   time.Duration
 	AllowedOrigins []string
 	AuthFailLimit  int
 	AuthFailWindow time.Duration
-
-	TLSCert string      // path to cert file (user-provided mode)
-	TLSKey  string      // path to key file (user-provided mode)
-	TLS     *tls.Config // pre-built TLS config (self-signed mode)
-
-	NewCapturer  CapturerFactory
-	NewEncoder   EncoderFactory
-	InputFactory session.InputHandlerFactory
-	ClipFactory  session.ClipboardHandlerFactory
+	PipelineLinger time.Duration // keep the pipeline alive this long after the last session leaves
+	AudioRetry     time.Duration // retry a failed audio capture open this often; default 5s
+	PinCPUs        []int         // pin the capture/encode thread to these CPUs (Linux)
+	Realtime       bool          // run the capture/encode thread with real-time priority (Linux)
+	EvenPacing     bool          // pace frames to absolute deadlines instead of a ticker
+
+	KeyframeInterval   time.Duration // minimum gap between IDRs forced by client PLI/FIR
+	MaxSessionDuration time.Duration // disconnect WebRTC sessions older than this (0 = no limit)
+
+	NoUI  bool   // don't serve the web UI; GET / and other unknown paths are 404
+	UIDir string // serve the web UI from this directory instead of the embedded one
+
+	TLSCert        string      // path to cert file (user-provided mode)
+	TLSKey         string      // path to key file (user-provided mode)
+	TLS            *tls.Config // pre-built TLS config (self-signed mode, or client auth)
+	TLSFingerprint string      // SHA-256 fingerprint of the self-signed cert
+	ClientCertAuth bool        // a verified client cert authenticates; Token (if set) is also required
+
+	NewCapturer      CapturerFactory
+	NewEncoder       EncoderFactory
+	NewAudioCapturer AudioCapturerFactory // nil = no audio
+	InputFactory     session.InputHandlerFactory
+	ClipFactory      session.ClipboardHandlerFactory
 }
 
 type Server struct {
 	cfg         Config
 	guestConfig []byte
+	ui          fs.FS // the web UI served under GET /; nil = none
 
 	mu sync.Mutex
 
 	// Shared tracks (owned by server, broadcast to all PCs)
 	videoTrack *webrtc.TrackLocalStaticSample
-	audioTrack *webrtc.TrackLocalStaticSample
+	audioTrack *webrtc.TrackLocalStaticRTP
 
 	// Pipeline resources
-	capturer types.MediaCapturer
-	encoder  types.VideoEncoder
-	audio    types.AudioCapturer
-	pipeStop chan struct{}  // closed to stop pipeline goroutine
-	pipeWg   sync.WaitGroup // waited before starting a new pipeline
+	capturer  types.MediaCapturer
+	encoder   types.VideoEncoder
+	codec     string // what encoder produces; may differ from cfg.Codec after a fallback
+	audio     types.AudioCapturer
+	pipeStop  chan struct{} // closed to stop pipeline goroutine
+	pipeState pipeState
+	pipeDone  *sync.Cond  // on mu; broadcast when pipeState leaves pipeStopping
+	linger    *time.Timer // pending delayed stop (see PipelineLinger)
+	paused    atomic.Bool // lingering: runPipeline idles without grabbing or encoding
+	pipeErr   error       // last pipeline init failure, cleared on success
+	pipeErrAt time.Time
+
+	// Rates achieved over the last second, in hundredths of a frame per
+	// second: capture loop iterations, and frames written to the tracks.
+	loopFPS, sentFPS atomic.Int64
+
+	// Client keyframe requests (see runKeyframeBridge)
+	keyReq      chan struct{}
+	kfForced    atomic.Uint64
+	kfCoalesced atomic.Uint64
+	kfPending   atomic.Bool // an IDR was forced; encode the next frame even if stale
 
 	// Sessions
-	ctrl    *session.Session            // at most one controller
-	viewers map[string]*session.Session // zero or more viewers
+	ctrl        *session.Session            // at most one controller
+	viewers     map[string]*session.Session // zero or more viewers
+	inputLocked bool                        // drop controller input (see handleInputLock)
+
+	closedBytes uint64 // bytes sent by sessions that have since closed
+
+	// Offers between starting the pipeline and registering their session,
+	// counted as clients so the pipeline isn't stopped under them.
+	pendingOffers int
+
+	// Raw elementary stream clients (GET /stream.h264). Guarded by its own
+	// mutex so the pipeline can publish without taking s.mu every frame.
+	streamMu sync.Mutex
+	streams  map[*streamClient]struct{}
+
+	rtsp        *rtsp.Server // nil unless RTSPAddr is set
+	rtspReaders int          // RTSP readers currently playing
 
 	authMu    sync.Mutex
 	authFails map[string]authWindow
+	onceUsed  map[string]onceUse // single-use signed tokens by nonce
+}
+
+// onceUse records what a single-use signed token was used for.
+type onceUse struct {
+	session string // the session it created; "" for a raw stream
+	bound   bool   // false while the request creating it is in progress
+	expires time.Time
 }
 
 type authWindow struct {
@@ -101,6 +184,20 @@ func New(cfg Config) *Server {
 	if cfg.AuthFailWindow <= 0 {
 		cfg.AuthFailWindow = time.Minute
 	}
+	if cfg.StreamID == "" {
+		cfg.StreamID = "bunghole"
+	}
+	if cfg.AudioRetry <= 0 {
+		cfg.AudioRetry = 5 * time.Second
+	}
+	if cfg.MaxFPS <= 0 || cfg.MaxFPS > HardMaxFPS {
+		cfg.MaxFPS = HardMaxFPS
+	}
+	if cfg.MaxBitrate <= 0 || cfg.MaxBitrate > HardMaxBitrate {
+		cfg.MaxBitrate = HardMaxBitrate
+	}
+	cfg.FPS = cfg.clampFPS(cfg.FPS)
+	cfg.Bitrate = cfg.clampBitrate(cfg.Bitrate)
 
 	configFile := "config/linux_desktop.json"
 	if runtime.GOOS == "darwin" {
@@ -115,35 +212,104 @@ func New(cfg Config) *Server {
 		log.Fatalf("failed to read guest config %s: %v", configFile, err)
 	}
 
-	return &Server{
+	s := &Server{
 		cfg:         cfg,
 		guestConfig: guestConfig,
 		viewers:     make(map[string]*session.Session),
+		streams:     make(map[*streamClient]struct{}),
+		keyReq:      make(chan struct{}, 1),
 		authFails:   make(map[string]authWindow),
+		onceUsed:    make(map[string]onceUse),
+	}
+	s.pipeDone = sync.NewCond(&s.mu)
+	switch {
+	case cfg.NoUI:
+	case cfg.UIDir != "":
+		s.ui = os.DirFS(cfg.UIDir)
+	default:
+		s.ui = web.Content
+	}
+	return s
+}
+
+// clampFPS limits a frame rate to 1..MaxFPS. Every frame rate the encoder
+// is given, at startup or later, goes through it.
+func (c *Config) clampFPS(fps int) int {
+	if fps > c.MaxFPS {
+		log.Printf("warning: %d fps is over the %d fps cap, using %d", fps, c.MaxFPS, c.MaxFPS)
+		return c.MaxFPS
+	}
+	return max(fps, 1)
+}
+
+// clampBitrate limits a bitrate in kbps to 1..MaxBitrate, like clampFPS.
+func (c *Config) clampBitrate(kbps int) int {
+	if kbps > c.MaxBitrate {
+		log.Printf("warning: %d kbps is over the %d kbps cap, using %d", kbps, c.MaxBitrate, c.MaxBitrate)
+		return c.MaxBitrate
 	}
+	return max(kbps, 1)
 }
 
 func (s *Server) ListenAndServe() error {
 	mux := http.NewServeMux()
-	mux.HandleFunc("GET /", s.handleIndex)
+	if s.ui != nil {
+		mux.HandleFunc("GET /", s.handleIndex)
+	}
 	mux.HandleFunc("GET /config", s.handleConfig)
 
 	// Controller endpoints
 	mux.HandleFunc("POST /whep", s.handleWHEPOffer)
 	mux.HandleFunc("PATCH /whep/{id}", s.handleWHEPPatch)
 	mux.HandleFunc("DELETE /whep/{id}", s.handleWHEPDelete)
+	mux.HandleFunc("POST /whep/{id}/refresh", s.handleWHEPRefresh)
 	mux.HandleFunc("OPTIONS /whep", s.handleWHEPOptions)
 	mux.HandleFunc("OPTIONS /whep/{id}", s.handleWHEPOptions)
+	mux.HandleFunc("OPTIONS /whep/{id}/refresh", s.handleWHEPOptions)
 
 	// Viewer endpoints
 	mux.HandleFunc("POST /whep/view", s.handleViewerOffer)
 	mux.HandleFunc("PATCH /whep/view/{id}", s.handleViewerPatch)
 	mux.HandleFunc("DELETE /whep/view/{id}", s.handleViewerDelete)
+	mux.HandleFunc("POST /whep/view/{id}/refresh", s.handleViewerRefresh)
 	mux.HandleFunc("OPTIONS /whep/view", s.handleWHEPOptions)
 	mux.HandleFunc("OPTIONS /whep/view/{id}", s.handleWHEPOptions)
-
+	mux.HandleFunc("OPTIONS /whep/view/{id}/refresh", s.handleWHEPOptions)
+
+	mux.HandleFunc("POST /input-lock", s.handleInputLock)
+	mux.HandleFunc("DELETE /input-lock", s.handleInputLock)
+	mux.HandleFunc("GET /status", s.handleStatus)
+	mux.HandleFunc("GET /sessions", s.handleSessions)
+	mux.HandleFunc("GET /stream.h264", s.handleStream)
+	mux.HandleFunc("GET /stream.h265", s.handleStream)
 	mux.HandleFunc("GET /debug/frame", s.handleDebugFrame)
 
+	if s.cfg.TLSFingerprint != "" {
+		mux.HandleFunc("GET /cert-fingerprint", s.handleCertFingerprint)
+	}
+
+	if s.cfg.RTSPAddr != "" {
+		rs, err := rtsp.NewServer(rtsp.Config{
+			Addr:   s.cfg.RTSPAddr,
+			Codec:  s.cfg.Codec,
+			Token:  s.cfg.Token,
+			OnPlay: s.rtspPlay,
+			OnStop: s.rtspStop,
+
+			RequestKeyframe: s.requestKeyframe,
+		})
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.rtsp = rs
+		s.mu.Unlock()
+	}
+
+	if s.cfg.MaxSessionDuration > 0 {
+		go s.reapSessions()
+	}
+
 	srv := &http.Server{
 		Addr:    s.cfg.Addr,
 		Handler: mux,
@@ -151,6 +317,7 @@ func (s *Server) ListenAndServe() error {
 
 	switch {
 	case s.cfg.TLSCert != "" && s.cfg.TLSKey != "":
+		srv.TLSConfig = s.cfg.TLS // nil unless client cert auth is enabled
 		log.Printf("starting bunghole on %s (HTTPS, user-provided cert, display %s, %d fps, %d kbps, codec %s)",
 			s.cfg.Addr, s.cfg.Display, s.cfg.FPS, s.cfg.Bitrate, s.cfg.Codec)
 		return srv.ListenAndServeTLS(s.cfg.TLSCert, s.cfg.TLSKey)
@@ -171,23 +338,106 @@ func (s *Server) ListenAndServe() error {
 // Teardown shuts down all sessions and releases resources.
 func (s *Server) Teardown() {
 	s.mu.Lock()
+	rs := s.rtsp
+	s.rtsp = nil
 	s.teardownLocked()
 	s.mu.Unlock()
-	s.pipeWg.Wait()
+	// Closed without s.mu: closing RTSP sessions calls back into rtspStop.
+	if rs != nil {
+		rs.Close()
+	}
+	s.mu.Lock()
+	for s.pipeState == pipeStopping {
+		s.pipeDone.Wait()
+	}
+	s.mu.Unlock()
+}
+
+// fingerprinted matches asset names that carry a hash of their content,
+// e.g. app.3f2a9c1b.js or font-5d41402abc4b2a76.woff2. The content under
+// such a name never changes, so clients may cache it for good.
+var fingerprinted = regexp.MustCompile(`[.-][0-9a-f]{8,}\.[^.]+$`)
+
+// precompressed are the encodings a web UI file may also be stored in, as
+// name.br or name.gz, in order of preference.
+var precompressed = []struct{ encoding, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
 }
 
+// handleIndex serves the web UI: index.html at / and other files by name.
+// Fingerprinted assets are cached as immutable; everything else is
+// revalidated by ETag, so a new build is picked up on the next load. A
+// precompressed name.br or name.gz is sent in place of name to clients
+// that accept it. Directories aren't listed.
 func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == "/" {
-		data, err := web.Content.ReadFile("index.html")
-		if err != nil {
-			http.Error(w, "internal error", 500)
-			return
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	if name == "" {
+		name = "index.html"
+	}
+	info, err := fs.Stat(s.ui, name)
+	if err != nil || info.IsDir() {
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("web UI: %v", err)
 		}
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.Write(data)
+		http.NotFound(w, r)
+		return
+	}
+	data, err := fs.ReadFile(s.ui, name)
+	if err != nil {
+		log.Printf("web UI: %v", err)
+		http.Error(w, "internal error", 500)
 		return
 	}
-	http.FileServer(http.FS(web.Content)).ServeHTTP(w, r)
+
+	// The type comes from the original file: a variant would sniff as
+	// its compression format.
+	h := w.Header()
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		ctype = http.DetectContentType(data)
+	}
+	h.Set("Content-Type", ctype)
+	h.Set("Vary", "Accept-Encoding")
+	accept := r.Header.Get("Accept-Encoding")
+	for _, p := range precompressed {
+		if !acceptsEncoding(accept, p.encoding) {
+			continue
+		}
+		if z, err := fs.ReadFile(s.ui, name+p.ext); err == nil {
+			h.Set("Content-Encoding", p.encoding)
+			data = z
+			break
+		}
+	}
+
+	if fingerprinted.MatchString(path.Base(name)) {
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		h.Set("Cache-Control", "no-cache")
+	}
+	// Embedded files have no modification time, so revalidation goes by
+	// a hash of what is sent.
+	sum := sha256.Sum256(data)
+	h.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows enc,
+// i.e. lists it without q=0.
+func acceptsEncoding(header, enc string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), enc) {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			f, err := strconv.ParseFloat(q, 64)
+			return err == nil && f > 0
+		}
+		return true
+	}
+	return false
 }
 
 func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
@@ -195,6 +445,14 @@ func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 	w.Write(s.guestConfig)
 }
 
+// handleCertFingerprint returns the self-signed certificate's SHA-256
+// fingerprint so clients can compare it against the browser's cert dialog.
+// Unauthenticated: the fingerprint is public (it is sent in every handshake).
+func (s *Server) handleCertFingerprint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(s.cfg.TLSFingerprint + "\n"))
+}
+
 func (s *Server) handleWHEPOptions(w http.ResponseWriter, r *http.Request) {
 	if !s.applyCORS(w, r) {
 		http.Error(w, "forbidden origin", 403)
@@ -202,10 +460,28 @@ func (s *Server) handleWHEPOptions(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-	w.Header().Set("Access-Control-Expose-Headers", "Location")
+	w.Header().Set("Access-Control-Expose-Headers", offerExposeHeaders)
 	w.WriteHeader(204)
 }
 
+// offerExposeHeaders are the offer response headers cross-origin clients
+// may read: the session URL and those set by streamHeadersLocked.
+const offerExposeHeaders = "Location, X-Bunghole-Codec, X-Bunghole-Resolution, X-Bunghole-FPS"
+
+// streamHeadersLocked describes the stream in an offer response, so
+// clients can show the codec, encoded size and frame rate without parsing
+// the SDP. Called with the pipeline running.
+func (s *Server) streamHeadersLocked(h http.Header) {
+	h.Set("X-Bunghole-Codec", s.codec)
+	h.Set("X-Bunghole-FPS", strconv.Itoa(s.cfg.FPS))
+	if s.capturer == nil {
+		return
+	}
+	if w, ht, err := encodeSize(s.codec, s.capturer.Width(), s.capturer.Height()); err == nil {
+		h.Set("X-Bunghole-Resolution", fmt.Sprintf("%dx%d", w, ht))
+	}
+}
+
 // --- Controller (interactive) endpoints ---
 
 func (s *Server) handleWHEPOffer(w http.ResponseWriter, r *http.Request) {
@@ -213,11 +489,13 @@ func (s *Server) handleWHEPOffer(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "forbidden origin", 403)
 		return
 	}
-	w.Header().Set("Access-Control-Expose-Headers", "Location")
+	w.Header().Set("Access-Control-Expose-Headers", offerExposeHeaders)
 
-	if !s.checkAuth(w, r) {
+	nonce, ok := s.checkCreateAuth(w, r)
+	if !ok {
 		return
 	}
+	defer s.releaseOnce(nonce)
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -241,17 +519,28 @@ func (s *Server) handleWHEPOffer(w http.ResponseWriter, r *http.Request) {
 	if err := s.ensurePipelineLocked(); err != nil {
 		s.mu.Unlock()
 		log.Printf("pipeline start error: %v", err)
-		http.Error(w, "internal error", 500)
+		pipelineStartError(w, err)
 		return
 	}
+	s.warnMobileLocked(r)
+	s.streamHeadersLocked(w.Header())
 
 	videoTrack := s.videoTrack
 	audioTrack := s.audioTrack
+	codec := s.codec
+	s.pendingOffers++
 	s.mu.Unlock()
+	defer s.offerDone()
+
+	// A video-only offer has no m-line to carry audio; adding the track
+	// anyway would leave it unnegotiated.
+	if !session.OfferHasAudio(offer) {
+		audioTrack = nil
+	}
 
 	sessionID := uuid.New().String()
-	sess, err := session.NewSession(sessionID, s.cfg.Display, s.cfg.Codec,
-		videoTrack, audioTrack,
+	sess, err := session.NewSession(sessionID, s.cfg.Display, codec,
+		videoTrack, audioTrack, s.requestKeyframe,
 		s.cfg.InputFactory, s.cfg.ClipFactory)
 	if err != nil {
 		log.Printf("session create error: %v", err)
@@ -293,9 +582,21 @@ func (s *Server) handleWHEPOffer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	sess.SetChatHandler(func(text string) { s.relayChat(sess, text) })
+
 	s.mu.Lock()
+	sess.SetInputLocked(s.inputLocked)
 	s.ctrl = sess
+	lateAudio := s.audioTrack
 	s.mu.Unlock()
+	s.bindOnce(nonce, sessionID)
+
+	// Audio may have come up while this offer was being processed.
+	if lateAudio != nil && lateAudio != audioTrack {
+		if err := sess.AddTrack(lateAudio); err != nil {
+			log.Printf("session %s: %v", sess.ID, err)
+		}
+	}
 
 	// Watch for controller disconnect
 	go s.watchSession(sess, true)
@@ -343,15 +644,48 @@ func (s *Server) handleWHEPDelete(w http.ResponseWriter, r *http.Request) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.ctrl == nil || s.ctrl.ID != id {
+	// DELETE is idempotent: a session that already ended (or was replaced
+	// by a newer controller) is as deleted as it gets.
+	if s.ctrl != nil && s.ctrl.ID == id {
+		s.ctrl.Close()
+		s.ctrl = nil
+		s.maybeStopPipelineLocked()
+	}
+	w.WriteHeader(204)
+}
+
+// handleWHEPRefresh asks for a keyframe on behalf of the controller, for
+// a client whose picture is corrupted and whose PLIs aren't getting
+// through; see refreshPicture.
+func (s *Server) handleWHEPRefresh(w http.ResponseWriter, r *http.Request) {
+	if !s.applyCORS(w, r) {
+		http.Error(w, "forbidden origin", 403)
+		return
+	}
+
+	if !s.checkAuth(w, r) {
+		return
+	}
+
+	id := r.PathValue("id")
+	s.mu.Lock()
+	sess := s.ctrl
+	s.mu.Unlock()
+
+	if sess == nil || sess.ID != id {
 		http.Error(w, "not found", 404)
 		return
 	}
 
-	s.ctrl.Close()
-	s.ctrl = nil
-	s.maybeStopPipelineLocked()
-	w.WriteHeader(200)
+	s.refreshPicture(w, sess)
+}
+
+// refreshPicture requests a keyframe the way an RTCP PLI does, so it is
+// coalesced with other requests and rate limited by KeyframeInterval.
+func (s *Server) refreshPicture(w http.ResponseWriter, sess *session.Session) {
+	log.Printf("session %s: picture refresh requested", sess.ID)
+	s.requestKeyframe()
+	w.WriteHeader(204)
 }
 
 // --- Viewer (view-only) endpoints ---
@@ -361,9 +695,17 @@ func (s *Server) handleViewerOffer(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "forbidden origin", 403)
 		return
 	}
-	w.Header().Set("Access-Control-Expose-Headers", "Location")
+	w.Header().Set("Access-Control-Expose-Headers", offerExposeHeaders)
 
-	if !s.checkAuth(w, r) {
+	nonce, ok := s.checkCreateAuth(w, r)
+	if !ok {
+		return
+	}
+	defer s.releaseOnce(nonce)
+
+	opts, err := viewerOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
 		return
 	}
 
@@ -382,16 +724,27 @@ func (s *Server) handleViewerOffer(w http.ResponseWriter, r *http.Request) {
 	if err := s.ensurePipelineLocked(); err != nil {
 		s.mu.Unlock()
 		log.Printf("pipeline start error: %v", err)
-		http.Error(w, "internal error", 500)
+		pipelineStartError(w, err)
 		return
 	}
+	s.warnMobileLocked(r)
+	s.streamHeadersLocked(w.Header())
 
 	videoTrack := s.videoTrack
 	audioTrack := s.audioTrack
+	codec := s.codec
+	s.pendingOffers++
 	s.mu.Unlock()
+	defer s.offerDone()
+
+	// A video-only offer has no m-line to carry audio; adding the track
+	// anyway would leave it unnegotiated.
+	if !session.OfferHasAudio(offer) {
+		audioTrack = nil
+	}
 
 	sessionID := uuid.New().String()
-	sess, err := session.NewViewerSession(sessionID, s.cfg.Codec, videoTrack, audioTrack)
+	sess, err := session.NewViewerSession(sessionID, codec, videoTrack, audioTrack, s.requestKeyframe, opts)
 	if err != nil {
 		log.Printf("viewer session create error: %v", err)
 		http.Error(w, "internal error", 500)
@@ -432,9 +785,19 @@ func (s *Server) handleViewerOffer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	sess.SetChatHandler(func(text string) { s.relayChat(sess, text) })
+
 	s.mu.Lock()
 	s.viewers[sessionID] = sess
+	lateAudio := s.audioTrack
 	s.mu.Unlock()
+	s.bindOnce(nonce, sessionID)
+
+	if lateAudio != nil && lateAudio != audioTrack {
+		if err := sess.AddTrack(lateAudio); err != nil {
+			log.Printf("session %s: %v", sess.ID, err)
+		}
+	}
 
 	go s.watchSession(sess, false)
 
@@ -444,6 +807,20 @@ func (s *Server) handleViewerOffer(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(sess.PC.LocalDescription().SDP))
 }
 
+// viewerOptions reads a viewer's options from its offer request: audio=0
+// (or false) in the query string asks for video only.
+func viewerOptions(r *http.Request) (session.ViewerOptions, error) {
+	var opts session.ViewerOptions
+	if v := r.URL.Query().Get("audio"); v != "" {
+		audio, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("bad audio parameter %q: want 0 or 1", v)
+		}
+		opts.NoAudio = !audio
+	}
+	return opts, nil
+}
+
 func (s *Server) handleViewerPatch(w http.ResponseWriter, r *http.Request) {
 	if !s.applyCORS(w, r) {
 		http.Error(w, "forbidden origin", 403)
@@ -481,16 +858,253 @@ func (s *Server) handleViewerDelete(w http.ResponseWriter, r *http.Request) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// Idempotent, like handleWHEPDelete.
+	if sess := s.viewers[id]; sess != nil {
+		sess.Close()
+		delete(s.viewers, id)
+		s.maybeStopPipelineLocked()
+	}
+	w.WriteHeader(204)
+}
+
+// handleViewerRefresh is handleWHEPRefresh for a viewer.
+func (s *Server) handleViewerRefresh(w http.ResponseWriter, r *http.Request) {
+	if !s.applyCORS(w, r) {
+		http.Error(w, "forbidden origin", 403)
+		return
+	}
+
+	if !s.checkAuth(w, r) {
+		return
+	}
+
+	id := r.PathValue("id")
+	s.mu.Lock()
 	sess := s.viewers[id]
+	s.mu.Unlock()
+
 	if sess == nil {
 		http.Error(w, "not found", 404)
 		return
 	}
 
-	sess.Close()
-	delete(s.viewers, id)
+	s.refreshPicture(w, sess)
+}
+
+// --- Status ---
+
+type statusResponse struct {
+	Pipeline   string     `json:"pipeline"` // "running", "stopped" or "error"
+	Error      string     `json:"error,omitempty"`
+	ErrorTime  *time.Time `json:"error_time,omitempty"`
+	Controller bool       `json:"controller"`
+	// ControllerSince is when the current controller connected.
+	ControllerSince *time.Time `json:"controller_since,omitempty"`
+	Viewers         int        `json:"viewers"`
+	InputLocked     bool       `json:"input_locked"`
+	// Frame rates while the pipeline runs: configured, achieved by the
+	// capture loop, and actually sent (lower when stale frames are skipped).
+	FPS        int     `json:"fps"`
+	CaptureFPS float64 `json:"capture_fps,omitempty"`
+	SentFPS    float64 `json:"sent_fps,omitempty"`
+	// Average and worst time from the controller's client sending an
+	// input event to its injection, over recent events. Only reported
+	// for clients that timestamp their events.
+	InputLatencyMS    float64 `json:"input_latency_ms,omitempty"`
+	InputLatencyMaxMS float64 `json:"input_latency_max_ms,omitempty"`
+	// Input events waiting for injection, and dropped since the
+	// controller connected because too many were waiting.
+	InputQueued  int    `json:"input_queued"`
+	InputDropped uint64 `json:"input_dropped"`
+}
+
+// handleStatus reports whether the pipeline is running and, if the last
+// attempt to start it failed, why, so the UI can show something better
+// than a stalled connect. It also says whether someone is in control,
+// for viewers of a shared session.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !s.applyCORS(w, r) {
+		http.Error(w, "forbidden origin", 403)
+		return
+	}
+
+	if !s.checkAuth(w, r) {
+		return
+	}
+
+	s.mu.Lock()
+	resp := statusResponse{
+		Pipeline:    "stopped",
+		Controller:  s.ctrl != nil,
+		Viewers:     len(s.viewers),
+		InputLocked: s.inputLocked,
+		FPS:         s.cfg.FPS,
+	}
+	if s.ctrl != nil {
+		since := s.ctrl.Created
+		resp.ControllerSince = &since
+		if avg, worst, n := s.ctrl.InputLatency(); n > 0 {
+			resp.InputLatencyMS = float64(avg.Microseconds()) / 1000
+			resp.InputLatencyMaxMS = float64(worst.Microseconds()) / 1000
+		}
+		resp.InputQueued, resp.InputDropped = s.ctrl.InputQueue()
+	}
+	switch {
+	case s.pipeStop != nil:
+		resp.Pipeline = "running"
+		resp.CaptureFPS = float64(s.loopFPS.Load()) / 100
+		resp.SentFPS = float64(s.sentFPS.Load()) / 100
+	case s.pipeErr != nil:
+		resp.Pipeline = "error"
+		resp.Error = s.pipeErr.Error()
+		at := s.pipeErrAt
+		resp.ErrorTime = &at
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// --- Session accounting ---
+
+type sessionInfo struct {
+	ID        string    `json:"id"`
+	Role      string    `json:"role"`
+	Connected time.Time `json:"connected"`
+	BytesSent uint64    `json:"bytes_sent"`
+}
+
+type sessionsResponse struct {
+	Sessions []sessionInfo `json:"sessions"`
+	// TotalBytesSent covers every session since startup, open or closed.
+	TotalBytesSent uint64 `json:"total_bytes_sent"`
+}
+
+// handleSessions lists connected sessions with the bytes sent to each, for
+// attributing bandwidth to clients.
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if !s.applyCORS(w, r) {
+		http.Error(w, "forbidden origin", 403)
+		return
+	}
+
+	if !s.checkAuth(w, r) {
+		return
+	}
+
+	s.mu.Lock()
+	resp := sessionsResponse{
+		Sessions:       []sessionInfo{},
+		TotalBytesSent: s.closedBytes,
+	}
+	for _, sess := range s.sessionsLocked() {
+		role := "viewer"
+		if sess == s.ctrl {
+			role = "controller"
+		}
+		n := sess.BytesSent()
+		resp.Sessions = append(resp.Sessions, sessionInfo{
+			ID:        sess.ID,
+			Role:      role,
+			Connected: sess.Created,
+			BytesSent: n,
+		})
+		resp.TotalBytesSent += n
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// --- Input lock ---
+
+// handleInputLock locks (POST) or unlocks (DELETE) controller input, e.g.
+// so nobody types while the screen is being presented. The lock outlasts
+// the controller: a new controller starts locked too.
+func (s *Server) handleInputLock(w http.ResponseWriter, r *http.Request) {
+	if !s.applyCORS(w, r) {
+		http.Error(w, "forbidden origin", 403)
+		return
+	}
+
+	if !s.checkAuth(w, r) {
+		return
+	}
+
+	locked := r.Method == http.MethodPost
+
+	s.mu.Lock()
+	s.inputLocked = locked
+	ctrl := s.ctrl
+	s.mu.Unlock()
+
+	if ctrl != nil {
+		ctrl.SetInputLocked(locked)
+	}
+	if locked {
+		log.Printf("controller input locked")
+	} else {
+		log.Printf("controller input unlocked")
+	}
+	w.WriteHeader(204)
+}
+
+// --- Chat ---
+
+// chatMessage is what the server sends on "chat" data channels: the text
+// of a message and who sent it.
+type chatMessage struct {
+	From string `json:"from"` // session ID of the sender
+	Role string `json:"role"` // "controller" or "viewer"
+	Text string `json:"text"`
+}
+
+// relayChat broadcasts a chat message from one session to all the others.
+func (s *Server) relayChat(from *session.Session, text string) {
+	s.mu.Lock()
+	role := "viewer"
+	if from == s.ctrl {
+		role = "controller"
+	}
+	sessions := s.sessionsLocked()
+	s.mu.Unlock()
+
+	data, err := json.Marshal(chatMessage{From: from.ID, Role: role, Text: text})
+	if err != nil {
+		return
+	}
+	for _, sess := range sessions {
+		if sess != from {
+			sess.SendChat(data)
+		}
+	}
+}
+
+// --- RTSP readers ---
+
+// rtspPlay starts the pipeline for an RTSP reader and keeps it running
+// until the matching rtspStop.
+func (s *Server) rtspPlay() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.ensurePipelineLocked(); err != nil {
+		log.Printf("pipeline start error: %v", err)
+		status, retryAfter := pipelineStartStatus(err)
+		return &rtsp.PlayError{Status: status, RetryAfter: retryAfter, Err: err}
+	}
+	s.rtspReaders++
+	return nil
+}
+
+func (s *Server) rtspStop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rtspReaders > 0 {
+		s.rtspReaders--
+	}
 	s.maybeStopPipelineLocked()
-	w.WriteHeader(200)
 }
 
 // --- Shared helpers ---
@@ -508,38 +1122,121 @@ func (s *Server) addICECandidates(sess *session.Session, w http.ResponseWriter,
 		return
 	}
 
-	lines := strings.Split(candidate, "\r\n")
-	for _, line := range lines {
+	rd := sess.PC.RemoteDescription()
+	for _, c := range parseTrickleFragment(candidate) {
+		if c.UsernameFragment != nil && rd != nil && !sdpHasUfrag(rd.SDP, *c.UsernameFragment) {
+			// From an earlier ICE generation; the client restarted ICE since.
+			log.Printf("dropping ice candidate for stale ufrag %s", *c.UsernameFragment)
+			continue
+		}
+		if err := sess.PC.AddICECandidate(c); err != nil {
+			log.Printf("add ice candidate error: %v", err)
+		}
+	}
+
+	w.WriteHeader(204)
+}
+
+// sdpHasUfrag reports whether an SDP uses the given ICE username fragment.
+func sdpHasUfrag(sdp, ufrag string) bool {
+	for _, line := range strings.Split(sdp, "\n") {
+		if strings.TrimSpace(line) == "a=ice-ufrag:"+ufrag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrickleFragment turns a trickle ICE SDP fragment (RFC 8840) into
+// candidates for AddICECandidate. Each candidate carries the mid, m-line
+// index and ufrag in effect where it appears, so it lands on the right
+// m-line; a=end-of-candidates becomes an empty candidate. Bare
+// a=candidate lines without any context are accepted too.
+func parseTrickleFragment(frag string) []webrtc.ICECandidateInit {
+	var (
+		out        []webrtc.ICECandidateInit
+		mid, ufrag *string
+		mLine      *uint16
+	)
+	for _, line := range strings.Split(frag, "\n") {
 		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "a=candidate:") {
+		switch {
+		case strings.HasPrefix(line, "m="):
+			var i uint16
+			if mLine != nil {
+				i = *mLine + 1
+			}
+			mLine, mid = &i, nil
+		case strings.HasPrefix(line, "a=mid:"):
+			v := strings.TrimPrefix(line, "a=mid:")
+			mid = &v
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			v := strings.TrimPrefix(line, "a=ice-ufrag:")
+			ufrag = &v
+		case strings.HasPrefix(line, "a=candidate:"), line == "a=end-of-candidates":
 			c := strings.TrimPrefix(line, "a=")
-			if err := sess.PC.AddICECandidate(webrtc.ICECandidateInit{
-				Candidate: c,
-			}); err != nil {
-				log.Printf("add ice candidate error: %v", err)
+			if c == "end-of-candidates" {
+				c = ""
 			}
+			out = append(out, webrtc.ICECandidateInit{
+				Candidate:        c,
+				SDPMid:           mid,
+				SDPMLineIndex:    mLine,
+				UsernameFragment: ufrag,
+			})
 		}
 	}
-
-	w.WriteHeader(204)
+	return out
 }
 
 func (s *Server) checkAuth(w http.ResponseWriter, r *http.Request) bool {
+	_, ok := s.authorize(w, r, false)
+	return ok
+}
+
+// checkCreateAuth is checkAuth for a request that creates a session or
+// stream. A single-use token is claimed by it: the token's nonce is
+// returned, for bindOnce or releaseOnce.
+func (s *Server) checkCreateAuth(w http.ResponseWriter, r *http.Request) (string, bool) {
+	return s.authorize(w, r, true)
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, create bool) (string, bool) {
 	ip := clientIP(r)
 	if s.isRateLimited(ip) {
 		http.Error(w, "too many auth failures", 429)
-		return false
+		return "", false
+	}
+
+	if s.cfg.ClientCertAuth {
+		// The handshake already requires a cert chaining to the client CA;
+		// this guards against the listener being misconfigured.
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			s.recordAuthFailure(ip)
+			http.Error(w, "client certificate required", 401)
+			return "", false
+		}
+		if s.cfg.Token == "" {
+			s.clearAuthFailures(ip)
+			return "", true
+		}
 	}
 
 	auth := r.Header.Get("Authorization")
 	if auth == "Bearer "+s.cfg.Token {
 		s.clearAuthFailures(ip)
-		return true
+		return "", true
+	}
+	if bearer, ok := strings.CutPrefix(auth, "Bearer "); ok {
+		if nonce, ok := s.checkSignedToken(bearer, ip, r.PathValue("id"), create); ok {
+			s.clearAuthFailures(ip)
+			return nonce, true
+		}
 	}
 
 	s.recordAuthFailure(ip)
 	http.Error(w, "unauthorized", 401)
-	return false
+	return "", false
 }
 
 // watchSession monitors a session's Stop channel and cleans up when it closes.
@@ -584,6 +1281,77 @@ func clientIP(r *http.Request) string {
 	return host
 }
 
+// checkSignedToken accepts a token minted by "bunghole token". A
+// single-use token creates one session: it is claimed by the first
+// request to create a session (or raw stream) with it, and afterwards
+// only accepted for requests about that session (id), so its client can
+// go on to trickle ICE, refresh and disconnect. The claiming request's
+// nonce is returned.
+func (s *Server) checkSignedToken(tok, ip, id string, create bool) (string, bool) {
+	if s.cfg.Token == "" || !strings.HasPrefix(tok, token.Prefix) {
+		return "", false
+	}
+	c, err := token.Verify(s.cfg.Token, tok)
+	if err != nil {
+		log.Printf("auth: %s: %v", ip, err)
+		return "", false
+	}
+	if !c.Once {
+		return "", true
+	}
+
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+	now := time.Now()
+	for nonce, u := range s.onceUsed {
+		if now.After(u.expires) {
+			delete(s.onceUsed, nonce)
+		}
+	}
+	if u, ok := s.onceUsed[c.Nonce]; ok {
+		if create || !u.bound || u.session == "" || id != u.session {
+			log.Printf("auth: %s: single-use token already used", ip)
+			return "", false
+		}
+		return "", true
+	}
+	if !create {
+		log.Printf("auth: %s: single-use token not yet used to create a session", ip)
+		return "", false
+	}
+	s.onceUsed[c.Nonce] = onceUse{expires: c.Expires}
+	return c.Nonce, true
+}
+
+// bindOnce binds a single-use token claimed by checkCreateAuth (nonce;
+// "" = none) to the session its request created, or "" for a raw stream.
+// It must be called before the response goes out, as the client may use
+// the token again as soon as it has the session's URL.
+func (s *Server) bindOnce(nonce, session string) {
+	if nonce == "" {
+		return
+	}
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+	if u, ok := s.onceUsed[nonce]; ok {
+		u.session, u.bound = session, true
+		s.onceUsed[nonce] = u
+	}
+}
+
+// releaseOnce frees a single-use token claimed by a request that failed
+// without binding it, so the client can retry (e.g. after a 503).
+func (s *Server) releaseOnce(nonce string) {
+	if nonce == "" {
+		return
+	}
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+	if u, ok := s.onceUsed[nonce]; ok && !u.bound {
+		delete(s.onceUsed, nonce)
+	}
+}
+
 func (s *Server) isRateLimited(ip string) bool {
 	s.authMu.Lock()
 	defer s.authMu.Unlock()
@@ -621,6 +1389,8 @@ func (s *Server) watchSession(sess *session.Session, isController bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.closedBytes += sess.BytesSent()
+
 	if isController {
 		if s.ctrl == sess {
 			s.ctrl = nil
@@ -636,51 +1406,230 @@ func (s *Server) watchSession(sess *session.Session, isController bool) {
 	s.maybeStopPipelineLocked()
 }
 
+// reapSessions disconnects sessions that have been connected longer than
+// MaxSessionDuration. Closing a session runs the usual watchSession cleanup.
+func (s *Server) reapSessions() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	closing := make(map[*session.Session]bool) // CloseWithReason in progress
+	for range ticker.C {
+		s.mu.Lock()
+		sessions := s.sessionsLocked()
+		s.mu.Unlock()
+
+		live := make(map[*session.Session]bool, len(sessions))
+		for _, sess := range sessions {
+			live[sess] = true
+			if closing[sess] || time.Since(sess.Created) < s.cfg.MaxSessionDuration {
+				continue
+			}
+			closing[sess] = true
+			go sess.CloseWithReason("maximum session duration reached")
+		}
+		for sess := range closing {
+			if !live[sess] {
+				delete(closing, sess)
+			}
+		}
+	}
+}
+
 // --- Pipeline lifecycle ---
 
+// pipeState is where the capture/encode pipeline is in its lifecycle. All
+// transitions happen under s.mu. There is no starting state: the pipeline
+// is built without releasing s.mu, so nobody can observe it half-built.
+type pipeState int
+
+const (
+	pipeStopped  pipeState = iota
+	pipeRunning            // runPipeline is running; pipeStop is set
+	pipeStopping           // pipeStop was closed; runPipeline is releasing the capturer and encoder
+)
+
 // ensurePipelineLocked starts the capture/encode pipeline if not already running.
-// Must be called with s.mu held.
+// Must be called with s.mu held; it may release it while waiting for a
+// previous pipeline to finish stopping.
 func (s *Server) ensurePipelineLocked() error {
-	if s.pipeStop != nil {
-		return nil // already running
+	// The capturer being released (e.g. an NvFBC session) may be one the
+	// new pipeline needs, so let the old one finish first.
+	for s.pipeState == pipeStopping {
+		s.pipeDone.Wait()
+	}
+	s.cancelLingerLocked()
+	if s.pipeState == pipeRunning {
+		return nil
 	}
 
-	// Wait for any previous pipeline goroutine to finish cleanup
-	s.mu.Unlock()
-	s.pipeWg.Wait()
-	s.mu.Lock()
+	err := s.startPipelineLocked()
+	s.pipeErr = err
+	if err != nil {
+		s.pipeErrAt = time.Now()
+	}
+	return err
+}
 
-	// Re-check after re-acquiring lock
-	if s.pipeStop != nil {
-		return nil
+// pipelineRetryAfter is the Retry-After, in seconds, sent with a 503 when
+// the pipeline can't start yet.
+const pipelineRetryAfter = 2
+
+// transientError marks a pipeline start failure that may clear up by
+// itself, such as the display still coming up, as opposed to one that
+// won't (no usable encoder, unsupported size).
+type transientError struct{ err error }
+
+func (e transientError) Error() string { return e.err.Error() }
+func (e transientError) Unwrap() error { return e.err }
+
+// pipelineStartError answers a request for which the pipeline failed to
+// start: 503 with Retry-After if it may work shortly, so clients back off
+// and retry, otherwise 500.
+func pipelineStartError(w http.ResponseWriter, err error) {
+	status, retryAfter := pipelineStartStatus(err)
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, "display not ready: "+err.Error(), status)
+		return
+	}
+	http.Error(w, "pipeline start failed: "+err.Error(), status)
+}
+
+// pipelineStartStatus returns the status pipelineStartError answers err
+// with, and its Retry-After in seconds (0 = none). RTSP shares HTTP's
+// status codes and Retry-After.
+func pipelineStartStatus(err error) (status, retryAfter int) {
+	var te transientError
+	if errors.As(err, &te) {
+		return 503, pipelineRetryAfter
+	}
+	return 500, 0
+}
+
+// encodeSize returns the size to encode a capture of w x h at. 4:2:0
+// chroma covers 2x2 pixel blocks, so odd dimensions are rounded down and
+// the last row or column is dropped; the encoders read a sub-rectangle of
+// the frame, so no copy is needed. Sizes beyond what NVENC and browser
+// decoders accept (4096 for H.264, 8192 for H.265) are rejected.
+func encodeSize(codec string, w, h int) (int, int, error) {
+	limit := 4096
+	if codec == "h265" {
+		limit = 8192
+	}
+	if w > limit || h > limit {
+		return 0, 0, fmt.Errorf("capture is %dx%d, larger than %s supports (%d per side)", w, h, codec, limit)
+	}
+	if w < 2 || h < 2 {
+		return 0, 0, fmt.Errorf("capture is %dx%d, too small to encode", w, h)
+	}
+	return w &^ 1, h &^ 1, nil
+}
+
+// checkFrame rejects a grabbed frame the encoder can't safely read: the
+// encoders read width x height pixels at the frame's stride from its
+// buffer, whatever the frame claims, so a capturer glitch (a resolution
+// change mid-stream, a NULL NvFBC buffer) would otherwise have them read
+// out of bounds.
+func checkFrame(f *types.Frame, width, height int) error {
+	if f == nil || (f.Ptr == nil && f.Data == nil) {
+		return errors.New("no pixel data")
+	}
+	if f.Width < width || f.Height < height {
+		return fmt.Errorf("%w: frame is %dx%d, encoding %dx%d", types.ErrFrameSize, f.Width, f.Height, width, height)
+	}
+	bpp, rows := 4, f.Height
+	if f.PixFmt == types.PixFmtNV12 {
+		bpp, rows = 1, f.Height*3/2
+	}
+	if f.Stride < f.Width*bpp {
+		return fmt.Errorf("stride %d is too short for %d pixels", f.Stride, f.Width)
 	}
+	if f.Ptr == nil && len(f.Data) < f.Stride*rows {
+		return fmt.Errorf("%d bytes of data, %d needed", len(f.Data), f.Stride*rows)
+	}
+	return nil
+}
+
+// offerDone ends the pipeline claim an offer took in handleOffer or
+// handleViewerOffer. If the offer failed and nobody else is left, the
+// pipeline it started is stopped.
+func (s *Server) offerDone() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pendingOffers--
+	s.maybeStopPipelineLocked()
+}
 
+// startPipelineLocked does the work of ensurePipelineLocked.
+// Must be called with s.mu held and the pipeline stopped.
+func (s *Server) startPipelineLocked() error {
 	cap, err := s.cfg.NewCapturer(s.cfg.Display, s.cfg.FPS, s.cfg.GPU)
 	if err != nil {
-		return fmt.Errorf("capturer init: %w", err)
+		// Most likely the display isn't up yet (e.g. just after --start-x).
+		return transientError{fmt.Errorf("capturer init: %w", err)}
+	}
+
+	encGPU := s.cfg.GPU
+	if s.cfg.EncodeGPU >= 0 {
+		encGPU = s.cfg.EncodeGPU
 	}
 
 	var cudaCtx, cuMemcpy2D unsafe.Pointer
-	if cp, ok := cap.(types.CUDAProvider); ok {
+	if hp, ok := cap.(types.HostFrameProvider); ok && encGPU != s.cfg.GPU {
+		// The capturer's CUDA context lives on the capture GPU, so frames
+		// can't be handed to NVENC on another GPU zero-copy. Bounce them
+		// through host memory instead.
+		hp.SetHostFrames(true)
+		log.Printf("pipeline: capture on GPU %d, encode on GPU %d (frames copied via host memory)", s.cfg.GPU, encGPU)
+	} else if cp, ok := cap.(types.CUDAProvider); ok {
 		cudaCtx = cp.CUDAContext()
 		cuMemcpy2D = cp.CuMemcpy2D()
 	}
 
-	enc, err := s.cfg.NewEncoder(cap.Width(), cap.Height(), s.cfg.FPS, s.cfg.Bitrate,
-		s.cfg.GPU, s.cfg.Codec, s.cfg.GOP, cudaCtx, cuMemcpy2D)
+	width, height, err := encodeSize(s.cfg.Codec, cap.Width(), cap.Height())
+	if err != nil {
+		cap.Close()
+		return err
+	}
+	if width != cap.Width() || height != cap.Height() {
+		log.Printf("pipeline: capture is %dx%d, encoding %dx%d (4:2:0 needs even dimensions)",
+			cap.Width(), cap.Height(), width, height)
+	}
+
+	enc, err := s.cfg.NewEncoder(width, height, s.cfg.FPS, s.cfg.Bitrate,
+		encGPU, s.cfg.Codec, s.cfg.GOP, s.cfg.Encoder, cudaCtx, cuMemcpy2D)
 	if err != nil {
 		cap.Close()
 		return fmt.Errorf("encoder init: %w", err)
 	}
 
+	// The track advertises what the encoder actually produces: its codec
+	// (H.264 when H.265 fell back, see --codec-fallback) and profile.
+	format := enc.Format()
+	codec := format.Codec
+	if codec != s.cfg.Codec {
+		log.Printf("pipeline: %s requested, encoding %s", s.cfg.Codec, codec)
+		// The size was checked against the requested codec, and H.264
+		// allows less than H.265.
+		if _, _, err := encodeSize(codec, cap.Width(), cap.Height()); err != nil {
+			enc.Close()
+			cap.Close()
+			return err
+		}
+	}
+
 	// Create shared tracks
 	var videoMimeType, videoFmtp string
-	if s.cfg.Codec == "h265" {
+	if codec == "h265" {
 		videoMimeType = webrtc.MimeTypeH265
 		videoFmtp = "profile-id=1"
 	} else {
 		videoMimeType = webrtc.MimeTypeH264
-		videoFmtp = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f"
+		level := format.Level
+		if level == 0 {
+			level = h264MinLevel(width, height, s.cfg.FPS, s.cfg.Bitrate, format.Profile)
+		}
+		videoFmtp = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + h264ProfileLevelID(format.Profile, level)
 	}
 
 	videoTrack, err := webrtc.NewTrackLocalStaticSample(
@@ -689,7 +1638,7 @@ func (s *Server) ensurePipelineLocked() error {
 			ClockRate:   90000,
 			SDPFmtpLine: videoFmtp,
 		},
-		"video", "bunghole",
+		"video", s.cfg.StreamID,
 	)
 	if err != nil {
 		enc.Close()
@@ -697,58 +1646,101 @@ func (s *Server) ensurePipelineLocked() error {
 		return fmt.Errorf("create video track: %w", err)
 	}
 
-	audioTrack, err := webrtc.NewTrackLocalStaticSample(
-		webrtc.RTPCodecCapability{
-			MimeType:  webrtc.MimeTypeOpus,
-			ClockRate: 48000,
-			Channels:  2,
-		},
-		"audio", "bunghole",
-	)
-	if err != nil {
-		enc.Close()
-		cap.Close()
-		return fmt.Errorf("create audio track: %w", err)
-	}
-
+	// The audio track is created by runAudio once audio capture is up,
+	// and added to already-connected sessions via renegotiation.
 	s.capturer = cap
 	s.encoder = enc
+	s.codec = codec
 	s.videoTrack = videoTrack
-	s.audioTrack = audioTrack
 	s.pipeStop = make(chan struct{})
+	s.pipeState = pipeRunning
 
-	s.pipeWg.Add(1)
-	go s.runPipeline(cap, enc, videoTrack, audioTrack, s.pipeStop)
+	go s.runPipeline(cap, enc, videoTrack, s.pipeStop)
 
-	log.Printf("pipeline started (%dx%d, %s)", cap.Width(), cap.Height(), s.cfg.Codec)
+	log.Printf("pipeline started (%dx%d, %s)", width, height, codec)
 	return nil
 }
 
 // maybeStopPipelineLocked stops the pipeline if no sessions remain.
+// With PipelineLinger set, the stop is delayed so a quick reconnect can
+// reuse the running capturer/encoder (and its CUDA context).
 // Must be called with s.mu held.
 func (s *Server) maybeStopPipelineLocked() {
-	if s.ctrl != nil || len(s.viewers) > 0 {
+	if s.hasClientsLocked() {
 		return
 	}
-	s.stopPipelineLocked()
+	if s.cfg.PipelineLinger <= 0 || s.pipeStop == nil {
+		s.stopPipelineLocked()
+		return
+	}
+	if s.linger != nil {
+		return // already scheduled
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(s.cfg.PipelineLinger, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.linger != t {
+			return // cancelled or superseded
+		}
+		s.linger = nil
+		if !s.hasClientsLocked() {
+			log.Printf("pipeline idle for %v, stopping", s.cfg.PipelineLinger)
+			s.stopPipelineLocked()
+		}
+	})
+	s.linger = t
+	s.paused.Store(true)
+	log.Printf("last session left, pipeline lingering for %v (paused)", s.cfg.PipelineLinger)
+}
+
+// hasClientsLocked reports whether anything still consumes the pipeline.
+// Must be called with s.mu held.
+func (s *Server) hasClientsLocked() bool {
+	if s.ctrl != nil || len(s.viewers) > 0 || s.rtspReaders > 0 || s.pendingOffers > 0 {
+		return true
+	}
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	return len(s.streams) > 0
+}
+
+// cancelLingerLocked cancels a pending delayed stop.
+// Must be called with s.mu held.
+func (s *Server) cancelLingerLocked() {
+	if s.linger != nil {
+		s.linger.Stop()
+		s.linger = nil
+	}
+	s.paused.Store(false)
 }
 
 // stopPipelineLocked signals the pipeline to stop.
 // Must be called with s.mu held.
 func (s *Server) stopPipelineLocked() {
-	if s.pipeStop == nil {
+	s.cancelLingerLocked()
+	if s.pipeState != pipeRunning {
 		return
 	}
 	close(s.pipeStop)
 	s.pipeStop = nil
-	// Cleanup happens in runPipeline's defer
+	s.pipeState = pipeStopping
+	// Cleanup happens in runPipeline's defer, which then marks it stopped.
 }
 
 // runPipeline is the capture/encode loop. It writes to shared tracks and
 // stops when pipeStop is closed. Cleanup of cap/enc/audio is done in defer.
-func (s *Server) runPipeline(cap types.MediaCapturer, enc types.VideoEncoder, videoTrack, audioTrack *webrtc.TrackLocalStaticSample, stop chan struct{}) {
-	defer s.pipeWg.Done()
+func (s *Server) runPipeline(cap types.MediaCapturer, enc types.VideoEncoder, videoTrack *webrtc.TrackLocalStaticSample, stop chan struct{}) {
+	// Goroutines that write to the tracks or use the encoder or audio
+	// capturer. They return once stop is closed, and are waited for before
+	// anything they use is released, so nothing is written, forced or
+	// read after teardown.
+	var helpers sync.WaitGroup
+
 	defer func() {
+		helpers.Wait()
+
 		s.mu.Lock()
 		// Only nil out if these are still our resources
 		if s.capturer == cap {
@@ -757,129 +1749,359 @@ func (s *Server) runPipeline(cap types.MediaCapturer, enc types.VideoEncoder, vi
 		if s.encoder == enc {
 			s.encoder = nil
 		}
-		if s.audio != nil {
-			s.audio.Close()
-			s.audio = nil
-		}
 		if s.videoTrack == videoTrack {
 			s.videoTrack = nil
 		}
-		if s.audioTrack == audioTrack {
-			s.audioTrack = nil
-		}
 		s.mu.Unlock()
 
+		s.loopFPS.Store(0)
+		s.sentFPS.Store(0)
+
 		// Close encoder before capturer (encoder uses CUDA context owned by capturer)
 		enc.Close()
 		cap.Close()
 		log.Printf("pipeline stopped")
-	}()
 
-	// Start audio capture (non-fatal if it fails)
-	var (
-		ac  types.AudioCapturer
-		err error
-	)
-	if s.cfg.AudioUDPListen != "" {
-		ac, err = audio.NewUDPAudioCapture(s.cfg.AudioUDPListen)
-		if err == nil {
-			log.Printf("audio: source=guest-udp listen=%s", s.cfg.AudioUDPListen)
-		}
-	} else if s.cfg.VsockAudioCh != nil {
-		// Vsock first when available (VM mode) — the guest HAL driver
-		// sends Opus directly over vsock, no host-side SCK needed.
-		ac = audio.NewVsockAudioCapture(s.cfg.VsockAudioCh)
-		log.Printf("audio: source=guest-vsock")
-		err = nil
-	} else {
-		// Host desktop mode — capture via ScreenCaptureKit.
-		ac, err = audio.NewAudioCapture()
-	}
-	if err != nil {
-		log.Printf("audio capture init failed (continuing without audio): %v", err)
-	} else {
 		s.mu.Lock()
-		s.audio = ac
+		if s.pipeStop == stop {
+			s.pipeStop = nil // exited without being asked to
+		}
+		s.pipeState = pipeStopped
+		s.pipeDone.Broadcast()
 		s.mu.Unlock()
+	}()
+
+	if len(s.cfg.PinCPUs) > 0 {
+		if err := pinPipelineThread(s.cfg.PinCPUs); err != nil {
+			log.Printf("pipeline: CPU pinning failed (continuing unpinned): %v", err)
+		} else {
+			log.Printf("pipeline: pinned to CPUs %v", s.cfg.PinCPUs)
+		}
+	}
+	s.mu.Lock()
+	rs := s.rtsp
+	s.mu.Unlock()
+	if rs != nil {
+		rs.Resync()
+	}
+
+	if s.cfg.Realtime {
+		if desc, err := raisePipelinePriority(); err != nil {
+			log.Printf("pipeline: priority boost failed (continuing at normal priority): %v", err)
+		} else {
+			log.Printf("pipeline: running with %s", desc)
+		}
+	}
 
-		audioPkts := make(chan *types.OpusPacket, 10)
-		go ac.Run(audioPkts, stop)
+	// Audio is optional: video runs whether or not it ever comes up.
+	if s.cfg.NewAudioCapturer != nil {
+		helpers.Add(1)
 		go func() {
-			for {
-				select {
-				case <-stop:
-					return
-				case pkt := <-audioPkts:
-					audioTrack.WriteSample(media.Sample{
-						Data:     pkt.Data,
-						Duration: pkt.Duration,
-					})
-				}
-			}
+			defer helpers.Done()
+			s.runAudio(rs, stop)
+		}()
+	}
+
+	kf, canForceKey := enc.(types.KeyframeForcer)
+	if canForceKey {
+		helpers.Add(1)
+		go func() {
+			defer helpers.Done()
+			s.runKeyframeBridge(kf, stop)
 		}()
 	}
 
 	frameDur := time.Duration(float64(time.Second) / float64(s.cfg.FPS))
-	ticker := time.NewTicker(frameDur)
-	defer ticker.Stop()
+	pacer := newFramePacer(s.cfg.EvenPacing, frameDur)
+	defer pacer.Stop()
 
-	var loopCount, grabFails, encodeFails, encodeNils int
+	var loopCount, grabFails, badFrames, encodeFails, encodeNils, staleSkips int
 	lastStats := time.Now()
 
-	for {
-		select {
-		case <-stop:
-			return
-		case <-ticker.C:
-			loopCount++
-			t0 := time.Now()
+	// The size the encoder was opened with; see checkFrame.
+	encWidth, encHeight, _ := encodeSize(enc.Format().Codec, cap.Width(), cap.Height())
+
+	// Stale frames (nothing changed on screen) are not encoded: the
+	// decoder keeps showing the last picture. One is still encoded every
+	// second as a refresh. That is too slow to count on for keyframes,
+	// as the GOP is counted in encoded frames, so clients that join
+	// request one, which is encoded stale or not (kfPending). skipped
+	// carries the gap into the next sample's RTP timestamp.
+	var staleRun, skipped int
+
+	// Achieved rates, measured against the wall clock: the pacer skips
+	// frames when grab+encode overruns the frame interval.
+	var fpsLoops, fpsSent int
+	fpsStart := time.Now()
+
+	// While lingering with nobody watching, the capturer and encoder (and
+	// their CUDA context / NvFBC session) stay open but no frames are
+	// grabbed or encoded. The first frame after resuming is an IDR.
+	var wasPaused bool
+
+	for pacer.Wait(stop) {
+		if s.paused.Load() {
+			if !wasPaused {
+				wasPaused = true
+				s.loopFPS.Store(0)
+				s.sentFPS.Store(0)
+			}
+			continue
+		}
+		if wasPaused {
+			wasPaused = false
+			fpsLoops, fpsSent = 0, 0
+			fpsStart = time.Now()
+			if canForceKey {
+				kf.ForceKeyframe()
+			}
+			s.kfPending.Store(true)
+			log.Printf("pipeline resumed")
+		}
 
-			frame, err := cap.Grab()
-			if err != nil {
-				grabFails++
-				continue
+		loopCount++
+		fpsLoops++
+		t0 := time.Now()
+		if el := t0.Sub(fpsStart); el >= time.Second {
+			s.loopFPS.Store(int64(float64(fpsLoops) * 100 / el.Seconds()))
+			s.sentFPS.Store(int64(float64(fpsSent) * 100 / el.Seconds()))
+			fpsLoops, fpsSent = 0, 0
+			fpsStart = t0
+		}
+
+		frame, err := cap.Grab()
+		if err != nil {
+			grabFails++
+			continue
+		}
+		if err := checkFrame(frame, encWidth, encHeight); err != nil {
+			if errors.Is(err, types.ErrFrameSize) {
+				s.frameSizeChanged(stop, err)
+				return
 			}
-			tGrab := time.Since(t0)
-
-			t1 := time.Now()
-			encoded, err := enc.Encode(frame)
-			if err != nil {
-				encodeFails++
-				if encodeFails <= 5 {
-					log.Printf("encode error: %v", err)
-				}
-				continue
+			grabFails++
+			if badFrames++; badFrames <= 5 {
+				log.Printf("pipeline: dropping bad frame from capturer: %v", err)
 			}
-			tEncode := time.Since(t1)
+			continue
+		}
+		tGrab := time.Since(t0)
 
-			if encoded == nil {
-				encodeNils++
+		if frame.Stale {
+			staleRun++
+			if staleRun < s.cfg.FPS && !s.kfPending.Load() {
+				staleSkips++
+				skipped++
 				continue
 			}
+		}
+		staleRun = 0
+		s.kfPending.Store(false)
+
+		t1 := time.Now()
+		encoded, err := enc.Encode(frame)
+		if err != nil {
+			if errors.Is(err, types.ErrFrameSize) {
+				s.frameSizeChanged(stop, err)
+				return
+			}
+			encodeFails++
+			if encodeFails <= 5 {
+				log.Printf("encode error: %v", err)
+			}
+			continue
+		}
+		tEncode := time.Since(t1)
 
-			t2 := time.Now()
-			// WriteSample broadcasts to all bound PeerConnections.
-			// Ignore errors — they occur when no PCs are bound yet.
-			videoTrack.WriteSample(media.Sample{
-				Data:     encoded.Data,
-				Duration: frameDur,
-			})
-			tSend := time.Since(t2)
-
-			if s.cfg.Stats && time.Since(lastStats) >= 5*time.Second {
-				log.Printf("pipeline: loops=%d grabFail=%d encFail=%d encNil=%d | last: grab=%v enc=%v send=%v",
-					loopCount, grabFails, encodeFails, encodeNils,
-					tGrab.Round(time.Microsecond), tEncode.Round(time.Microsecond), tSend.Round(time.Microsecond))
-				loopCount = 0
-				grabFails = 0
-				encodeFails = 0
-				encodeNils = 0
-				lastStats = time.Now()
+		if encoded == nil {
+			encodeNils++
+			continue
+		}
+
+		t2 := time.Now()
+		// WriteSample broadcasts to all bound PeerConnections.
+		// Ignore errors — they occur when no PCs are bound yet.
+		videoTrack.WriteSample(media.Sample{
+			Data:               encoded.Data,
+			Duration:           frameDur,
+			PrevDroppedPackets: uint16(skipped),
+		})
+		skipped = 0
+		fpsSent++
+		s.publishStream(encoded)
+		if rs != nil {
+			rs.WriteVideo(encoded.Data, encoded.IsKey)
+		}
+		tSend := time.Since(t2)
+
+		if s.cfg.Stats && time.Since(lastStats) >= 5*time.Second {
+			log.Printf("pipeline: fps=%.1f/%.1f/%d (capture/sent/target) loops=%d grabFail=%d encFail=%d encNil=%d stale=%d kfForced=%d kfCoalesced=%d | last: grab=%v enc=%v send=%v%s",
+				float64(s.loopFPS.Load())/100, float64(s.sentFPS.Load())/100, s.cfg.FPS,
+				loopCount, grabFails, encodeFails, encodeNils, staleSkips,
+				s.kfForced.Swap(0), s.kfCoalesced.Swap(0),
+				tGrab.Round(time.Microsecond), tEncode.Round(time.Microsecond), tSend.Round(time.Microsecond),
+				s.inputStats())
+			loopCount = 0
+			grabFails = 0
+			encodeFails = 0
+			encodeNils = 0
+			staleSkips = 0
+			lastStats = time.Now()
+		}
+	}
+}
+
+// rtpOutboundMTU is the RTP packet size limit, as pion uses for the
+// tracks it packetizes itself.
+const rtpOutboundMTU = 1200
+
+// runAudio opens audio capture, retrying every AudioRetry until it works
+// or stop is closed, so audio that isn't up yet when the pipeline starts
+// (a PulseAudio server still starting, a guest not yet connected) joins
+// later. Once it works, the audio track is created and added to every
+// session already connected, which renegotiates them, and captured
+// packets are sent to it and to RTSP until stop is closed.
+func (s *Server) runAudio(rs *rtsp.Server, stop chan struct{}) {
+	var ac types.AudioCapturer
+	for attempt := 1; ; attempt++ {
+		var err error
+		if ac, err = s.cfg.NewAudioCapturer(); err == nil {
+			if attempt > 1 {
+				log.Printf("audio capture started after %d attempts", attempt)
+			}
+			break
+		}
+		if attempt == 1 {
+			log.Printf("audio capture init failed (continuing without audio, retrying every %v): %v", s.cfg.AudioRetry, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(s.cfg.AudioRetry):
+		}
+	}
+
+	track, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{
+			MimeType:  webrtc.MimeTypeOpus,
+			ClockRate: 48000,
+			Channels:  2,
+		},
+		"audio", s.cfg.StreamID,
+	)
+	if err != nil {
+		ac.Close()
+		log.Printf("create audio track (continuing without audio): %v", err)
+		return
+	}
+	// Packets are packetized here rather than by a TrackLocalStaticSample,
+	// which reports frames skipped by DTX as dropped packets: that skips
+	// sequence numbers too, so receivers count every silence as loss and
+	// conceal it instead of playing comfort noise. DTX (RFC 7587) keeps
+	// sequence numbers contiguous and only advances the timestamp. SSRC
+	// and payload type are set per PeerConnection by the track.
+	packetizer := rtp.NewPacketizer(rtpOutboundMTU, 0, 0, &codecs.OpusPayloader{},
+		rtp.NewRandomSequencer(), 48000)
+
+	// Publishing the track and listing the sessions under one lock means
+	// an offer registering its session concurrently either is listed here
+	// or finds the track when it registers.
+	s.mu.Lock()
+	select {
+	case <-stop:
+		s.mu.Unlock()
+		ac.Close()
+		return
+	default:
+	}
+	s.audio = ac
+	s.audioTrack = track
+	sessions := s.sessionsLocked()
+	s.mu.Unlock()
+
+	for _, sess := range sessions {
+		if err := sess.AddTrack(track); err != nil {
+			log.Printf("session %s: %v", sess.ID, err)
+		}
+	}
+
+	pkts := make(chan *types.OpusPacket, 10)
+	ran := make(chan struct{})
+	go func() {
+		defer close(ran)
+		ac.Run(pkts, stop)
+	}()
+	defer func() {
+		<-ran
+		s.mu.Lock()
+		if s.audio == ac {
+			s.audio = nil
+		}
+		if s.audioTrack == track {
+			s.audioTrack = nil
+		}
+		s.mu.Unlock()
+		ac.Close()
+	}()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case pkt := <-pkts:
+			samples := uint32(pkt.Duration * 48000 / time.Second)
+			if pkt.Skipped > 0 {
+				packetizer.SkipSamples(uint32(pkt.Skipped) * samples)
+			}
+			// Errors only mean no PeerConnection is bound yet.
+			for _, p := range packetizer.Packetize(pkt.Data, samples) {
+				track.WriteRTP(p)
+			}
+			if rs != nil {
+				rs.WriteAudio(pkt.Data)
 			}
 		}
 	}
 }
 
+// frameSizeChanged stops the pipeline whose capture changed size under
+// it. The encoder and the video track sessions negotiated are both sized
+// for the old capture, so sessions and streams are closed, telling
+// clients why, and reconnecting builds a pipeline at the new size.
+func (s *Server) frameSizeChanged(stop chan struct{}, err error) {
+	log.Printf("pipeline: %v; stopping so clients reconnect at the new size", err)
+	s.mu.Lock()
+	if s.pipeStop != stop {
+		s.mu.Unlock()
+		return // already being stopped
+	}
+	sessions := s.sessionsLocked()
+	s.stopPipelineLocked()
+	s.mu.Unlock()
+
+	s.closeStreams()
+	for _, sess := range sessions {
+		go sess.CloseWithReason("display resolution changed")
+	}
+}
+
+// inputStats formats the controller's input queue and latency for the
+// --stats line, or returns "" without a controller.
+func (s *Server) inputStats() string {
+	s.mu.Lock()
+	ctrl := s.ctrl
+	s.mu.Unlock()
+	if ctrl == nil {
+		return ""
+	}
+	queued, dropped := ctrl.InputQueue()
+	out := fmt.Sprintf(" | input: queued=%d dropped=%d", queued, dropped)
+	if avg, worst, n := ctrl.InputLatency(); n > 0 {
+		out += fmt.Sprintf(" latency=%v/%v (avg/max)", avg.Round(100*time.Microsecond), worst.Round(100*time.Microsecond))
+	}
+	return out
+}
+
 func (s *Server) handleDebugFrame(w http.ResponseWriter, r *http.Request) {
 	if !s.checkAuth(w, r) {
 		return
@@ -917,6 +2139,19 @@ func (s *Server) handleDebugFrame(w http.ResponseWriter, r *http.Request) {
 	png.Encode(w, img)
 }
 
+// sessionsLocked returns the controller (if any) and all viewers.
+// Must be called with s.mu held.
+func (s *Server) sessionsLocked() []*session.Session {
+	sessions := make([]*session.Session, 0, len(s.viewers)+1)
+	if s.ctrl != nil {
+		sessions = append(sessions, s.ctrl)
+	}
+	for _, v := range s.viewers {
+		sessions = append(sessions, v)
+	}
+	return sessions
+}
+
 func (s *Server) teardownLocked() {
 	if s.ctrl != nil {
 		s.ctrl.Close()
@@ -926,5 +2161,6 @@ func (s *Server) teardownLocked() {
 		v.Close()
 		delete(s.viewers, id)
 	}
+	s.closeStreams()
 	s.stopPipelineLocked()
 }
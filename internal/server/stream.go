@@ -0,0 +1,150 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"bunghole/internal/types"
+)
+
+// streamClientBuffer is how many encoded frames a raw stream client may
+// fall behind before frames are dropped (about two seconds at 30 fps).
+const streamClientBuffer = 60
+
+// streamClient receives the encoded video for one GET /stream.* request.
+type streamClient struct {
+	frames  chan []byte
+	synced  bool // a keyframe has been queued since start or the last drop
+	dropped int
+}
+
+// streamExt returns the file extension of the raw stream for a codec.
+func streamExt(codec string) string {
+	if codec == "h265" {
+		return "h265"
+	}
+	return "h264"
+}
+
+// handleStream serves the encoded video as a raw Annex-B elementary stream
+// for players that can't do WebRTC (ffmpeg, VLC, mpv). The stream starts
+// at the next keyframe and keeps the pipeline running while connected.
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	if !s.applyCORS(w, r) {
+		http.Error(w, "forbidden origin", 403)
+		return
+	}
+
+	nonce, ok := s.checkCreateAuth(w, r)
+	if !ok {
+		return
+	}
+	defer s.releaseOnce(nonce)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", 500)
+		return
+	}
+
+	c := &streamClient{frames: make(chan []byte, streamClientBuffer)}
+
+	s.mu.Lock()
+	if err := s.ensurePipelineLocked(); err != nil {
+		s.mu.Unlock()
+		log.Printf("pipeline start error: %v", err)
+		pipelineStartError(w, err)
+		return
+	}
+	if ext := streamExt(s.codec); !strings.HasSuffix(r.URL.Path, "."+ext) {
+		// The encoder produces the other codec (see --codec-fallback);
+		// send the player to the stream it can decode.
+		s.maybeStopPipelineLocked()
+		s.mu.Unlock()
+		u := "/stream." + ext
+		if r.URL.RawQuery != "" {
+			u += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+		return
+	}
+	codec := s.codec
+	s.streamMu.Lock()
+	s.streams[c] = struct{}{}
+	s.streamMu.Unlock()
+	s.mu.Unlock()
+	s.bindOnce(nonce, "")
+	// The encoder's own keyframes may be a GOP away, and on an idle
+	// desktop only one frame a second is encoded.
+	s.requestKeyframe()
+
+	ip := clientIP(r)
+	log.Printf("stream client %s connected", ip)
+	defer func() {
+		s.mu.Lock()
+		s.streamMu.Lock()
+		delete(s.streams, c)
+		dropped := c.dropped
+		s.streamMu.Unlock()
+		s.maybeStopPipelineLocked()
+		s.mu.Unlock()
+		log.Printf("stream client %s disconnected (%d frames dropped)", ip, dropped)
+	}()
+
+	w.Header().Set("Content-Type", "video/"+streamExt(codec))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case data, ok := <-c.frames:
+			if !ok {
+				return // server shutting down
+			}
+			if _, err := w.Write(data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// publishStream queues an encoded frame for every raw stream client.
+// Clients join at a keyframe; a client whose buffer is full loses the
+// frame and skips ahead to the next keyframe, which is requested for it,
+// so its decoder never sees a broken reference chain.
+func (s *Server) publishStream(encoded *types.EncodedFrame) {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+
+	for c := range s.streams {
+		if !c.synced {
+			if !encoded.IsKey {
+				continue
+			}
+			c.synced = true
+		}
+		select {
+		case c.frames <- encoded.Data:
+		default:
+			c.synced = false
+			c.dropped++
+			s.requestKeyframe()
+		}
+	}
+}
+
+// closeStreams ends all raw stream responses.
+func (s *Server) closeStreams() {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+
+	for c := range s.streams {
+		close(c.frames)
+		delete(s.streams, c)
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A stream client joining an idle desktop, where hardly anything is
+// encoded and the encoder's next keyframe is a GOP away, gets a keyframe
+// straight away.
+func TestStreamStartsWithKeyframe(t *testing.T) {
+	dev := newFakeDevices()
+	s := newTestServer(t, dev, Config{})
+
+	if id, w := offer(s.handleViewerOffer, "/whep/view", clientOffer(t, true)); id == "" {
+		t.Fatalf("offer: %d %s", w.Code, w.Body)
+	}
+	waitFor(t, "the first keyframe", func() bool {
+		dev.mu.Lock()
+		defer dev.mu.Unlock()
+		return dev.encoded > 2
+	})
+	dev.mu.Lock()
+	dev.stale = true
+	dev.mu.Unlock()
+
+	hs := httptest.NewServer(http.HandlerFunc(s.handleStream))
+	defer hs.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", hs.URL+"/stream.h264", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("GET /stream.h264: %s", resp.Status)
+	}
+
+	idr := []byte{0x00, 0x00, 0x00, 0x01, 0x65}
+	got := make([]byte, len(idr))
+	if _, err := io.ReadFull(resp.Body, got); err != nil {
+		t.Fatalf("no keyframe within 500ms: %v", err)
+	}
+	if !bytes.Equal(got, idr) {
+		t.Errorf("stream starts with % x, want an IDR slice", got)
+	}
+}
+
+func TestStreamPipelineStartError(t *testing.T) {
+	dev := newFakeDevices()
+	dev.capErr = errors.New("cannot open display")
+	s := newTestServer(t, dev, Config{})
+
+	hs := httptest.NewServer(http.HandlerFunc(s.handleStream))
+	defer hs.Close()
+	req, _ := http.NewRequest("GET", hs.URL+"/stream.h264", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 503 || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("GET /stream.h264 with no display: %s, Retry-After %q; want 503 with Retry-After", resp.Status, resp.Header.Get("Retry-After"))
+	}
+}
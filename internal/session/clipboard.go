@@ -0,0 +1,142 @@
+package session
+
+import (
+	"hash/maphash"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clipMinInterval is the shortest gap between clipboard syncs in each
+// direction. 0 = no limit.
+var clipMinInterval = 500 * time.Millisecond
+
+// SetClipboardMinInterval sets the shortest gap between clipboard syncs,
+// separately for host → client and client → host. Changes that come
+// faster are held back and only the newest is sent once the gap is up, so
+// a program rewriting the clipboard many times a second can't flood the
+// data channel. 0 syncs every change.
+func SetClipboardMinInterval(d time.Duration) {
+	clipMinInterval = d
+}
+
+// clipEchoWindow is how long content that crossed in either direction is
+// remembered; the same content arriving again within it is an echo.
+const clipEchoWindow = 2 * time.Second
+
+// clipRecent is how many recently synced contents are remembered.
+const clipRecent = 8
+
+var clipSeed = maphash.MakeSeed()
+
+// clipGuard sits between a session's clipboard channel and its handler,
+// rate limiting syncs (see SetClipboardMinInterval) and breaking loops.
+// Each handler skips content equal to the last it synced, but when both
+// ends change the clipboard at once they can still swap two contents back
+// and forth for good. Here any content that crossed in either direction
+// within clipEchoWindow is not sent again in either direction.
+type clipGuard struct {
+	stop <-chan struct{}
+
+	mu       sync.Mutex
+	recent   [clipRecent]clipSeen
+	next     int
+	toHost   clipThrottle
+	toClient clipThrottle
+
+	echoes atomic.Uint64
+}
+
+type clipSeen struct {
+	sum uint64
+	at  time.Time
+}
+
+// clipThrottle holds back syncs in one direction; guarded by clipGuard.mu.
+type clipThrottle struct {
+	deliver func(text string)
+	last    time.Time
+	pending string
+	waiting bool // pending is set and a timer will deliver it
+}
+
+func newClipGuard(stop <-chan struct{}, toHost, toClient func(text string)) *clipGuard {
+	return &clipGuard{
+		stop:     stop,
+		toHost:   clipThrottle{deliver: toHost},
+		toClient: clipThrottle{deliver: toClient},
+	}
+}
+
+// FromClient passes clipboard content the client sent on to the host.
+func (g *clipGuard) FromClient(text string) { g.sync(&g.toHost, text) }
+
+// FromHost passes clipboard content the host's handler read on to the
+// client.
+func (g *clipGuard) FromHost(text string) { g.sync(&g.toClient, text) }
+
+func (g *clipGuard) sync(t *clipThrottle, text string) {
+	g.mu.Lock()
+	if g.echoLocked(text) {
+		g.mu.Unlock()
+		return
+	}
+	wait := clipMinInterval - time.Since(t.last)
+	if wait <= 0 && !t.waiting {
+		g.sentLocked(t, text)
+		g.mu.Unlock()
+		t.deliver(text)
+		return
+	}
+	// Hold it; a newer change replaces it before the timer fires.
+	t.pending = text
+	if !t.waiting {
+		t.waiting = true
+		time.AfterFunc(wait, func() { g.flush(t) })
+	}
+	g.mu.Unlock()
+}
+
+// flush delivers the change held back in t, unless it has become an echo
+// of something sent in the meantime.
+func (g *clipGuard) flush(t *clipThrottle) {
+	select {
+	case <-g.stop:
+		return
+	default:
+	}
+	g.mu.Lock()
+	text := t.pending
+	t.pending, t.waiting = "", false
+	if g.echoLocked(text) {
+		g.mu.Unlock()
+		return
+	}
+	g.sentLocked(t, text)
+	g.mu.Unlock()
+	t.deliver(text)
+}
+
+// echoLocked reports whether text crossed in either direction within
+// clipEchoWindow.
+func (g *clipGuard) echoLocked(text string) bool {
+	sum := maphash.String(clipSeed, text)
+	for _, r := range g.recent {
+		if r.sum == sum && !r.at.IsZero() && time.Since(r.at) < clipEchoWindow {
+			// Log the first echo and then every 100th, not every one.
+			if n := g.echoes.Add(1); n%100 == 1 {
+				log.Printf("clipboard: not syncing content that just crossed the other way (%d echoes dropped)", n)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (g *clipGuard) sentLocked(t *clipThrottle, text string) {
+	now := time.Now()
+	t.last = now
+	g.recent[g.next] = clipSeen{sum: maphash.String(clipSeed, text), at: now}
+	g.next = (g.next + 1) % clipRecent
+}
@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"bunghole/internal/types"
 
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v4"
 )
 
@@ -24,34 +27,156 @@ type Session struct {
 	InputHandler     types.EventInjector
 	ClipboardHandler types.ClipboardSync
 	Stop             chan struct{}
+	Created          time.Time
+	NoAudio          bool // never sends audio, even once it starts (see ViewerOptions)
 	closed           bool
+	bytesSent        uint64 // snapshot taken at Close, once the PC's stats are gone
 	mu               sync.Mutex
+
+	// Server-initiated renegotiation over the client's "signaling" data channel.
+	sigMu       sync.Mutex
+	signalDC    *webrtc.DataChannel
+	renegotiate bool // a track change is waiting for the channel or a pending answer
+
+	// Text chat over the client's "chat" data channel; guarded by mu.
+	chatDC *webrtc.DataChannel
+	onChat func(text string)
+
+	// Input lock (see SetInputLocked); inputDC is guarded by mu.
+	inputLocked atomic.Bool
+	inputDC     *webrtc.DataChannel
+
+	lastPong atomic.Int64 // UnixNano of the client's last keepalive reply; 0 = never
+
+	dcDrops atomic.Uint64 // server messages dropped by sendBounded
+
+	// Input events waiting for runInput (see queueInput).
+	inMu     sync.Mutex
+	inQueue  []types.InputEvent
+	inReady  chan struct{}
+	injectMu sync.Mutex // held while injecting, so Close doesn't free the handler mid-batch
+
+	// Input latency from the events' client timestamps; guarded by latMu.
+	latMu      sync.Mutex
+	clockOff   float64   // client clock minus ours, in ms
+	clockRTT   float64   // round trip of the ping clockOff came from; 0 = not synced
+	clockAt    time.Time // when clockOff was measured
+	latSamples [latencySamples]float64
+	latN       int
+	lastMoveTS float64 // client ts of the newest absolute mousemove injected
+
+	staleDrops atomic.Uint64 // mousemoves dropped by dropStaleInput
+	queueDrops atomic.Uint64 // events dropped because the input queue was full
+}
+
+// keepaliveTimeout is how long a controller's client may go without
+// answering a ping on its input channel before the session is closed.
+// 0 disables the keepalive.
+var keepaliveTimeout time.Duration
+
+// SetKeepaliveTimeout enables pings on each controller's input channel,
+// closing sessions whose client stops answering within d. This catches
+// connections that stay "connected" after the client went away (e.g. the
+// machine slept) and would otherwise hold the controller slot. Clients
+// that never answer a ping are assumed not to support it and are left
+// alone.
+func SetKeepaliveTimeout(d time.Duration) {
+	keepaliveTimeout = d
+}
+
+// maxBuffered is how many bytes a data channel may have queued before
+// server-initiated messages on it are dropped. 0 = never drop.
+var maxBuffered uint64 = 1 << 20
+
+// SetMaxBuffered sets how many bytes may be queued on a data channel
+// before server-initiated messages (clipboard, chat, pings, ...) are
+// dropped instead of queued, so a client on a slow link can't grow the
+// queue without bound. 0 queues everything.
+func SetMaxBuffered(n uint64) {
+	maxBuffered = n
+}
+
+// maxInputAge is how old an absolute mousemove may be when it is about to
+// be injected before it is dropped. 0 = never drop.
+var maxInputAge time.Duration
+
+// SetMaxInputAge drops absolute mousemoves that reach injection more than
+// d after the client sent them, judged by their client timestamps. A
+// newer move follows, so the cursor skips ahead instead of replaying a
+// backlog. Clicks, keys and relative moves are never dropped.
+func SetMaxInputAge(d time.Duration) {
+	maxInputAge = d
+}
+
+// latencySamples is how many of the most recent input events InputLatency
+// averages over.
+const latencySamples = 128
+
+// clockResync is how long a clock offset measurement is kept before a
+// later ping replaces it even if that ping's round trip was slower.
+const clockResync = time.Minute
+
+// keepaliveMessage is a ping from the server or the client's pong on the
+// input channel.
+type keepaliveMessage struct {
+	Type string  `json:"type"`         // "ping" or "pong"
+	TS   float64 `json:"ts,omitempty"` // ping: our clock in ms, echoed back in the pong
+}
+
+// inputLockMessage tells the client on its "input" channel whether its
+// input is currently being dropped.
+type inputLockMessage struct {
+	Type   string `json:"type"` // "inputlock"
+	Locked bool   `json:"locked"`
+}
+
+// maxQueuedInput bounds the input events waiting to be injected; more are
+// dropped rather than queued behind an injector that is stuck.
+var maxQueuedInput = 1024
+
+// SetInputQueueSize sets how many input events may wait for injection
+// before further ones are dropped.
+func SetInputQueueSize(n int) {
+	maxQueuedInput = n
+}
+
+// MaxChatMessage is the longest chat message, in bytes, that is relayed.
+const MaxChatMessage = 4096
+
+// signalMessage is exchanged over the "signaling" data channel when the
+// server renegotiates an established session (see AddTrack), or tells the
+// client why it is being disconnected.
+type signalMessage struct {
+	Type   string `json:"type"` // "offer", "answer" or "close"
+	SDP    string `json:"sdp,omitempty"`
+	Reason string `json:"reason,omitempty"`
 }
 
 // newPeerConnection creates a PeerConnection with the given codec registered
-// and the shared tracks added.
-func newPeerConnection(codec string, videoTrack, audioTrack *webrtc.TrackLocalStaticSample) (*webrtc.PeerConnection, error) {
+// and the shared tracks added. The video codec is registered with the
+// track's own fmtp, so the SDP always advertises the profile the encoder
+// produces. audioTrack is nil for sessions without audio, and until audio
+// capture is up; it is then added via AddTrack. onKeyframe, if set, is
+// called when the client reports picture loss on the video track.
+func newPeerConnection(codec string, videoTrack *webrtc.TrackLocalStaticSample, audioTrack *webrtc.TrackLocalStaticRTP, onKeyframe func()) (*webrtc.PeerConnection, error) {
 	me := &webrtc.MediaEngine{}
 
-	var videoMimeType string
-	var videoFmtp string
-	var videoPayloadType webrtc.PayloadType
-
+	videoPayloadType := webrtc.PayloadType(96)
 	if codec == "h265" {
-		videoMimeType = webrtc.MimeTypeH265
-		videoFmtp = "profile-id=1"
 		videoPayloadType = 97
-	} else {
-		videoMimeType = webrtc.MimeTypeH264
-		videoFmtp = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f"
-		videoPayloadType = 96
 	}
 
 	if err := me.RegisterCodec(webrtc.RTPCodecParameters{
 		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType:    videoMimeType,
+			MimeType:    videoTrack.Codec().MimeType,
 			ClockRate:   90000,
-			SDPFmtpLine: videoFmtp,
+			SDPFmtpLine: videoTrack.Codec().SDPFmtpLine,
+			// Clients only send the PLI/FIR readVideoRTCP turns into
+			// keyframes if the answer offers them.
+			RTCPFeedback: []webrtc.RTCPFeedback{
+				{Type: "nack", Parameter: "pli"},
+				{Type: "ccm", Parameter: "fir"},
+			},
 		},
 		PayloadType: videoPayloadType,
 	}, webrtc.RTPCodecTypeVideo); err != nil {
@@ -75,31 +200,56 @@ func newPeerConnection(codec string, videoTrack, audioTrack *webrtc.TrackLocalSt
 		return nil, fmt.Errorf("create peer connection: %w", err)
 	}
 
-	if _, err = pc.AddTrack(videoTrack); err != nil {
+	videoSender, err := pc.AddTrack(videoTrack)
+	if err != nil {
 		pc.Close()
 		return nil, fmt.Errorf("add video track: %w", err)
 	}
+	go readVideoRTCP(videoSender, onKeyframe)
 
-	if _, err = pc.AddTrack(audioTrack); err != nil {
-		pc.Close()
-		return nil, fmt.Errorf("add audio track: %w", err)
+	if audioTrack != nil {
+		if _, err = pc.AddTrack(audioTrack); err != nil {
+			pc.Close()
+			return nil, fmt.Errorf("add audio track: %w", err)
+		}
 	}
 
 	return pc, nil
 }
 
+// readVideoRTCP reads RTCP from the client for the video sender and reports
+// PLI/FIR as keyframe requests. It returns when the PeerConnection closes.
+func readVideoRTCP(sender *webrtc.RTPSender, onKeyframe func()) {
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		if onKeyframe == nil {
+			continue
+		}
+		for _, pkt := range pkts {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				onKeyframe()
+			}
+		}
+	}
+}
+
 // NewSession creates a controller session with data channels for input/clipboard.
 // The shared video and audio tracks are added to the PeerConnection.
-func NewSession(id, displayName, codec string, videoTrack, audioTrack *webrtc.TrackLocalStaticSample, inputFactory InputHandlerFactory, clipboardFactory ClipboardHandlerFactory) (*Session, error) {
-	pc, err := newPeerConnection(codec, videoTrack, audioTrack)
+func NewSession(id, displayName, codec string, videoTrack *webrtc.TrackLocalStaticSample, audioTrack *webrtc.TrackLocalStaticRTP, onKeyframe func(), inputFactory InputHandlerFactory, clipboardFactory ClipboardHandlerFactory) (*Session, error) {
+	pc, err := newPeerConnection(codec, videoTrack, audioTrack, onKeyframe)
 	if err != nil {
 		return nil, err
 	}
 
 	sess := &Session{
-		ID:   id,
-		PC:   pc,
-		Stop: make(chan struct{}),
+		ID:      id,
+		PC:      pc,
+		Stop:    make(chan struct{}),
+		Created: time.Now(),
 	}
 
 	// Set up input handler via factory
@@ -109,6 +259,8 @@ func NewSession(id, displayName, codec string, videoTrack, audioTrack *webrtc.Tr
 			log.Printf("warning: input handler init failed: %v", err)
 		} else {
 			sess.InputHandler = ih
+			sess.inReady = make(chan struct{}, 1)
+			go sess.runInput()
 		}
 	}
 
@@ -116,25 +268,61 @@ func NewSession(id, displayName, codec string, videoTrack, audioTrack *webrtc.Tr
 	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
 		switch dc.Label() {
 		case "input":
+			dc.OnOpen(func() {
+				sess.mu.Lock()
+				sess.inputDC = dc
+				sess.mu.Unlock()
+				if sess.inputLocked.Load() {
+					sess.sendInputLock(dc, true)
+				}
+				// One ping up front so input latency can be measured
+				// even without the keepalive.
+				sess.sendPing(dc)
+				if keepaliveTimeout > 0 {
+					go sess.runKeepalive(dc)
+				}
+			})
 			dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+				var event types.InputEvent
+				if err := json.Unmarshal(msg.Data, &event); err != nil {
+					return
+				}
+				if event.Type == "pong" {
+					sess.lastPong.Store(time.Now().UnixNano())
+					if event.Echo > 0 && event.TS > 0 {
+						sess.syncClock(event.Echo, event.TS)
+					}
+					return
+				}
 				if sess.InputHandler != nil {
-					var event types.InputEvent
-					if err := json.Unmarshal(msg.Data, &event); err != nil {
+					// Releases still go through so that nothing held
+					// when the lock was set stays stuck down.
+					if sess.inputLocked.Load() && event.Type != "keyup" && event.Type != "mouseup" {
 						return
 					}
-					sess.InputHandler.Inject(event)
+					sess.queueInput(event)
 				}
 			})
+		case "signaling":
+			sess.attachSignaling(dc)
+		case "chat":
+			sess.attachChat(dc)
 		case "clipboard":
 			if clipboardFactory == nil {
 				break
 			}
+			guard := newClipGuard(sess.Stop, func(text string) {
+				sess.mu.Lock()
+				ch := sess.ClipboardHandler
+				sess.mu.Unlock()
+				if ch != nil {
+					ch.SetFromClient(text)
+				}
+			}, func(text string) {
+				sess.sendBounded(dc, text)
+			})
 			dc.OnOpen(func() {
-				ch, err := clipboardFactory(displayName, func(text string) {
-					if dc.ReadyState() == webrtc.DataChannelStateOpen {
-						dc.SendText(text)
-					}
-				})
+				ch, err := clipboardFactory(displayName, guard.FromHost)
 				if err != nil {
 					log.Printf("clipboard handler init failed: %v", err)
 					return
@@ -149,12 +337,7 @@ func NewSession(id, displayName, codec string, videoTrack, audioTrack *webrtc.Tr
 				go ch.Run(sess.Stop)
 			})
 			dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-				sess.mu.Lock()
-				ch := sess.ClipboardHandler
-				sess.mu.Unlock()
-				if ch != nil {
-					ch.SetFromClient(string(msg.Data))
-				}
+				guard.FromClient(string(msg.Data))
 			})
 		}
 	})
@@ -171,20 +354,42 @@ func NewSession(id, displayName, codec string, videoTrack, audioTrack *webrtc.Tr
 	return sess, nil
 }
 
+// ViewerOptions are what a viewer asked for when it connected.
+type ViewerOptions struct {
+	NoAudio bool // video only, e.g. for a silent monitoring wall
+}
+
 // NewViewerSession creates a view-only session (no data channels, no input).
-// The shared video and audio tracks are added to the PeerConnection.
-func NewViewerSession(id, codec string, videoTrack, audioTrack *webrtc.TrackLocalStaticSample) (*Session, error) {
-	pc, err := newPeerConnection(codec, videoTrack, audioTrack)
+// The shared video and audio tracks are added to the PeerConnection, the
+// audio one unless opts.NoAudio.
+func NewViewerSession(id, codec string, videoTrack *webrtc.TrackLocalStaticSample, audioTrack *webrtc.TrackLocalStaticRTP, onKeyframe func(), opts ViewerOptions) (*Session, error) {
+	if opts.NoAudio {
+		audioTrack = nil
+	}
+	pc, err := newPeerConnection(codec, videoTrack, audioTrack, onKeyframe)
 	if err != nil {
 		return nil, err
 	}
 
 	sess := &Session{
-		ID:   id,
-		PC:   pc,
-		Stop: make(chan struct{}),
+		ID:      id,
+		PC:      pc,
+		Stop:    make(chan struct{}),
+		Created: time.Now(),
+		NoAudio: opts.NoAudio,
 	}
 
+	// Viewers have no input/clipboard, but may still open a signaling
+	// channel so they can receive tracks added after connect, and chat.
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		switch dc.Label() {
+		case "signaling":
+			sess.attachSignaling(dc)
+		case "chat":
+			sess.attachChat(dc)
+		}
+	})
+
 	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		log.Printf("viewer %s connection state: %s", id, state.String())
 		if state == webrtc.PeerConnectionStateFailed ||
@@ -197,6 +402,458 @@ func NewViewerSession(id, codec string, videoTrack, audioTrack *webrtc.TrackLoca
 	return sess, nil
 }
 
+// OfferHasAudio reports whether an SDP offer includes an audio m-line the
+// server can answer. Unparseable offers report true so that the error
+// surfaces from SetRemoteDescription instead.
+func OfferHasAudio(offer webrtc.SessionDescription) bool {
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return true
+	}
+	for _, m := range parsed.MediaDescriptions {
+		if m.MediaName.Media == "audio" && m.MediaName.Port.Value != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// AddTrack attaches a shared track to an established session and sends the
+// client a new offer over the signaling channel. Tracks that are already
+// attached are ignored, as are audio tracks for clients that did not offer
+// audio or asked for none. If the channel is not open yet, renegotiation
+// is deferred until it is.
+func (s *Session) AddTrack(track webrtc.TrackLocal) error {
+	if s.IsClosed() {
+		return nil
+	}
+	if track.Kind() == webrtc.RTPCodecTypeAudio {
+		if s.NoAudio {
+			return nil
+		}
+		if rd := s.PC.RemoteDescription(); rd != nil && !OfferHasAudio(*rd) {
+			return nil
+		}
+	}
+
+	s.sigMu.Lock()
+	for _, sender := range s.PC.GetSenders() {
+		if sender.Track() == track {
+			s.sigMu.Unlock()
+			return nil
+		}
+	}
+	if _, err := s.PC.AddTrack(track); err != nil {
+		s.sigMu.Unlock()
+		return fmt.Errorf("add %s track: %w", track.Kind(), err)
+	}
+	s.renegotiate = true
+	s.sigMu.Unlock()
+
+	s.sendOffer()
+	return nil
+}
+
+func (s *Session) attachSignaling(dc *webrtc.DataChannel) {
+	dc.OnOpen(func() {
+		s.sigMu.Lock()
+		s.signalDC = dc
+		s.sigMu.Unlock()
+		s.sendOffer()
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var m signalMessage
+		if err := json.Unmarshal(msg.Data, &m); err != nil || m.Type != "answer" {
+			return
+		}
+		s.sigMu.Lock()
+		err := s.PC.SetRemoteDescription(webrtc.SessionDescription{
+			Type: webrtc.SDPTypeAnswer,
+			SDP:  m.SDP,
+		})
+		s.sigMu.Unlock()
+		if err != nil {
+			log.Printf("session %s renegotiation answer error: %v", s.ID, err)
+			return
+		}
+		// Tracks added while the offer was outstanding need another round.
+		s.sendOffer()
+	})
+}
+
+// queueInput hands an event to runInput. A mousemove still waiting at the
+// end of the queue is replaced by a newer one (relative moves add up), so
+// however fast the client sends moves, each injection round carries at
+// most one per run of moves instead of falling further behind.
+func (s *Session) queueInput(event types.InputEvent) {
+	s.inMu.Lock()
+	n := len(s.inQueue)
+	if last := n - 1; event.Type == "mousemove" && last >= 0 &&
+		s.inQueue[last].Type == "mousemove" && s.inQueue[last].Relative == event.Relative {
+		if event.Relative {
+			s.inQueue[last].X += event.X
+			s.inQueue[last].Y += event.Y
+			s.inQueue[last].TS = event.TS
+		} else {
+			s.inQueue[last] = event
+		}
+	} else if n < maxQueuedInput {
+		s.inQueue = append(s.inQueue, event)
+	} else if d := s.queueDrops.Add(1); d%100 == 1 {
+		// Log the first drop and then every 100th, not every event.
+		log.Printf("session %s: input queue full (%d events), injection is falling behind; dropping %s (%d dropped)",
+			s.ID, n, event.Type, d)
+	}
+	s.inMu.Unlock()
+
+	select {
+	case s.inReady <- struct{}{}:
+	default:
+	}
+}
+
+// runInput injects queued input events until the session closes. Each
+// round takes everything queued, so events that arrive during a slow
+// injection are coalesced and injected together with one flush.
+func (s *Session) runInput() {
+	batcher, _ := s.InputHandler.(types.BatchInjector)
+	for {
+		select {
+		case <-s.Stop:
+			return
+		case <-s.inReady:
+		}
+		s.inMu.Lock()
+		events := s.dropStaleInput(s.inQueue)
+		s.inQueue = nil
+		s.inMu.Unlock()
+
+		s.injectMu.Lock()
+		select {
+		case <-s.Stop:
+			s.injectMu.Unlock()
+			return
+		default:
+		}
+		if batcher != nil {
+			batcher.InjectBatch(events)
+		} else {
+			for _, event := range events {
+				s.InputHandler.Inject(event)
+			}
+		}
+		s.injectMu.Unlock()
+		s.noteInputLatency(events)
+	}
+}
+
+// InputQueue returns how many input events are waiting for injection and
+// how many have been dropped because the queue was full. Drops mean the
+// injector (e.g. a slow X server) can't keep up, as opposed to events
+// arriving late from the network, which shows in InputLatency.
+func (s *Session) InputQueue() (queued int, dropped uint64) {
+	s.inMu.Lock()
+	queued = len(s.inQueue)
+	s.inMu.Unlock()
+	return queued, s.queueDrops.Load()
+}
+
+// clockMS is the session's clock in ms, sent in pings so the client's
+// timestamps can be related to it.
+func (s *Session) clockMS() float64 {
+	return float64(time.Since(s.Created)) / float64(time.Millisecond)
+}
+
+// syncClock estimates the offset between the client's clock and ours from
+// a pong: the client stamped it halfway through the round trip of the
+// ping it answers. The estimate from the fastest round trip is kept, as
+// it has the least slack, until it is clockResync old.
+func (s *Session) syncClock(echo, clientTS float64) {
+	rtt := s.clockMS() - echo
+	if rtt < 0 {
+		return
+	}
+	s.latMu.Lock()
+	defer s.latMu.Unlock()
+	if s.clockRTT == 0 || rtt <= s.clockRTT || time.Since(s.clockAt) > clockResync {
+		s.clockOff = clientTS - (echo + rtt/2)
+		s.clockRTT = max(rtt, 0.001)
+		s.clockAt = time.Now()
+	}
+}
+
+// eventAge returns how long ago, in ms, the client sent an event, or false
+// if it isn't timestamped or the clocks aren't synced yet. Called with
+// latMu held.
+func (s *Session) eventAge(event types.InputEvent, now float64) (float64, bool) {
+	if event.TS <= 0 || s.clockRTT == 0 {
+		return 0, false
+	}
+	return max(now-(event.TS-s.clockOff), 0), true
+}
+
+// dropStaleInput removes absolute mousemoves that are older than one
+// already injected (the client's timestamps went backwards) or, with
+// SetMaxInputAge, too old to be worth injecting. Both need client
+// timestamps; events without them are kept.
+func (s *Session) dropStaleInput(events []types.InputEvent) []types.InputEvent {
+	now := s.clockMS()
+	s.latMu.Lock()
+	defer s.latMu.Unlock()
+
+	kept := events[:0]
+	for _, event := range events {
+		if event.Type == "mousemove" && !event.Relative && event.TS > 0 {
+			age, ok := s.eventAge(event, now)
+			if event.TS < s.lastMoveTS || (ok && maxInputAge > 0 && age > float64(maxInputAge/time.Millisecond)) {
+				// Log the first drop and then every 100th, not every move.
+				if n := s.staleDrops.Add(1); n%100 == 1 {
+					log.Printf("session %s: dropping stale mousemove (%d dropped)", s.ID, n)
+				}
+				continue
+			}
+			s.lastMoveTS = event.TS
+		}
+		kept = append(kept, event)
+	}
+	return kept
+}
+
+// noteInputLatency records the time from the client sending each
+// timestamped event to its injection.
+func (s *Session) noteInputLatency(events []types.InputEvent) {
+	now := s.clockMS()
+	s.latMu.Lock()
+	defer s.latMu.Unlock()
+	for _, event := range events {
+		if age, ok := s.eventAge(event, now); ok {
+			s.latSamples[s.latN%latencySamples] = age
+			s.latN++
+		}
+	}
+}
+
+// InputLatency returns the average and worst time from the client sending
+// an input event to its injection, over the last events that carried a
+// timestamp, and how many events that covers. n is 0 until the client has
+// answered a ping and sent timestamped events.
+func (s *Session) InputLatency() (avg, worst time.Duration, n int) {
+	s.latMu.Lock()
+	defer s.latMu.Unlock()
+	n = min(s.latN, latencySamples)
+	if n == 0 {
+		return 0, 0, 0
+	}
+	var sum, top float64
+	for _, v := range s.latSamples[:n] {
+		sum += v
+		top = max(top, v)
+	}
+	ms := float64(time.Millisecond)
+	return time.Duration(sum / float64(n) * ms), time.Duration(top * ms), n
+}
+
+// runKeepalive pings the client on its input channel a few times per
+// keepaliveTimeout and closes the session once a client that has answered
+// before stops answering. It returns when the session closes.
+func (s *Session) runKeepalive(dc *webrtc.DataChannel) {
+	ticker := time.NewTicker(keepaliveTimeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.Stop:
+			return
+		case <-ticker.C:
+		}
+		if last := s.lastPong.Load(); last != 0 && time.Since(time.Unix(0, last)) > keepaliveTimeout {
+			s.CloseWithReason(fmt.Sprintf("no keepalive reply for %s", keepaliveTimeout))
+			return
+		}
+		s.sendPing(dc)
+	}
+}
+
+// sendPing sends a keepalive ping stamped with our clock. Clients echo the
+// stamp in their pong along with their own, which syncClock uses to relate
+// input event timestamps to our clock.
+func (s *Session) sendPing(dc *webrtc.DataChannel) {
+	ping, err := json.Marshal(keepaliveMessage{Type: "ping", TS: s.clockMS()})
+	if err != nil {
+		return
+	}
+	s.sendBounded(dc, string(ping))
+}
+
+// SetInputLocked sets whether input events from the client are dropped,
+// and tells the client over its input channel.
+func (s *Session) SetInputLocked(locked bool) {
+	if s.inputLocked.Swap(locked) == locked {
+		return
+	}
+	s.mu.Lock()
+	dc := s.inputDC
+	s.mu.Unlock()
+	if dc != nil {
+		s.sendInputLock(dc, locked)
+	}
+}
+
+func (s *Session) sendInputLock(dc *webrtc.DataChannel, locked bool) {
+	data, err := json.Marshal(inputLockMessage{Type: "inputlock", Locked: locked})
+	if err != nil {
+		return
+	}
+	s.sendBounded(dc, string(data))
+}
+
+// sendBounded sends a server-initiated message on dc if it is open and has
+// less than maxBuffered queued, and reports whether it did. Dropping is
+// fine for everything sent this way: a later message (the next clipboard
+// change, ping or lock state) supersedes it, and a client too far behind
+// to take it would only see it late.
+func (s *Session) sendBounded(dc *webrtc.DataChannel, text string) bool {
+	if dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return false
+	}
+	if maxBuffered > 0 && dc.BufferedAmount() >= maxBuffered {
+		// Log the first drop and then every 100th, not every message.
+		if n := s.dcDrops.Add(1); n%100 == 1 {
+			log.Printf("session %s: %s channel has %d bytes queued, dropping message (%d dropped)",
+				s.ID, dc.Label(), dc.BufferedAmount(), n)
+		}
+		return false
+	}
+	return dc.SendText(text) == nil
+}
+
+// SetChatHandler sets the function called with each message the client
+// sends on its "chat" data channel.
+func (s *Session) SetChatHandler(fn func(text string)) {
+	s.mu.Lock()
+	s.onChat = fn
+	s.mu.Unlock()
+}
+
+// SendChat delivers a chat message to the client, if it has a chat
+// channel open.
+func (s *Session) SendChat(msg []byte) {
+	s.mu.Lock()
+	dc := s.chatDC
+	s.mu.Unlock()
+	if dc != nil {
+		s.sendBounded(dc, string(msg))
+	}
+}
+
+func (s *Session) attachChat(dc *webrtc.DataChannel) {
+	dc.OnOpen(func() {
+		s.mu.Lock()
+		s.chatDC = dc
+		s.mu.Unlock()
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if !msg.IsString || len(msg.Data) == 0 || len(msg.Data) > MaxChatMessage {
+			return
+		}
+		s.mu.Lock()
+		fn := s.onChat
+		s.mu.Unlock()
+		if fn != nil {
+			fn(string(msg.Data))
+		}
+	})
+}
+
+// sendOffer sends a new offer if a renegotiation is pending and the
+// signaling channel is open with no offer outstanding. s.sigMu is not held
+// while ICE gathering completes, so answers and track changes aren't held
+// up behind it; the offer is outstanding (signaling state not stable) from
+// SetLocalDescription on, so nobody else starts one meanwhile.
+func (s *Session) sendOffer() {
+	s.sigMu.Lock()
+	dc := s.signalDC
+	if !s.renegotiate || dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen ||
+		s.PC.SignalingState() != webrtc.SignalingStateStable {
+		s.sigMu.Unlock()
+		return
+	}
+	offer, err := s.PC.CreateOffer(nil)
+	if err != nil {
+		s.sigMu.Unlock()
+		log.Printf("session %s renegotiation offer error: %v", s.ID, err)
+		return
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(s.PC)
+	if err := s.PC.SetLocalDescription(offer); err != nil {
+		s.sigMu.Unlock()
+		log.Printf("session %s renegotiation set local desc error: %v", s.ID, err)
+		return
+	}
+	// This offer covers every track added so far; one added from here on
+	// sets renegotiate again and is offered once the answer is in.
+	s.renegotiate = false
+	s.sigMu.Unlock()
+
+	select {
+	case <-gatherComplete:
+	case <-s.Stop:
+		return
+	}
+
+	data, err := json.Marshal(signalMessage{Type: "offer", SDP: s.PC.LocalDescription().SDP})
+	if err != nil {
+		return
+	}
+	if !s.sendBounded(dc, string(data)) {
+		log.Printf("session %s renegotiation offer not sent", s.ID)
+		return
+	}
+	log.Printf("session %s renegotiating", s.ID)
+}
+
+// BytesSent returns the cumulative bytes sent to the client over the ICE
+// transport: video, audio and data channels, including RTP/SRTP overhead.
+// After Close it returns the total at the time the session closed.
+func (s *Session) BytesSent() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return s.bytesSent
+	}
+	return transportBytesSent(s.PC)
+}
+
+func transportBytesSent(pc *webrtc.PeerConnection) uint64 {
+	for _, stat := range pc.GetStats() {
+		if ts, ok := stat.(webrtc.TransportStats); ok {
+			return ts.BytesSent
+		}
+	}
+	return 0
+}
+
+// CloseWithReason tells the client why it is being disconnected, if it
+// has a signaling channel open, then closes the session.
+func (s *Session) CloseWithReason(reason string) {
+	s.sigMu.Lock()
+	dc := s.signalDC
+	s.sigMu.Unlock()
+
+	if dc != nil && dc.ReadyState() == webrtc.DataChannelStateOpen {
+		data, err := json.Marshal(signalMessage{Type: "close", Reason: reason})
+		if err == nil && s.sendBounded(dc, string(data)) {
+			// Give the message a moment to leave before the PC goes away.
+			deadline := time.Now().Add(time.Second)
+			for dc.BufferedAmount() > 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+	log.Printf("session %s closing: %s", s.ID, reason)
+	s.Close()
+}
+
 func (s *Session) Close() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -204,16 +861,19 @@ func (s *Session) Close() {
 		return
 	}
 	s.closed = true
+	s.bytesSent = transportBytesSent(s.PC)
 	close(s.Stop)
 
 	if s.InputHandler != nil {
+		s.injectMu.Lock()
 		s.InputHandler.Close()
+		s.injectMu.Unlock()
 	}
 	if s.ClipboardHandler != nil {
 		s.ClipboardHandler.Close()
 	}
 	s.PC.Close()
-	log.Printf("session %s closed", s.ID)
+	log.Printf("session %s closed (%d bytes sent)", s.ID, s.bytesSent)
 }
 
 func (s *Session) IsClosed() bool {
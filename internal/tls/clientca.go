@@ -0,0 +1,21 @@
+package tls
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// LoadClientCAs reads a PEM bundle of CA certificates used to verify
+// client certificates (mutual TLS).
+func LoadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read client CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
@@ -12,35 +12,50 @@ import (
 	"log"
 	"math/big"
 	"net"
+	"strings"
 	"time"
 )
 
+// Options customizes the self-signed certificate.
+type Options struct {
+	DNSNames []string      // extra DNS SANs (in addition to localhost)
+	IPs      []net.IP      // extra IP SANs (in addition to loopback and interface IPs)
+	Validity time.Duration // certificate lifetime (0 = 1 year)
+}
+
 // SelfSigned generates an ephemeral self-signed TLS certificate and returns
-// a *tls.Config with the certificate loaded. The cert uses ECDSA P-256,
-// is valid for 1 year, and includes SANs for localhost, loopback addresses,
-// and all non-loopback interface IPs. The SHA-256 fingerprint is logged so
-// users can verify the certificate in their browser.
-func SelfSigned() (*tls.Config, error) {
+// a *tls.Config with the certificate loaded, along with the certificate's
+// SHA-256 fingerprint. The cert uses ECDSA P-256, is valid for 1 year unless
+// opts.Validity is set, and includes SANs for localhost, loopback addresses,
+// all non-loopback interface IPs, and any extra names from opts. The
+// fingerprint is also logged so users can verify the certificate in their
+// browser.
+func SelfSigned(opts Options) (*tls.Config, string, error) {
+	validity := opts.Validity
+	if validity <= 0 {
+		validity = 365 * 24 * time.Hour
+	}
+
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		return nil, fmt.Errorf("generate key: %w", err)
+		return nil, "", fmt.Errorf("generate key: %w", err)
 	}
 
 	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 	if err != nil {
-		return nil, fmt.Errorf("generate serial: %w", err)
+		return nil, "", fmt.Errorf("generate serial: %w", err)
 	}
 
 	now := time.Now()
 	tmpl := &x509.Certificate{
 		SerialNumber:          serialNumber,
 		NotBefore:             now,
-		NotAfter:              now.Add(365 * 24 * time.Hour),
+		NotAfter:              now.Add(validity),
 		KeyUsage:              x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
-		DNSNames:              []string{"localhost"},
-		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		DNSNames:              append([]string{"localhost"}, opts.DNSNames...),
+		IPAddresses:           append([]net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}, opts.IPs...),
 	}
 
 	// Add all non-loopback interface IPs so the cert works for LAN access.
@@ -54,26 +69,37 @@ func SelfSigned() (*tls.Config, error) {
 
 	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
 	if err != nil {
-		return nil, fmt.Errorf("create certificate: %w", err)
+		return nil, "", fmt.Errorf("create certificate: %w", err)
 	}
 
 	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
 	keyDER, err := x509.MarshalECPrivateKey(key)
 	if err != nil {
-		return nil, fmt.Errorf("marshal key: %w", err)
+		return nil, "", fmt.Errorf("marshal key: %w", err)
 	}
 	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
 
 	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
 	if err != nil {
-		return nil, fmt.Errorf("load key pair: %w", err)
+		return nil, "", fmt.Errorf("load key pair: %w", err)
 	}
 
 	// Log fingerprint so users can verify in their browser's cert warning dialog.
-	fp := sha256.Sum256(certDER)
-	log.Printf("self-signed certificate fingerprint: %X", fp)
+	fp := Fingerprint(certDER)
+	log.Printf("self-signed certificate fingerprint: %s", fp)
 
 	return &tls.Config{
 		Certificates: []tls.Certificate{tlsCert},
-	}, nil
+	}, fp, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a DER-encoded certificate
+// as colon-separated uppercase hex, matching how browsers display it.
+func Fingerprint(certDER []byte) string {
+	sum := sha256.Sum256(certDER)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
 }
@@ -0,0 +1,80 @@
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefix marks a signed access token, as opposed to the static token.
+const Prefix = "bh1."
+
+// Claims are the contents of a signed access token.
+type Claims struct {
+	Expires time.Time
+	Nonce   string // random, identifies the token for single-use tracking
+	Once    bool   // the token creates a single session, and is then only good for it
+}
+
+// Mint creates an access token that expires after ttl, signed with the
+// server's static token. The server validates it without keeping state,
+// except for remembering which session a single-use token created.
+func Mint(secret string, ttl time.Duration, once bool) (string, error) {
+	var n [8]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return "", fmt.Errorf("generate nonce: %w", err)
+	}
+	onceFlag := "0"
+	if once {
+		onceFlag = "1"
+	}
+	payload := fmt.Sprintf("%d.%s.%s", time.Now().Add(ttl).Unix(), hex.EncodeToString(n[:]), onceFlag)
+	return Prefix + payload + "." + sign(secret, payload), nil
+}
+
+// Verify checks a token's signature and expiry and returns its claims.
+func Verify(secret, tok string) (Claims, error) {
+	rest, ok := strings.CutPrefix(tok, Prefix)
+	if !ok {
+		return Claims{}, errors.New("not a signed token")
+	}
+	i := strings.LastIndexByte(rest, '.')
+	if i < 0 {
+		return Claims{}, errors.New("malformed token")
+	}
+	payload, sig := rest[:i], rest[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(sign(secret, payload))) {
+		return Claims{}, errors.New("bad token signature")
+	}
+
+	parts := strings.Split(payload, ".")
+	if len(parts) != 3 {
+		return Claims{}, errors.New("malformed token")
+	}
+	exp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Claims{}, errors.New("malformed token expiry")
+	}
+	c := Claims{
+		Expires: time.Unix(exp, 0),
+		Nonce:   parts[1],
+		Once:    parts[2] == "1",
+	}
+	if time.Now().After(c.Expires) {
+		return Claims{}, errors.New("token expired")
+	}
+	return c, nil
+}
+
+func sign(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
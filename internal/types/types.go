@@ -1,6 +1,7 @@
 package types
 
 import (
+	"errors"
 	"image"
 	"time"
 	"unsafe"
@@ -14,34 +15,83 @@ type Frame struct {
 	Height int
 	Stride int
 	IsCUDA bool // true = Ptr is a CUDA device pointer (NV12 format)
-	PixFmt int  // 0 = BGRA (default), 1 = NV12
+	PixFmt int  // 0 = BGRA (default), 1 = NV12, 2 = RGBA
+	Stale  bool // same content as the previous Grab; encoding it is optional
 }
 
+// Packed 32-bit formats are named by their byte order in memory. The 4th
+// byte is alpha or padding; encoders ignore it.
 const (
 	PixFmtBGRA = 0
 	PixFmtNV12 = 1
+	PixFmtRGBA = 2
 )
 
+// ErrFrameSize is returned, wrapped, for a frame whose size no longer
+// matches the encoder's, as after a change of display resolution. The
+// pipeline has to be rebuilt at the new size.
+var ErrFrameSize = errors.New("frame size changed")
+
 type EncodedFrame struct {
 	Data  []byte
 	IsKey bool
 }
 
 type InputEvent struct {
-	Type     string  `json:"type"`
-	X        float64 `json:"x,omitempty"`
-	Y        float64 `json:"y,omitempty"`
-	DX       float64 `json:"dx,omitempty"`
-	DY       float64 `json:"dy,omitempty"`
-	Button   int     `json:"button,omitempty"`
-	Key      string  `json:"key,omitempty"`
-	Code     string  `json:"code,omitempty"`
-	Relative bool    `json:"relative,omitempty"`
+	Type       string  `json:"type"`
+	X          float64 `json:"x,omitempty"`
+	Y          float64 `json:"y,omitempty"`
+	DX         float64 `json:"dx,omitempty"`
+	DY         float64 `json:"dy,omitempty"`
+	Button     int     `json:"button,omitempty"`
+	Key        string  `json:"key,omitempty"`
+	Code       string  `json:"code,omitempty"`
+	Relative   bool    `json:"relative,omitempty"`
+	Normalized bool    `json:"normalized,omitempty"` // X/Y are 0.0–1.0 fractions of the display
+	CapsLock   bool    `json:"capsLock,omitempty"`   // setlock: desired Caps Lock state
+	NumLock    bool    `json:"numLock,omitempty"`    // setlock: desired Num Lock state
+	DeltaMode  int     `json:"deltaMode,omitempty"`  // wheel: unit of DX/DY, one of the Wheel* constants
+	TS         float64 `json:"ts,omitempty"`         // client's monotonic clock (ms) when sent; optional
+	Echo       float64 `json:"echo,omitempty"`       // pong: the ts of the ping it answers
+}
+
+// Position returns the event's absolute X/Y in display coordinates,
+// scaling normalized coordinates by the given display size.
+func (e InputEvent) Position(width, height int) (float64, float64) {
+	if !e.Normalized {
+		return e.X, e.Y
+	}
+	return e.X * float64(width), e.Y * float64(height)
+}
+
+// Wheel delta modes, as in the browser's WheelEvent.deltaMode.
+const (
+	WheelPixel = 0
+	WheelLine  = 1
+	WheelPage  = 2
+)
+
+// WheelLinePixels is how far one line of a line-mode wheel event scrolls.
+// Browsers that report lines send about 3 per notch, which comes out close
+// to the ~100-120px per notch of pixel-mode browsers.
+const WheelLinePixels = 40
+
+// WheelDelta returns a wheel event's DX/DY in pixels, scaling line and
+// page deltas; a page is the given display size.
+func (e InputEvent) WheelDelta(width, height int) (float64, float64) {
+	switch e.DeltaMode {
+	case WheelLine:
+		return e.DX * WheelLinePixels, e.DY * WheelLinePixels
+	case WheelPage:
+		return e.DX * float64(width), e.DY * float64(height)
+	}
+	return e.DX, e.DY
 }
 
 type OpusPacket struct {
 	Data     []byte
 	Duration time.Duration
+	Skipped  int // frames of Duration not sent (Opus DTX) since the previous packet
 }
 
 type MediaCapturer interface {
@@ -51,6 +101,22 @@ type MediaCapturer interface {
 	Close()
 }
 
+// Cursor is the pointer as a capturer last saw it.
+type Cursor struct {
+	Image      *image.RGBA // alpha-premultiplied, as X delivers it; replaced, never modified
+	X, Y       int         // top-left of Image in frame coordinates
+	HotX, HotY int         // hotspot within Image
+	Serial     uint64      // changes whenever Image does
+}
+
+// CursorProvider is optionally implemented by a MediaCapturer that can
+// report the pointer separately from the frames, so a client can draw it
+// locally instead of waiting for it in the video. CursorInfo returns
+// false until the pointer has been seen.
+type CursorProvider interface {
+	CursorInfo() (Cursor, bool)
+}
+
 // CUDAProvider is optionally implemented by a MediaCapturer that captures
 // directly to CUDA device memory (e.g. NvFBC). The encoder uses this to
 // set up a CUDA hw_frames_ctx for zero-copy NVENC encoding.
@@ -59,6 +125,13 @@ type CUDAProvider interface {
 	CuMemcpy2D() unsafe.Pointer
 }
 
+// HostFrameProvider is optionally implemented by a CUDAProvider that can
+// instead deliver NV12 frames in host memory, for an encoder on a
+// different GPU than the one capturing.
+type HostFrameProvider interface {
+	SetHostFrames(enabled bool)
+}
+
 // DebugGrabber is optionally implemented by a MediaCapturer to provide
 // a debug image for the /debug/frame endpoint.
 type DebugGrabber interface {
@@ -67,14 +140,53 @@ type DebugGrabber interface {
 
 type VideoEncoder interface {
 	Encode(frame *Frame) (*EncodedFrame, error)
+	// Format returns what is actually produced, which can differ from
+	// what was requested when the encoder fell back. The SDP must
+	// advertise exactly this.
+	Format() VideoFormat
 	Close()
 }
 
+// VideoFormat describes an encoder's bitstream.
+type VideoFormat struct {
+	Codec   string // "h264" or "h265"
+	Profile string // H.264: baseline, main or high
+	Level   int    // H.264 level_idc, e.g. 51 for 5.1; 0 = chosen by the encoder per stream
+}
+
+// EncoderOptions tune a video encoder beyond its size, rate and codec.
+// Zero values take the defaults, which favor latency. B-frames are always
+// off: WebRTC clients expect frames in presentation order.
+type EncoderOptions struct {
+	Preset string // NVENC preset, p1 (fastest, default) to p7 (best quality)
+	Tune   string // NVENC tune: ull (ultra-low latency, default), ll or hq
+	RC     string // NVENC rate control: cbr (default) or vbr
+
+	H264Profile string // baseline (default), main or high
+	H264Level   string // e.g. "5.1"; "" = chosen by the encoder
+
+	CodecFallback string // "h264": H.265 falls back to hardware H.264, not libx265
+	SoftwareOnly  bool   // skip the hardware encoders
+	RGBInput      bool   // NVENC converts BGRA frames to YUV itself (Linux)
+}
+
+// KeyframeForcer is optionally implemented by a VideoEncoder that can emit
+// an IDR on demand, e.g. when a client reports picture loss.
+type KeyframeForcer interface {
+	ForceKeyframe()
+}
+
 type EventInjector interface {
 	Inject(event InputEvent)
 	Close()
 }
 
+// BatchInjector is optionally implemented by an EventInjector that can
+// inject several events with a single flush to the display server.
+type BatchInjector interface {
+	InjectBatch(events []InputEvent)
+}
+
 type ClipboardSync interface {
 	SetFromClient(text string)
 	Run(stop <-chan struct{})
@@ -0,0 +1,117 @@
+//go:build darwin
+
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Virtualization.framework doesn't report the guest's IP, so it's looked
+// up by the network device's MAC: in the leases of the host's DHCP server
+// for NAT, or in the host's ARP cache for bridged networking, where the
+// guest only shows up once it has talked to the host.
+const (
+	dhcpLeases     = "/var/db/dhcpd_leases"
+	guestIPPoll    = 2 * time.Second
+	guestIPTimeout = 5 * time.Minute
+)
+
+// GuestIP returns the guest's IP address, or "" until it is known.
+func (vm *VMManager) GuestIP() string {
+	vm.ipMu.Lock()
+	defer vm.ipMu.Unlock()
+	return vm.guestIP
+}
+
+// watchGuestIP polls for the guest's IP after boot and logs it once found.
+func (vm *VMManager) watchGuestIP() {
+	mac := normalizeMAC(vm.mac)
+	deadline := time.Now().Add(guestIPTimeout)
+	for time.Now().Before(deadline) {
+		ip := leaseIP(mac)
+		if ip == "" {
+			ip = arpIP(mac)
+		}
+		if ip != "" {
+			vm.ipMu.Lock()
+			vm.guestIP = ip
+			vm.ipMu.Unlock()
+			log.Printf("VM guest IP: %s (MAC %s)", ip, vm.mac)
+			return
+		}
+		time.Sleep(guestIPPoll)
+	}
+	log.Printf("VM guest IP not found after %v (MAC %s); look it up in the guest", guestIPTimeout, vm.mac)
+}
+
+// leaseIP finds mac in the host DHCP server's leases, which hold blocks of
+//
+//	ip_address=192.168.64.2
+//	hw_address=1,a2:b3:c4:d5:e6:f7
+func leaseIP(mac string) string {
+	f, err := os.Open(dhcpLeases)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	var ip string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		key, val, _ := strings.Cut(strings.TrimSpace(sc.Text()), "=")
+		switch key {
+		case "{":
+			ip = ""
+		case "ip_address":
+			ip = val
+		case "hw_address":
+			if _, hw, ok := strings.Cut(val, ","); ok && normalizeMAC(hw) == mac && ip != "" {
+				return ip
+			}
+		}
+	}
+	return ""
+}
+
+// arpIP finds mac in the host's ARP cache, whose lines read
+//
+//	? (192.168.1.23) at a2:b3:c4:d5:e6:f7 on en0 ifscope [ethernet]
+func arpIP(mac string) string {
+	out, err := exec.Command("arp", "-an").Output()
+	if err != nil {
+		return ""
+	}
+	for _, line := range bytes.Split(out, []byte("\n")) {
+		fields := strings.Fields(string(line))
+		if len(fields) < 4 || fields[2] != "at" || normalizeMAC(fields[3]) != mac {
+			continue
+		}
+		return strings.Trim(fields[1], "()")
+	}
+	return ""
+}
+
+// normalizeMAC zero-pads each octet, as bootpd and arp leave them off
+// ("a2:b:c4:..."), so addresses compare as strings.
+func normalizeMAC(mac string) string {
+	parts := strings.Split(mac, ":")
+	if len(parts) != 6 {
+		return ""
+	}
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 16, 8)
+		if err != nil {
+			return ""
+		}
+		parts[i] = fmt.Sprintf("%02x", n)
+	}
+	return strings.Join(parts, ":")
+}
@@ -9,8 +9,9 @@ package vm
 
 void vm_input_key(void *view, int keycode, int press, const char *chars);
 void vm_input_mouse_move(void *view, double x, double y);
-void vm_input_mouse_button(void *view, int button, int press, double x, double y);
+void vm_input_mouse_button(void *view, int button, int press, double x, double y, int clicks);
 void vm_input_scroll(void *view, double dx, double dy, double x, double y);
+void vm_input_set_caps_lock(void *view, int on);
 */
 import "C"
 import (
@@ -22,32 +23,41 @@ import (
 )
 
 type VMInputHandler struct {
-	view         unsafe.Pointer
-	lastX, lastY float64
+	view          unsafe.Pointer
+	width, height int // VM display size, for normalized coordinates
+	lastX, lastY  float64
+	clicks        input.ClickCounter
+	capsLock      bool // Caps Lock state last sent to the guest
+	capsSent      bool // capsLock has been sent
 }
 
-func NewVMInputHandler(view unsafe.Pointer) types.EventInjector {
-	return &VMInputHandler{view: view}
+func NewVMInputHandler(view unsafe.Pointer, width, height int) types.EventInjector {
+	return &VMInputHandler{view: view, width: width, height: height}
 }
 
 func (h *VMInputHandler) Inject(event types.InputEvent) {
 	switch event.Type {
 	case "mousemove":
-		h.lastX = event.X
-		h.lastY = event.Y
-		C.vm_input_mouse_move(h.view, C.double(event.X), C.double(event.Y))
+		h.lastX, h.lastY = event.Position(h.width, h.height)
+		C.vm_input_mouse_move(h.view, C.double(h.lastX), C.double(h.lastY))
 	case "mousedown":
-		h.lastX = event.X
-		h.lastY = event.Y
+		if event.Button > 2 {
+			return // NSEvent can't carry thumb buttons; don't turn them into a middle click
+		}
+		h.lastX, h.lastY = event.Position(h.width, h.height)
+		clicks := h.clicks.Press(event, h.lastX, h.lastY)
 		C.vm_input_mouse_button(h.view, C.int(event.Button), C.int(1),
-			C.double(event.X), C.double(event.Y))
+			C.double(h.lastX), C.double(h.lastY), C.int(clicks))
 	case "mouseup":
-		h.lastX = event.X
-		h.lastY = event.Y
+		if event.Button > 2 {
+			return
+		}
+		h.lastX, h.lastY = event.Position(h.width, h.height)
 		C.vm_input_mouse_button(h.view, C.int(event.Button), C.int(0),
-			C.double(event.X), C.double(event.Y))
+			C.double(h.lastX), C.double(h.lastY), C.int(h.clicks.Release(event)))
 	case "wheel":
-		C.vm_input_scroll(h.view, C.double(event.DX), C.double(event.DY),
+		dx, dy := event.WheelDelta(h.width, h.height)
+		C.vm_input_scroll(h.view, C.double(dx), C.double(dy),
 			C.double(h.lastX), C.double(h.lastY))
 	case "keydown":
 		if kc, ok := input.CodeMap[event.Code]; ok {
@@ -63,6 +73,19 @@ func (h *VMInputHandler) Inject(event types.InputEvent) {
 			C.vm_input_key(h.view, C.int(kc), C.int(0), cChars)
 			C.free(unsafe.Pointer(cChars))
 		}
+	case "setlock":
+		// The guest keeps its own lock state, which can't be read from
+		// here; the view presses Caps Lock for the guest when the flag
+		// it is sent changes. Macs have no Num Lock.
+		if h.capsSent && h.capsLock == event.CapsLock {
+			return
+		}
+		on := 0
+		if event.CapsLock {
+			on = 1
+		}
+		C.vm_input_set_caps_lock(h.view, C.int(on))
+		h.capsLock, h.capsSent = event.CapsLock, true
 	}
 }
 
@@ -47,6 +47,33 @@ void vm_input_key(void *view, int keycode, int press, const char *chars) {
     });
 }
 
+// vm_input_set_caps_lock sends the view a Caps Lock flags change, as a
+// real Caps Lock press would.
+void vm_input_set_caps_lock(void *view, int on) {
+    dispatch_async(dispatch_get_main_queue(), ^{
+        @autoreleasepool {
+            VZVirtualMachineView *vmView = (__bridge VZVirtualMachineView *)view;
+            NSWindow *window = vmView.window;
+            if (!window) return;
+
+            [window makeFirstResponder:vmView];
+            [window makeKeyWindow];
+
+            NSEvent *event = [NSEvent keyEventWithType:NSEventTypeFlagsChanged
+                location:NSZeroPoint
+                modifierFlags:on ? NSEventModifierFlagCapsLock : 0
+                timestamp:[[NSProcessInfo processInfo] systemUptime]
+                windowNumber:[window windowNumber]
+                context:nil
+                characters:@""
+                charactersIgnoringModifiers:@""
+                isARepeat:NO
+                keyCode:0x39]; // kVK_CapsLock
+            [vmView flagsChanged:event];
+        }
+    });
+}
+
 void vm_input_mouse_move(void *view, double x, double y) {
     dispatch_async(dispatch_get_main_queue(), ^{
         @autoreleasepool {
@@ -89,7 +116,7 @@ void vm_input_mouse_move(void *view, double x, double y) {
     });
 }
 
-void vm_input_mouse_button(void *view, int button, int press, double x, double y) {
+void vm_input_mouse_button(void *view, int button, int press, double x, double y, int clicks) {
     dispatch_async(dispatch_get_main_queue(), ^{
         @autoreleasepool {
             VZVirtualMachineView *vmView = (__bridge VZVirtualMachineView *)view;
@@ -125,7 +152,7 @@ void vm_input_mouse_button(void *view, int button, int press, double x, double y
                 windowNumber:[window windowNumber]
                 context:nil
                 eventNumber:0
-                clickCount:1
+                clickCount:clicks
                 pressure:press ? 1.0 : 0.0];
 
             switch (type) {
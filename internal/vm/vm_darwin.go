@@ -21,28 +21,40 @@ typedef struct {
 
 void vm_nsapp_run(void);
 void vm_nsapp_stop(void);
-int  vm_create(const char *bundle_path, const char *shared_dir,
-               int width, int height, int audio_passthru, VMHandle *out);
-int  vm_start(VMHandle *h);
+int  vm_create(const char *bundle_path, const char **share_dirs,
+               const char **share_tags, int n_shares,
+               int width, int height, int audio_passthru,
+               int bridged, const char *bridge_iface, const char *mac,
+               VMHandle *out, char **out_err);
+int  vm_start(VMHandle *h, char **out_err);
 void vm_stop(VMHandle *h);
 void vm_destroy(VMHandle *h);
 void* vm_get_view(VMHandle *h);
 uint32_t vm_get_window_id(VMHandle *h);
+const char *vm_share_tag(void);
 
 int vm_fetch_restore_url(char **out_url, uint64_t *out_size);
 int vm_download_ipsw(const char *url, const char *dest,
                      void (*progress)(uint64_t done, uint64_t total));
-int vm_create_bundle(const char *ipsw, const char *bundle, uint64_t disk_gb);
+int vm_create_bundle(const char *ipsw, const char *bundle, uint64_t disk_gb,
+                     char **out_err);
 int vm_install(const char *bundle, const char *ipsw,
-               void (*progress)(double fraction));
+               void (*progress)(double fraction), char **out_err);
+
+extern void vm_go_download_progress(uint64_t done, uint64_t total);
+extern void vm_go_install_progress(double fraction);
 */
 import "C"
 import (
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"unsafe"
 )
 
@@ -56,19 +68,104 @@ type VMManager struct {
 	Height      int
 	WindowID    uint32
 	vsockClipCh <-chan net.Conn
+	mac         string // guest network device's MAC, for finding its IP
+
+	ipMu    sync.Mutex
+	guestIP string
 }
 
 func SetGlobal(vm *VMManager) { globalVM = vm }
 func GetGlobal() *VMManager   { return globalVM }
 
-func NewVMManager(bundlePath, sharedDir string, w, h int, audioPassthru bool) (*VMManager, error) {
+// Share is a host directory exported to the guest over VirtioFS.
+type Share struct {
+	Tag string
+	Dir string
+}
+
+// Network is how the guest's network device is attached to the host.
+type Network struct {
+	Bridged   bool
+	Interface string // bridged: host interface, e.g. en0; empty = the first one
+}
+
+// ParseNetwork parses --vm-network: "nat", "bridged" or "bridged:IFACE".
+func ParseNetwork(spec string) (Network, error) {
+	mode, iface, hasIface := strings.Cut(spec, ":")
+	switch {
+	case mode == "nat" && !hasIface:
+		return Network{}, nil
+	case mode == "bridged" && (!hasIface || iface != ""):
+		return Network{Bridged: true, Interface: iface}, nil
+	}
+	return Network{}, fmt.Errorf("invalid network %q: want nat, bridged or bridged:IFACE", spec)
+}
+
+// ParseShares parses --vm-share values, each "DIR" or "TAG=DIR". A share
+// without a tag gets the macOS automount tag, so only one may omit it.
+func ParseShares(specs []string) ([]Share, error) {
+	automount := C.GoString(C.vm_share_tag())
+	seen := make(map[string]bool)
+	shares := make([]Share, 0, len(specs))
+	for _, spec := range specs {
+		s := Share{Tag: automount, Dir: spec}
+		// Tags can't contain '/', which tells "TAG=DIR" apart from a
+		// path that happens to contain '='.
+		if tag, dir, ok := strings.Cut(spec, "="); ok && !strings.Contains(tag, "/") {
+			s = Share{Tag: tag, Dir: dir}
+		}
+		if s.Tag == "" || s.Dir == "" {
+			return nil, fmt.Errorf("invalid share %q: want DIR or TAG=DIR", spec)
+		}
+		if seen[s.Tag] {
+			if s.Tag == automount {
+				return nil, fmt.Errorf("share %q: only one share may omit the tag, use TAG=DIR", spec)
+			}
+			return nil, fmt.Errorf("share %q: tag %s used twice", spec, s.Tag)
+		}
+		seen[s.Tag] = true
+		if fi, err := os.Stat(s.Dir); err != nil {
+			return nil, fmt.Errorf("share %q: %w", spec, err)
+		} else if !fi.IsDir() {
+			return nil, fmt.Errorf("share %q: not a directory", spec)
+		}
+		shares = append(shares, s)
+	}
+	return shares, nil
+}
+
+func NewVMManager(bundlePath string, shares []Share, w, h int, audioPassthru bool, network Network) (*VMManager, error) {
 	cBundle := C.CString(bundlePath)
 	defer C.free(unsafe.Pointer(cBundle))
 
-	var cShare *C.char
-	if sharedDir != "" {
-		cShare = C.CString(sharedDir)
-		defer C.free(unsafe.Pointer(cShare))
+	mac, err := bundleMAC(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	cMAC := C.CString(mac)
+	defer C.free(unsafe.Pointer(cMAC))
+
+	var cBridged C.int
+	if network.Bridged {
+		cBridged = 1
+	}
+	cIface := C.CString(network.Interface)
+	defer C.free(unsafe.Pointer(cIface))
+
+	var cDirs, cTags **C.char
+	if n := len(shares); n > 0 {
+		cDirs = (**C.char)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(uintptr(0)))))
+		cTags = (**C.char)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(uintptr(0)))))
+		defer C.free(unsafe.Pointer(cDirs))
+		defer C.free(unsafe.Pointer(cTags))
+		dirs := unsafe.Slice(cDirs, n)
+		tags := unsafe.Slice(cTags, n)
+		for i, s := range shares {
+			dirs[i] = C.CString(s.Dir)
+			tags[i] = C.CString(s.Tag)
+			defer C.free(unsafe.Pointer(dirs[i]))
+			defer C.free(unsafe.Pointer(tags[i]))
+		}
 	}
 
 	var cAudio C.int
@@ -77,8 +174,13 @@ func NewVMManager(bundlePath, sharedDir string, w, h int, audioPassthru bool) (*
 	}
 
 	var handle C.VMHandle
-	if ret := C.vm_create(cBundle, cShare, C.int(w), C.int(h), cAudio, &handle); ret != 0 {
-		return nil, fmt.Errorf("vm_create failed")
+	var cErr *C.char
+	if ret := C.vm_create(cBundle, cDirs, cTags, C.int(len(shares)), C.int(w), C.int(h), cAudio,
+		cBridged, cIface, cMAC, &handle, &cErr); ret != 0 {
+		return nil, nativeError("vm_create", cErr)
+	}
+	for _, s := range shares {
+		logShare(s)
 	}
 
 	return &VMManager{
@@ -88,14 +190,62 @@ func NewVMManager(bundlePath, sharedDir string, w, h int, audioPassthru bool) (*
 		Width:      w,
 		Height:     h,
 		WindowID:   uint32(C.vm_get_window_id(&handle)),
+		mac:        mac,
 	}, nil
 }
 
+// bundleMAC returns the MAC address of the VM's network device, kept in
+// the bundle so the guest keeps its DHCP lease, and its IP, across runs.
+// A bundle without one gets a random locally administered address.
+func bundleMAC(bundlePath string) (string, error) {
+	path := filepath.Join(bundlePath, "mac-address")
+	if b, err := os.ReadFile(path); err == nil {
+		mac := strings.TrimSpace(string(b))
+		if _, err := net.ParseMAC(mac); err != nil {
+			return "", fmt.Errorf("%s: %v", path, err)
+		}
+		return mac, nil
+	}
+
+	var b [6]byte
+	rand.Read(b[:])
+	b[0] = b[0]&^1 | 2 // unicast, locally administered
+	mac := net.HardwareAddr(b[:]).String()
+	if err := os.WriteFile(path, []byte(mac+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("save MAC address: %v", err)
+	}
+	return mac, nil
+}
+
+// nativeError turns an error message from the Objective-C side into an
+// error and frees it. The message already names the step; what is only
+// used when there's none.
+func nativeError(what string, cErr *C.char) error {
+	if cErr == nil {
+		return fmt.Errorf("%s failed", what)
+	}
+	defer C.free(unsafe.Pointer(cErr))
+	return errors.New(C.GoString(cErr))
+}
+
+// logShare tells the user where a shared directory shows up in the
+// guest. The host can't see whether the guest actually mounted it.
+func logShare(s Share) {
+	log.Printf("VirtioFS: sharing %s with tag %s", s.Dir, s.Tag)
+	if s.Tag == C.GoString(C.vm_share_tag()) {
+		log.Printf("VirtioFS: the guest mounts it at \"/Volumes/My Shared Files\" after login; to mount it elsewhere, in the guest run: mkdir -p ~/share && mount_virtiofs %s ~/share", s.Tag)
+		return
+	}
+	log.Printf("VirtioFS: to mount it, in the guest run: mkdir -p ~/%s && mount_virtiofs %s ~/%s", s.Tag, s.Tag, s.Tag)
+}
+
 func (vm *VMManager) Start() error {
-	if ret := C.vm_start(&vm.handle); ret != 0 {
-		return fmt.Errorf("vm_start failed")
+	var cErr *C.char
+	if ret := C.vm_start(&vm.handle, &cErr); ret != 0 {
+		return nativeError("vm_start", cErr)
 	}
 	log.Printf("VM started (bundle: %s)", vm.bundlePath)
+	go vm.watchGuestIP()
 	return nil
 }
 
@@ -109,9 +259,41 @@ func (vm *VMManager) View() unsafe.Pointer { return vm.view }
 func (vm *VMManager) SetVsockClipCh(ch <-chan net.Conn) { vm.vsockClipCh = ch }
 func (vm *VMManager) VsockClipCh() <-chan net.Conn      { return vm.vsockClipCh }
 
-func BundlePath() string {
+// supportDir is where bunghole keeps VM bundles and the IPSW cache.
+func supportDir() string {
 	home, _ := os.UserHomeDir()
-	return filepath.Join(home, "Library", "Application Support", "bunghole", "vm")
+	return filepath.Join(home, "Library", "Application Support", "bunghole")
+}
+
+// BundlePath returns the bundle of the VM with the given name (see
+// --vm-name), or of the default VM if name is empty.
+func BundlePath(name string) string {
+	if name == "" {
+		return filepath.Join(supportDir(), "vm")
+	}
+	return filepath.Join(supportDir(), "vms", name)
+}
+
+// ValidateName checks a --vm-name: letters, digits, '-', '_' and '.', not
+// starting with '.', so it names a directory under vms/ and nothing else.
+func ValidateName(name string) error {
+	if name == "" {
+		return nil
+	}
+	if name[0] == '.' {
+		return fmt.Errorf("%q may not start with '.'", name)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return fmt.Errorf("%q may only contain letters, digits, '-', '_' and '.'", name)
+		}
+	}
+	return nil
+}
+
+// ipswCachePath is the restore image cache, shared by all VMs.
+func ipswCachePath() string {
+	return filepath.Join(supportDir(), "cache", "restore.ipsw")
 }
 
 func BundleExists(path string) bool {
@@ -122,8 +304,8 @@ func BundleExists(path string) bool {
 	return err1 == nil && err2 == nil
 }
 
-func RunSetup(diskGB int) {
-	bundlePath := BundlePath()
+func RunSetup(name string, diskGB int) {
+	bundlePath := BundlePath(name)
 
 	if BundleExists(bundlePath) {
 		log.Printf("VM bundle already exists at %s", bundlePath)
@@ -142,9 +324,8 @@ func RunSetup(diskGB int) {
 
 	log.Printf("restore URL: %s", restoreURL)
 
-	ipswDir := filepath.Join(filepath.Dir(bundlePath), "cache")
-	os.MkdirAll(ipswDir, 0755)
-	ipswPath := filepath.Join(ipswDir, "restore.ipsw")
+	ipswPath := ipswCachePath()
+	os.MkdirAll(filepath.Dir(ipswPath), 0755)
 
 	if _, err := os.Stat(ipswPath); os.IsNotExist(err) {
 		log.Printf("downloading macOS restore image...")
@@ -153,7 +334,7 @@ func RunSetup(diskGB int) {
 		defer C.free(unsafe.Pointer(cIPSWURL))
 		defer C.free(unsafe.Pointer(cIPSWDest))
 
-		if ret := C.vm_download_ipsw(cIPSWURL, cIPSWDest, nil); ret != 0 {
+		if ret := C.vm_download_ipsw(cIPSWURL, cIPSWDest, downloadProgress()); ret != 0 {
 			log.Fatal("failed to download IPSW")
 		}
 		log.Printf("IPSW downloaded to %s", ipswPath)
@@ -167,18 +348,23 @@ func RunSetup(diskGB int) {
 	defer C.free(unsafe.Pointer(cIPSW))
 	defer C.free(unsafe.Pointer(cBundle))
 
-	if ret := C.vm_create_bundle(cIPSW, cBundle, C.uint64_t(diskGB)); ret != 0 {
-		log.Fatal("failed to create VM bundle")
+	var cErr *C.char
+	if ret := C.vm_create_bundle(cIPSW, cBundle, C.uint64_t(diskGB), &cErr); ret != 0 {
+		log.Fatalf("failed to create VM bundle: %v", nativeError("vm_create_bundle", cErr))
 	}
 
 	log.Printf("installing macOS (this may take a while)...")
-	if ret := C.vm_install(cBundle, cIPSW, nil); ret != 0 {
-		log.Fatal("macOS installation failed")
+	if ret := C.vm_install(cBundle, cIPSW, installProgress(), &cErr); ret != 0 {
+		log.Fatalf("macOS installation failed: %v", nativeError("vm_install", cErr))
 	}
 
 	log.Printf("macOS installed successfully!")
 	log.Printf("VM bundle: %s", bundlePath)
-	log.Printf("Start with: bunghole --vm --token <secret>")
+	if name != "" {
+		log.Printf("Start with: bunghole --vm --vm-name %s --token <secret>", name)
+	} else {
+		log.Printf("Start with: bunghole --vm --token <secret>")
+	}
 }
 
 func AutoProvision(bundlePath string) error {
@@ -192,9 +378,8 @@ func AutoProvision(bundlePath string) error {
 	restoreURL := C.GoString(cURL)
 	C.free(unsafe.Pointer(cURL))
 
-	ipswDir := filepath.Join(filepath.Dir(bundlePath), "cache")
-	os.MkdirAll(ipswDir, 0755)
-	ipswPath := filepath.Join(ipswDir, "restore.ipsw")
+	ipswPath := ipswCachePath()
+	os.MkdirAll(filepath.Dir(ipswPath), 0755)
 
 	if _, err := os.Stat(ipswPath); os.IsNotExist(err) {
 		log.Printf("downloading macOS restore image...")
@@ -203,7 +388,7 @@ func AutoProvision(bundlePath string) error {
 		defer C.free(unsafe.Pointer(cIPSWURL))
 		defer C.free(unsafe.Pointer(cIPSWDest))
 
-		if ret := C.vm_download_ipsw(cIPSWURL, cIPSWDest, nil); ret != 0 {
+		if ret := C.vm_download_ipsw(cIPSWURL, cIPSWDest, downloadProgress()); ret != 0 {
 			return fmt.Errorf("IPSW download failed")
 		}
 	}
@@ -213,18 +398,64 @@ func AutoProvision(bundlePath string) error {
 	defer C.free(unsafe.Pointer(cIPSW))
 	defer C.free(unsafe.Pointer(cBundle))
 
-	if ret := C.vm_create_bundle(cIPSW, cBundle, C.uint64_t(64)); ret != 0 {
-		return fmt.Errorf("bundle creation failed")
+	var cErr *C.char
+	if ret := C.vm_create_bundle(cIPSW, cBundle, C.uint64_t(64), &cErr); ret != 0 {
+		return fmt.Errorf("bundle creation failed: %w", nativeError("vm_create_bundle", cErr))
 	}
 
-	if ret := C.vm_install(cBundle, cIPSW, nil); ret != 0 {
-		return fmt.Errorf("macOS installation failed")
+	if ret := C.vm_install(cBundle, cIPSW, installProgress(), &cErr); ret != 0 {
+		return fmt.Errorf("macOS installation failed: %w", nativeError("vm_install", cErr))
 	}
 
 	log.Printf("auto-provision complete")
 	return nil
 }
 
+// progressStep is how many percent a download or install has to advance
+// before it is logged again.
+const progressStep = 5
+
+// downloadLogged and installLogged are the last logged percentages (or, for
+// a download of unknown size, gigabytes). Setup runs one step at a time, so
+// the callbacks don't race.
+var downloadLogged, installLogged int
+
+func downloadProgress() *[0]byte {
+	downloadLogged = -1
+	return (*[0]byte)(C.vm_go_download_progress)
+}
+
+func installProgress() *[0]byte {
+	installLogged = -1
+	return (*[0]byte)(C.vm_go_install_progress)
+}
+
+//export vm_go_download_progress
+func vm_go_download_progress(done, total C.uint64_t) {
+	if total == 0 {
+		if gb := int(done >> 30); gb > downloadLogged {
+			downloadLogged = gb
+			log.Printf("downloading IPSW: %d GB", gb)
+		}
+		return
+	}
+	pct := int(uint64(done) * 100 / uint64(total))
+	if pct >= downloadLogged+progressStep || (pct == 100 && downloadLogged < 100) {
+		downloadLogged = pct
+		log.Printf("downloading IPSW: %d%% (%.1f of %.1f GB)", pct,
+			float64(done)/(1<<30), float64(total)/(1<<30))
+	}
+}
+
+//export vm_go_install_progress
+func vm_go_install_progress(fraction C.double) {
+	pct := int(fraction * 100)
+	if pct >= installLogged+progressStep || (pct == 100 && installLogged < 100) {
+		installLogged = pct
+		log.Printf("installing macOS: %d%%", pct)
+	}
+}
+
 func NSAppRun() {
 	C.vm_nsapp_run()
 }
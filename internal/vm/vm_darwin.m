@@ -4,6 +4,7 @@
 #import <Cocoa/Cocoa.h>
 #include <stdlib.h>
 #include <string.h>
+#include <errno.h>
 #include <stdint.h>
 #include <sys/sysctl.h>
 #include <sys/fcntl.h>
@@ -41,6 +42,30 @@ typedef struct {
 }
 @end
 
+// ---- Error reporting ----
+
+// describe_error renders an NSError with its domain and code, plus the
+// underlying error, which is often where the actionable part ("No space
+// left on device") is.
+static NSString *describe_error(NSError *err) {
+    if (!err) return @"unknown error";
+    NSString *s = [NSString stringWithFormat:@"%@ (%@ %ld)",
+        err.localizedDescription, err.domain, (long)err.code];
+    NSError *under = err.userInfo[NSUnderlyingErrorKey];
+    if (under) {
+        s = [s stringByAppendingFormat:@": %@", describe_error(under)];
+    }
+    return s;
+}
+
+// fail logs msg and hands a malloc'd copy to Go through out_err, which
+// frees it. Returns -1 so callers can return it directly.
+static int fail(char **out_err, NSString *msg) {
+    NSLog(@"%@", msg);
+    if (out_err) *out_err = strdup(msg.UTF8String);
+    return -1;
+}
+
 // ---- Hardware config JSON ----
 
 typedef struct {
@@ -121,6 +146,49 @@ static uint64_t host_ram_bytes(void) {
     return 8ULL * 1024 * 1024 * 1024;
 }
 
+// ---- Helper: network device ----
+
+// make_network builds the guest's network device with the given MAC: NAT
+// by default, or bridged to the host interface iface (the first one when
+// empty). Bridging needs the com.apple.vm.networking entitlement; without
+// it no interfaces are offered.
+static VZVirtioNetworkDeviceConfiguration *make_network(int bridged, const char *iface,
+                                                         const char *mac, char **out_err) {
+    VZVirtioNetworkDeviceConfiguration *net = [[VZVirtioNetworkDeviceConfiguration alloc] init];
+    VZMACAddress *addr = [[VZMACAddress alloc] initWithString:[NSString stringWithUTF8String:mac]];
+    if (!addr) {
+        fail(out_err, [NSString stringWithFormat:@"vm_create: invalid MAC address %s", mac]);
+        return nil;
+    }
+    net.MACAddress = addr;
+
+    if (!bridged) {
+        net.attachment = [[VZNATNetworkDeviceAttachment alloc] init];
+        return net;
+    }
+
+    NSString *want = iface[0] ? [NSString stringWithUTF8String:iface] : nil;
+    NSArray<VZBridgedNetworkInterface *> *ifaces = VZBridgedNetworkInterface.networkInterfaces;
+    NSMutableArray<NSString *> *names = [NSMutableArray arrayWithCapacity:ifaces.count];
+    VZBridgedNetworkInterface *found = nil;
+    for (VZBridgedNetworkInterface *i in ifaces) {
+        [names addObject:i.identifier];
+        if (!found && (!want || [i.identifier isEqualToString:want])) found = i;
+    }
+    if (ifaces.count == 0) {
+        fail(out_err, @"vm_create: no host interfaces can be bridged (bridging needs the com.apple.vm.networking entitlement)");
+        return nil;
+    }
+    if (!found) {
+        fail(out_err, [NSString stringWithFormat:@"vm_create: can't bridge to %@ (have: %@)",
+            want, [names componentsJoinedByString:@", "]]);
+        return nil;
+    }
+    NSLog(@"vm_create: bridging to %@ (%@)", found.identifier, found.localizedDisplayName);
+    net.attachment = [[VZBridgedNetworkDeviceAttachment alloc] initWithInterface:found];
+    return net;
+}
+
 // ---- NSApplication RunLoop ----
 
 void vm_nsapp_run(void) {
@@ -143,8 +211,11 @@ void vm_nsapp_stop(void) {
 
 // ---- VM Create ----
 
-int vm_create(const char *bundle_path, const char *shared_dir,
-              int width, int height, int audio_passthru, VMHandle *out) {
+int vm_create(const char *bundle_path, const char **share_dirs,
+              const char **share_tags, int n_shares,
+              int width, int height, int audio_passthru,
+              int bridged, const char *bridge_iface, const char *mac,
+              VMHandle *out, char **out_err) {
     @autoreleasepool {
         memset(out, 0, sizeof(VMHandle));
 
@@ -154,8 +225,7 @@ int vm_create(const char *bundle_path, const char *shared_dir,
 
         HardwareConfig *hwCfg = load_hardware_config(bundle_path);
         if (!hwCfg) {
-            NSLog(@"vm_create: failed to load hardware.json");
-            return -1;
+            return fail(out_err, @"vm_create: failed to load hardware.json");
         }
 
         NSData *hwModelData = [[NSData alloc] initWithBase64EncodedString:
@@ -165,22 +235,19 @@ int vm_create(const char *bundle_path, const char *shared_dir,
         free_hardware_config(hwCfg);
 
         if (!hwModelData || !machineIdData) {
-            NSLog(@"vm_create: invalid hardware config data");
-            return -1;
+            return fail(out_err, @"vm_create: invalid hardware config data");
         }
 
         VZMacHardwareModel *hardwareModel = [[VZMacHardwareModel alloc]
             initWithDataRepresentation:hwModelData];
         if (!hardwareModel) {
-            NSLog(@"vm_create: invalid hardware model");
-            return -1;
+            return fail(out_err, @"vm_create: invalid hardware model");
         }
 
         VZMacMachineIdentifier *machineIdentifier = [[VZMacMachineIdentifier alloc]
             initWithDataRepresentation:machineIdData];
         if (!machineIdentifier) {
-            NSLog(@"vm_create: invalid machine identifier");
-            return -1;
+            return fail(out_err, @"vm_create: invalid machine identifier");
         }
 
         NSError *err = nil;
@@ -213,14 +280,14 @@ int vm_create(const char *bundle_path, const char *shared_dir,
         VZDiskImageStorageDeviceAttachment *diskAttachment = [[VZDiskImageStorageDeviceAttachment alloc]
             initWithURL:[NSURL fileURLWithPath:diskPath] readOnly:NO error:&err];
         if (err) {
-            NSLog(@"vm_create: disk attachment error: %@", err);
-            return -1;
+            return fail(out_err, [NSString stringWithFormat:@"vm_create: disk attachment error: %@",
+                describe_error(err)]);
         }
         VZVirtioBlockDeviceConfiguration *disk = [[VZVirtioBlockDeviceConfiguration alloc]
             initWithAttachment:diskAttachment];
 
-        VZVirtioNetworkDeviceConfiguration *net = [[VZVirtioNetworkDeviceConfiguration alloc] init];
-        net.attachment = [[VZNATNetworkDeviceAttachment alloc] init];
+        VZVirtioNetworkDeviceConfiguration *net = make_network(bridged, bridge_iface, mac, out_err);
+        if (!net) return -1;
 
         VZUSBKeyboardConfiguration *keyboard = [[VZUSBKeyboardConfiguration alloc] init];
         VZUSBScreenCoordinatePointingDeviceConfiguration *pointing =
@@ -250,22 +317,30 @@ int vm_create(const char *bundle_path, const char *shared_dir,
         VZVirtioSocketDeviceConfiguration *vsockDev = [[VZVirtioSocketDeviceConfiguration alloc] init];
         config.socketDevices = @[vsockDev];
 
-        if (shared_dir) {
-            NSString *sharePath = [NSString stringWithUTF8String:shared_dir];
+        // One VirtioFS device per shared directory, each under its own tag.
+        NSMutableArray *shares = [NSMutableArray arrayWithCapacity:n_shares];
+        for (int i = 0; i < n_shares; i++) {
+            NSString *tag = [NSString stringWithUTF8String:share_tags[i]];
+            if (![VZVirtioFileSystemDeviceConfiguration validateTag:tag error:&err]) {
+                return fail(out_err, [NSString stringWithFormat:@"vm_create: invalid share tag %@: %@",
+                    tag, describe_error(err)]);
+            }
+            NSString *sharePath = [NSString stringWithUTF8String:share_dirs[i]];
             VZSharedDirectory *sharedDirectory = [[VZSharedDirectory alloc]
                 initWithURL:[NSURL fileURLWithPath:sharePath] readOnly:NO];
             VZSingleDirectoryShare *share = [[VZSingleDirectoryShare alloc]
                 initWithDirectory:sharedDirectory];
             VZVirtioFileSystemDeviceConfiguration *fs = [[VZVirtioFileSystemDeviceConfiguration alloc]
-                initWithTag:VZVirtioFileSystemDeviceConfiguration.macOSGuestAutomountTag];
+                initWithTag:tag];
             fs.share = share;
-            config.directorySharingDevices = @[fs];
+            [shares addObject:fs];
         }
+        config.directorySharingDevices = shares;
 
         [config validateWithError:&err];
         if (err) {
-            NSLog(@"vm_create: config validation error: %@", err);
-            return -1;
+            return fail(out_err, [NSString stringWithFormat:@"vm_create: config validation error: %@",
+                describe_error(err)]);
         }
 
         // Create VM on main thread
@@ -319,7 +394,7 @@ int vm_create(const char *bundle_path, const char *shared_dir,
 
 // ---- VM Start ----
 
-int vm_start(VMHandle *h) {
+int vm_start(VMHandle *h, char **out_err) {
     @autoreleasepool {
         VZVirtualMachine *vm = (__bridge VZVirtualMachine *)h->vm;
 
@@ -329,8 +404,8 @@ int vm_start(VMHandle *h) {
         void (^startBlock)(void) = ^{
             [vm startWithCompletionHandler:^(NSError *error) {
                 if (error) {
-                    NSLog(@"vm_start: error: %@", error);
-                    result = -1;
+                    result = fail(out_err, [NSString stringWithFormat:@"vm_start: %@",
+                        describe_error(error)]);
                 } else {
                     NSLog(@"vm_start: VM started successfully");
                 }
@@ -432,6 +507,12 @@ uint32_t vm_get_window_id(VMHandle *h) {
     return h ? h->windowID : 0;
 }
 
+// The VirtioFS tag of a shared directory given without one. macOS guests
+// automount this tag at "/Volumes/My Shared Files".
+const char *vm_share_tag(void) {
+    return VZVirtioFileSystemDeviceConfiguration.macOSGuestAutomountTag.UTF8String;
+}
+
 // ---- Setup / Install ----
 
 int vm_fetch_restore_url(char **out_url, uint64_t *out_size) {
@@ -499,12 +580,19 @@ int vm_download_ipsw(const char *url, const char *dest,
             }];
 
         [task resume];
-        dispatch_semaphore_wait(sem, DISPATCH_TIME_FOREVER);
+        // Report progress once a second until the download completes.
+        while (dispatch_semaphore_wait(sem, dispatch_time(DISPATCH_TIME_NOW, NSEC_PER_SEC)) != 0) {
+            if (progress) {
+                int64_t total = task.countOfBytesExpectedToReceive;
+                progress((uint64_t)task.countOfBytesReceived, total > 0 ? (uint64_t)total : 0);
+            }
+        }
         return result;
     }
 }
 
-int vm_create_bundle(const char *ipsw_path, const char *bundle_path, uint64_t disk_gb) {
+int vm_create_bundle(const char *ipsw_path, const char *bundle_path, uint64_t disk_gb,
+                     char **out_err) {
     @autoreleasepool {
         NSString *bundlePath = [NSString stringWithUTF8String:bundle_path];
         NSString *ipswPath = [NSString stringWithUTF8String:ipsw_path];
@@ -516,18 +604,20 @@ int vm_create_bundle(const char *ipsw_path, const char *bundle_path, uint64_t di
 
         [fm createDirectoryAtPath:bundlePath withIntermediateDirectories:YES attributes:nil error:&err];
         if (err) {
-            NSLog(@"vm_create_bundle: mkdir error: %@", err);
-            return -1;
+            return fail(out_err, [NSString stringWithFormat:@"vm_create_bundle: mkdir error: %@",
+                describe_error(err)]);
         }
 
         // Load restore image to get hardware model
         __block VZMacOSRestoreImage *restoreImage = nil;
         dispatch_semaphore_t sem = dispatch_semaphore_create(0);
 
+        __block NSError *fetchErr = nil;
         [VZMacOSRestoreImage fetchLatestSupportedWithCompletionHandler:
             ^(VZMacOSRestoreImage *image, NSError *error) {
                 if (error) {
                     NSLog(@"vm_create_bundle: fetch restore image error: %@", error);
+                    fetchErr = error;
                 }
                 dispatch_semaphore_signal(sem);
             }];
@@ -538,20 +628,22 @@ int vm_create_bundle(const char *ipsw_path, const char *bundle_path, uint64_t di
         [VZMacOSRestoreImage fetchLatestSupportedWithCompletionHandler:
             ^(VZMacOSRestoreImage *image, NSError *error) {
                 if (!error) restoreImage = image;
+                else fetchErr = error;
                 dispatch_semaphore_signal(sem);
             }];
         dispatch_semaphore_wait(sem, DISPATCH_TIME_FOREVER);
 
-        if (!restoreImage) return -1;
+        if (!restoreImage) {
+            return fail(out_err, [NSString stringWithFormat:@"vm_create_bundle: fetch restore image: %@",
+                describe_error(fetchErr)]);
+        }
 
         VZMacOSConfigurationRequirements *reqs = restoreImage.mostFeaturefulSupportedConfiguration;
         if (!reqs) {
-            NSLog(@"vm_create_bundle: no supported configuration");
-            return -1;
+            return fail(out_err, @"vm_create_bundle: no supported configuration");
         }
         if (!reqs.hardwareModel.supported) {
-            NSLog(@"vm_create_bundle: hardware model not supported on this host");
-            return -1;
+            return fail(out_err, @"vm_create_bundle: hardware model not supported on this host");
         }
 
         VZMacHardwareModel *hardwareModel = reqs.hardwareModel;
@@ -564,8 +656,8 @@ int vm_create_bundle(const char *ipsw_path, const char *bundle_path, uint64_t di
             options:VZMacAuxiliaryStorageInitializationOptionAllowOverwrite
             error:&err];
         if (err || !auxStorage) {
-            NSLog(@"vm_create_bundle: aux storage error: %@", err);
-            return -1;
+            return fail(out_err, [NSString stringWithFormat:@"vm_create_bundle: aux storage error: %@",
+                describe_error(err)]);
         }
 
         // Create sparse disk image
@@ -575,17 +667,21 @@ int vm_create_bundle(const char *ipsw_path, const char *bundle_path, uint64_t di
 
         int fd = open([diskPath UTF8String], O_RDWR | O_CREAT | O_TRUNC, 0644);
         if (fd < 0) {
-            NSLog(@"vm_create_bundle: create disk error");
-            return -1;
+            return fail(out_err, [NSString stringWithFormat:@"vm_create_bundle: create disk %@: %s",
+                diskPath, strerror(errno)]);
+        }
+        if (ftruncate(fd, diskSize) != 0) {
+            int e = errno;
+            close(fd);
+            return fail(out_err, [NSString stringWithFormat:@"vm_create_bundle: size disk to %llu GB: %s",
+                diskSize >> 30, strerror(e)]);
         }
-        ftruncate(fd, diskSize);
         close(fd);
 
         // Save hardware config
         if (save_hardware_config(bundle_path, hardwareModel.dataRepresentation,
                                  machineId.dataRepresentation) != 0) {
-            NSLog(@"vm_create_bundle: save hardware config error");
-            return -1;
+            return fail(out_err, @"vm_create_bundle: save hardware config error");
         }
 
         NSLog(@"vm_create_bundle: bundle created at %@ (disk: %llu GB)", bundlePath, disk_gb);
@@ -594,7 +690,7 @@ int vm_create_bundle(const char *ipsw_path, const char *bundle_path, uint64_t di
 }
 
 int vm_install(const char *bundle_path, const char *ipsw_path,
-               void (*progress)(double fraction)) {
+               void (*progress)(double fraction), char **out_err) {
     @autoreleasepool {
         NSString *bundlePath = [NSString stringWithUTF8String:bundle_path];
         NSString *ipswPath = [NSString stringWithUTF8String:ipsw_path];
@@ -603,8 +699,7 @@ int vm_install(const char *bundle_path, const char *ipsw_path,
 
         HardwareConfig *hwCfg = load_hardware_config(bundle_path);
         if (!hwCfg) {
-            NSLog(@"vm_install: failed to load hardware config");
-            return -1;
+            return fail(out_err, @"vm_install: failed to load hardware config");
         }
 
         NSData *hwModelData = [[NSData alloc] initWithBase64EncodedString:
@@ -648,8 +743,8 @@ int vm_install(const char *bundle_path, const char *ipsw_path,
         VZDiskImageStorageDeviceAttachment *diskAttachment = [[VZDiskImageStorageDeviceAttachment alloc]
             initWithURL:[NSURL fileURLWithPath:diskPath] readOnly:NO error:&err];
         if (err) {
-            NSLog(@"vm_install: disk attachment error: %@", err);
-            return -1;
+            return fail(out_err, [NSString stringWithFormat:@"vm_install: disk attachment error: %@",
+                describe_error(err)]);
         }
         VZVirtioBlockDeviceConfiguration *disk = [[VZVirtioBlockDeviceConfiguration alloc]
             initWithAttachment:diskAttachment];
@@ -674,8 +769,8 @@ int vm_install(const char *bundle_path, const char *ipsw_path,
 
         [config validateWithError:&err];
         if (err) {
-            NSLog(@"vm_install: config validation error: %@", err);
-            return -1;
+            return fail(out_err, [NSString stringWithFormat:@"vm_install: config validation error: %@",
+                describe_error(err)]);
         }
 
         // Create VM and install (must be on main thread)
@@ -700,8 +795,8 @@ int vm_install(const char *bundle_path, const char *ipsw_path,
             [installer installWithCompletionHandler:^(NSError *error) {
                 if (progressTimer) [progressTimer invalidate];
                 if (error) {
-                    NSLog(@"vm_install: install error: %@", error);
-                    result = -1;
+                    result = fail(out_err, [NSString stringWithFormat:@"vm_install: install error: %@",
+                        describe_error(error)]);
                 } else {
                     NSLog(@"vm_install: macOS installed successfully");
                 }
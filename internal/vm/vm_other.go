@@ -16,9 +16,9 @@ func GetGlobal() *VMManager   { return globalVM }
 func (vm *VMManager) Window() unsafe.Pointer { return nil }
 func (vm *VMManager) View() unsafe.Pointer   { return nil }
 
-func BundlePath() string             { return "" }
+func BundlePath(name string) string  { return "" }
 func BundleExists(path string) bool  { return false }
-func RunSetup(diskGB int)            {}
+func RunSetup(name string, diskGB int) {}
 func AutoProvision(path string) error { return nil }
 func NSAppRun()                      {}
 func NSAppStop()                     {}
@@ -14,10 +14,13 @@ void vm_vsock_stop(void *vm_ptr, uint32_t port);
 import "C"
 import (
 	"fmt"
+	"log"
 	"net"
 	"os"
 	"sync"
 	"unsafe"
+
+	"bunghole/internal/vsockmux"
 )
 
 var (
@@ -80,6 +83,20 @@ func vsock_go_accepted(fd C.int, port C.uint32_t) {
 		return
 	}
 
+	deliverVsockConn(uint32(port), conn)
+}
+
+// deliverVsockConn hands conn to the listener on port as if it had been
+// accepted there, closing it if nobody listens or the queue is full.
+func deliverVsockConn(port uint32, conn net.Conn) {
+	vsockMu.Lock()
+	ch := vsockPorts[port]
+	vsockMu.Unlock()
+
+	if ch == nil {
+		conn.Close()
+		return
+	}
 	select {
 	case ch <- conn:
 	default:
@@ -87,6 +104,38 @@ func vsock_go_accepted(fd C.int, port C.uint32_t) {
 	}
 }
 
+// StartVsockMux listens on port for guests that multiplex several streams
+// over one connection (see vsockmux). Each stream is delivered to the
+// listener on the port routes maps its ID to, as if the guest had
+// connected there directly. Stop it with StopVsockListener(port).
+func StartVsockMux(vmPtr unsafe.Pointer, port uint32, routes map[byte]uint32) error {
+	ch, err := StartVsockListener(vmPtr, port)
+	if err != nil {
+		return err
+	}
+	ids := make([]byte, 0, len(routes))
+	for id := range routes {
+		ids = append(ids, id)
+	}
+	go func() {
+		for conn := range ch {
+			go func() {
+				v, err := vsockmux.ReadHello(conn)
+				if err != nil {
+					log.Printf("vsock mux: guest rejected: %v", err)
+					conn.Close()
+					return
+				}
+				log.Printf("vsock mux: guest connected (protocol v%d)", v)
+				for i, s := range vsockmux.Split(conn, ids...) {
+					deliverVsockConn(routes[ids[i]], s)
+				}
+			}()
+		}
+	}()
+	return nil
+}
+
 // VMPtr returns the raw VM pointer for use with vsock APIs.
 func (vm *VMManager) VMPtr() unsafe.Pointer {
 	return vm.handle.vm
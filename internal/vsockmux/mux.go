@@ -0,0 +1,241 @@
+// Package vsockmux carries several guest↔host byte streams over one vsock
+// connection, so a single guest agent can send audio and sync the
+// clipboard through one port.
+//
+// The guest opens the connection with a hello: the magic "BHM" and a
+// protocol version byte. After that every frame is
+// [1-byte stream ID][2-byte BE length][payload]. A payload is a chunk of
+// that stream's bytes in its usual protocol (including its own hello), so
+// the audio and clipboard code on either end is unchanged.
+package vsockmux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream IDs.
+const (
+	StreamAudio     byte = 1
+	StreamClipboard byte = 2
+)
+
+// DefaultPort is the vsock port of the multiplexed connection. The host
+// (--vsock-mux-port) and bunghole-vm-audio (--mux-port) must agree on it.
+const DefaultPort = 5003
+
+// Version is the mux protocol version this build speaks.
+const Version = 1
+
+// maxChunk is the largest payload of one frame.
+const maxChunk = 1<<16 - 1
+
+// maxBuffered bounds the bytes queued for a stream nobody reads, e.g. audio
+// before the pipeline starts. Past it the stream is closed rather than
+// stalling the others or growing without bound.
+const maxBuffered = 4 << 20
+
+var helloMagic = [3]byte{'B', 'H', 'M'}
+
+// WriteHello sends the guest's hello; call it once, before Split.
+func WriteHello(w io.Writer) error {
+	_, err := w.Write([]byte{helloMagic[0], helloMagic[1], helloMagic[2], Version})
+	return err
+}
+
+// ReadHello reads the guest's hello and returns its protocol version.
+func ReadHello(r io.Reader) (int, error) {
+	var hello [4]byte
+	if _, err := io.ReadFull(r, hello[:]); err != nil {
+		return 0, err
+	}
+	if [3]byte(hello[:3]) != helloMagic {
+		return 0, fmt.Errorf("not a multiplexed stream (hello %q); check the vsock ports", hello[:3])
+	}
+	if v := int(hello[3]); v == 0 || v > Version {
+		return 0, fmt.Errorf("guest speaks mux protocol v%d, this host only up to v%d; update bunghole on the host", v, Version)
+	}
+	return int(hello[3]), nil
+}
+
+// Split multiplexes the given streams over conn and returns one net.Conn
+// per stream ID, in order. Frames for other stream IDs are dropped. conn
+// is closed once every stream has been closed or conn fails.
+func Split(conn net.Conn, ids ...byte) []net.Conn {
+	m := &mux{conn: conn, streams: make(map[byte]*stream, len(ids))}
+	out := make([]net.Conn, len(ids))
+	for i, id := range ids {
+		s := &stream{mux: m, id: id}
+		s.cond = sync.NewCond(&s.mu)
+		m.streams[id] = s
+		out[i] = s
+	}
+	m.open = len(ids)
+	go m.readLoop()
+	return out
+}
+
+type mux struct {
+	conn    net.Conn
+	streams map[byte]*stream
+
+	writeMu sync.Mutex
+
+	mu   sync.Mutex
+	open int // streams not yet closed
+}
+
+func (m *mux) readLoop() {
+	br := bufio.NewReader(m.conn)
+	var err error
+	for {
+		var hdr [3]byte
+		if _, err = io.ReadFull(br, hdr[:]); err != nil {
+			break
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(hdr[1:]))
+		if _, err = io.ReadFull(br, buf); err != nil {
+			break
+		}
+		s := m.streams[hdr[0]]
+		if s == nil {
+			log.Printf("vsockmux: dropping %d bytes for unknown stream %d", len(buf), hdr[0])
+			continue
+		}
+		s.push(buf)
+	}
+	for _, s := range m.streams {
+		s.fail(err)
+	}
+	m.conn.Close()
+}
+
+func (m *mux) write(id byte, p []byte) (int, error) {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	n := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		var hdr [3]byte
+		hdr[0] = id
+		binary.BigEndian.PutUint16(hdr[1:], uint16(len(chunk)))
+		if _, err := m.conn.Write(hdr[:]); err != nil {
+			return n, err
+		}
+		if _, err := m.conn.Write(chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (m *mux) streamClosed() {
+	m.mu.Lock()
+	m.open--
+	last := m.open == 0
+	m.mu.Unlock()
+	if last {
+		m.conn.Close()
+	}
+}
+
+// stream is one multiplexed stream. Reads come from a queue the mux read
+// loop fills, so a stream nobody reads doesn't block the others.
+type stream struct {
+	mux *mux
+	id  byte
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	err    error // read error once buf drains
+	closed bool
+}
+
+func (s *stream) push(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.err != nil {
+		return
+	}
+	if len(s.buf)+len(p) > maxBuffered {
+		log.Printf("vsockmux: stream %d not read, %d bytes queued; closing it", s.id, len(s.buf))
+		s.err = fmt.Errorf("vsockmux: stream %d overflowed", s.id)
+		s.buf = nil
+		s.cond.Broadcast()
+		return
+	}
+	s.buf = append(s.buf, p...)
+	s.cond.Broadcast()
+}
+
+func (s *stream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.buf) == 0 && s.err == nil && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return 0, net.ErrClosed
+	}
+	if len(s.buf) == 0 {
+		return 0, s.err
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	return s.mux.write(s.id, p)
+}
+
+func (s *stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.buf = nil
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.mux.streamClosed()
+	return nil
+}
+
+func (s *stream) LocalAddr() net.Addr  { return s.mux.conn.LocalAddr() }
+func (s *stream) RemoteAddr() net.Addr { return s.mux.conn.RemoteAddr() }
+
+// Deadlines aren't supported; nothing reading a stream uses them.
+func (s *stream) SetDeadline(time.Time) error      { return errors.ErrUnsupported }
+func (s *stream) SetReadDeadline(time.Time) error  { return errors.ErrUnsupported }
+func (s *stream) SetWriteDeadline(time.Time) error { return errors.ErrUnsupported }
@@ -0,0 +1,132 @@
+//go:build linux
+
+package xserver
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DisplayInfo describes a running X display.
+type DisplayInfo struct {
+	Name    string       `json:"name"`
+	Width   int          `json:"width,omitempty"`
+	Height  int          `json:"height,omitempty"`
+	Outputs []OutputInfo `json:"outputs,omitempty"`
+	Error   string       `json:"error,omitempty"` // why xrandr couldn't query it, e.g. no access
+}
+
+// OutputInfo is one xrandr output of a display.
+type OutputInfo struct {
+	Name      string   `json:"name"`
+	Connected bool     `json:"connected"`
+	Primary   bool     `json:"primary,omitempty"`
+	Geometry  string   `json:"geometry,omitempty"` // WxH+X+Y when the output is active
+	Modes     []string `json:"modes,omitempty"`
+}
+
+// GPUInfo is an NVIDIA GPU as reported by nvidia-smi. Index is what --gpu
+// and --encode-gpu take.
+type GPUInfo struct {
+	Index     int    `json:"index"`
+	Name      string `json:"name"`
+	BusID     string `json:"bus_id"`
+	XorgBusID string `json:"xorg_bus_id"`
+}
+
+// ListDisplays finds running X displays by their sockets in /tmp/.X11-unix
+// and queries each with xrandr. Displays we aren't authorized for (see
+// XAUTHORITY) are listed with an error.
+func ListDisplays() []DisplayInfo {
+	sockets, _ := filepath.Glob("/tmp/.X11-unix/X*")
+	var nums []int
+	for _, s := range sockets {
+		if n, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(s), "X")); err == nil {
+			nums = append(nums, n)
+		}
+	}
+	sort.Ints(nums)
+
+	displays := make([]DisplayInfo, 0, len(nums))
+	for _, n := range nums {
+		d := DisplayInfo{Name: fmt.Sprintf(":%d", n)}
+		cmd := exec.Command("xrandr", "--query")
+		cmd.Env = append(os.Environ(), "DISPLAY="+d.Name)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			d.Error = fmt.Sprintf("xrandr: %v: %s", err, strings.TrimSpace(string(out)))
+		} else {
+			parseXrandr(&d, string(out))
+		}
+		displays = append(displays, d)
+	}
+	return displays
+}
+
+// parseXrandr fills in the screen size and outputs from `xrandr --query`.
+func parseXrandr(d *DisplayInfo, out string) {
+	for _, line := range strings.Split(out, "\n") {
+		// Screen 0: minimum 8 x 8, current 1920 x 1080, maximum 32767 x 32767
+		if _, rest, ok := strings.Cut(line, ", current "); ok && strings.HasPrefix(line, "Screen ") {
+			fmt.Sscanf(rest, "%d x %d", &d.Width, &d.Height)
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// Mode line ("   1920x1080     60.00*+") of the output above.
+			if n := len(d.Outputs); n > 0 {
+				d.Outputs[n-1].Modes = append(d.Outputs[n-1].Modes, fields[0])
+			}
+			continue
+		}
+		if len(fields) < 2 || (fields[1] != "connected" && fields[1] != "disconnected") {
+			continue
+		}
+		o := OutputInfo{Name: fields[0], Connected: fields[1] == "connected"}
+		for _, f := range fields[2:] {
+			if f == "primary" {
+				o.Primary = true
+			} else if strings.Contains(f, "+") {
+				o.Geometry = f
+				break
+			}
+		}
+		d.Outputs = append(d.Outputs, o)
+	}
+}
+
+// ListGPUs queries nvidia-smi for the NVIDIA GPUs in index order.
+func ListGPUs() ([]GPUInfo, error) {
+	out, err := exec.Command("nvidia-smi",
+		"--query-gpu=name,pci.bus_id", "--format=csv,noheader").Output()
+	if err != nil {
+		return nil, fmt.Errorf("nvidia-smi: %w", err)
+	}
+
+	var gpus []GPUInfo
+	for i, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		// The bus ID is the last column; GPU names don't contain commas
+		// in practice, but don't depend on it.
+		idx := strings.LastIndex(line, ",")
+		if idx < 0 {
+			continue
+		}
+		busID := strings.TrimSpace(line[idx+1:])
+		gpus = append(gpus, GPUInfo{
+			Index:     i,
+			Name:      strings.TrimSpace(line[:idx]),
+			BusID:     busID,
+			XorgBusID: nvidiaToXorgBusID(busID),
+		})
+	}
+	return gpus, nil
+}
@@ -16,15 +16,50 @@ import (
 )
 
 type XServer struct {
-	Display     string
-	Xauthority  string
-	PulseServer string
-	xorgCmd     *exec.Cmd
-	sessionCmd  *exec.Cmd
-	tmpDir      string
+	Display        string
+	Xauthority     string
+	PulseServer    string
+	name           string    // "Xorg" or "Xvfb", for messages
+	xorgCmd        *exec.Cmd // the X server, Xorg or Xvfb
+	sessionCmd     *exec.Cmd
+	tmpDir         string
+	virtual        string // framebuffer size, may exceed the output mode
+	xorgLogPath    string
+	sessionLogPath string
 }
 
-func StartXServer(resolution string, gpu int) (*XServer, error) {
+// logTailLines is how much of the Xorg or session log is copied into our
+// own log when startup fails.
+const logTailLines = 50
+
+var (
+	xorgVerbose = 3
+	logDir      string
+)
+
+// SetXorgVerbose sets Xorg's -verbose level (0-7) for its stderr output,
+// which goes to xorg.log.
+func SetXorgVerbose(level int) {
+	xorgVerbose = level
+}
+
+// SetLogDir keeps the Xorg and desktop session logs in dir, where they
+// survive Stop, instead of the temp dir. Files are named after the display
+// and start time so earlier runs aren't overwritten. Empty means the temp
+// dir.
+func SetLogDir(dir string) {
+	logDir = dir
+}
+
+// StartXServer starts a headless Xorg whose output runs at resolution.
+// virtual sets the framebuffer (xorg.conf Virtual) size; it may be larger
+// than resolution to get a desktop bigger than any monitor mode. Empty
+// means the same as resolution.
+func StartXServer(resolution, virtual string, gpu int) (*XServer, error) {
+	if virtual == "" {
+		virtual = resolution
+	}
+
 	checkHeadlessPrereqs()
 	cleanStaleXorgProcesses()
 
@@ -38,10 +73,15 @@ func StartXServer(resolution string, gpu int) (*XServer, error) {
 	}
 
 	xauth := filepath.Join(tmpDir, "Xauthority")
+	xorgLogPath, sessionLogPath, err := logPaths(tmpDir, displayNum)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
 
 	// Generate xorg.conf for headless nvidia
 	confPath := filepath.Join(tmpDir, "xorg.conf")
-	if err := writeXorgConf(confPath, resolution, gpu); err != nil {
+	if err := writeXorgConf(confPath, resolution, virtual, gpu); err != nil {
 		os.RemoveAll(tmpDir)
 		return nil, fmt.Errorf("write xorg.conf: %w", err)
 	}
@@ -64,7 +104,7 @@ func StartXServer(resolution string, gpu int) (*XServer, error) {
 		"-noreset",
 		"-keeptty",
 		"-novtswitch",
-		"-verbose", "3",
+		"-verbose", strconv.Itoa(xorgVerbose),
 	}
 
 	// Add nvidia module path if the driver is installed outside the
@@ -77,7 +117,7 @@ func StartXServer(resolution string, gpu int) (*XServer, error) {
 	log.Printf("starting Xorg on %s (vt%d, gpu %d)", display, vtNum, gpu)
 	xorgCmd := exec.Command("Xorg", xorgArgs...)
 
-	xorgLog, err := os.Create(filepath.Join(tmpDir, "xorg.log"))
+	xorgLog, err := os.Create(xorgLogPath)
 	if err != nil {
 		os.RemoveAll(tmpDir)
 		return nil, fmt.Errorf("create xorg log: %w", err)
@@ -96,10 +136,14 @@ func StartXServer(resolution string, gpu int) (*XServer, error) {
 	}
 
 	xs := &XServer{
-		Display:    display,
-		Xauthority: xauth,
-		xorgCmd:    xorgCmd,
-		tmpDir:     tmpDir,
+		Display:        display,
+		Xauthority:     xauth,
+		name:           "Xorg",
+		xorgCmd:        xorgCmd,
+		tmpDir:         tmpDir,
+		virtual:        virtual,
+		xorgLogPath:    xorgLogPath,
+		sessionLogPath: sessionLogPath,
 	}
 
 	// Wait for X server to be ready
@@ -112,6 +156,37 @@ func StartXServer(resolution string, gpu int) (*XServer, error) {
 	return xs, nil
 }
 
+// logPaths returns where the Xorg and session logs go: the temp dir, or
+// --xorg-log-dir if set.
+func logPaths(tmpDir string, displayNum int) (xorgLog, sessionLog string, err error) {
+	if logDir == "" {
+		return filepath.Join(tmpDir, "xorg.log"), filepath.Join(tmpDir, "session.log"), nil
+	}
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return "", "", fmt.Errorf("create log dir: %w", err)
+	}
+	stamp := time.Now().Format("20060102-150405")
+	xorgLog = filepath.Join(logDir, fmt.Sprintf("xorg-%d-%s.log", displayNum, stamp))
+	sessionLog = filepath.Join(logDir, fmt.Sprintf("session-%d-%s.log", displayNum, stamp))
+	log.Printf("Xorg and session logs: %s, %s", xorgLog, sessionLog)
+	return xorgLog, sessionLog, nil
+}
+
+// logTail copies the last logTailLines lines of a log file into our own
+// log, so the reason for a failure is visible without the file.
+func logTail(name, path string) {
+	data, err := os.ReadFile(path)
+	if err != nil || len(data) == 0 {
+		return
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > logTailLines {
+		lines = lines[len(lines)-logTailLines:]
+	}
+	log.Printf("--- %s log (last %d lines of %s) ---\n%s\n--- end %s log ---",
+		name, len(lines), path, strings.Join(lines, "\n"), name)
+}
+
 func (xs *XServer) configureDisplay(resolution string) error {
 	env := append(os.Environ(),
 		"DISPLAY="+xs.Display,
@@ -152,8 +227,15 @@ func (xs *XServer) configureDisplay(resolution string) error {
 
 	log.Printf("configuring output %s from %s to %s", output, currentMode, resolution)
 
+	// xrandr shrinks the framebuffer to fit the outputs unless told
+	// otherwise, which would undo a larger Virtual size.
+	var fb []string
+	if xs.virtual != "" && xs.virtual != resolution {
+		fb = []string{"--fb", xs.virtual}
+	}
+
 	// First try setting the mode directly (nvidia provides many built-in modes)
-	_, err = xs.runCmd(env, "xrandr", "--output", output, "--mode", resolution)
+	_, err = xs.runCmd(env, "xrandr", append([]string{"--output", output, "--mode", resolution}, fb...)...)
 	if err == nil {
 		log.Printf("set %s to %s", output, resolution)
 		return nil
@@ -189,7 +271,7 @@ func (xs *XServer) configureDisplay(resolution string) error {
 
 	xs.runCmd(env, "xrandr", "--newmode", modeName, modeParams)
 	xs.runCmd(env, "xrandr", "--addmode", output, modeName)
-	_, err = xs.runCmd(env, "xrandr", "--output", output, "--mode", modeName)
+	_, err = xs.runCmd(env, "xrandr", append([]string{"--output", output, "--mode", modeName}, fb...)...)
 	if err != nil {
 		return fmt.Errorf("xrandr set mode %s: %w", modeName, err)
 	}
@@ -294,7 +376,7 @@ exec gnome-shell --x11
 	cmd := exec.Command("dbus-run-session", "--", "bash", launcherPath)
 	cmd.Env = sessionEnv
 
-	sessionLog, err := os.Create(filepath.Join(xs.tmpDir, "session.log"))
+	sessionLog, err := os.Create(xs.sessionLogPath)
 	if err != nil {
 		return fmt.Errorf("create session log: %w", err)
 	}
@@ -333,6 +415,7 @@ exec gnome-shell --x11
 	}
 
 	log.Printf("desktop session started on %s (gnome-shell may still be initializing)", xs.Display)
+	logTail("session", xs.sessionLogPath)
 	return nil
 }
 
@@ -350,7 +433,7 @@ func (xs *XServer) Stop() {
 	}
 
 	if xs.xorgCmd != nil && xs.xorgCmd.Process != nil {
-		log.Printf("stopping Xorg")
+		log.Printf("stopping %s", xs.name)
 		xs.xorgCmd.Process.Signal(syscall.SIGTERM)
 		done := make(chan error, 1)
 		go func() { done <- xs.xorgCmd.Wait() }()
@@ -374,7 +457,7 @@ func (xs *XServer) Stop() {
 func (xs *XServer) waitReady(timeout time.Duration) error {
 	deadline := time.Now().Add(timeout)
 	for time.Now().Before(deadline) {
-		// Check if Xorg exited early
+		// Check if the X server exited early
 		if xs.xorgCmd.ProcessState != nil {
 			break
 		}
@@ -391,14 +474,16 @@ func (xs *XServer) waitReady(timeout time.Duration) error {
 		}
 		time.Sleep(200 * time.Millisecond)
 	}
-	// Dump Xorg log so the failure reason is visible
-	logPath := filepath.Join(xs.tmpDir, "xorg.log")
-	if data, err := os.ReadFile(logPath); err == nil && len(data) > 0 {
-		log.Printf("--- Xorg log ---\n%s--- end Xorg log ---", data)
-	}
+	logTail(xs.name, xs.xorgLogPath)
 	return fmt.Errorf("timeout waiting for X server on %s", xs.Display)
 }
 
+// Reachable reports whether an X server answers on display, using the
+// inherited XAUTHORITY.
+func Reachable(display string) bool {
+	return exec.Command("xdpyinfo", "-display", display).Run() == nil
+}
+
 func findAvailableDisplay() int {
 	for i := 1; i <= 99; i++ {
 		socket := fmt.Sprintf("/tmp/.X11-unix/X%d", i)
@@ -471,7 +556,7 @@ func generateXauthCookie() string {
 	return fmt.Sprintf("%x", buf)
 }
 
-func writeXorgConf(path, resolution string, gpuIndex int) error {
+func writeXorgConf(path, resolution, virtual string, gpuIndex int) error {
 	busID, err := getGPUBusID(gpuIndex)
 	if err != nil {
 		return err
@@ -507,7 +592,7 @@ Section "Monitor"
     Identifier     "Monitor0"
     Option         "Enable" "true"
 EndSection
-`, busID, resolution, strings.ReplaceAll(resolution, "x", " "))
+`, busID, resolution, strings.ReplaceAll(virtual, "x", " "))
 
 	return os.WriteFile(path, []byte(conf), 0644)
 }
@@ -521,18 +606,14 @@ func getGPUBusID(index int) (string, error) {
 }
 
 func getRawGPUBusID(index int) (string, error) {
-	out, err := exec.Command("nvidia-smi",
-		"--query-gpu=pci.bus_id", "--format=csv,noheader").Output()
+	gpus, err := ListGPUs()
 	if err != nil {
-		return "", fmt.Errorf("nvidia-smi: %w", err)
+		return "", err
 	}
-
-	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
-	if index >= len(lines) {
-		return "", fmt.Errorf("GPU index %d out of range (have %d GPUs)", index, len(lines))
+	if index >= len(gpus) {
+		return "", fmt.Errorf("GPU index %d out of range (have %d GPUs)", index, len(gpus))
 	}
-
-	return strings.TrimSpace(lines[index]), nil
+	return gpus[index].BusID, nil
 }
 
 func nvidiaToXorgBusID(nvBusID string) string {
@@ -559,8 +640,8 @@ func nvidiaToXorgBusID(nvBusID string) string {
 	return "PCI:" + nvBusID
 }
 
-// cleanStaleXorgProcesses finds and kills Xorg processes left behind by
-// previous bunghole runs that weren't cleaned up (e.g. bunghole was killed
+// cleanStaleXorgProcesses finds and kills Xorg (and Xvfb) processes left
+// behind by previous bunghole runs that weren't cleaned up (e.g. bunghole was killed
 // with SIGKILL, or the parent process crashed). Orphaned Xorg processes
 // hold DRM master and prevent new instances from starting.
 func cleanStaleXorgProcesses() {
@@ -579,10 +660,16 @@ func cleanStaleXorgProcesses() {
 			continue
 		}
 		args := string(cmdline)
-		if !strings.Contains(args, "Xorg") || !strings.Contains(args, "bunghole-x-") {
+		if !strings.Contains(args, "bunghole-x-") {
+			continue
+		}
+		name := "Xorg"
+		if strings.Contains(args, "Xvfb") {
+			name = "Xvfb"
+		} else if !strings.Contains(args, "Xorg") {
 			continue
 		}
-		log.Printf("killing stale Xorg process %d", pid)
+		log.Printf("killing stale %s process %d", name, pid)
 		proc, err := os.FindProcess(pid)
 		if err != nil {
 			continue
@@ -0,0 +1,96 @@
+//go:build linux
+
+package xserver
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// StartXvfb starts an Xvfb virtual framebuffer server at resolution, as a
+// GPU-free stand-in for StartXServer: no xorg.conf, no nvidia driver or
+// GPU bus ID, no VT and no root needed. Frames are captured with XShm, so
+// it suits development and CI machines without NVIDIA hardware. Xvfb has
+// a single screen, so virtual may not differ from resolution.
+func StartXvfb(resolution, virtual string) (*XServer, error) {
+	if virtual != "" && virtual != resolution {
+		return nil, fmt.Errorf("Xvfb can't have a framebuffer (%s) larger than its screen (%s)", virtual, resolution)
+	}
+
+	cleanStaleXorgProcesses()
+
+	displayNum := findAvailableDisplay()
+	display := fmt.Sprintf(":%d", displayNum)
+
+	tmpDir, err := os.MkdirTemp("", "bunghole-x-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp dir: %w", err)
+	}
+
+	xauth := filepath.Join(tmpDir, "Xauthority")
+	xorgLogPath, sessionLogPath, err := logPaths(tmpDir, displayNum)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+
+	cookie := generateXauthCookie()
+	xauthCmd := exec.Command("xauth", "-f", xauth, "add", display, "MIT-MAGIC-COOKIE-1", cookie)
+	if out, err := xauthCmd.CombinedOutput(); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, fmt.Errorf("xauth add: %w: %s", err, out)
+	}
+
+	xvfbArgs := []string{
+		display,
+		"-screen", "0", resolution + "x24",
+		"-auth", xauth,
+		"-noreset",
+		"-nolisten", "tcp",
+		"+extension", "RANDR",
+	}
+
+	log.Printf("starting Xvfb on %s (%s)", display, resolution)
+	xvfbCmd := exec.Command("Xvfb", xvfbArgs...)
+
+	xvfbLog, err := os.Create(xorgLogPath)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, fmt.Errorf("create Xvfb log: %w", err)
+	}
+	xvfbCmd.Stdout = xvfbLog
+	xvfbCmd.Stderr = xvfbLog
+	xvfbCmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:    true,
+		Pdeathsig: syscall.SIGTERM,
+	}
+
+	if err := xvfbCmd.Start(); err != nil {
+		xvfbLog.Close()
+		os.RemoveAll(tmpDir)
+		return nil, fmt.Errorf("start Xvfb: %w", err)
+	}
+
+	xs := &XServer{
+		Display:        display,
+		Xauthority:     xauth,
+		name:           "Xvfb",
+		xorgCmd:        xvfbCmd,
+		tmpDir:         tmpDir,
+		xorgLogPath:    xorgLogPath,
+		sessionLogPath: sessionLogPath,
+	}
+
+	if err := xs.waitReady(10 * time.Second); err != nil {
+		xs.Stop()
+		return nil, fmt.Errorf("Xvfb not ready: %w", err)
+	}
+
+	log.Printf("Xvfb ready on %s", display)
+	return xs, nil
+}
@@ -174,5 +174,8 @@ fi
 echo
 echo "Optional install-time overrides in guest:"
 echo "  BUNGHOLE_VM_AUDIO_UDP=<host:port>   (force UDP transport)"
+echo "  BUNGHOLE_VM_AUDIO_VSOCK_PORT=<port> (match host --vsock-audio-port)"
+echo "  BUNGHOLE_VM_AUDIO_MUX=1             (audio and clipboard over one vsock connection)"
+echo "  BUNGHOLE_VM_AUDIO_MUX_PORT=<port>   (match host --vsock-mux-port)"
 echo "  BUNGHOLE_VM_AUDIO_STATS_INTERVAL=<duration>"
 echo "  BUNGHOLE_VM_AUDIO_SKIP_PROBE=1"
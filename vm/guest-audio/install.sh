@@ -13,6 +13,9 @@ TEMPLATE="$SCRIPT_DIR/$LABEL.plist.template"
 UDP_DEST="${BUNGHOLE_VM_AUDIO_UDP:-}"
 STATS_INTERVAL="${BUNGHOLE_VM_AUDIO_STATS_INTERVAL:-5s}"
 SKIP_PROBE="${BUNGHOLE_VM_AUDIO_SKIP_PROBE:-0}"
+VSOCK_PORT="${BUNGHOLE_VM_AUDIO_VSOCK_PORT:-}"
+MUX="${BUNGHOLE_VM_AUDIO_MUX:-0}"
+MUX_PORT="${BUNGHOLE_VM_AUDIO_MUX_PORT:-}"
 LOG_OUT="$HOME/Library/Logs/bunghole-vm-audio.log"
 LOG_ERR="$HOME/Library/Logs/bunghole-vm-audio.err.log"
 
@@ -48,11 +51,21 @@ fi
 
 # Determine transport arguments
 TRANSPORT_ARGS=""
-if [[ -n "$UDP_DEST" ]]; then
+if [[ "$MUX" == "1" ]]; then
+    TRANSPORT_ARGS="        <string>--transport=mux</string>"
+    if [[ -n "$MUX_PORT" ]]; then
+        TRANSPORT_ARGS="$TRANSPORT_ARGS
+        <string>--mux-port=$MUX_PORT</string>"
+    fi
+elif [[ -n "$UDP_DEST" ]]; then
     TRANSPORT_ARGS="        <string>--transport=udp</string>
         <string>--udp=$UDP_DEST</string>"
 else
     TRANSPORT_ARGS="        <string>--transport=auto</string>"
+    if [[ -n "$VSOCK_PORT" ]]; then
+        TRANSPORT_ARGS="$TRANSPORT_ARGS
+        <string>--vsock-port=$VSOCK_PORT</string>"
+    fi
 fi
 
 sed \